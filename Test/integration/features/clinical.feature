@@ -0,0 +1,256 @@
+Feature: Patients, Encounters and Prescriptions
+  As a doctor
+  I want to record the encounters of my patients with their diagnoses and prescriptions
+  So that the diagnosis and medicine catalogs are used in clinical records.
+
+  Background:
+    # Login to obtain accessToken is handled globally by InitializeScenario
+    # and the token is automatically added to headers by the addAuthHeader function.
+
+  Scenario: TC01 - Register, update and search a patient
+    Given I generate a unique alias as "patientLastName"
+    When I send a POST request to "/api/patients" with body:
+      """
+      {
+        "firstName": "Gloria",
+        "lastName": "${patientLastName}",
+        "birthDate": "1956-04-27",
+        "sex": "female",
+        "email": "gloria@example.com"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "patientID"
+    When I send a PUT request to "/api/patients/${patientID}" with body:
+      """
+      {
+        "phone": "5512345678"
+      }
+      """
+    Then the response code should be 200
+    And the JSON response should contain "phone": "5512345678"
+    When I send a GET request to "/api/patients/search-paginated?last_name_like=${patientLastName}"
+    Then the response code should be 200
+    And the JSON response should contain "total_records": 1
+    When I send a POST request to "/api/patients" with body:
+      """
+      {
+        "firstName": "Gloria",
+        "lastName": "${patientLastName}",
+        "birthDate": "1956-04-27",
+        "sex": "female",
+        "curp": "HEGG560427MVZRRL05"
+      }
+      """
+    Then the response code should be 400
+    And the response body should contain "CURP check digit is invalid"
+    When I send a POST request to "/api/patients" with body:
+      """
+      {
+        "firstName": "Gloria",
+        "lastName": "${patientLastName}",
+        "birthDate": "1956-04-27",
+        "sex": "unknown"
+      }
+      """
+    Then the response code should be 400
+
+  Scenario: TC02 - Record an encounter with diagnoses and prescribe medicines in it
+    Given I generate a unique alias as "encounterLastName"
+    And I generate a unique ICD-10 code as "encounterPrimaryCode"
+    And I generate a unique ICD-10 code as "encounterSecondaryCode"
+    And I generate a unique EAN code as "prescribedEan"
+    When I send a POST request to "/api/patients" with body:
+      """
+      {
+        "firstName": "Mario",
+        "lastName": "${encounterLastName}",
+        "birthDate": "1980-01-15",
+        "sex": "male"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "encounterPatientID"
+    When I send a POST request to "/api/icd-cie" with body:
+      """
+      {
+        "cieVersion": "CIE-10",
+        "code": "${encounterPrimaryCode}",
+        "description": "Encounter primary diagnosis"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "primaryDiagnosisID"
+    When I send a POST request to "/api/icd-cie" with body:
+      """
+      {
+        "cieVersion": "CIE-10",
+        "code": "${encounterSecondaryCode}",
+        "description": "Encounter secondary diagnosis"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "secondaryDiagnosisID"
+    When I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${prescribedEan}",
+        "description": "Prescribed medicine",
+        "type": "tablet",
+        "temperatureControl": "room",
+        "unitType": "tablet"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "prescribedMedicineID"
+    When I send a POST request to "/api/encounters" with body:
+      """
+      {
+        "patientId": ${encounterPatientID},
+        "diagnoses": [
+          {"icdCieId": ${primaryDiagnosisID}, "rank": "primary"},
+          {"icdCieId": ${secondaryDiagnosisID}, "rank": "primary"}
+        ]
+      }
+      """
+    Then the response code should be 400
+    When I send a POST request to "/api/encounters" with body:
+      """
+      {
+        "patientId": ${encounterPatientID},
+        "reason": "Cough and fever",
+        "diagnoses": [
+          {"icdCieId": ${primaryDiagnosisID}, "rank": "primary"},
+          {"icdCieId": ${secondaryDiagnosisID}, "rank": "secondary"}
+        ]
+      }
+      """
+    Then the response code should be 201
+    And the response body should contain "${encounterPrimaryCode}"
+    And I save the JSON response key "id" as "encounterID"
+    When I send a POST request to "/api/prescriptions" with body:
+      """
+      {
+        "encounterId": ${encounterID},
+        "notes": "Rest and fluids",
+        "items": [
+          {
+            "medicineId": ${prescribedMedicineID},
+            "dose": "1",
+            "doseUnit": "tablet",
+            "route": "oral",
+            "frequencyHours": 8,
+            "durationDays": 5,
+            "quantity": 15
+          }
+        ]
+      }
+      """
+    Then the response code should be 201
+    And the JSON response should contain key "authorId"
+    And I save the JSON response key "id" as "prescriptionID"
+    When I send a GET request to "/api/encounters/${encounterID}"
+    Then the response code should be 200
+    And the response body should contain "Rest and fluids"
+    When I send a GET request to "/api/encounters/search-paginated?icd_code_match=${encounterSecondaryCode}&patient_id_match=${encounterPatientID}"
+    Then the response code should be 200
+    And the JSON response should contain "total_records": 1
+    When I send a GET request to "/api/prescriptions/search-paginated?patient_id_match=${encounterPatientID}&medicine_id_match=${prescribedMedicineID}"
+    Then the response code should be 200
+    And the JSON response should contain "total_records": 1
+    When I send a POST request to "/api/prescriptions" with body:
+      """
+      {
+        "encounterId": ${encounterID},
+        "items": [
+          {
+            "medicineId": ${prescribedMedicineID},
+            "dose": "0",
+            "doseUnit": "tablet",
+            "frequencyHours": 8,
+            "durationDays": 5,
+            "quantity": 15
+          }
+        ]
+      }
+      """
+    Then the response code should be 400
+
+  Scenario: TC03 - Print a prescription and verify it without exposing the patient
+    Given I generate a unique alias as "printedLastName"
+    And I generate a unique ICD-10 code as "printedDiagnosisCode"
+    And I generate a unique EAN code as "printedEan"
+    When I send a POST request to "/api/patients" with body:
+      """
+      {
+        "firstName": "Lucía",
+        "lastName": "${printedLastName}",
+        "birthDate": "1975-09-03",
+        "sex": "female"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "printedPatientID"
+    When I send a POST request to "/api/icd-cie" with body:
+      """
+      {
+        "cieVersion": "CIE-10",
+        "code": "${printedDiagnosisCode}",
+        "description": "Printed diagnosis"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "printedDiagnosisID"
+    When I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${printedEan}",
+        "description": "Printed medicine",
+        "type": "tablet",
+        "temperatureControl": "room",
+        "unitType": "tablet"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "printedMedicineID"
+    When I send a POST request to "/api/encounters" with body:
+      """
+      {
+        "patientId": ${printedPatientID},
+        "diagnoses": [{"icdCieId": ${printedDiagnosisID}}]
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "printedEncounterID"
+    When I send a POST request to "/api/prescriptions" with body:
+      """
+      {
+        "encounterId": ${printedEncounterID},
+        "items": [
+          {
+            "medicineId": ${printedMedicineID},
+            "dose": "500",
+            "doseUnit": "mg",
+            "frequencyHours": 12,
+            "durationDays": 7,
+            "quantity": 14,
+            "instructions": "Después de los alimentos"
+          }
+        ]
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "printedPrescriptionID"
+    When I send a GET request to "/api/prescriptions/${printedPrescriptionID}/pdf"
+    Then the response code should be 200
+    And the response header "Content-Type" should contain "application/pdf"
+    And the response header "Content-Disposition" should contain "prescription-${printedPrescriptionID}.pdf"
+    And the response body should contain "%PDF-1.4"
+    When I send a GET request to "/api/prescriptions/999999999/pdf"
+    Then the response code should be 404
+    When I send a GET request to "/prescriptions/${printedPrescriptionID}/verify?signature=0000000000000000000000000000000000000000000000000000000000000000"
+    Then the response code should be 404
+    And the JSON response should contain "valid": false
+    And the response body should not contain "${printedLastName}"
+    When I send a GET request to "/prescriptions/${printedPrescriptionID}/verify"
+    Then the response code should be 400
@@ -10,7 +10,7 @@ Feature: ICD-CIE Management
     # by the test framework's teardown mechanism.
 
   Scenario: TC01 - Create a new ICD-CIE record successfully
-    Given I generate a unique alias as "newCieCode"
+    Given I generate a unique ICD-10 code as "newCieCode"
     When I send a POST request to "/api/icd-cie" with body:
       """
       {
@@ -42,7 +42,7 @@ Feature: ICD-CIE Management
     And the JSON response should contain key "error"
 
   Scenario: TC01.2 - Attempt to create an ICD-CIE record with duplicate code
-    Given I generate a unique alias as "duplicateCieCode"
+    Given I generate a unique ICD-10 code as "duplicateCieCode"
     And I send a POST request to "/api/icd-cie" with body:
       """
       {
@@ -74,7 +74,7 @@ Feature: ICD-CIE Management
     And the JSON response should be an array
 
   Scenario: TC03 - Retrieve a specific ICD-CIE record
-    Given I generate a unique alias as "retrieveCieCode"
+    Given I generate a unique ICD-10 code as "retrieveCieCode"
     And I send a POST request to "/api/icd-cie" with body:
       """
       {
@@ -103,7 +103,7 @@ Feature: ICD-CIE Management
     And the JSON response should contain error "error": "Invalid ID"
 
   Scenario: TC04 - Update an existing ICD-CIE record
-    Given I generate a unique alias as "updateCieCode"
+    Given I generate a unique ICD-10 code as "updateCieCode"
     And I send a POST request to "/api/icd-cie" with body:
       """
       {
@@ -115,7 +115,7 @@ Feature: ICD-CIE Management
       }
       """
     And I save the JSON response key "id" as "updateIcdCieID"
-    And I generate a unique alias as "updatedCieCode"
+    And I generate a unique ICD-11 code as "updatedCieCode"
     When I send a PUT request to "/api/icd-cie/${updateIcdCieID}" with body:
       """
       {
@@ -134,7 +134,7 @@ Feature: ICD-CIE Management
     And the JSON response should contain "chapterTitle": "Diseases of the eye and adnexa"
 
   Scenario: TC04.1 - Update ICD-CIE record with partial fields (only description)
-    Given I generate a unique alias as "partialUpdateCieCode"
+    Given I generate a unique ICD-10 code as "partialUpdateCieCode"
     And I send a POST request to "/api/icd-cie" with body:
       """
       {
@@ -160,7 +160,7 @@ Feature: ICD-CIE Management
     And the JSON response should contain "chapterTitle": "Diseases of the nervous system"
 
   Scenario: TC04.2 - Update ICD-CIE record with multiple partial fields
-    Given I generate a unique alias as "multiPartialUpdateCieCode"
+    Given I generate a unique ICD-10 code as "multiPartialUpdateCieCode"
     And I send a POST request to "/api/icd-cie" with body:
       """
       {
@@ -175,20 +175,19 @@ Feature: ICD-CIE Management
     When I send a PUT request to "/api/icd-cie/${multiPartialUpdateIcdCieID}" with body:
       """
       {
-        "cieVersion": "CIE-11",
         "description": "Updated description",
         "chapterNo": "VII"
       }
       """
     Then the response code should be 200
-    And the JSON response should contain "cieVersion": "CIE-11"
+    And the JSON response should contain "cieVersion": "CIE-10"
     And the JSON response should contain "description": "Updated description"
     And the JSON response should contain "chapterNo": "VII"
     And the JSON response should contain "code": "${multiPartialUpdateCieCode}"
     And the JSON response should contain "chapterTitle": "Original chapter title"
 
   Scenario: TC04.3 - Update ICD-CIE record with empty request
-    Given I generate a unique alias as "emptyUpdateCieCode"
+    Given I generate a unique ICD-10 code as "emptyUpdateCieCode"
     And I send a POST request to "/api/icd-cie" with body:
       """
       {
@@ -223,7 +222,7 @@ Feature: ICD-CIE Management
     And the JSON response should contain error "error": "ICDCie record not found"
 
   Scenario: TC05 - Delete an ICD-CIE record
-    Given I generate a unique alias as "deleteCieCode"
+    Given I generate a unique ICD-10 code as "deleteCieCode"
     And I send a POST request to "/api/icd-cie" with body:
       """
       {
@@ -237,7 +236,7 @@ Feature: ICD-CIE Management
     And I save the JSON response key "id" as "deleteIcdCieID"
     When I send a DELETE request to "/api/icd-cie/${deleteIcdCieID}"
     Then the response code should be 200
-    And the JSON response should contain "message": "ICDCie record deleted successfully"
+    And the JSON response should contain "message": "ICDCie record retired successfully"
 
   Scenario: TC06 - Search ICD-CIE records paginated
     When I send a GET request to "/api/icd-cie/search-paginated?page=1&limit=10"
@@ -258,7 +257,7 @@ Feature: ICD-CIE Management
     And the JSON response should contain key "total_records"
 
   Scenario: TC06.2 - Search ICD-CIE records with exact matches
-    Given I generate a unique alias as "exactMatchCieCode"
+    Given I generate a unique ICD-10 code as "exactMatchCieCode"
     And I send a POST request to "/api/icd-cie" with body:
       """
       {
@@ -310,9 +309,9 @@ Feature: ICD-CIE Management
     And the JSON response should contain error "error": "Invalid property or search_text"
 
   Scenario: TC08 - Create multiple ICD-CIE records for comprehensive testing
-    Given I generate a unique alias as "multiCieCode1"
-    And I generate a unique alias as "multiCieCode2"
-    And I generate a unique alias as "multiCieCode3"
+    Given I generate a unique ICD-10 code as "multiCieCode1"
+    And I generate a unique ICD-10 code as "multiCieCode2"
+    And I generate a unique ICD-10 code as "multiCieCode3"
     When I send a POST request to "/api/icd-cie" with body:
       """
       {
@@ -375,4 +374,313 @@ Feature: ICD-CIE Management
     When I send a GET request to "/api/icd-cie/search-paginated?page=-1&limit=-5"
     Then the response code should be 200
     And the JSON response should contain "current_page": 1
-    And the JSON response should contain "page_size": 10 
\ No newline at end of file
+    And the JSON response should contain "page_size": 10 
+  Scenario: TC11 - Export filtered ICD-CIE records as NDJSON
+    Given I generate a unique ICD-10 code as "exportCieCode"
+    And I send a POST request to "/api/icd-cie" with body:
+      """
+      {
+        "cieVersion": "CIE-10",
+        "code": "${exportCieCode}",
+        "description": "Export test ICD-CIE record",
+        "chapterNo": "X",
+        "chapterTitle": "Diseases of the respiratory system"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "exportIcdCieID"
+    When I send a GET request to "/api/icd-cie/export?format=ndjson&code_match=${exportCieCode}"
+    Then the response code should be 200
+    And the response header "Content-Type" should contain "application/x-ndjson"
+    And the response body should contain "${exportCieCode}"
+    And the response body should contain "Export test ICD-CIE record"
+
+  Scenario: TC12 - Browse the ICD hierarchy of a category and its subcategories
+    Given I generate a unique ICD-11 category as "treeCategory"
+    When I send a POST request to "/api/icd-cie" with body:
+      """
+      {
+        "cieVersion": "CIE-11",
+        "code": "${treeCategory}",
+        "description": "Hierarchy test category"
+      }
+      """
+    Then the response code should be 201
+    And the JSON response should contain "kind": "category"
+    And I save the JSON response key "id" as "treeCategoryID"
+    When I send a POST request to "/api/icd-cie" with body:
+      """
+      {
+        "cieVersion": "CIE-11",
+        "code": "${treeCategory}.1",
+        "description": "Hierarchy test subcategory"
+      }
+      """
+    Then the response code should be 201
+    And the JSON response should contain "kind": "subcategory"
+    And the JSON response should contain "parentId": "${treeCategoryID}"
+    And I save the JSON response key "id" as "treeSubcategoryID"
+    When I send a POST request to "/api/icd-cie" with body:
+      """
+      {
+        "cieVersion": "CIE-11",
+        "code": "${treeCategory}.1Y",
+        "description": "Hierarchy test residual subcategory"
+      }
+      """
+    Then the response code should be 201
+    And the JSON response should contain "parentId": "${treeSubcategoryID}"
+    And I save the JSON response key "id" as "treeLeafID"
+    When I send a GET request to "/api/icd-cie/${treeLeafID}/ancestors"
+    Then the response code should be 200
+    And the response body should contain "${treeCategory}.1"
+    When I send a GET request to "/api/icd-cie/${treeCategoryID}/descendants"
+    Then the response code should be 200
+    And the response body should contain "${treeCategory}.1Y"
+    When I send a GET request to "/api/icd-cie/tree?cie_version=CIE-11&parent_code=${treeCategory}"
+    Then the response code should be 200
+    And the response body should contain "childCount"
+    And the response body should contain "Hierarchy test subcategory"
+    When I send a DELETE request to "/api/icd-cie/${treeCategoryID}"
+    Then the response code should be 409
+
+  Scenario: TC13 - Reject codes that do not follow the syntax of their version
+    When I send a POST request to "/api/icd-cie" with body:
+      """
+      {
+        "cieVersion": "CIE-10",
+        "code": "1A00",
+        "description": "ICD-11 code declared as CIE-10"
+      }
+      """
+    Then the response code should be 400
+    And the response body should contain "is not a valid CIE-10 code"
+
+  Scenario: TC14 - Import an ICD release idempotently
+    Given I generate a unique ICD-11 category as "importCategory"
+    When I upload the file "release.xml" to "/api/icd-cie/import?cie_version=CIE-11&release=it-${importCategory}&dry_run=true" with content:
+      """
+      <?xml version="1.0" encoding="UTF-8"?>
+      <ClaML version="2.0.0">
+        <Class code="${importCategory}" kind="category">
+          <Rubric kind="preferred"><Label>Release import test category</Label></Rubric>
+        </Class>
+        <Class code="${importCategory}.0" kind="category">
+          <SuperClass code="${importCategory}"/>
+          <Rubric kind="preferred"><Label>Release import test subcategory</Label></Rubric>
+        </Class>
+      </ClaML>
+      """
+    Then the response code should be 200
+    And the JSON response should contain "dry_run": true
+    And the JSON response should contain "added": 2
+    And the response body should contain "${importCategory}.0"
+    When I send a GET request to "/api/icd-cie/search-paginated?code_match=${importCategory}"
+    Then the response code should be 200
+    And the response body should not contain "Release import test category"
+    When I upload the file "release.xml" to "/api/icd-cie/import?cie_version=CIE-11&release=it-${importCategory}" with content:
+      """
+      <?xml version="1.0" encoding="UTF-8"?>
+      <ClaML version="2.0.0">
+        <Class code="${importCategory}" kind="category">
+          <Rubric kind="preferred"><Label>Release import test category</Label></Rubric>
+        </Class>
+        <Class code="${importCategory}.0" kind="category">
+          <SuperClass code="${importCategory}"/>
+          <Rubric kind="preferred"><Label>Release import test subcategory</Label></Rubric>
+        </Class>
+      </ClaML>
+      """
+    Then the response code should be 200
+    And the JSON response should contain "already_imported": false
+    And the JSON response should contain "added": 2
+    When I upload the file "release.xml" to "/api/icd-cie/import?cie_version=CIE-11&release=it-${importCategory}" with content:
+      """
+      <?xml version="1.0" encoding="UTF-8"?>
+      <ClaML version="2.0.0">
+        <Class code="${importCategory}" kind="category">
+          <Rubric kind="preferred"><Label>Release import test category</Label></Rubric>
+        </Class>
+        <Class code="${importCategory}.0" kind="category">
+          <SuperClass code="${importCategory}"/>
+          <Rubric kind="preferred"><Label>Release import test subcategory</Label></Rubric>
+        </Class>
+      </ClaML>
+      """
+    Then the response code should be 200
+    And the JSON response should contain "already_imported": true
+    When I upload the file "release.xml" to "/api/icd-cie/import?cie_version=CIE-11&release=it-${importCategory}" with content:
+      """
+      <?xml version="1.0" encoding="UTF-8"?>
+      <ClaML version="2.0.0">
+        <Class code="${importCategory}" kind="category">
+          <Rubric kind="preferred"><Label>Release import test category, revised</Label></Rubric>
+        </Class>
+      </ClaML>
+      """
+    Then the response code should be 409
+    When I send a GET request to "/api/icd-cie/releases?cie_version=CIE-11"
+    Then the response code should be 200
+    And the response body should contain "it-${importCategory}"
+    When I send a GET request to "/api/icd-cie/search-paginated?code_match=${importCategory}.0"
+    Then the response code should be 200
+    And I save the first array element key "id" from array "records" as "importSubcategoryID"
+    When I send a DELETE request to "/api/icd-cie/${importSubcategoryID}"
+    Then the response code should be 200
+    When I send a GET request to "/api/icd-cie/search-paginated?code_match=${importCategory}"
+    Then the response code should be 200
+    And I save the first array element key "id" from array "records" as "importCategoryID"
+    When I send a DELETE request to "/api/icd-cie/${importCategoryID}"
+    Then the response code should be 200
+
+  Scenario: TC15 - Translate codes between versions with the WHO transition tables
+    Given I generate a unique ICD-10 code as "mapSource"
+    And I generate a unique ICD-10 code as "mapOrphan"
+    And I generate a unique ICD-11 category as "mapTarget"
+    When I send a POST request to "/api/icd-cie" with body:
+      """
+      {
+        "cieVersion": "CIE-10",
+        "code": "${mapSource}",
+        "description": "Mapping test source"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "mapSourceID"
+    When I upload the file "10To11MapToMultipleCategories.txt" to "/api/icd-cie/mappings/import?release=2024-01" with content:
+      """
+      icd10Code	icd10Title	icd11Code	icd11Title
+      ${mapSource}	Mapping test source	${mapTarget}	Mapping test target
+      ${mapSource}	Mapping test source	${mapTarget}.0	Mapping test target detail
+      ${mapOrphan}	Mapping test orphan		No Mapping
+      """
+    Then the response code should be 200
+    And the JSON response should contain "source_version": "CIE-10"
+    And the JSON response should contain "one_to_many": 1
+    And the JSON response should contain "no_map": 1
+    When I send a GET request to "/api/icd-cie/translate?from=CIE-10&codes=${mapSource},${mapOrphan}"
+    Then the response code should be 200
+    And the JSON response should be an array
+    And the response body should contain "one_to_many"
+    And the response body should contain "no_map"
+    And the response body should contain "${mapTarget}.0"
+    When I send a GET request to "/api/icd-cie/${mapSourceID}"
+    Then the response code should be 200
+    And the JSON response should contain key "mapping"
+    And the response body should contain "${mapTarget}"
+    When I send a GET request to "/api/icd-cie/translate?from=CIE-10"
+    Then the response code should be 400
+
+  Scenario: TC16 - Find diagnoses regardless of accents and typos
+    Given I generate a unique ICD-10 code as "searchCode"
+    When I send a POST request to "/api/icd-cie" with body:
+      """
+      {
+        "cieVersion": "CIE-10",
+        "code": "${searchCode}",
+        "description": "Neumonía bacteriana de prueba"
+      }
+      """
+    Then the response code should be 201
+    When I send a GET request to "/api/icd-cie/search-paginated?q=neumonia%20bacter&code_match=${searchCode}"
+    Then the response code should be 200
+    And the JSON response should contain "total_records": 1
+    And the response body should contain "highlight"
+    And the response body should contain "rank"
+    When I send a GET request to "/api/icd-cie/search-paginated?q=neumonia%20bacteriaan&code_match=${searchCode}"
+    Then the response code should be 200
+    And the JSON response should contain "total_records": 1
+    When I send a GET request to "/api/icd-cie/search-paginated?description_like=neumonia%20bacteriana%20de%20prueba&code_match=${searchCode}"
+    Then the response code should be 200
+    And the JSON response should contain "total_records": 1
+    When I send a GET request to "/api/icd-cie/search-by-property?property=description&search_text=neumonia%20bacteriana%20de%20prueba"
+    Then the response code should be 200
+    And the response body should contain "bacteriana de prueba"
+
+  Scenario: TC17 - Keep the history of a record and retire it instead of deleting it
+    Given I generate a unique ICD-10 code as "historyCode"
+    When I send a POST request to "/api/icd-cie" with body:
+      """
+      {
+        "cieVersion": "CIE-10",
+        "code": "${historyCode}",
+        "description": "Versioned record"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "historyID"
+    When I send a PUT request to "/api/icd-cie/${historyID}" with body:
+      """
+      {
+        "description": "Versioned record, renamed"
+      }
+      """
+    Then the response code should be 200
+    When I send a DELETE request to "/api/icd-cie/${historyID}"
+    Then the response code should be 200
+    And the JSON response should contain "message": "ICDCie record retired successfully"
+    When I send a GET request to "/api/icd-cie/${historyID}"
+    Then the response code should be 200
+    And the JSON response should contain "retired": true
+    And the JSON response should contain key "validTo"
+    When I send a GET request to "/api/icd-cie/${historyID}/history"
+    Then the response code should be 200
+    And the JSON response should be an array
+    And the response body should contain "Versioned record, renamed"
+    And the response body should contain "icdCieId"
+    When I send a GET request to "/api/icd-cie/search-paginated?code_match=${historyCode}"
+    Then the response code should be 200
+    And the JSON response should contain "total_records": 0
+    When I send a GET request to "/api/icd-cie/search-paginated?code_match=${historyCode}&retired=any"
+    Then the response code should be 200
+    And the JSON response should contain "total_records": 1
+    When I send a PUT request to "/api/icd-cie/${historyID}" with body:
+      """
+      {
+        "description": "Changed after retirement"
+      }
+      """
+    Then the response code should be 409
+    When I send a GET request to "/api/icd-cie/search-paginated?code_match=${historyCode}&as_of=2000-01-01"
+    Then the response code should be 200
+    And the JSON response should contain "total_records": 0
+    When I send a GET request to "/api/icd-cie?retired=sometimes"
+    Then the response code should be 400
+
+  Scenario: TC18 - Create ICD records in a batch, atomically or one by one
+    Given I generate a unique ICD-10 code as "firstBatchCode"
+    And I generate a unique ICD-10 code as "secondBatchCode"
+    When I send a POST request to "/api/icd-cie/batch" with body:
+      """
+      {
+        "atomic": true,
+        "operations": [
+          { "method": "create", "body": { "cieVersion": "CIE-10", "code": "${firstBatchCode}", "description": "Batch record A" } },
+          { "method": "create", "body": { "cieVersion": "CIE-10", "code": "${firstBatchCode}", "description": "Batch record A again" } }
+        ]
+      }
+      """
+    Then the response code should be 409
+    And the JSON response should contain "committed": false
+    And the response body should contain "Rolled back, operation 1 failed"
+    When I send a GET request to "/api/icd-cie/search-paginated?code_eq=${firstBatchCode}"
+    Then the response code should be 200
+    And the JSON response should contain "total_records": 0
+    When I send a POST request to "/api/icd-cie/batch" with body:
+      """
+      {
+        "atomic": false,
+        "operations": [
+          { "method": "create", "body": { "cieVersion": "CIE-10", "code": "${firstBatchCode}", "description": "Batch record A" } },
+          { "method": "create", "body": { "cieVersion": "CIE-10", "code": "${firstBatchCode}", "description": "Batch record A again" } },
+          { "method": "create", "body": { "cieVersion": "CIE-10", "code": "${secondBatchCode}", "description": "Batch record B" } },
+          { "method": "delete" }
+        ]
+      }
+      """
+    Then the response code should be 200
+    And the response body should contain "Could not create ICDCie record: duplicate code"
+    And the response body should contain "id is required to delete"
+    When I send a GET request to "/api/icd-cie/search-paginated?code_in=${firstBatchCode}&code_in=${secondBatchCode}"
+    Then the response code should be 200
+    And the JSON response should contain "total_records": 2
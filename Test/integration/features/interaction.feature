@@ -0,0 +1,177 @@
+Feature: Active Ingredients and Drug Interactions
+  As an API consumer
+  I want medicines linked to normalized active ingredients
+  So that I can detect interactions between the medicines of a prescription.
+
+  Background:
+    # Login to obtain accessToken is handled globally by InitializeScenario
+    # and the token is automatically added to headers by the addAuthHeader function.
+
+  Scenario: TC01 - Create an active ingredient with synonyms and reject a duplicated name
+    Given I generate a unique alias as "ingredientName"
+    And I generate a unique alias as "ingredientSynonym"
+    When I send a POST request to "/api/active-ingredients" with body:
+      """
+      {
+        "name": "${ingredientName}",
+        "atcCode": "N02BE01",
+        "synonyms": ["${ingredientSynonym}"]
+      }
+      """
+    Then the response code should be 201
+    And the JSON response should contain key "normalizedName"
+    And I save the JSON response key "id" as "ingredientID"
+    When I send a GET request to "/api/active-ingredients/${ingredientID}"
+    Then the response code should be 200
+    And the response body should contain "${ingredientSynonym}"
+    When I send a POST request to "/api/active-ingredients" with body:
+      """
+      {
+        "name": "${ingredientSynonym}"
+      }
+      """
+    Then the response code should be 409
+
+  Scenario: TC02 - Import interactions and check the medicines of a prescription
+    Given I generate a unique alias as "anticoagulant"
+    And I generate a unique alias as "analgesic"
+    And I generate a unique EAN code as "anticoagulantEan"
+    And I generate a unique EAN code as "analgesicEan"
+    When I upload the file "interactions.csv" to "/api/interactions/import?dry_run=true" with content:
+      """
+      ingredient_a,ingredient_b,severity,description,source
+      ${anticoagulant},${analgesic},major,Increased bleeding risk,Test dataset
+      ${anticoagulant},${anticoagulant},minor,Same ingredient,Test dataset
+      """
+    Then the response code should be 200
+    And the JSON response should contain "dry_run": true
+    And the JSON response should contain "valid_rows": 1
+    And the JSON response should contain "invalid_rows": 1
+    When I upload the file "interactions.csv" to "/api/interactions/import" with content:
+      """
+      ingredient_a,ingredient_b,severity,description,source
+      ${anticoagulant},${analgesic},major,Increased bleeding risk,Test dataset
+      """
+    Then the response code should be 200
+    And the JSON response should contain "created": 1
+    When I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${anticoagulantEan}",
+        "description": "Interaction Anticoagulant",
+        "type": "tablet",
+        "activeIngredient": "${anticoagulant} 5mg",
+        "temperatureControl": "room",
+        "unitType": "tablet"
+      }
+      """
+    Then the response code should be 201
+    And the response body should contain "ingredients"
+    And I save the JSON response key "id" as "anticoagulantMedicineID"
+    When I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${analgesicEan}",
+        "description": "Interaction Analgesic",
+        "type": "tablet",
+        "activeIngredient": "${analgesic} 500mg",
+        "temperatureControl": "room",
+        "unitType": "tablet"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "analgesicMedicineID"
+    When I send a POST request to "/api/interactions/check" with body:
+      """
+      {
+        "medicineIds": [${anticoagulantMedicineID}, ${analgesicMedicineID}]
+      }
+      """
+    Then the response code should be 200
+    And the response body should contain "major"
+    And the response body should contain "Increased bleeding risk"
+
+  Scenario: TC03 - Checking unknown medicines returns not found
+    When I send a POST request to "/api/interactions/check" with body:
+      """
+      {
+        "medicineIds": [999999999]
+      }
+      """
+    Then the response code should be 404
+
+  Scenario: TC04 - Find therapeutic equivalents and exclude them with an override
+    Given I generate a unique alias as "equivalentIngredient"
+    And I generate a unique alias as "equivalentPriceListName"
+    And I generate a unique EAN code as "referenceEan"
+    And I generate a unique EAN code as "genericEan"
+    When I send a POST request to "/api/active-ingredients" with body:
+      """
+      {
+        "name": "${equivalentIngredient}"
+      }
+      """
+    Then the response code should be 201
+    When I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${referenceEan}",
+        "description": "Reference Tablets",
+        "type": "tablet",
+        "activeIngredient": "${equivalentIngredient} 500mg",
+        "temperatureControl": "room",
+        "unitQuantity": 10,
+        "unitType": "tablet"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "referenceMedicineID"
+    When I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${genericEan}",
+        "description": "Generic Capsules",
+        "type": "capsule",
+        "activeIngredient": "${equivalentIngredient} 500 mg",
+        "temperatureControl": "room",
+        "unitQuantity": 20,
+        "unitType": "capsule"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "genericMedicineID"
+    When I send a POST request to "/api/price-lists" with body:
+      """
+      {
+        "name": "${equivalentPriceListName}",
+        "customerType": "retail"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "equivalentPriceListID"
+    When I send a POST request to "/api/price-lists/${equivalentPriceListID}/prices" with body:
+      """
+      {
+        "medicineId": ${genericMedicineID},
+        "price": "40",
+        "validFrom": "2020-01-01T00:00:00Z"
+      }
+      """
+    Then the response code should be 201
+    When I send a GET request to "/api/medicines/${referenceMedicineID}/equivalents?price_list_id=${equivalentPriceListID}"
+    Then the response code should be 200
+    And the response body should contain "${genericEan}"
+    And the response body should contain "automatic"
+    When I send a POST request to "/api/therapeutic-equivalences" with body:
+      """
+      {
+        "medicineId": ${genericMedicineID},
+        "equivalentMedicineId": ${referenceMedicineID},
+        "equivalent": false,
+        "reason": "Bioequivalence not proven"
+      }
+      """
+    Then the response code should be 201
+    When I send a GET request to "/api/medicines/${referenceMedicineID}/equivalents?price_list_id=${equivalentPriceListID}"
+    Then the response code should be 200
+    And the response body should not contain "${genericEan}"
@@ -0,0 +1,130 @@
+Feature: CFDI Invoices
+  As an API consumer
+  I want to invoice medicine sales
+  So that I can issue signed and stamped CFDI 4.0 documents.
+
+  Background:
+    # Login to obtain accessToken is handled globally by InitializeScenario
+    # and the token is automatically added to headers by the addAuthHeader function.
+    # The integration script configures the test CSD and the fake PAC.
+
+  Scenario: TC01 - Invoice a medicine sale and download the stamped XML
+    Given I generate a unique EAN code as "invoicedEan"
+    And I generate a unique alias as "invoicePriceListName"
+    And I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${invoicedEan}",
+        "description": "Invoiced Medicine",
+        "type": "tablet",
+        "iva": "16",
+        "satKey": "51142001",
+        "temperatureControl": "room",
+        "unitType": "tablet"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "invoicedMedicineID"
+    When I send a POST request to "/api/price-lists" with body:
+      """
+      {
+        "name": "${invoicePriceListName}",
+        "customerType": "retail"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "invoicePriceListID"
+    When I send a POST request to "/api/price-lists/${invoicePriceListID}/prices" with body:
+      """
+      {
+        "medicineId": ${invoicedMedicineID},
+        "price": "12.50",
+        "validFrom": "2020-01-01T00:00:00Z"
+      }
+      """
+    Then the response code should be 201
+    When I send a POST request to "/api/invoices" with body:
+      """
+      {
+        "priceListId": ${invoicePriceListID},
+        "paymentForm": "01",
+        "paymentMethod": "PUE",
+        "receiver": {
+          "rfc": "XAXX010101000",
+          "name": "Publico en general",
+          "zipCode": "42501",
+          "taxRegime": "616",
+          "cfdiUse": "S01"
+        },
+        "items": [
+          { "medicineId": ${invoicedMedicineID}, "quantity": 3 }
+        ]
+      }
+      """
+    Then the response code should be 201
+    And the JSON response should contain "status": "stamped"
+    And the JSON response should contain "total": "43.5"
+    And the JSON response should contain key "uuid"
+    And I save the JSON response key "id" as "invoiceID"
+    When I send a GET request to "/api/invoices/${invoiceID}/xml"
+    Then the response code should be 200
+    And the response header "Content-Type" should contain "application/xml"
+    And the response body should contain "cfdi:Comprobante"
+    And the response body should contain "51142001"
+    And the response body should contain "tfd:TimbreFiscalDigital"
+    When I send a POST request to "/api/invoices/${invoiceID}/stamp"
+    Then the response code should be 409
+
+  Scenario: TC02 - Invoice with invalid receiver fiscal data fails validation
+    Given I generate a unique EAN code as "rejectedEan"
+    And I generate a unique alias as "rejectedPriceListName"
+    And I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${rejectedEan}",
+        "description": "Rejected Invoice Medicine",
+        "type": "tablet",
+        "iva": "exempt",
+        "satKey": "51142001",
+        "temperatureControl": "room",
+        "unitType": "tablet"
+      }
+      """
+    And I save the JSON response key "id" as "rejectedMedicineID"
+    And I send a POST request to "/api/price-lists" with body:
+      """
+      {
+        "name": "${rejectedPriceListName}",
+        "customerType": "retail"
+      }
+      """
+    And I save the JSON response key "id" as "rejectedPriceListID"
+    And I send a POST request to "/api/price-lists/${rejectedPriceListID}/prices" with body:
+      """
+      {
+        "medicineId": ${rejectedMedicineID},
+        "price": "10",
+        "validFrom": "2020-01-01T00:00:00Z"
+      }
+      """
+    When I send a POST request to "/api/invoices" with body:
+      """
+      {
+        "priceListId": ${rejectedPriceListID},
+        "paymentForm": "01",
+        "paymentMethod": "PUE",
+        "receiver": {
+          "rfc": "NOT-AN-RFC",
+          "name": "Cliente",
+          "zipCode": "123",
+          "taxRegime": "616",
+          "cfdiUse": "S01"
+        },
+        "items": [
+          { "medicineId": ${rejectedMedicineID}, "quantity": 1 }
+        ]
+      }
+      """
+    Then the response code should be 422
+    And the response body should contain "Receptor Rfc"
+    And the response body should contain "DomicilioFiscalReceptor"
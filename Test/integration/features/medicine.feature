@@ -150,7 +150,7 @@ Feature: Medicine Management
         "description": "Ibuprofen 600mg Tablets - Updated",
         "laboratory": "PharmaTest Labs Inc.",
         "type": "tablet",
-        "iva": "16UPD",
+        "iva": "8",
         "satKey": "51182201_UPD",
         "activeIngredient": "Ibuprofen Forte",
         "temperatureControl": "refrigerated",
@@ -164,6 +164,7 @@ Feature: Medicine Management
     And the JSON response should contain "description": "Ibuprofen 600mg Tablets - Updated"
     And the JSON response should contain "eanCode": "${updatedMedicineEan}"
     And the JSON response should contain "isControlled": true
+    And the JSON response field "taxRate" should contain string "IVA 8%"
 
   Scenario: TC03.1 - Attempt to update a non-existent medicine
     When I send a PUT request to "/api/medicines/999999" with body:
@@ -386,7 +387,7 @@ Feature: Medicine Management
       """
     When I send a GET request to "/api/medicines/search-paginated?description_like=Ibuprofen&page=1&limit=5"
     Then the response code should be 200
-    And the JSON response should contain key "medicines"
+    And the JSON response should contain key "records"
     And the JSON response should contain key "total_records"
 
   Scenario: TC04.1 - Search for medicines by EAN code (paginated)
@@ -410,7 +411,7 @@ Feature: Medicine Management
       """
     When I send a GET request to "/api/medicines/search-paginated?ean_code_like=${searchEanCode}"
     Then the response code should be 200
-    And the JSON response should contain key "medicines"
+    And the JSON response should contain key "records"
 
   Scenario: TC05 - Search for medicine property coincidences
     Given I generate a unique EAN code as "propertySearchEan"
@@ -438,3 +439,556 @@ Feature: Medicine Management
     When I send a GET request to "/api/medicines/search-by-property?property=invalidProp&search_text=Test"
     Then the response code should be 400
     And the JSON response should contain error "error": "Invalid property"
+
+  Scenario: TC06 - Dry-run a CSV catalog import reporting invalid rows
+    Given I generate a unique EAN code as "importEanValid"
+    And I generate a unique EAN code as "importEanInvalid"
+    When I upload the file "catalog.csv" to "/api/medicines/import?dry_run=true" with content:
+      """
+      eanCode,description,type,laboratory,iva,satKey,activeIngredient,temperatureControl,isControlled,unitQuantity,unitType
+      ${importEanValid},Import Test Tablets,tablet,Import Labs,16,51182200,Ibuprofen,room,false,20,tablet
+      ${importEanInvalid},Import Test Syrup,syrup,Import Labs,16,51182200,Ibuprofen,room,false,120,ml
+      """
+    Then the response code should be 200
+    And the JSON response should contain "dry_run": true
+    And the JSON response should contain "total_rows": 2
+    And the JSON response should contain "valid_rows": 1
+    And the JSON response should contain "invalid_rows": 1
+    And the JSON response should contain "created": 1
+    When I send a GET request to "/api/medicines/search-paginated?ean_code_match=${importEanValid}"
+    Then the response code should be 200
+    And the JSON response should contain "total_records": 0
+
+  Scenario: TC06.1 - Import a CSV catalog and upsert by EAN code
+    Given I generate a unique EAN code as "importUpsertEan"
+    When I upload the file "catalog.csv" to "/api/medicines/import" with content:
+      """
+      ean_code,description,type,temperature_control,unit_type,unit_quantity
+      ${importUpsertEan},Imported Paracetamol,tablet,room,tablet,10
+      """
+    Then the response code should be 200
+    And the JSON response should contain "created": 1
+    When I upload the file "catalog.csv" to "/api/medicines/import" with content:
+      """
+      ean_code,description,type,temperature_control,unit_type,unit_quantity
+      ${importUpsertEan},Imported Paracetamol Updated,tablet,room,tablet,20
+      """
+    Then the response code should be 200
+    And the JSON response should contain "updated": 1
+    When I send a GET request to "/api/medicines/search-paginated?ean_code_match=${importUpsertEan}"
+    Then the response code should be 200
+    And I save the first array element key "id" from array "medicines" as "importedMedicineID"
+    When I send a GET request to "/api/medicines/${importedMedicineID}"
+    Then the response code should be 200
+    And the JSON response should contain "description": "Imported Paracetamol Updated"
+    When I send a DELETE request to "/api/medicines/${importedMedicineID}"
+    Then the response code should be 200
+
+  Scenario: TC06.2 - Reject an import file without the required columns
+    When I upload the file "catalog.csv" to "/api/medicines/import" with content:
+      """
+      description,laboratory
+      Missing EAN,Import Labs
+      """
+    Then the response code should be 400
+    And the JSON response field "error" should contain string "missing required column"
+
+  Scenario: TC07 - Export filtered medicines as CSV with a custom column set
+    Given I generate a unique EAN code as "exportEan"
+    And I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${exportEan}",
+        "description": "Export Test Medicine",
+        "laboratory": "Export Labs",
+        "type": "capsule",
+        "temperatureControl": "room",
+        "unitQuantity": 14.0,
+        "unitType": "capsule"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "exportMedicineID"
+    When I send a GET request to "/api/medicines/export?format=csv&columns=ean_code,description&ean_code_match=${exportEan}"
+    Then the response code should be 200
+    And the response header "Content-Type" should contain "text/csv"
+    And the response header "Content-Disposition" should contain "attachment"
+    And the response body should contain "ean_code,description"
+    And the response body should contain "${exportEan},Export Test Medicine"
+
+  Scenario: TC07.1 - Reject a medicine export with an unknown column or format
+    When I send a GET request to "/api/medicines/export?columns=ean_code,secret"
+    Then the response code should be 400
+    And the JSON response field "error" should contain string "invalid column"
+    When I send a GET request to "/api/medicines/export?format=pdf"
+    Then the response code should be 400
+    And the JSON response field "error" should contain string "Invalid format"
+
+  Scenario: TC08 - Reject a medicine whose EAN code has an invalid check digit
+    When I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "7501234567890",
+        "description": "Invalid Check Digit Medicine",
+        "type": "tablet",
+        "temperatureControl": "room",
+        "unitType": "tablet"
+      }
+      """
+    Then the response code should be 400
+    And the JSON response field "error" should contain string "Invalid EAN code"
+
+  Scenario: TC08.1 - Look up a medicine by barcode using its GTIN-14 form
+    Given I generate a unique EAN code as "barcodeEan"
+    And I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "0${barcodeEan}",
+        "description": "Barcode Lookup Medicine",
+        "type": "tablet",
+        "temperatureControl": "room",
+        "unitType": "tablet"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "barcodeMedicineID"
+    And the JSON response should contain "eanCode": "${barcodeEan}"
+    When I send a GET request to "/api/medicines/by-barcode/0${barcodeEan}"
+    Then the response code should be 200
+    And the JSON response should contain "description": "Barcode Lookup Medicine"
+    When I send a GET request to "/api/medicines/by-barcode/7501234567890"
+    Then the response code should be 400
+
+  Scenario: TC08.2 - Render a medicine barcode as PNG and SVG
+    Given I generate a unique EAN code as "labelEan"
+    And I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${labelEan}",
+        "description": "Barcode Label Medicine",
+        "type": "capsule",
+        "temperatureControl": "room",
+        "unitType": "capsule"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "labelMedicineID"
+    When I send a GET request to "/api/medicines/${labelMedicineID}/barcode?format=png"
+    Then the response code should be 200
+    And the response header "Content-Type" should contain "image/png"
+    When I send a GET request to "/api/medicines/${labelMedicineID}/barcode?format=svg&width=400&height=150"
+    Then the response code should be 200
+    And the response header "Content-Type" should contain "image/svg+xml"
+    And the response body should contain "<svg"
+
+  Scenario: TC09 - Reject a medicine with an unknown IVA tax rate
+    Given I generate a unique EAN code as "badIvaEan"
+    When I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${badIvaEan}",
+        "description": "Unknown IVA Medicine",
+        "type": "tablet",
+        "iva": "16UPD",
+        "temperatureControl": "room",
+        "unitType": "tablet"
+      }
+      """
+    Then the response code should be 400
+    And the JSON response field "error" should contain string "Invalid iva"
+
+  Scenario: TC10 - Price a medicine and quote a basket with IVA
+    Given I generate a unique EAN code as "pricedEan"
+    And I generate a unique alias as "priceListName"
+    And I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${pricedEan}",
+        "description": "Priced Medicine",
+        "type": "tablet",
+        "iva": "16",
+        "temperatureControl": "room",
+        "unitType": "tablet"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "pricedMedicineID"
+    When I send a POST request to "/api/price-lists" with body:
+      """
+      {
+        "name": "${priceListName}",
+        "customerType": "retail"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "priceListID"
+    When I send a POST request to "/api/price-lists/${priceListID}/prices" with body:
+      """
+      {
+        "medicineId": ${pricedMedicineID},
+        "price": "12.50",
+        "validFrom": "2020-01-01T00:00:00Z"
+      }
+      """
+    Then the response code should be 201
+    When I send a POST request to "/api/price-lists/${priceListID}/prices" with body:
+      """
+      {
+        "medicineId": ${pricedMedicineID},
+        "price": "25.00"
+      }
+      """
+    Then the response code should be 201
+    When I send a GET request to "/api/medicines/${pricedMedicineID}/prices/current?price_list_id=${priceListID}&at=2021-06-01"
+    Then the response code should be 200
+    And the JSON response should contain "price": "12.5"
+    When I send a GET request to "/api/medicines/${pricedMedicineID}/prices?price_list_id=${priceListID}"
+    Then the response code should be 200
+    And the JSON response should be an array
+    When I send a POST request to "/api/quotes" with body:
+      """
+      {
+        "priceListId": ${priceListID},
+        "items": [
+          { "medicineId": ${pricedMedicineID}, "quantity": 3 }
+        ]
+      }
+      """
+    Then the response code should be 200
+    And the JSON response should contain "subtotal": "75"
+    And the JSON response should contain "iva": "12"
+    And the JSON response should contain "total": "87"
+
+  Scenario: TC10.1 - Quoting a medicine without a price fails
+    Given I generate a unique EAN code as "unpricedEan"
+    And I generate a unique alias as "emptyPriceListName"
+    And I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${unpricedEan}",
+        "description": "Unpriced Medicine",
+        "type": "tablet",
+        "iva": "0",
+        "temperatureControl": "room",
+        "unitType": "tablet"
+      }
+      """
+    And I save the JSON response key "id" as "unpricedMedicineID"
+    And I send a POST request to "/api/price-lists" with body:
+      """
+      {
+        "name": "${emptyPriceListName}",
+        "customerType": "institution",
+        "institution": "Hospital Test"
+      }
+      """
+    And I save the JSON response key "id" as "emptyPriceListID"
+    When I send a POST request to "/api/quotes" with body:
+      """
+      {
+        "priceListId": ${emptyPriceListID},
+        "items": [
+          { "medicineId": ${unpricedMedicineID}, "quantity": 1 }
+        ]
+      }
+      """
+    Then the response code should be 422
+    And the JSON response field "error" should contain string "has no price"
+
+  Scenario: TC11 - Filter and sort medicines with search operators
+    Given I generate a unique alias as "operatorLab"
+    And I generate a unique EAN code as "lightEan"
+    And I generate a unique EAN code as "heavyEan"
+    And I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${lightEan}",
+        "description": "Operator Light Medicine",
+        "laboratory": "${operatorLab}",
+        "type": "tablet",
+        "temperatureControl": "room",
+        "unitQuantity": 10.0,
+        "unitType": "tablet"
+      }
+      """
+    And I save the JSON response key "id" as "lightMedicineID"
+    And I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${heavyEan}",
+        "description": "Operator Heavy Medicine",
+        "laboratory": "${operatorLab}",
+        "type": "tablet",
+        "temperatureControl": "room",
+        "unitQuantity": 30.0,
+        "unitType": "tablet"
+      }
+      """
+    And I save the JSON response key "id" as "heavyMedicineID"
+    When I send a GET request to "/api/medicines/search-paginated?laboratory_eq=${operatorLab}&unit_quantity_gt=20"
+    Then the response code should be 200
+    And the JSON response should contain "total_records": 1
+    And the response body should contain "${heavyEan}"
+    When I send a GET request to "/api/medicines/search-paginated?laboratory_eq=${operatorLab}&unit_quantity_between=5,30&tax_rate_id_is_null=true"
+    Then the response code should be 200
+    And the JSON response should contain "total_records": 2
+    When I send a GET request to "/api/medicines/search-paginated?laboratory_in=${operatorLab}&sort=-unit_quantity,description&limit=1"
+    Then the response code should be 200
+    And the JSON response should contain "total_pages": 2
+    And the response body should contain "${heavyEan}"
+    And the response body should not contain "${lightEan}"
+    When I send a GET request to "/api/medicines/search-paginated?laboratory_eq=${operatorLab}&ean_code_ne=${heavyEan}"
+    Then the response code should be 200
+    And the JSON response should contain "total_records": 1
+    And the response body should contain "${lightEan}"
+    When I send a GET request to "/api/medicines/search-paginated?sort=is_deleted"
+    Then the response code should be 400
+    When I send a GET request to "/api/medicines/search-paginated?rx_code_eq=RX1"
+    Then the response code should be 400
+    When I send a GET request to "/api/medicines/search-paginated?unit_quantity_gt=many"
+    Then the response code should be 400
+    When I send a GET request to "/api/users/search-paginated?enabled_eq=true&sort=-created_at"
+    Then the response code should be 200
+    And the JSON response should contain key "records"
+
+  Scenario: TC12 - Page medicines by cursor in both directions
+    Given I generate a unique alias as "cursorLab"
+    And I generate a unique EAN code as "firstCursorEan"
+    And I generate a unique EAN code as "secondCursorEan"
+    And I generate a unique EAN code as "thirdCursorEan"
+    And I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${firstCursorEan}",
+        "description": "Cursor Medicine A",
+        "laboratory": "${cursorLab}",
+        "type": "tablet",
+        "temperatureControl": "room",
+        "unitQuantity": 10.0,
+        "unitType": "tablet"
+      }
+      """
+    And I save the JSON response key "id" as "firstCursorMedicineID"
+    And I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${secondCursorEan}",
+        "description": "Cursor Medicine B",
+        "laboratory": "${cursorLab}",
+        "type": "tablet",
+        "temperatureControl": "room",
+        "unitQuantity": 10.0,
+        "unitType": "tablet"
+      }
+      """
+    And I save the JSON response key "id" as "secondCursorMedicineID"
+    And I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${thirdCursorEan}",
+        "description": "Cursor Medicine C",
+        "laboratory": "${cursorLab}",
+        "type": "tablet",
+        "temperatureControl": "room",
+        "unitQuantity": 10.0,
+        "unitType": "tablet"
+      }
+      """
+    And I save the JSON response key "id" as "thirdCursorMedicineID"
+    When I send a GET request to "/api/medicines/search-paginated?laboratory_eq=${cursorLab}&sort=description&cursor=&limit=2&count=exact"
+    Then the response code should be 200
+    And the JSON response should contain "total_records": 3
+    And the JSON response should contain "page_size": 2
+    And the response body should contain "${secondCursorEan}"
+    And the response body should not contain "${thirdCursorEan}"
+    And I save the JSON response key "next_cursor" as "nextCursor"
+    When I send a GET request to "/api/medicines/search-paginated?laboratory_eq=${cursorLab}&sort=description&cursor=${nextCursor}&limit=2"
+    Then the response code should be 200
+    And the response body should contain "${thirdCursorEan}"
+    And the response body should not contain "${firstCursorEan}"
+    And the response body should not contain "total_records"
+    And I save the JSON response key "prev_cursor" as "prevCursor"
+    When I send a GET request to "/api/medicines/search-paginated?laboratory_eq=${cursorLab}&sort=description&cursor=${prevCursor}&limit=2"
+    Then the response code should be 200
+    And the response body should contain "${firstCursorEan}"
+    And the response body should contain "${secondCursorEan}"
+    When I send a GET request to "/api/medicines/search-paginated?laboratory_eq=${cursorLab}&sort=-description&cursor=${nextCursor}"
+    Then the response code should be 400
+    When I send a GET request to "/api/medicines/search-paginated?cursor=abc.def"
+    Then the response code should be 400
+    When I send a GET request to "/api/medicines/search-paginated?sort=tax_rate_id&cursor="
+    Then the response code should be 400
+    When I send a GET request to "/api/medicines/search-paginated?limit=100000"
+    Then the response code should be 200
+    And the JSON response should contain "page_size": 100
+
+  Scenario: TC13 - Reject writes based on a stale version of a medicine
+    Given I generate a unique EAN code as "versionedEan"
+    And I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${versionedEan}",
+        "description": "Versioned Medicine",
+        "type": "tablet",
+        "temperatureControl": "room",
+        "unitQuantity": 10.0,
+        "unitType": "tablet"
+      }
+      """
+    And I save the JSON response key "id" as "versionedMedicineID"
+    When I send a GET request to "/api/medicines/${versionedMedicineID}"
+    Then the response code should be 200
+    And I save the response header "ETag" as "firstETag"
+    When I set the request header "If-None-Match" to "${firstETag}"
+    And I send a GET request to "/api/medicines/${versionedMedicineID}"
+    Then the response code should be 304
+    When I set the request header "If-Match" to "${firstETag}"
+    And I send a PUT request to "/api/medicines/${versionedMedicineID}" with body:
+      """
+      {
+        "description": "Versioned Medicine Updated"
+      }
+      """
+    Then the response code should be 200
+    And the JSON response should contain "version": 2
+    And I save the response header "ETag" as "secondETag"
+    When I set the request header "If-Match" to "${firstETag}"
+    And I send a PUT request to "/api/medicines/${versionedMedicineID}" with body:
+      """
+      {
+        "description": "Versioned Medicine Lost Update"
+      }
+      """
+    Then the response code should be 412
+    And the JSON response should contain error message "The record was modified since it was read"
+    When I set the request header "If-Match" to "${firstETag}"
+    And I send a DELETE request to "/api/medicines/${versionedMedicineID}"
+    Then the response code should be 412
+    When I set the request header "If-Match" to "${secondETag}"
+    And I send a DELETE request to "/api/medicines/${versionedMedicineID}"
+    Then the response code should be 200
+
+  Scenario: TC14 - Patch a medicine with a merge patch and a JSON Patch
+    Given I generate a unique EAN code as "patchedEan"
+    And I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${patchedEan}",
+        "description": "Patched Medicine",
+        "laboratory": "Patch Lab",
+        "type": "tablet",
+        "iva": "16",
+        "temperatureControl": "room",
+        "unitQuantity": 10.0,
+        "unitType": "tablet"
+      }
+      """
+    And I save the JSON response key "id" as "patchedMedicineID"
+    When I set the request header "Content-Type" to "application/merge-patch+json"
+    And I send a PATCH request to "/api/medicines/${patchedMedicineID}" with body:
+      """
+      {
+        "laboratory": null,
+        "iva": null
+      }
+      """
+    Then the response code should be 200
+    And the JSON response should contain "laboratory": ""
+    And the JSON response should contain "description": "Patched Medicine"
+    And the response body should not contain "IVA 16%"
+    When I set the request header "Content-Type" to "application/json-patch+json"
+    And I send a PATCH request to "/api/medicines/${patchedMedicineID}" with body:
+      """
+      [
+        { "op": "test", "path": "/description", "value": "Patched Medicine" },
+        { "op": "replace", "path": "/unitQuantity", "value": 20 },
+        { "op": "add", "path": "/iva", "value": "0" }
+      ]
+      """
+    Then the response code should be 200
+    And the JSON response should contain "unitQuantity": 20
+    And the response body should contain "IVA 0%"
+    When I set the request header "Content-Type" to "application/json-patch+json"
+    And I send a PATCH request to "/api/medicines/${patchedMedicineID}" with body:
+      """
+      [
+        { "op": "test", "path": "/description", "value": "Another Description" },
+        { "op": "replace", "path": "/description", "value": "Never Written" }
+      ]
+      """
+    Then the response code should be 409
+    When I set the request header "Content-Type" to "application/merge-patch+json"
+    And I send a PATCH request to "/api/medicines/${patchedMedicineID}" with body:
+      """
+      {
+        "type": "syrup"
+      }
+      """
+    Then the response code should be 400
+    When I send a PATCH request to "/api/medicines/${patchedMedicineID}" with body:
+      """
+      {
+        "description": "Wrong Media Type"
+      }
+      """
+    Then the response code should be 415
+
+  Scenario: TC15 - Override a global medicine for the organization
+    Given I generate a unique EAN code as "globalEan"
+    And I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${globalEan}",
+        "description": "Global Medicine",
+        "type": "tablet",
+        "laboratory": "Global Lab",
+        "temperatureControl": "room",
+        "unitQuantity": 10.0,
+        "unitType": "tablet",
+        "global": true
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "globalMedicineID"
+    When I send a GET request to "/api/medicines/search-paginated?organization_id_is_null=true&ean_code_eq=${globalEan}"
+    Then the response code should be 200
+    And the response body should contain "Global Medicine"
+    When I send a GET request to "/api/medicines/${globalMedicineID}/override"
+    Then the response code should be 404
+    When I send a PUT request to "/api/medicines/${globalMedicineID}/override" with body:
+      """
+      {
+        "description": "Organization Medicine"
+      }
+      """
+    Then the response code should be 200
+    And the JSON response should contain "description": "Organization Medicine"
+    And the JSON response should contain "laboratory": "Global Lab"
+    When I send a GET request to "/api/medicines/${globalMedicineID}/override"
+    Then the response code should be 200
+    And the JSON response should contain "description": "Organization Medicine"
+    When I send a DELETE request to "/api/medicines/${globalMedicineID}/override"
+    Then the response code should be 200
+    When I send a GET request to "/api/medicines/${globalMedicineID}"
+    Then the response code should be 200
+    And the JSON response should contain "description": "Global Medicine"
+    Given I generate a unique EAN code as "ownEan"
+    And I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${ownEan}",
+        "description": "Own Medicine",
+        "type": "tablet",
+        "temperatureControl": "room",
+        "unitQuantity": 10.0,
+        "unitType": "tablet"
+      }
+      """
+    And I save the JSON response key "id" as "ownMedicineID"
+    When I send a PUT request to "/api/medicines/${ownMedicineID}/override" with body:
+      """
+      {
+        "description": "Not Allowed"
+      }
+      """
+    Then the response code should be 400
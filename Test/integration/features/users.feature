@@ -837,4 +837,248 @@ Feature: User Management
   Scenario: TC17 - Search device coincidences by property
     When I send a GET request to "/api/users/devices/search-by-property?property=device_type&search_text=desktop"
     Then the response code should be 200
-    And the JSON response should be an array 
\ No newline at end of file
+    And the JSON response should be an array 
+  Scenario: TC18 - Export users as CSV without password hashes
+    When I send a GET request to "/api/users/export?format=csv"
+    Then the response code should be 200
+    And the response header "Content-Type" should contain "text/csv"
+    And the response body should contain "id,username,first_name,last_name,email"
+    And the response body should not contain "hash_password"
+
+  Scenario: TC19 - Read only the requested fields and relations of a user
+    Given I generate a unique alias as "sparseUserUsername"
+    And I generate a unique alias as "sparseUserEmail"
+    And I generate a unique alias as "sparseUserRoleName"
+    And I send a POST request to "/api/users/roles" with body:
+      """
+      {
+        "name": "${sparseUserRoleName}",
+        "description": "Role for sparse fieldset test",
+        "enabled": true
+      }
+      """
+    And I save the JSON response key "id" as "sparseUserRoleID"
+    And I send a POST request to "/api/users" with body:
+      """
+      {
+        "username": "${sparseUserUsername}",
+        "firstName": "Sparse",
+        "lastName": "Fields",
+        "email": "${sparseUserEmail}@test.com",
+        "password": "securePassword123",
+        "jobPosition": "Auditor",
+        "roleId": ${sparseUserRoleID},
+        "enabled": true
+      }
+      """
+    And I save the JSON response key "id" as "sparseUserID"
+    When I send a GET request to "/api/users/${sparseUserID}?fields=username,email&expand=role"
+    Then the response code should be 200
+    And the JSON response should contain "username": "${sparseUserUsername}"
+    And the JSON response should contain key "role"
+    And the response body should contain "${sparseUserRoleName}"
+    And the response body should not contain "jobPosition"
+    And the response body should not contain "devices"
+    When I send a GET request to "/api/users/${sparseUserID}?expand="
+    Then the response code should be 200
+    And the JSON response should contain "jobPosition": "Auditor"
+    And the response body should not contain "${sparseUserRoleName}"
+    When I send a GET request to "/api/users/search-paginated?username_eq=${sparseUserUsername}&fields=first_name&expand="
+    Then the response code should be 200
+    And the response body should contain "Sparse"
+    And the response body should not contain "${sparseUserUsername}"
+    When I send a GET request to "/api/users/${sparseUserID}?fields=hash_password"
+    Then the response code should be 400
+    When I send a GET request to "/api/users?expand=permissions"
+    Then the response code should be 400
+
+  Scenario: TC20 - Deleted roles are hidden, readable by admins and restorable
+    Given I generate a unique alias as "softRoleName"
+    And I send a POST request to "/api/users/roles" with body:
+      """
+      {
+        "name": "${softRoleName}",
+        "description": "Role to be restored",
+        "enabled": true
+      }
+      """
+    And I save the JSON response key "id" as "softRoleID"
+    When I send a DELETE request to "/api/users/roles/${softRoleID}"
+    Then the response code should be 200
+    When I send a GET request to "/api/users/roles/${softRoleID}"
+    Then the response code should be 404
+    When I send a GET request to "/api/users/roles/${softRoleID}?include_deleted=true"
+    Then the response code should be 200
+    And the JSON response should contain key "deletedBy"
+    When I send a POST request to "/api/users/roles" with body:
+      """
+      {
+        "name": "${softRoleName}",
+        "description": "Takes the name of the deleted role",
+        "enabled": true
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "softRoleReplacementID"
+    When I send a POST request to "/api/users/roles/${softRoleID}/restore" with body:
+      """
+      {}
+      """
+    Then the response code should be 409
+    When I send a DELETE request to "/api/users/roles/${softRoleReplacementID}"
+    Then the response code should be 200
+    When I send a POST request to "/api/users/roles/${softRoleID}/restore" with body:
+      """
+      {}
+      """
+    Then the response code should be 200
+    And the JSON response should contain "name": "${softRoleName}"
+    When I send a GET request to "/api/users/roles/${softRoleID}"
+    Then the response code should be 200
+    When I send a DELETE request to "/api/users/roles/${softRoleID}"
+    Then the response code should be 200
+
+  Scenario: TC21 - Roles in use cannot be deleted and deleting a user deletes its devices
+    Given I generate a unique alias as "integrityRoleName"
+    And I generate a unique alias as "integrityOtherRoleName"
+    And I generate a unique alias as "integrityUserUsername"
+    And I generate a unique alias as "integrityUserEmail"
+    And I send a POST request to "/api/users/roles" with body:
+      """
+      {
+        "name": "${integrityRoleName}",
+        "description": "Role held by a user",
+        "enabled": true
+      }
+      """
+    And I save the JSON response key "id" as "integrityRoleID"
+    And I send a POST request to "/api/users/roles" with body:
+      """
+      {
+        "name": "${integrityOtherRoleName}",
+        "description": "Role the user is moved to",
+        "enabled": true
+      }
+      """
+    And I save the JSON response key "id" as "integrityOtherRoleID"
+    And I send a POST request to "/api/users" with body:
+      """
+      {
+        "username": "${integrityUserUsername}",
+        "firstName": "Integrity",
+        "lastName": "User",
+        "email": "${integrityUserEmail}@test.com",
+        "password": "securePassword123",
+        "jobPosition": "Integrity Tester",
+        "roleId": ${integrityRoleID},
+        "enabled": true
+      }
+      """
+    And I save the JSON response key "id" as "integrityUserID"
+    And I send a POST request to "/api/users/devices" with body:
+      """
+      {
+        "userId": ${integrityUserID},
+        "ip_address": "192.168.1.121",
+        "user_agent": "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36",
+        "device_type": "desktop",
+        "browser": "Firefox",
+        "browser_version": "121.0",
+        "os": "Linux",
+        "language": "en-US"
+      }
+      """
+    And I save the JSON response key "id" as "integrityDeviceID"
+    When I send a DELETE request to "/api/users/roles/${integrityRoleID}"
+    Then the response code should be 409
+    And the JSON response should contain key "dependents"
+    When I send a DELETE request to "/api/users/roles/${integrityRoleID}?reassign_to=${integrityRoleID}"
+    Then the response code should be 400
+    When I send a DELETE request to "/api/users/roles/${integrityRoleID}?reassign_to=${integrityOtherRoleID}"
+    Then the response code should be 200
+    And the JSON response should contain "reassignedUsers" with numeric value 1
+    When I send a GET request to "/api/users/${integrityUserID}"
+    Then the response code should be 200
+    And the JSON response should contain "roleId" with value "${integrityOtherRoleID}"
+    When I send a DELETE request to "/api/users/${integrityUserID}"
+    Then the response code should be 200
+    And the JSON response should contain "deletedDevices" with numeric value 1
+    When I send a GET request to "/api/users/devices/${integrityDeviceID}"
+    Then the response code should be 404
+    When I send a POST request to "/api/users/devices/${integrityDeviceID}/restore" with body:
+      """
+      {}
+      """
+    Then the response code should be 409
+    When I send a POST request to "/api/users/${integrityUserID}/restore" with body:
+      """
+      {}
+      """
+    Then the response code should be 200
+    When I send a GET request to "/api/users/devices/${integrityDeviceID}"
+    Then the response code should be 200
+
+  Scenario: TC22 - Platform admins open organizations and disable them
+    When I send a GET request to "/api/organizations/current"
+    Then the response code should be 200
+    And the JSON response should contain "slug" with value "default"
+    And I save the JSON response key "id" as "defaultOrganizationID"
+    Given I generate a unique organization slug as "organizationSlug"
+    When I send a POST request to "/api/organizations" with body:
+      """
+      {
+        "name": "Integration clinic",
+        "slug": "${organizationSlug}",
+        "admin": {
+          "username": "${organizationSlug}",
+          "email": "${organizationSlug}@example.com",
+          "password": "Secret123",
+          "firstName": "Integration"
+        }
+      }
+      """
+    Then the response code should be 201
+    And the JSON response should contain "slug" with value "${organizationSlug}"
+    And the JSON response should contain key "admin"
+    And I save the JSON response key "id" as "organizationID"
+    When I send a POST request to "/api/organizations" with body:
+      """
+      {
+        "name": "Integration clinic again",
+        "slug": "${organizationSlug}",
+        "admin": {
+          "username": "${organizationSlug}",
+          "email": "${organizationSlug}@example.com",
+          "password": "Secret123"
+        }
+      }
+      """
+    Then the response code should be 409
+    When I send a POST request to "/api/organizations" with body:
+      """
+      {
+        "name": "Integration clinic",
+        "slug": "Not A Slug",
+        "admin": {
+          "username": "someone",
+          "email": "someone@example.com",
+          "password": "Secret123"
+        }
+      }
+      """
+    Then the response code should be 400
+    When I send a PUT request to "/api/organizations/${organizationID}" with body:
+      """
+      {
+        "enabled": false
+      }
+      """
+    Then the response code should be 200
+    And the JSON response should contain "enabled": false
+    When I send a PUT request to "/api/organizations/${defaultOrganizationID}" with body:
+      """
+      {
+        "enabled": false
+      }
+      """
+    Then the response code should be 400
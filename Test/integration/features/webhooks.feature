@@ -0,0 +1,99 @@
+Feature: Webhooks
+  As an API consumer
+  I want to subscribe endpoints to the events of my organization
+  So that other systems learn about changes as they happen.
+
+  Background:
+    # Login to obtain accessToken is handled globally by InitializeScenario
+    # and the token is automatically added to headers by the addAuthHeader function.
+
+  Scenario: TC01 - Deliver a signed event to a subscription and replay it
+    Given I start a webhook receiver as "hookUrl"
+    When I send a POST request to "/api/webhooks/subscriptions" with body:
+      """
+      {
+        "url": "${hookUrl}",
+        "description": "Integration receiver",
+        "events": ["medicine.created"]
+      }
+      """
+    Then the response code should be 201
+    And the JSON response should contain "enabled": true
+    And I save the JSON response key "id" as "subscriptionID"
+    And I save the JSON response key "secret" as "hookSecret"
+    Given I generate a unique EAN code as "hookEan"
+    When I send a POST request to "/api/medicines" with body:
+      """
+      {
+        "eanCode": "${hookEan}",
+        "description": "Webhook Medicine",
+        "type": "tablet",
+        "temperatureControl": "room",
+        "unitQuantity": 10.0,
+        "unitType": "tablet"
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "hookMedicineID"
+    Then the webhook receiver "hookUrl" should receive 1 "medicine.created" event within 10 seconds
+    And the last received webhook should be signed with secret "${hookSecret}"
+    And the last received webhook should contain "${hookEan}"
+    When I poll GET "/api/webhooks/deliveries?subscription_id_eq=${subscriptionID}&status_eq=succeeded" until the response body contains "succeeded" within 10 seconds
+    Then I save the first array element key "id" from array "records" as "deliveryID"
+    When I send a POST request to "/api/webhooks/deliveries/${deliveryID}/replay"
+    Then the response code should be 201
+    And the JSON response should contain "replayOf" with value "${deliveryID}"
+    And the JSON response should contain "status": "pending"
+    Then the webhook receiver "hookUrl" should receive 2 "medicine.created" events within 10 seconds
+    And the last received webhook should be signed with secret "${hookSecret}"
+    When I send a DELETE request to "/api/webhooks/subscriptions/${subscriptionID}"
+    Then the response code should be 200
+    When I send a GET request to "/api/webhooks/deliveries/${deliveryID}"
+    Then the response code should be 404
+
+  Scenario: TC02 - Reject a subscription to an unknown event or an invalid URL
+    When I send a POST request to "/api/webhooks/subscriptions" with body:
+      """
+      {
+        "url": "http://localhost:9/hooks",
+        "events": ["medicine.exploded"]
+      }
+      """
+    Then the response code should be 400
+    And the response body should contain "Invalid event medicine.exploded"
+    When I send a POST request to "/api/webhooks/subscriptions" with body:
+      """
+      {
+        "url": "ftp://localhost/hooks",
+        "events": ["medicine.created"]
+      }
+      """
+    Then the response code should be 400
+    When I send a GET request to "/api/webhooks/events"
+    Then the response code should be 200
+    And the response body should contain "login.failed"
+
+  Scenario: TC03 - Retry a delivery the endpoint turns down
+    Given I start a failing webhook receiver as "failingHookUrl"
+    When I send a POST request to "/api/webhooks/subscriptions" with body:
+      """
+      {
+        "url": "${failingHookUrl}",
+        "events": ["login.failed"]
+      }
+      """
+    Then the response code should be 201
+    And I save the JSON response key "id" as "failingSubscriptionID"
+    When I send a POST request to "/login" with body:
+      """
+      {
+        "email": "${START_USER_EMAIL}",
+        "password": "not-the-password"
+      }
+      """
+    Then the response code should be 401
+    Then the webhook receiver "failingHookUrl" should receive 2 "login.failed" events within 15 seconds
+    And the last received webhook should contain "${START_USER_EMAIL}"
+    When I poll GET "/api/webhooks/deliveries?subscription_id_eq=${failingSubscriptionID}&attempts_gt=1" until the response body contains "the endpoint answered 500" within 10 seconds
+    When I send a DELETE request to "/api/webhooks/subscriptions/${failingSubscriptionID}"
+    Then the response code should be 200
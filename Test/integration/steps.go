@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"strconv"
@@ -33,7 +34,8 @@ var (
 	deletedResources  []string // Track resources that have been manually deleted
 	lastRequestMethod string
 	lastRequestPath   string
-	skipNextTracking  bool // Flag to skip tracking for manually deleted resources
+	skipNextTracking  bool                      // Flag to skip tracking for manually deleted resources
+	requestHeaders    = make(map[string]string) // Headers sent with the next request only
 )
 
 // ===== AUTONOMOUS RESOURCE MANAGEMENT FUNCTIONS =====
@@ -99,6 +101,7 @@ func iSendARequestTo(method, path string) error {
 		return e
 	}
 	addAuthHeader(req)
+	addRequestHeaders(req)
 	logger.Printf("Request headers: %v\n", req.Header)
 	resp, err = http.DefaultClient.Do(req)
 	if err != nil {
@@ -142,6 +145,7 @@ func iSendARequestWithBody(method, path string, payload *godog.DocString) error
 	}
 	req.Header.Set("Content-Type", "application/json")
 	addAuthHeader(req)
+	addRequestHeaders(req)
 	logger.Printf("Request headers: %v\n", req.Header)
 	resp, err = http.DefaultClient.Do(req)
 	if err != nil {
@@ -163,6 +167,47 @@ func iSendARequestWithBody(method, path string, payload *godog.DocString) error
 	return nil
 }
 
+func iUploadTheFileToWithContent(filename, path string, payload *godog.DocString) error {
+	substitutedPath := substitute(path)
+	fullURL := base + substitutedPath
+	lastRequestMethod = "POST"
+	lastRequestPath = substitutedPath
+	fileContent := replaceVars(payload.Content)
+	if strings.Contains(substitutedPath, "${") || strings.Contains(fileContent, "${") {
+		logger.Printf("ERROR: Unsubstituted variable found in upload. URL: %s, File: %s", substitutedPath, fileContent)
+		return fmt.Errorf("unsubstituted variable found in upload: URL or file contains ${...}")
+	}
+	logger.Printf("Uploading file %s to: %s\n", filename, fullURL)
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, e := writer.CreateFormFile("file", filename)
+	if e != nil {
+		return e
+	}
+	if _, e := part.Write([]byte(fileContent)); e != nil {
+		return e
+	}
+	if e := writer.Close(); e != nil {
+		return e
+	}
+
+	req, e := http.NewRequest("POST", fullURL, &buf)
+	if e != nil {
+		logger.Printf("Error creating upload request: %v\n", e)
+		return e
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	addAuthHeader(req)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Printf("Error sending upload request: %v\n", err)
+		return err
+	}
+	logger.Printf("Received response status: %s\n", resp.Status)
+	return nil
+}
+
 func theResponseCodeShouldBe(code int) error {
 	if resp == nil {
 		return fmt.Errorf("response is nil, cannot check status code")
@@ -189,6 +234,39 @@ func theResponseCodeShouldBe(code int) error {
 	return nil
 }
 
+func theResponseHeaderShouldContain(header, expected string) error {
+	if resp == nil {
+		return fmt.Errorf("response is nil, cannot check headers")
+	}
+	value := resp.Header.Get(header)
+	if !strings.Contains(value, replaceVars(expected)) {
+		return fmt.Errorf("expected header '%s' to contain '%s' but got '%s'", header, expected, value)
+	}
+	return nil
+}
+
+func theResponseBodyShouldContain(expected string) error {
+	if body == nil {
+		return fmt.Errorf("response body is nil")
+	}
+	expected = replaceVars(expected)
+	if !strings.Contains(string(body), expected) {
+		return fmt.Errorf("expected response body to contain '%s' but got: %s", expected, string(body))
+	}
+	return nil
+}
+
+func theResponseBodyShouldNotContain(unexpected string) error {
+	if body == nil {
+		return fmt.Errorf("response body is nil")
+	}
+	unexpected = replaceVars(unexpected)
+	if strings.Contains(string(body), unexpected) {
+		return fmt.Errorf("expected response body not to contain '%s'", unexpected)
+	}
+	return nil
+}
+
 func theJSONResponseShouldContainKey(key string) error {
 	if body == nil {
 		return fmt.Errorf("response body is nil")
@@ -405,6 +483,8 @@ func iSaveTheJSONResponseKeyAs(key, varName string) error {
 			resourceType = "icd-cie"
 		} else if strings.Contains(lastRequestPath, "/medicines") {
 			resourceType = "medicine"
+		} else if strings.Contains(lastRequestPath, "/patients") {
+			resourceType = "patient"
 		} else if strings.Contains(lastRequestPath, "/users") {
 			resourceType = "user"
 		}
@@ -475,6 +555,32 @@ func addAuthHeader(req *http.Request) {
 	}
 }
 
+// addRequestHeaders sets the headers given for the next request and forgets them
+func addRequestHeaders(req *http.Request) {
+	for header, value := range requestHeaders {
+		req.Header.Set(header, value)
+	}
+	requestHeaders = make(map[string]string)
+}
+
+func iSetTheRequestHeaderTo(header, value string) error {
+	requestHeaders[header] = replaceVars(value)
+	return nil
+}
+
+func iSaveTheResponseHeaderAs(header, varName string) error {
+	if resp == nil {
+		return fmt.Errorf("response is nil, cannot read headers")
+	}
+	value := resp.Header.Get(header)
+	if value == "" {
+		return fmt.Errorf("header '%s' not found in response", header)
+	}
+	savedVars[varName] = value
+	logger.Printf("Saved header '%s' as '%s' with value: %s", header, varName, value)
+	return nil
+}
+
 func trackResource(path string) {
 	if !skipNextTracking {
 		createdResources = append(createdResources, path)
@@ -496,13 +602,74 @@ func removeResourceFromTracking(fullURL string) {
 	}
 }
 
+// generateUniqueEAN generates a random EAN-13 with a valid check digit
+func generateUniqueEAN() string {
+	id := uuid.New()
+	digits := "750"
+	for _, b := range id[:9] {
+		digits += strconv.Itoa(int(b) % 10)
+	}
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if (len(digits)-1-i)%2 == 0 {
+			sum += d * 3
+		} else {
+			sum += d
+		}
+	}
+	return digits + strconv.Itoa((10-sum%10)%10)
+}
+
 func iGenerateAUniqueEANCodeAs(varName string) error {
-	uniqueEAN := generateUniqueValue("EAN")
+	uniqueEAN := generateUniqueEAN()
 	savedVars[varName] = uniqueEAN
 	logger.Printf("Generated unique EAN code: %s", uniqueEAN)
 	return nil
 }
 
+// generateUniqueICDCategory generates a random category code with the syntax of the given version:
+// A00 for CIE-10 and 1A00 for CIE-11, whose codes never use the letters I and O
+func generateUniqueICDCategory(version string) string {
+	const letters = "ABCDEFGHJKLMNPQRSTUVWXYZ"
+	const alphanumerics = "0123456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+	id := uuid.New()
+	if version == "CIE-11" {
+		return fmt.Sprintf("%c%c%d%c", alphanumerics[1+int(id[0])%(len(alphanumerics)-1)], letters[int(id[1])%len(letters)],
+			int(id[2])%10, alphanumerics[int(id[3])%len(alphanumerics)])
+	}
+	return fmt.Sprintf("%c%02d", letters[int(id[0])%len(letters)], int(id[1])%100)
+}
+
+// generateUniqueICDCode generates a random subcategory code, such as A00.0X or 1A00.0X
+func generateUniqueICDCode(version string) string {
+	const alphanumerics = "0123456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+	id := uuid.New()
+	return fmt.Sprintf("%s.%c%c", generateUniqueICDCategory(version),
+		alphanumerics[int(id[0])%len(alphanumerics)], alphanumerics[int(id[1])%len(alphanumerics)])
+}
+
+func iGenerateAUniqueICDCodeAs(version, varName string) error {
+	uniqueCode := generateUniqueICDCode("CIE-" + version)
+	savedVars[varName] = uniqueCode
+	logger.Printf("Generated unique ICD code: %s", uniqueCode)
+	return nil
+}
+
+func iGenerateAUniqueICDCategoryAs(version, varName string) error {
+	uniqueCategory := generateUniqueICDCategory("CIE-" + version)
+	savedVars[varName] = uniqueCategory
+	logger.Printf("Generated unique ICD category: %s", uniqueCategory)
+	return nil
+}
+
+func iGenerateAUniqueOrganizationSlugAs(varName string) error {
+	uniqueSlug := strings.ToLower(generateUniqueValue("org"))
+	savedVars[varName] = uniqueSlug
+	logger.Printf("Generated unique organization slug: %s", uniqueSlug)
+	return nil
+}
+
 func iGenerateAUniqueLoteAs(varName string) error {
 	uniqueLote := generateUniqueValue("LOTE")
 	savedVars[varName] = uniqueLote
@@ -846,14 +1013,19 @@ func InitializeScenario(ctx *godog.ScenarioContext) {
 			http.DefaultClient.Do(req)
 		}
 
-		// Clean up autonomous resources for this scenario
-		for resourceType, resourceIDs := range autonomousResources {
-			for _, resourceID := range resourceIDs {
-				logger.Printf("Cleaning up autonomous resource: %s/%s", resourceType, resourceID)
-				deleteAutonomousResource(resourceType, resourceID)
+		// Clean up autonomous resources for this scenario, devices and users before the roles
+		// they hold, and newest first so that children (such as ICD subcategories) go before
+		// their parents
+		for _, resourceType := range autonomousCleanupOrder {
+			resourceIDs := autonomousResources[resourceType]
+			for i := len(resourceIDs) - 1; i >= 0; i-- {
+				logger.Printf("Cleaning up autonomous resource: %s/%s", resourceType, resourceIDs[i])
+				deleteAutonomousResource(resourceType, resourceIDs[i])
 			}
 		}
 
+		closeWebhookReceivers()
+
 		// Clear scenario-specific variables
 		for key := range savedVars {
 			if strings.HasPrefix(key, "scenario_") {
@@ -868,6 +1040,8 @@ func InitializeScenario(ctx *godog.ScenarioContext) {
 	ctx.Step(`^the service is initialized$`, theServiceIsInitialized)
 	ctx.Step(`^I send a (GET|POST|PUT|DELETE|PATCH) request to "([^"]*)"$`, iSendARequestTo)
 	ctx.Step(`^I send a (GET|POST|PUT|DELETE|PATCH) request to "([^"]*)" with body:$`, iSendARequestWithBody)
+	ctx.Step(`^I set the request header "([^"]*)" to "([^"]*)"$`, iSetTheRequestHeaderTo)
+	ctx.Step(`^I upload the file "([^"]*)" to "([^"]*)" with content:$`, iUploadTheFileToWithContent)
 	ctx.Step(`^the response code should be (\d+)$`, theResponseCodeShouldBe)
 	ctx.Step(`^the response code should be (\d+) or (\d+)$`, theResponseCodeShouldBeOr)
 
@@ -881,9 +1055,15 @@ func InitializeScenario(ctx *godog.ScenarioContext) {
 	ctx.Step(`^the JSON response should be an array$`, theJSONResponseShouldBeAnArray)
 	ctx.Step(`^the JSON response field "([^"]*)" should contain string "([^"]*)"$`, theJSONResponseFieldShouldContainString)
 
+	// Raw response validation steps
+	ctx.Step(`^the response header "([^"]*)" should contain "([^"]*)"$`, theResponseHeaderShouldContain)
+	ctx.Step(`^the response body should contain "([^"]*)"$`, theResponseBodyShouldContain)
+	ctx.Step(`^the response body should not contain "([^"]*)"$`, theResponseBodyShouldNotContain)
+
 	// Variable management steps
 	ctx.Step(`^I save the JSON response key "([^"]*)" as "([^"]*)"$`, iSaveTheJSONResponseKeyAs)
 	ctx.Step(`^I save the first array element key "([^"]*)" from array "([^"]*)" as "([^"]*)"$`, iSaveFirstArrayElementKeyAs)
+	ctx.Step(`^I save the response header "([^"]*)" as "([^"]*)"$`, iSaveTheResponseHeaderAs)
 
 	// Unique value generation steps
 	ctx.Step(`^I generate a unique EAN code as "([^"]*)"$`, iGenerateAUniqueEANCodeAs)
@@ -891,6 +1071,9 @@ func InitializeScenario(ctx *godog.ScenarioContext) {
 	ctx.Step(`^I generate a unique RFC as "([^"]*)"$`, iGenerateAUniqueRFCAs)
 	ctx.Step(`^I generate a unique alias as "([^"]*)"$`, iGenerateAUniqueAliasAs)
 	ctx.Step(`^I generate a unique legal name as "([^"]*)"$`, iGenerateAUniqueLegalNameAs)
+	ctx.Step(`^I generate a unique ICD-(10|11) code as "([^"]*)"$`, iGenerateAUniqueICDCodeAs)
+	ctx.Step(`^I generate a unique ICD-(10|11) category as "([^"]*)"$`, iGenerateAUniqueICDCategoryAs)
+	ctx.Step(`^I generate a unique organization slug as "([^"]*)"$`, iGenerateAUniqueOrganizationSlugAs)
 
 	// Additional JSON response validation steps
 	ctx.Step(`^the JSON response should contain "([^"]*)": "([^"]*)"$`, theJSONResponseShouldContain)
@@ -903,6 +1086,14 @@ func InitializeScenario(ctx *godog.ScenarioContext) {
 
 	// Authentication steps
 	ctx.Step(`^I clear the authentication token$`, iClearTheAuthenticationToken)
+
+	// Webhook steps
+	ctx.Step(`^I start a webhook receiver as "([^"]*)"$`, iStartAWebhookReceiverAs)
+	ctx.Step(`^I start a failing webhook receiver as "([^"]*)"$`, iStartAFailingWebhookReceiverAs)
+	ctx.Step(`^the webhook receiver "([^"]*)" should receive (\d+) "([^"]*)" events? within (\d+) seconds$`, theWebhookReceiverShouldReceiveEventsWithin)
+	ctx.Step(`^the last received webhook should be signed with secret "([^"]*)"$`, theLastReceivedWebhookShouldBeSignedWithSecret)
+	ctx.Step(`^the last received webhook should contain "([^"]*)"$`, theLastReceivedWebhookShouldContain)
+	ctx.Step(`^I poll GET "([^"]*)" until the response body contains "([^"]*)" within (\d+) seconds$`, iPollUntilTheResponseBodyContains)
 }
 
 func iClearTheAuthenticationToken() error {
@@ -980,7 +1171,7 @@ func createUniqueMedicine(prefix string) (int, error) {
 	medicineData := map[string]interface{}{
 		"name":        fmt.Sprintf("%s Medicine", prefix),
 		"description": fmt.Sprintf("Description for %s medicine", prefix),
-		"eanCode":     generateUniqueValue("EAN"),
+		"eanCode":     generateUniqueEAN(),
 		"lote":        generateUniqueValue("LOTE"),
 		"active":      true,
 	}
@@ -1061,7 +1252,8 @@ func theJSONResponseShouldContainWithValue(field, expectedValue string) error {
 func iGetAValidICDCIECodeForTheClient() error {
 	// Create a test ICD-CIE code
 	icdData := map[string]interface{}{
-		"code":        generateUniqueValue("ICD"),
+		"cieVersion":  "CIE-10",
+		"code":        generateUniqueICDCode("CIE-10"),
 		"description": "Test ICD-CIE code for integration tests",
 		"active":      true,
 	}
@@ -1215,6 +1407,10 @@ func createTestUser() {
 	}
 }
 
+// autonomousCleanupOrder lists the types of autonomous resources in the order they are deleted in, as a
+// role cannot be deleted while users have it
+var autonomousCleanupOrder = []string{"device", "user", "role", "patient", "medicine", "icd-cie"}
+
 func deleteAutonomousResource(resourceType, resourceID string) error {
 	var endpoint string
 	switch resourceType {
@@ -1222,6 +1418,8 @@ func deleteAutonomousResource(resourceType, resourceID string) error {
 		endpoint = fmt.Sprintf("/api/users/%s", resourceID)
 	case "medicine":
 		endpoint = fmt.Sprintf("/api/medicines/%s", resourceID)
+	case "patient":
+		endpoint = fmt.Sprintf("/api/patients/%s", resourceID)
 	case "icd-cie":
 		endpoint = fmt.Sprintf("/api/icd-cie/%s", resourceID)
 	case "device":
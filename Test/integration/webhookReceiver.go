@@ -0,0 +1,167 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// receivedWebhook is a delivery posted to a webhook receiver
+type receivedWebhook struct {
+	event     string
+	timestamp string
+	signature string
+	body      []byte
+}
+
+// webhookReceiver is a local endpoint the API posts webhook deliveries to, recording them so that the
+// scenarios can check them. A failing receiver answers 500 to every delivery.
+type webhookReceiver struct {
+	server   *httptest.Server
+	failing  bool
+	mu       sync.Mutex
+	received []receivedWebhook
+}
+
+var (
+	webhookReceivers = make(map[string]*webhookReceiver) // variable name -> receiver
+	lastWebhook      *receivedWebhook
+)
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	payload, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	r.received = append(r.received, receivedWebhook{
+		event:     req.Header.Get("X-Webhook-Event"),
+		timestamp: req.Header.Get("X-Webhook-Timestamp"),
+		signature: req.Header.Get("X-Webhook-Signature"),
+		body:      payload,
+	})
+	r.mu.Unlock()
+	if r.failing {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ofEvent answers the deliveries of event the receiver got so far
+func (r *webhookReceiver) ofEvent(event string) []receivedWebhook {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var matching []receivedWebhook
+	for _, received := range r.received {
+		if received.event == event {
+			matching = append(matching, received)
+		}
+	}
+	return matching
+}
+
+func startWebhookReceiver(varName string, failing bool) error {
+	if _, exists := webhookReceivers[varName]; exists {
+		return fmt.Errorf("webhook receiver '%s' is already started", varName)
+	}
+	receiver := &webhookReceiver{failing: failing}
+	receiver.server = httptest.NewServer(receiver)
+	webhookReceivers[varName] = receiver
+	savedVars[varName] = receiver.server.URL + "/hooks"
+	logger.Printf("Started webhook receiver '%s' at %s", varName, savedVars[varName])
+	return nil
+}
+
+func iStartAWebhookReceiverAs(varName string) error {
+	return startWebhookReceiver(varName, false)
+}
+
+func iStartAFailingWebhookReceiverAs(varName string) error {
+	return startWebhookReceiver(varName, true)
+}
+
+// theWebhookReceiverShouldReceiveEventsWithin waits until the receiver got count deliveries of event,
+// failing if it got fewer in time or more
+func theWebhookReceiverShouldReceiveEventsWithin(varName string, count int, event string, seconds int) error {
+	receiver, exists := webhookReceivers[varName]
+	if !exists {
+		return fmt.Errorf("webhook receiver '%s' is not started", varName)
+	}
+	deadline := time.Now().Add(time.Duration(seconds) * time.Second)
+	for {
+		received := receiver.ofEvent(event)
+		if len(received) > count {
+			return fmt.Errorf("webhook receiver '%s' got %d '%s' events, expected %d", varName, len(received), event, count)
+		}
+		if len(received) == count {
+			lastWebhook = &received[count-1]
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("webhook receiver '%s' got %d '%s' events in %d seconds, expected %d", varName, len(received), event, seconds, count)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func theLastReceivedWebhookShouldBeSignedWithSecret(secret string) error {
+	if lastWebhook == nil {
+		return fmt.Errorf("no webhook has been received")
+	}
+	mac := hmac.New(sha256.New, []byte(replaceVars(secret)))
+	mac.Write([]byte(lastWebhook.timestamp + "."))
+	mac.Write(lastWebhook.body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(lastWebhook.signature)) {
+		return fmt.Errorf("webhook signature '%s' does not match the secret, expected '%s'", lastWebhook.signature, expected)
+	}
+	return nil
+}
+
+func theLastReceivedWebhookShouldContain(text string) error {
+	if lastWebhook == nil {
+		return fmt.Errorf("no webhook has been received")
+	}
+	expected := replaceVars(text)
+	if !strings.Contains(string(lastWebhook.body), expected) {
+		return fmt.Errorf("webhook body does not contain '%s': %s", expected, string(lastWebhook.body))
+	}
+	return nil
+}
+
+// iPollUntilTheResponseBodyContains repeats a GET request until its body contains text, for the state
+// the API reaches in the background, e.g. the outcome of a webhook delivery
+func iPollUntilTheResponseBodyContains(path, text string, seconds int) error {
+	deadline := time.Now().Add(time.Duration(seconds) * time.Second)
+	expected := replaceVars(text)
+	for {
+		if err := iSendARequestTo("GET", path); err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusOK && strings.Contains(string(body), expected) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("response body of %s did not contain '%s' in %d seconds: %s", path, expected, seconds, string(body))
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// closeWebhookReceivers stops the receivers of a scenario
+func closeWebhookReceivers() {
+	for varName, receiver := range webhookReceivers {
+		receiver.server.Close()
+		delete(webhookReceivers, varName)
+		delete(savedVars, varName)
+	}
+	lastWebhook = nil
+}
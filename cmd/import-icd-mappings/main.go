@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"ia-boilerplate/src/handlers"
+	"ia-boilerplate/src/infrastructure"
+	"ia-boilerplate/src/repository"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+func main() {
+	filePath := flag.String("file", "", "path of the tab-delimited WHO transition table to import")
+	release := flag.String("release", "", "release label stored with the mappings")
+	dryRun := flag.Bool("dry-run", false, "report mapped, one-to-many and unmapped codes without writing")
+	flag.Parse()
+
+	if *filePath == "" {
+		fmt.Fprintln(os.Stderr, "usage: import-icd-mappings -file <10To11MapToOneCategory.txt> [-release <label>] [-dry-run]")
+		os.Exit(2)
+	}
+
+	logger, err := infrastructure.NewLogger()
+	if err != nil {
+		panic("failed to initialize logger: " + err.Error())
+	}
+	defer func() { _ = logger.Log.Sync() }()
+
+	auth := infrastructure.NewAuth(logger)
+	repo := &repository.Repository{
+		Auth:   auth,
+		Logger: logger,
+	}
+	if err := repo.InitDatabase(); err != nil {
+		logger.Error("Failed to initialize database", zap.Error(err))
+		os.Exit(1)
+	}
+	h := handlers.NewHandler(repo, logger, auth)
+
+	file, err := os.Open(*filePath)
+	if err != nil {
+		logger.Error("Could not open import file", zap.String("file", *filePath), zap.Error(err))
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	result, importErr := h.ImportICDMappings(repo.DB, file, handlers.ICDMappingImportOptions{Release: *release, DryRun: *dryRun})
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(result); err != nil {
+		logger.Error("Could not write import report", zap.Error(err))
+	}
+
+	if importErr != nil {
+		logger.Error("ICD mapping import failed", zap.Error(importErr))
+		os.Exit(1)
+	}
+	if len(result.Errors) > 0 {
+		os.Exit(3)
+	}
+}
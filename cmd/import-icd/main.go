@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"ia-boilerplate/src/handlers"
+	"ia-boilerplate/src/icd"
+	"ia-boilerplate/src/infrastructure"
+	"ia-boilerplate/src/repository"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func main() {
+	filePath := flag.String("file", "", "path of the ClaML XML or tab-delimited ICD release file to import")
+	version := flag.String("version", "", "CIE version of the release (CIE-10 or CIE-11)")
+	release := flag.String("release", "", "release label, taken from the file when empty")
+	format := flag.String("format", "", "file format (claml or tsv), inferred from the extension when empty")
+	effective := flag.String("effective", "", "date the release takes effect (YYYY-MM-DD or RFC3339), now when empty")
+	dryRun := flag.Bool("dry-run", false, "report added, changed and retired codes without writing")
+	flag.Parse()
+
+	if *filePath == "" || *version == "" {
+		fmt.Fprintln(os.Stderr, "usage: import-icd -file <release.xml|release.txt> -version <CIE-10|CIE-11> [-release <label>] [-effective <date>] [-dry-run]")
+		os.Exit(2)
+	}
+	var effectiveFrom time.Time
+	if *effective != "" {
+		var err error
+		if effectiveFrom, err = time.Parse(time.RFC3339, *effective); err != nil {
+			if effectiveFrom, err = time.Parse(time.DateOnly, *effective); err != nil {
+				fmt.Fprintln(os.Stderr, "invalid -effective, must be YYYY-MM-DD or RFC3339")
+				os.Exit(2)
+			}
+		}
+	}
+
+	logger, err := infrastructure.NewLogger()
+	if err != nil {
+		panic("failed to initialize logger: " + err.Error())
+	}
+	defer func() { _ = logger.Log.Sync() }()
+
+	auth := infrastructure.NewAuth(logger)
+	repo := &repository.Repository{
+		Auth:   auth,
+		Logger: logger,
+	}
+	if err := repo.InitDatabase(); err != nil {
+		logger.Error("Failed to initialize database", zap.Error(err))
+		os.Exit(1)
+	}
+	h := handlers.NewHandler(repo, logger, auth)
+
+	resolvedFormat, err := icd.FormatFromFilename(*filePath, *format)
+	if err != nil {
+		logger.Error("Invalid import format", zap.Error(err))
+		os.Exit(2)
+	}
+
+	file, err := os.Open(*filePath)
+	if err != nil {
+		logger.Error("Could not open import file", zap.String("file", *filePath), zap.Error(err))
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	result, importErr := h.ImportICDRelease(file, handlers.ICDImportOptions{
+		CieVersion:    repository.CieVersionType(*version),
+		Release:       *release,
+		Format:        resolvedFormat,
+		FileName:      filepath.Base(*filePath),
+		EffectiveFrom: effectiveFrom,
+		DryRun:        *dryRun,
+	})
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(result); err != nil {
+		logger.Error("Could not write import report", zap.Error(err))
+	}
+
+	if importErr != nil {
+		logger.Error("ICD release import failed", zap.Error(importErr))
+		os.Exit(1)
+	}
+	if len(result.Errors) > 0 {
+		os.Exit(3)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"ia-boilerplate/src/handlers"
+	"ia-boilerplate/src/infrastructure"
+	"ia-boilerplate/src/repository"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+func main() {
+	filePath := flag.String("file", "", "path of the CSV or XLSX interaction dataset to import")
+	format := flag.String("format", "", "file format (csv or xlsx), inferred from the extension when empty")
+	dryRun := flag.Bool("dry-run", false, "validate the file and report per-row errors without writing")
+	flag.Parse()
+
+	if *filePath == "" {
+		fmt.Fprintln(os.Stderr, "usage: import-interactions -file <interactions.csv|interactions.xlsx> [-dry-run]")
+		os.Exit(2)
+	}
+
+	logger, err := infrastructure.NewLogger()
+	if err != nil {
+		panic("failed to initialize logger: " + err.Error())
+	}
+	defer func() { _ = logger.Log.Sync() }()
+
+	auth := infrastructure.NewAuth(logger)
+	repo := &repository.Repository{
+		Auth:   auth,
+		Logger: logger,
+	}
+	if err := repo.InitDatabase(); err != nil {
+		logger.Error("Failed to initialize database", zap.Error(err))
+		os.Exit(1)
+	}
+	h := handlers.NewHandler(repo, logger, auth)
+
+	resolvedFormat, err := handlers.ImportFormatFromFilename(*filePath, *format)
+	if err != nil {
+		logger.Error("Invalid import format", zap.Error(err))
+		os.Exit(2)
+	}
+
+	file, err := os.Open(*filePath)
+	if err != nil {
+		logger.Error("Could not open import file", zap.String("file", *filePath), zap.Error(err))
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	rows, err := handlers.ReadImportRows(file, resolvedFormat)
+	if err != nil {
+		logger.Error("Could not parse import file", zap.String("file", *filePath), zap.Error(err))
+		os.Exit(1)
+	}
+
+	result, importErr := h.ImportInteractionRows(repo.DB, rows, *dryRun)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(result); err != nil {
+		logger.Error("Could not write import report", zap.Error(err))
+	}
+
+	if importErr != nil {
+		logger.Error("Interaction import failed", zap.Error(importErr))
+		os.Exit(1)
+	}
+	if result.InvalidRows > 0 {
+		os.Exit(3)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"ia-boilerplate/src/handlers"
+	"ia-boilerplate/src/infrastructure"
+	"ia-boilerplate/src/repository"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+func main() {
+	filePath := flag.String("file", "", "path of the CSV or XLSX catalog to import")
+	format := flag.String("format", "", "file format (csv or xlsx), inferred from the extension when empty")
+	dryRun := flag.Bool("dry-run", false, "validate the file and report per-row errors without writing")
+	batchSize := flag.Int("batch-size", 500, "number of rows upserted per transaction")
+	organizationSlug := flag.String("organization", repository.DefaultOrganizationSlug, "slug of the organization the medicines are imported into")
+	global := flag.Bool("global", false, "import into the global catalog shared by every organization instead")
+	flag.Parse()
+
+	if *filePath == "" {
+		fmt.Fprintln(os.Stderr, "usage: import-medicines -file <catalog.csv|catalog.xlsx> [-organization default | -global] [-dry-run] [-batch-size 500]")
+		os.Exit(2)
+	}
+
+	logger, err := infrastructure.NewLogger()
+	if err != nil {
+		panic("failed to initialize logger: " + err.Error())
+	}
+	defer func() { _ = logger.Log.Sync() }()
+
+	auth := infrastructure.NewAuth(logger)
+	repo := &repository.Repository{
+		Auth:   auth,
+		Logger: logger,
+	}
+	if err := repo.InitDatabase(); err != nil {
+		logger.Error("Failed to initialize database", zap.Error(err))
+		os.Exit(1)
+	}
+	h := handlers.NewHandler(repo, logger, auth)
+
+	db := repo.DB.WithContext(repository.WithGlobalCatalog(context.Background()))
+	if !*global {
+		var organization repository.Organization
+		if err := repo.DB.Where("slug = ?", *organizationSlug).First(&organization).Error; err != nil {
+			logger.Error("Organization not found", zap.String("organization", *organizationSlug), zap.Error(err))
+			os.Exit(2)
+		}
+		db = repo.DB.WithContext(repository.WithOrganization(context.Background(), organization.ID))
+	}
+
+	resolvedFormat, err := handlers.ImportFormatFromFilename(*filePath, *format)
+	if err != nil {
+		logger.Error("Invalid import format", zap.Error(err))
+		os.Exit(2)
+	}
+
+	file, err := os.Open(*filePath)
+	if err != nil {
+		logger.Error("Could not open import file", zap.String("file", *filePath), zap.Error(err))
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	rows, err := handlers.ReadImportRows(file, resolvedFormat)
+	if err != nil {
+		logger.Error("Could not parse import file", zap.String("file", *filePath), zap.Error(err))
+		os.Exit(1)
+	}
+
+	result, importErr := h.ImportMedicineRows(db, rows, *dryRun, *batchSize)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(result); err != nil {
+		logger.Error("Could not write import report", zap.Error(err))
+	}
+
+	if importErr != nil {
+		logger.Error("Medicine import failed", zap.Error(importErr))
+		os.Exit(1)
+	}
+	if result.InvalidRows > 0 {
+		os.Exit(3)
+	}
+}
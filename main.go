@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"ia-boilerplate/src/cfdi"
 	"ia-boilerplate/src/handlers"
 	"ia-boilerplate/src/infrastructure"
 	"ia-boilerplate/src/middlewares"
 	"ia-boilerplate/src/repository"
+	"ia-boilerplate/src/webhook"
 	"net/http"
 	"time"
 
@@ -18,7 +21,6 @@ func main() {
 	logger, err := infrastructure.NewLogger()
 	if err != nil {
 		panic("failed to initialize logger: " + err.Error())
-		return
 	}
 	defer func(Log *zap.Logger) {
 		err := Log.Sync()
@@ -45,8 +47,37 @@ func main() {
 	}
 	logger.Info("Database initialized", zap.Time("at", time.Now()))
 
+	if err := cfdi.LoadStructure(); err != nil {
+		logger.Error("Failed to load the CFDI structure rules", zap.Error(err))
+		panic(err)
+	}
+
 	h := handlers.NewHandler(repo, logger, auth)
 
+	invoicer, err := cfdi.LoadInvoicer()
+	if err != nil {
+		logger.Error("Failed to load the invoicing configuration", zap.Error(err))
+		panic(err)
+	}
+	if invoicer == nil {
+		logger.Warn("Invoicing is disabled, CFDI_PAC is not set")
+	}
+	h.Invoicer = invoicer
+
+	cursorKey, err := handlers.LoadSearchCursorKey()
+	if err != nil {
+		logger.Error("Failed to load the search cursor key", zap.Error(err))
+		panic(err)
+	}
+	h.CursorKey = cursorKey
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dispatcher := webhook.NewDispatcher(repo.DB, logger)
+	h.Webhooks = dispatcher
+	go dispatcher.Run(ctx)
+	logger.Info("Webhook dispatcher started")
+
 	c := cron.New()
 	_, err = c.AddFunc("0 1 * * *", func() {
 		logger.Info("Scheduled task executed", zap.Time("at", time.Now()))
@@ -54,6 +85,17 @@ func main() {
 	if err != nil {
 		logger.Error("Error setting up cron job", zap.Error(err))
 	}
+	_, err = c.AddFunc("30 2 * * *", func() {
+		purged, kept, err := repo.PurgeDeleted(repository.SoftDeleteRetention())
+		if err != nil {
+			logger.Error("Error purging deleted records", zap.Error(err))
+			return
+		}
+		logger.Info("Purged deleted records", zap.Int("purged", purged), zap.Int("kept", kept))
+	})
+	if err != nil {
+		logger.Error("Error setting up purge job", zap.Error(err))
+	}
 	c.Start()
 	logger.Info("Cron scheduler started")
 	defer c.Stop()
@@ -74,9 +116,13 @@ func SetupRoutes(router *gin.Engine, handler *handlers.Handler) {
 	r := router.Group("/")
 	r.POST("/login", handler.Login)
 	r.POST("/access-token/refresh", handler.AccessTokenByRefreshToken)
+	r.GET("/prescriptions/:id/verify", handler.VerifyPrescription)
 	api := r.Group("/api")
 
 	api.Use(middlewares.JWTAuthMiddleware(handler))
+	if repository.TenantRLSEnabled() {
+		api.Use(middlewares.TenantConnection(handler))
+	}
 
 	device := api.Group("/device")
 	device.Use(middlewares.DeviceInfoInterceptor())
@@ -93,21 +139,37 @@ func SetupRoutes(router *gin.Engine, handler *handlers.Handler) {
 		c.JSON(http.StatusOK, gin.H{"message": "authenticated"})
 	})
 
+	organizationRoutes := api.Group("/organizations")
+	{
+		organizationRoutes.GET("", handler.GetOrganizations)
+		organizationRoutes.GET("/current", handler.GetCurrentOrganization)
+		organizationRoutes.GET("/:id", handler.GetOrganization)
+		organizationRoutes.POST("", handler.CreateOrganization)
+		organizationRoutes.PUT("/:id", handler.UpdateOrganization)
+	}
+
 	userRoutes := api.Group("/users")
 	{
 		userRoutes.GET("", handler.GetUsers)
+		userRoutes.GET("/export", handler.ExportUsers)
 		userRoutes.GET("/:id", handler.GetUser)
 		userRoutes.POST("", handler.CreateUser)
+		userRoutes.POST("/batch", handler.BatchUsers)
 		userRoutes.PUT("/:id", handler.UpdateUser)
+		userRoutes.PATCH("/:id", handler.PatchUser)
 		userRoutes.DELETE("/:id", handler.DeleteUser)
+		userRoutes.POST("/:id/restore", handler.RestoreUser)
 
 		roleRoutes := userRoutes.Group("/roles")
 		{
 			roleRoutes.GET("", handler.GetRoles)
 			roleRoutes.GET("/:id", handler.GetRole)
 			roleRoutes.POST("", handler.CreateRole)
+			roleRoutes.POST("/batch", handler.BatchRoles)
 			roleRoutes.PUT("/:id", handler.UpdateRole)
+			roleRoutes.PATCH("/:id", handler.PatchRole)
 			roleRoutes.DELETE("/:id", handler.DeleteRole)
+			roleRoutes.POST("/:id/restore", handler.RestoreRole)
 		}
 
 		deviceRoutes := userRoutes.Group("/devices")
@@ -115,8 +177,11 @@ func SetupRoutes(router *gin.Engine, handler *handlers.Handler) {
 			deviceRoutes.GET("/user-id/:userId", handler.GetDevicesByUser)
 			deviceRoutes.GET("/:id", handler.GetDevice)
 			deviceRoutes.POST("", handler.CreateDevice)
+			deviceRoutes.POST("/batch", handler.BatchDevices)
 			deviceRoutes.PUT("/:id", handler.UpdateDevice)
+			deviceRoutes.PATCH("/:id", handler.PatchDevice)
 			deviceRoutes.DELETE("/:id", handler.DeleteDevice)
+			deviceRoutes.POST("/:id/restore", handler.RestoreDevice)
 			deviceRoutes.GET("/search-paginated", handler.SearchDeviceDetailsPaginated)
 			deviceRoutes.GET("/search-by-property", handler.SearchDeviceCoincidencesByProperty)
 		}
@@ -125,11 +190,96 @@ func SetupRoutes(router *gin.Engine, handler *handlers.Handler) {
 	medicineRoutes := api.Group("/medicines")
 	{
 		medicineRoutes.GET("/:id", handler.GetMedicine)
+		medicineRoutes.GET("/:id/barcode", handler.GetMedicineBarcode)
+		medicineRoutes.GET("/by-barcode/:code", handler.GetMedicineByBarcode)
+		medicineRoutes.GET("/:id/prices", handler.GetMedicinePriceHistory)
+		medicineRoutes.GET("/:id/prices/current", handler.GetMedicineCurrentPrice)
+		medicineRoutes.GET("/:id/equivalents", handler.GetMedicineEquivalents)
 		medicineRoutes.POST("", handler.CreateMedicine)
+		medicineRoutes.POST("/batch", handler.BatchMedicines)
+		medicineRoutes.POST("/import", handler.ImportMedicines)
 		medicineRoutes.PUT("/:id", handler.UpdateMedicine)
+		medicineRoutes.PATCH("/:id", handler.PatchMedicine)
 		medicineRoutes.DELETE("/:id", handler.DeleteMedicine)
+		medicineRoutes.POST("/:id/restore", handler.RestoreMedicine)
+		medicineRoutes.GET("/:id/override", handler.GetMedicineOverride)
+		medicineRoutes.PUT("/:id/override", handler.SetMedicineOverride)
+		medicineRoutes.DELETE("/:id/override", handler.DeleteMedicineOverride)
 		medicineRoutes.GET("/search-paginated", handler.SearchMedicinesPaginated)
 		medicineRoutes.GET("/search-by-property", handler.SearchMedicineCoincidencesByProperty)
+		medicineRoutes.GET("/export", handler.ExportMedicines)
+	}
+
+	api.GET("/tax-rates", handler.GetTaxRates)
+	api.POST("/tax-rates", handler.CreateTaxRate)
+
+	priceListRoutes := api.Group("/price-lists")
+	{
+		priceListRoutes.GET("", handler.GetPriceLists)
+		priceListRoutes.GET("/:id", handler.GetPriceList)
+		priceListRoutes.POST("", handler.CreatePriceList)
+		priceListRoutes.PUT("/:id", handler.UpdatePriceList)
+		priceListRoutes.POST("/:id/prices", handler.SetMedicinePrice)
+	}
+
+	api.POST("/quotes", handler.QuoteBasket)
+
+	ingredientRoutes := api.Group("/active-ingredients")
+	{
+		ingredientRoutes.GET("", handler.GetActiveIngredients)
+		ingredientRoutes.GET("/:id", handler.GetActiveIngredient)
+		ingredientRoutes.POST("", handler.CreateActiveIngredient)
+		ingredientRoutes.POST("/:id/synonyms", handler.AddActiveIngredientSynonym)
+		ingredientRoutes.POST("/link-medicines", handler.LinkMedicineIngredients)
+	}
+
+	interactionRoutes := api.Group("/interactions")
+	{
+		interactionRoutes.POST("/import", handler.ImportInteractions)
+		interactionRoutes.POST("/check", handler.CheckInteractions)
+	}
+
+	equivalenceRoutes := api.Group("/therapeutic-equivalences")
+	{
+		equivalenceRoutes.GET("", handler.GetTherapeuticEquivalences)
+		equivalenceRoutes.POST("", handler.SetTherapeuticEquivalence)
+		equivalenceRoutes.DELETE("/:id", handler.DeleteTherapeuticEquivalence)
+	}
+
+	invoiceRoutes := api.Group("/invoices")
+	{
+		invoiceRoutes.GET("", handler.GetInvoices)
+		invoiceRoutes.GET("/:id", handler.GetInvoice)
+		invoiceRoutes.GET("/:id/xml", handler.GetInvoiceXML)
+		invoiceRoutes.POST("", handler.CreateInvoice)
+		invoiceRoutes.POST("/:id/stamp", handler.StampInvoice)
+	}
+
+	patientRoutes := api.Group("/patients")
+	{
+		patientRoutes.GET("/:id", handler.GetPatient)
+		patientRoutes.POST("", handler.CreatePatient)
+		patientRoutes.PUT("/:id", handler.UpdatePatient)
+		patientRoutes.DELETE("/:id", handler.DeletePatient)
+		patientRoutes.POST("/:id/restore", handler.RestorePatient)
+		patientRoutes.GET("/search-paginated", handler.SearchPatientsPaginated)
+		patientRoutes.GET("/search-by-property", handler.SearchPatientCoincidencesByProperty)
+	}
+
+	encounterRoutes := api.Group("/encounters")
+	{
+		encounterRoutes.GET("/:id", handler.GetEncounter)
+		encounterRoutes.POST("", handler.CreateEncounter)
+		encounterRoutes.PUT("/:id", handler.UpdateEncounter)
+		encounterRoutes.GET("/search-paginated", handler.SearchEncountersPaginated)
+	}
+
+	prescriptionRoutes := api.Group("/prescriptions")
+	{
+		prescriptionRoutes.GET("/:id", handler.GetPrescription)
+		prescriptionRoutes.POST("", handler.CreatePrescription)
+		prescriptionRoutes.GET("/search-paginated", handler.SearchPrescriptionsPaginated)
+		prescriptionRoutes.GET("/:id/pdf", handler.GetPrescriptionPDF)
 	}
 
 	icdcieRoutes := api.Group("/icd-cie")
@@ -137,9 +287,39 @@ func SetupRoutes(router *gin.Engine, handler *handlers.Handler) {
 		icdcieRoutes.GET("", handler.GetICDCies)
 		icdcieRoutes.GET("/:id", handler.GetICDCie)
 		icdcieRoutes.POST("", handler.CreateICDCie)
+		icdcieRoutes.POST("/batch", handler.BatchICDCies)
 		icdcieRoutes.PUT("/:id", handler.UpdateICDCie)
+		icdcieRoutes.PATCH("/:id", handler.PatchICDCie)
 		icdcieRoutes.DELETE("/:id", handler.DeleteICDCie)
+		icdcieRoutes.POST("/:id/restore", handler.RestoreICDCie)
+		icdcieRoutes.GET("/:id/override", handler.GetICDCieOverride)
+		icdcieRoutes.PUT("/:id/override", handler.SetICDCieOverride)
+		icdcieRoutes.DELETE("/:id/override", handler.DeleteICDCieOverride)
 		icdcieRoutes.GET("/search-paginated", handler.SearchICDCiePaginated)
 		icdcieRoutes.GET("/search-by-property", handler.SearchIcdCoincidencesByProperty)
+		icdcieRoutes.GET("/export", handler.ExportICDCies)
+		icdcieRoutes.GET("/tree", handler.GetICDTree)
+		icdcieRoutes.GET("/:id/children", handler.GetICDChildren)
+		icdcieRoutes.GET("/:id/ancestors", handler.GetICDAncestors)
+		icdcieRoutes.GET("/:id/descendants", handler.GetICDDescendants)
+		icdcieRoutes.GET("/:id/history", handler.GetICDCieHistory)
+		icdcieRoutes.POST("/import", handler.ImportICDReleaseFile)
+		icdcieRoutes.GET("/releases", handler.GetICDReleases)
+		icdcieRoutes.GET("/translate", handler.TranslateICDCodes)
+		icdcieRoutes.POST("/mappings/import", handler.ImportICDMappingFile)
+	}
+
+	webhookRoutes := api.Group("/webhooks")
+	{
+		webhookRoutes.GET("/events", handler.GetWebhookEvents)
+		webhookRoutes.GET("/subscriptions", handler.GetWebhookSubscriptions)
+		webhookRoutes.POST("/subscriptions", handler.CreateWebhookSubscription)
+		webhookRoutes.GET("/subscriptions/:id", handler.GetWebhookSubscription)
+		webhookRoutes.PUT("/subscriptions/:id", handler.UpdateWebhookSubscription)
+		webhookRoutes.DELETE("/subscriptions/:id", handler.DeleteWebhookSubscription)
+		webhookRoutes.POST("/subscriptions/:id/secret", handler.RotateWebhookSecret)
+		webhookRoutes.GET("/deliveries", handler.SearchWebhookDeliveries)
+		webhookRoutes.GET("/deliveries/:id", handler.GetWebhookDelivery)
+		webhookRoutes.POST("/deliveries/:id/replay", handler.ReplayWebhookDelivery)
 	}
 }
@@ -83,6 +83,23 @@ validate_required_env_vars() {
   [[ -z "${APP_PORT:-}" ]] && export APP_PORT=8080
   [[ -z "${ACCESS_TOKEN_TTL:-}" ]] && export ACCESS_TOKEN_TTL=15
   [[ -z "${REFRESH_TOKEN_TTL:-}" ]] && export REFRESH_TOKEN_TTL=10080
+
+  # CFDI invoicing uses the test CSD and the fake PAC unless configured
+  [[ -z "${CFDI_ISSUER_RFC:-}" ]] && export CFDI_ISSUER_RFC=EKU9003173C9
+  [[ -z "${CFDI_ISSUER_NAME:-}" ]] && export CFDI_ISSUER_NAME="ESCUELA KEMPER URGATE"
+  [[ -z "${CFDI_ISSUER_REGIMEN:-}" ]] && export CFDI_ISSUER_REGIMEN=601
+  [[ -z "${CFDI_EXPEDITION_ZIP:-}" ]] && export CFDI_EXPEDITION_ZIP=42501
+  [[ -z "${CFDI_CSD_CERT_PATH:-}" ]] && export CFDI_CSD_CERT_PATH="$PROJECT_ROOT/Test/integration/testdata/csd/test.cer"
+  [[ -z "${CFDI_CSD_KEY_PATH:-}" ]] && export CFDI_CSD_KEY_PATH="$PROJECT_ROOT/Test/integration/testdata/csd/test.key"
+  [[ -z "${CFDI_CSD_KEY_PASSWORD:-}" ]] && export CFDI_CSD_KEY_PASSWORD=12345678a
+  [[ -z "${CFDI_PAC:-}" ]] && export CFDI_PAC=fake
+  [[ -z "${CFDI_ALLOW_FAKE_PAC:-}" ]] && export CFDI_ALLOW_FAKE_PAC=true
+  # Prescription PDFs link to the API under test
+  [[ -z "${PUBLIC_BASE_URL:-}" ]] && export PUBLIC_BASE_URL="http://localhost:${APP_PORT}"
+  # Webhook receivers of the scenarios listen on localhost
+  [[ -z "${WEBHOOK_ALLOW_PRIVATE_NETWORKS:-}" ]] && export WEBHOOK_ALLOW_PRIVATE_NETWORKS=true
+  [[ -z "${WEBHOOK_POLL_SECONDS:-}" ]] && export WEBHOOK_POLL_SECONDS=1
+  [[ -z "${WEBHOOK_RETRY_BASE_SECONDS:-}" ]] && export WEBHOOK_RETRY_BASE_SECONDS=1
   
   if [[ ${#missing_vars[@]} -gt 0 ]]; then
     echo "❌ Error: The following required environment variables are not set:"
@@ -0,0 +1,181 @@
+package cfdi
+
+import (
+	"time"
+	// embedded so the issuing time zone is available in minimal container images
+	_ "time/tzdata"
+
+	"github.com/shopspring/decimal"
+)
+
+// Issuer holds the fiscal data of the company issuing the invoices
+type Issuer struct {
+	Rfc             string
+	Nombre          string
+	RegimenFiscal   string
+	LugarExpedicion string
+}
+
+// Customer holds the fiscal data of the invoice receiver as registered with the SAT
+type Customer struct {
+	Rfc             string
+	Nombre          string
+	DomicilioFiscal string
+	RegimenFiscal   string
+	UsoCFDI         string
+}
+
+// SaleItem is a priced line of a sale. Importe and IVA must already be rounded to cents.
+type SaleItem struct {
+	ClaveProdServ    string
+	NoIdentificacion string
+	ClaveUnidad      string
+	Unidad           string
+	Descripcion      string
+	Cantidad         decimal.Decimal
+	ValorUnitario    decimal.Decimal
+	Importe          decimal.Decimal
+	TasaIVA          decimal.Decimal
+	Exento           bool
+	IVA              decimal.Decimal
+}
+
+type Sale struct {
+	Serie      string
+	Folio      string
+	Fecha      time.Time
+	FormaPago  string
+	MetodoPago string
+	Moneda     string
+	Customer   Customer
+	Items      []SaleItem
+}
+
+// Now returns the current time in Mexico City, the local time used for the Fecha attribute
+func Now() time.Time {
+	loc, err := time.LoadLocation("America/Mexico_City")
+	if err != nil {
+		return time.Now()
+	}
+	return time.Now().In(loc)
+}
+
+type trasladoKey struct {
+	tipoFactor string
+	tasa       string
+}
+
+// NewComprobante builds an unsigned ingreso CFDI for the sale. Every concept transfers IVA,
+// either at its rate or as exempt, and the voucher level taxes summarize them by rate.
+func NewComprobante(issuer Issuer, sale Sale) *Comprobante {
+	c := &Comprobante{
+		XmlnsCfdi:         Namespace,
+		XmlnsXsi:          XSINamespace,
+		SchemaLocation:    SchemaLocation,
+		Version:           Version,
+		Serie:             sale.Serie,
+		Folio:             sale.Folio,
+		Fecha:             sale.Fecha.Format(FechaLayout),
+		FormaPago:         sale.FormaPago,
+		Moneda:            sale.Moneda,
+		TipoDeComprobante: TipoComprobanteIngreso,
+		Exportacion:       ExportacionNoAplica,
+		MetodoPago:        sale.MetodoPago,
+		LugarExpedicion:   issuer.LugarExpedicion,
+		Emisor: Emisor{
+			Rfc:           issuer.Rfc,
+			Nombre:        issuer.Nombre,
+			RegimenFiscal: issuer.RegimenFiscal,
+		},
+		Receptor: Receptor{
+			Rfc:                     sale.Customer.Rfc,
+			Nombre:                  sale.Customer.Nombre,
+			DomicilioFiscalReceptor: sale.Customer.DomicilioFiscal,
+			RegimenFiscalReceptor:   sale.Customer.RegimenFiscal,
+			UsoCFDI:                 sale.Customer.UsoCFDI,
+		},
+	}
+
+	subtotal := decimal.Zero
+	transferred := decimal.Zero
+	hasTasa := false
+	var order []trasladoKey
+	bases := map[trasladoKey]decimal.Decimal{}
+	amounts := map[trasladoKey]decimal.Decimal{}
+
+	for _, item := range sale.Items {
+		traslado := Traslado{
+			Base:     formatAmount(item.Importe),
+			Impuesto: ImpuestoIVA,
+		}
+		key := trasladoKey{tipoFactor: TipoFactorExento}
+		if item.Exento {
+			traslado.TipoFactor = TipoFactorExento
+		} else {
+			traslado.TipoFactor = TipoFactorTasa
+			traslado.TasaOCuota = item.TasaIVA.StringFixed(6)
+			traslado.Importe = formatAmount(item.IVA)
+			key = trasladoKey{tipoFactor: TipoFactorTasa, tasa: traslado.TasaOCuota}
+			transferred = transferred.Add(item.IVA)
+			hasTasa = true
+		}
+		if _, ok := bases[key]; !ok {
+			order = append(order, key)
+			bases[key] = decimal.Zero
+			amounts[key] = decimal.Zero
+		}
+		bases[key] = bases[key].Add(item.Importe)
+		amounts[key] = amounts[key].Add(item.IVA)
+		subtotal = subtotal.Add(item.Importe)
+
+		c.Conceptos.Concepto = append(c.Conceptos.Concepto, Concepto{
+			ClaveProdServ:    item.ClaveProdServ,
+			NoIdentificacion: item.NoIdentificacion,
+			Cantidad:         item.Cantidad.String(),
+			ClaveUnidad:      item.ClaveUnidad,
+			Unidad:           item.Unidad,
+			Descripcion:      item.Descripcion,
+			ValorUnitario:    formatUnitValue(item.ValorUnitario),
+			Importe:          formatAmount(item.Importe),
+			ObjetoImp:        ObjetoImpSi,
+			Impuestos:        &ConceptoImpuestos{Traslados: Traslados{Traslado: []Traslado{traslado}}},
+		})
+	}
+
+	impuestos := &Impuestos{}
+	if hasTasa {
+		impuestos.TotalImpuestosTrasladados = formatAmount(transferred)
+	}
+	for _, key := range order {
+		traslado := Traslado{
+			Base:       formatAmount(bases[key]),
+			Impuesto:   ImpuestoIVA,
+			TipoFactor: key.tipoFactor,
+			TasaOCuota: key.tasa,
+		}
+		if key.tipoFactor == TipoFactorTasa {
+			traslado.Importe = formatAmount(amounts[key])
+		}
+		impuestos.Traslados.Traslado = append(impuestos.Traslados.Traslado, traslado)
+	}
+	if len(order) > 0 {
+		c.Impuestos = impuestos
+	}
+
+	c.SubTotal = formatAmount(subtotal)
+	c.Total = formatAmount(subtotal.Add(transferred))
+	return c
+}
+
+// formatAmount renders an amount with the two decimals of the MXN currency
+func formatAmount(d decimal.Decimal) string {
+	return d.StringFixed(2)
+}
+
+// formatUnitValue keeps up to six decimals of a unit price, which the SAT accepts for ValorUnitario
+func formatUnitValue(d decimal.Decimal) string {
+	if d.Equal(d.Round(2)) {
+		return d.StringFixed(2)
+	}
+	return d.Round(6).String()
+}
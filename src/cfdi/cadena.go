@@ -0,0 +1,71 @@
+package cfdi
+
+import "strings"
+
+// cadenaBuilder accumulates the values of the original string following the rules of the SAT
+// cadenaoriginal_4_0.xslt: required attributes are always emitted, optional ones only when present,
+// and every value has its whitespace normalized
+type cadenaBuilder struct {
+	fields []string
+}
+
+func (b *cadenaBuilder) required(values ...string) {
+	for _, v := range values {
+		b.fields = append(b.fields, strings.Join(strings.Fields(v), " "))
+	}
+}
+
+func (b *cadenaBuilder) optional(values ...string) {
+	for _, v := range values {
+		if v != "" {
+			b.required(v)
+		}
+	}
+}
+
+func (b *cadenaBuilder) traslado(t Traslado) {
+	b.required(t.Base, t.Impuesto, t.TipoFactor)
+	b.optional(t.TasaOCuota, t.Importe)
+}
+
+func (b *cadenaBuilder) String() string {
+	return "||" + strings.Join(b.fields, "|") + "||"
+}
+
+// CadenaOriginal returns the original string that is signed to produce the Sello. Nodes are visited in
+// the same order as the SAT transformation for the subset of CFDI 4.0 modelled by Comprobante.
+func CadenaOriginal(c *Comprobante) string {
+	b := &cadenaBuilder{}
+	b.required(c.Version)
+	b.optional(c.Serie, c.Folio)
+	b.required(c.Fecha)
+	b.optional(c.FormaPago)
+	b.required(c.NoCertificado, c.SubTotal, c.Moneda, c.Total, c.TipoDeComprobante, c.Exportacion)
+	b.optional(c.MetodoPago)
+	b.required(c.LugarExpedicion)
+
+	b.required(c.Emisor.Rfc, c.Emisor.Nombre, c.Emisor.RegimenFiscal)
+	b.required(c.Receptor.Rfc, c.Receptor.Nombre, c.Receptor.DomicilioFiscalReceptor,
+		c.Receptor.RegimenFiscalReceptor, c.Receptor.UsoCFDI)
+
+	for _, concepto := range c.Conceptos.Concepto {
+		b.required(concepto.ClaveProdServ)
+		b.optional(concepto.NoIdentificacion)
+		b.required(concepto.Cantidad, concepto.ClaveUnidad)
+		b.optional(concepto.Unidad)
+		b.required(concepto.Descripcion, concepto.ValorUnitario, concepto.Importe, concepto.ObjetoImp)
+		if concepto.Impuestos != nil {
+			for _, t := range concepto.Impuestos.Traslados.Traslado {
+				b.traslado(t)
+			}
+		}
+	}
+
+	if c.Impuestos != nil {
+		for _, t := range c.Impuestos.Traslados.Traslado {
+			b.traslado(t)
+		}
+		b.optional(c.Impuestos.TotalImpuestosTrasladados)
+	}
+	return b.String()
+}
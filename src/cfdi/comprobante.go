@@ -0,0 +1,118 @@
+package cfdi
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+const (
+	Version        = "4.0"
+	Namespace      = "http://www.sat.gob.mx/cfd/4"
+	XSINamespace   = "http://www.w3.org/2001/XMLSchema-instance"
+	SchemaLocation = "http://www.sat.gob.mx/cfd/4 http://www.sat.gob.mx/sitio_internet/cfd/4/cfdv40.xsd"
+
+	TipoComprobanteIngreso  = "I"
+	ExportacionNoAplica     = "01"
+	ObjetoImpSi             = "02"
+	ImpuestoIVA             = "002"
+	TipoFactorTasa          = "Tasa"
+	TipoFactorExento        = "Exento"
+	MetodoPagoUnaExhibicion = "PUE"
+	MetodoPagoParcialidades = "PPD"
+	FormaPagoPorDefinir     = "99"
+
+	// FechaLayout is the local date-time format required by the Fecha attribute
+	FechaLayout = "2006-01-02T15:04:05"
+)
+
+// Comprobante is the root node of a CFDI 4.0 document. Only the attributes and nodes used for
+// medicine sales (ingreso vouchers with transferred IVA) are modelled.
+type Comprobante struct {
+	XMLName           xml.Name   `xml:"cfdi:Comprobante"`
+	XmlnsCfdi         string     `xml:"xmlns:cfdi,attr"`
+	XmlnsXsi          string     `xml:"xmlns:xsi,attr"`
+	SchemaLocation    string     `xml:"xsi:schemaLocation,attr"`
+	Version           string     `xml:"Version,attr"`
+	Serie             string     `xml:"Serie,attr,omitempty"`
+	Folio             string     `xml:"Folio,attr,omitempty"`
+	Fecha             string     `xml:"Fecha,attr"`
+	Sello             string     `xml:"Sello,attr"`
+	FormaPago         string     `xml:"FormaPago,attr,omitempty"`
+	NoCertificado     string     `xml:"NoCertificado,attr"`
+	Certificado       string     `xml:"Certificado,attr"`
+	SubTotal          string     `xml:"SubTotal,attr"`
+	Moneda            string     `xml:"Moneda,attr"`
+	Total             string     `xml:"Total,attr"`
+	TipoDeComprobante string     `xml:"TipoDeComprobante,attr"`
+	Exportacion       string     `xml:"Exportacion,attr"`
+	MetodoPago        string     `xml:"MetodoPago,attr,omitempty"`
+	LugarExpedicion   string     `xml:"LugarExpedicion,attr"`
+	Emisor            Emisor     `xml:"cfdi:Emisor"`
+	Receptor          Receptor   `xml:"cfdi:Receptor"`
+	Conceptos         Conceptos  `xml:"cfdi:Conceptos"`
+	Impuestos         *Impuestos `xml:"cfdi:Impuestos,omitempty"`
+}
+
+type Emisor struct {
+	Rfc           string `xml:"Rfc,attr"`
+	Nombre        string `xml:"Nombre,attr"`
+	RegimenFiscal string `xml:"RegimenFiscal,attr"`
+}
+
+type Receptor struct {
+	Rfc                     string `xml:"Rfc,attr"`
+	Nombre                  string `xml:"Nombre,attr"`
+	DomicilioFiscalReceptor string `xml:"DomicilioFiscalReceptor,attr"`
+	RegimenFiscalReceptor   string `xml:"RegimenFiscalReceptor,attr"`
+	UsoCFDI                 string `xml:"UsoCFDI,attr"`
+}
+
+type Conceptos struct {
+	Concepto []Concepto `xml:"cfdi:Concepto"`
+}
+
+type Concepto struct {
+	ClaveProdServ    string             `xml:"ClaveProdServ,attr"`
+	NoIdentificacion string             `xml:"NoIdentificacion,attr,omitempty"`
+	Cantidad         string             `xml:"Cantidad,attr"`
+	ClaveUnidad      string             `xml:"ClaveUnidad,attr"`
+	Unidad           string             `xml:"Unidad,attr,omitempty"`
+	Descripcion      string             `xml:"Descripcion,attr"`
+	ValorUnitario    string             `xml:"ValorUnitario,attr"`
+	Importe          string             `xml:"Importe,attr"`
+	ObjetoImp        string             `xml:"ObjetoImp,attr"`
+	Impuestos        *ConceptoImpuestos `xml:"cfdi:Impuestos,omitempty"`
+}
+
+type ConceptoImpuestos struct {
+	Traslados Traslados `xml:"cfdi:Traslados"`
+}
+
+type Impuestos struct {
+	TotalImpuestosTrasladados string    `xml:"TotalImpuestosTrasladados,attr,omitempty"`
+	Traslados                 Traslados `xml:"cfdi:Traslados"`
+}
+
+type Traslados struct {
+	Traslado []Traslado `xml:"cfdi:Traslado"`
+}
+
+type Traslado struct {
+	Base       string `xml:"Base,attr"`
+	Impuesto   string `xml:"Impuesto,attr"`
+	TipoFactor string `xml:"TipoFactor,attr"`
+	TasaOCuota string `xml:"TasaOCuota,attr,omitempty"`
+	Importe    string `xml:"Importe,attr,omitempty"`
+}
+
+// Marshal renders the comprobante as an UTF-8 XML document
+func (c *Comprobante) Marshal() ([]byte, error) {
+	body, err := xml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var sb strings.Builder
+	sb.WriteString(xml.Header)
+	sb.Write(body)
+	return []byte(sb.String()), nil
+}
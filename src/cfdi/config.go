@@ -0,0 +1,87 @@
+package cfdi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config is the invoicing configuration read from the environment
+type Config struct {
+	Issuer      Issuer
+	CertPath    string
+	KeyPath     string
+	KeyPassword string
+	PAC         string
+}
+
+// LoadConfig reads the CFDI_* environment variables and reports every missing required one. The fake
+// PAC, whose stamps have no fiscal validity, is only accepted with CFDI_ALLOW_FAKE_PAC=true.
+func LoadConfig() (Config, error) {
+	cfg := Config{
+		Issuer: Issuer{
+			Rfc:             os.Getenv("CFDI_ISSUER_RFC"),
+			Nombre:          os.Getenv("CFDI_ISSUER_NAME"),
+			RegimenFiscal:   os.Getenv("CFDI_ISSUER_REGIMEN"),
+			LugarExpedicion: os.Getenv("CFDI_EXPEDITION_ZIP"),
+		},
+		CertPath:    os.Getenv("CFDI_CSD_CERT_PATH"),
+		KeyPath:     os.Getenv("CFDI_CSD_KEY_PATH"),
+		KeyPassword: os.Getenv("CFDI_CSD_KEY_PASSWORD"),
+		PAC:         os.Getenv("CFDI_PAC"),
+	}
+	var missing []string
+	for _, v := range []struct{ name, value string }{
+		{"CFDI_ISSUER_RFC", cfg.Issuer.Rfc},
+		{"CFDI_ISSUER_NAME", cfg.Issuer.Nombre},
+		{"CFDI_ISSUER_REGIMEN", cfg.Issuer.RegimenFiscal},
+		{"CFDI_EXPEDITION_ZIP", cfg.Issuer.LugarExpedicion},
+		{"CFDI_CSD_CERT_PATH", cfg.CertPath},
+		{"CFDI_CSD_KEY_PATH", cfg.KeyPath},
+		{"CFDI_PAC", cfg.PAC},
+	} {
+		if v.value == "" {
+			missing = append(missing, v.name)
+		}
+	}
+	if len(missing) > 0 {
+		return Config{}, errors.New("missing environment variables: " + strings.Join(missing, ", "))
+	}
+	if cfg.PAC == PACFake {
+		if allow, _ := strconv.ParseBool(os.Getenv("CFDI_ALLOW_FAKE_PAC")); !allow {
+			return Config{}, errors.New("CFDI_PAC=fake issues stamps with no fiscal validity, set CFDI_ALLOW_FAKE_PAC=true to use it in development and tests")
+		}
+	}
+	return cfg, nil
+}
+
+// Invoicer holds the configuration, the issuer CSD and the PAC used to issue invoices, loaded once at
+// startup
+type Invoicer struct {
+	Config Config
+	Signer *Signer
+	PAC    PAC
+}
+
+// LoadInvoicer loads the invoicing configuration and checks the CSD key and password. It returns nil
+// when CFDI_PAC is not set, which leaves invoicing disabled.
+func LoadInvoicer() (*Invoicer, error) {
+	if os.Getenv("CFDI_PAC") == "" {
+		return nil, nil
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	signer, err := LoadSigner(cfg.CertPath, cfg.KeyPath, cfg.KeyPassword)
+	if err != nil {
+		return nil, err
+	}
+	pac, err := NewPAC(cfg.PAC, signer)
+	if err != nil {
+		return nil, fmt.Errorf("configuring the PAC: %w", err)
+	}
+	return &Invoicer{Config: cfg, Signer: signer, PAC: pac}, nil
+}
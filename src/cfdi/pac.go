@@ -0,0 +1,122 @@
+package cfdi
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"ia-boilerplate/src/repository"
+)
+
+const (
+	PACFake = "fake"
+
+	tfdVersion        = "1.1"
+	tfdNamespace      = "http://www.sat.gob.mx/TimbreFiscalDigital"
+	tfdSchemaLocation = "http://www.sat.gob.mx/TimbreFiscalDigital http://www.sat.gob.mx/sitio_internet/cfd/TimbreFiscalDigital/TimbreFiscalDigitalv11.xsd"
+)
+
+var ErrStampRejected = errors.New("the PAC rejected the document")
+
+// StampResult is the fiscal stamp (Timbre Fiscal Digital) returned by a PAC
+type StampResult struct {
+	UUID             string
+	FechaTimbrado    time.Time
+	RfcProvCertif    string
+	NoCertificadoSAT string
+	SelloSAT         string
+	// XML is the stamped document including the TimbreFiscalDigital complement
+	XML []byte
+}
+
+// PAC is a Proveedor Autorizado de Certificación that certifies sealed CFDI documents
+type PAC interface {
+	Stamp(ctx context.Context, document []byte) (StampResult, error)
+}
+
+// NewPAC returns the PAC implementation configured by name
+func NewPAC(name string, signer *Signer) (PAC, error) {
+	switch name {
+	case PACFake:
+		return &FakePAC{Signer: signer, RfcProvCertif: "SPR190613I52"}, nil
+	default:
+		return nil, fmt.Errorf("unsupported PAC %q", name)
+	}
+}
+
+// FakePAC stamps documents locally, signing the stamp with the issuer CSD instead of a SAT
+// certificate. It is meant for development and tests: its stamps have no fiscal validity.
+type FakePAC struct {
+	Signer        *Signer
+	RfcProvCertif string
+}
+
+func (p *FakePAC) Stamp(ctx context.Context, document []byte) (StampResult, error) {
+	if err := ctx.Err(); err != nil {
+		return StampResult{}, err
+	}
+	selloCFD, err := rootAttribute(document, "Comprobante", "Sello")
+	if err != nil {
+		return StampResult{}, err
+	}
+
+	uuid, err := repository.GenerateNewUUID()
+	if err != nil {
+		return StampResult{}, err
+	}
+	result := StampResult{
+		UUID:             strings.ToUpper(uuid),
+		FechaTimbrado:    Now(),
+		RfcProvCertif:    p.RfcProvCertif,
+		NoCertificadoSAT: p.Signer.NoCertificado(),
+	}
+	fecha := result.FechaTimbrado.Format(FechaLayout)
+	cadena := fmt.Sprintf("||%s|%s|%s|%s|%s|%s||", tfdVersion, result.UUID, fecha, result.RfcProvCertif, selloCFD, result.NoCertificadoSAT)
+	if result.SelloSAT, err = p.Signer.Sign(cadena); err != nil {
+		return StampResult{}, err
+	}
+
+	timbre := fmt.Sprintf(`<cfdi:Complemento><tfd:TimbreFiscalDigital xmlns:tfd="%s" xsi:schemaLocation="%s" Version="%s" UUID="%s" FechaTimbrado="%s" RfcProvCertif="%s" SelloCFD="%s" NoCertificadoSAT="%s" SelloSAT="%s"/></cfdi:Complemento>`,
+		tfdNamespace, tfdSchemaLocation, tfdVersion, result.UUID, fecha, result.RfcProvCertif,
+		html.EscapeString(selloCFD), result.NoCertificadoSAT, result.SelloSAT)
+	closing := []byte("</cfdi:Comprobante>")
+	idx := bytes.LastIndex(document, closing)
+	if idx < 0 {
+		return StampResult{}, fmt.Errorf("%w: missing cfdi:Comprobante closing tag", ErrStampRejected)
+	}
+	stamped := make([]byte, 0, len(document)+len(timbre))
+	stamped = append(stamped, document[:idx]...)
+	stamped = append(stamped, timbre...)
+	stamped = append(stamped, document[idx:]...)
+	result.XML = stamped
+	return result, nil
+}
+
+// rootAttribute returns an attribute of the document root element, checking the root name
+func rootAttribute(document []byte, root, attr string) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrStampRejected, err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local != root {
+			return "", fmt.Errorf("%w: root element must be %s", ErrStampRejected, root)
+		}
+		for _, a := range start.Attr {
+			if a.Name.Local == attr && a.Value != "" {
+				return a.Value, nil
+			}
+		}
+		return "", fmt.Errorf("%w: the document is not sealed", ErrStampRejected)
+	}
+}
@@ -0,0 +1,100 @@
+package cfdi
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/youmark/pkcs8"
+)
+
+// Signer seals comprobantes with a CSD (Certificado de Sello Digital) issued by the SAT
+type Signer struct {
+	certificate *x509.Certificate
+	key         *rsa.PrivateKey
+}
+
+// LoadSigner reads a CSD certificate (.cer, DER or PEM) and its private key (.key, encrypted
+// PKCS#8 DER as delivered by the SAT, or PEM) and checks that both belong together
+func LoadSigner(certPath, keyPath, password string) (*Signer, error) {
+	certData, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading CSD certificate: %w", err)
+	}
+	if block, _ := pem.Decode(certData); block != nil {
+		certData = block.Bytes
+	}
+	certificate, err := x509.ParseCertificate(certData)
+	if err != nil {
+		return nil, fmt.Errorf("parsing CSD certificate: %w", err)
+	}
+
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading CSD key: %w", err)
+	}
+	if block, _ := pem.Decode(keyData); block != nil {
+		keyData = block.Bytes
+	}
+	var parsed interface{}
+	if password != "" {
+		parsed, err = pkcs8.ParsePKCS8PrivateKey(keyData, []byte(password))
+	} else {
+		parsed, err = pkcs8.ParsePKCS8PrivateKey(keyData)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing CSD key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("CSD key must be an RSA key")
+	}
+
+	publicKey, ok := certificate.PublicKey.(*rsa.PublicKey)
+	if !ok || !publicKey.Equal(&key.PublicKey) {
+		return nil, errors.New("CSD key does not match the certificate")
+	}
+	return &Signer{certificate: certificate, key: key}, nil
+}
+
+// NoCertificado returns the 20 digit certificate number. SAT certificates encode it as the
+// ASCII digits of their serial number.
+func (s *Signer) NoCertificado() string {
+	return string(s.certificate.SerialNumber.Bytes())
+}
+
+// Certificado returns the certificate encoded in base64 as expected by the Certificado attribute
+func (s *Signer) Certificado() string {
+	return base64.StdEncoding.EncodeToString(s.certificate.Raw)
+}
+
+// Sign returns the base64 SHA256withRSA signature of the given string
+func (s *Signer) Sign(value string) (string, error) {
+	digest := sha256.Sum256([]byte(value))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// Seal sets the certificate attributes and the Sello of the comprobante and returns the
+// original string that was signed
+func (s *Signer) Seal(c *Comprobante) (string, error) {
+	c.NoCertificado = s.NoCertificado()
+	c.Certificado = s.Certificado()
+	cadena := CadenaOriginal(c)
+	sello, err := s.Sign(cadena)
+	if err != nil {
+		return "", fmt.Errorf("signing CFDI: %w", err)
+	}
+	c.Sello = sello
+	return cadena, nil
+}
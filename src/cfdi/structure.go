@@ -0,0 +1,812 @@
+package cfdi
+
+import (
+	"bytes"
+	"embed"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shopspring/decimal"
+)
+
+const xsdNamespace = "http://www.w3.org/2001/XMLSchema"
+
+// structureFiles are the structural rules of a CFDI 4.0 document, written in XML Schema syntax from
+// Anexo 20: comprobante.xsd and the catalog and data type rules it imports by file name. They are not
+// the SAT schemas, and the large catalogs are only checked by the shape of their keys.
+//
+//go:embed structure/*.xsd
+var structureFiles embed.FS
+
+// cfdiStructure compiles the structural rules once, the first time a document is checked
+var cfdiStructure = sync.OnceValues(func() (*schema, error) {
+	return loadSchema("comprobante.xsd")
+})
+
+// CheckStructure pre-checks the structure of a document (elements, attributes, patterns and the small
+// catalogs) before it is sealed and sent to the PAC, which validates it against the official schemas
+// and catalogs. Problems in the document are reported as a *ValidationError; any other error means
+// the rules could not be used.
+func CheckStructure(document []byte) error {
+	s, err := cfdiStructure()
+	if err != nil {
+		return fmt.Errorf("loading CFDI structure rules: %w", err)
+	}
+	return s.validate(document)
+}
+
+// LoadStructure compiles the structural rules so a broken bundle is reported at startup
+func LoadStructure() error {
+	_, err := cfdiStructure()
+	return err
+}
+
+// The compiler understands the subset of XML Schema the structural rules are written in: global and
+// local elements, sequences, choices and wildcards, attributes and simple types restricted with
+// facets. Anything else is rejected so a document is never checked partially.
+
+type schema struct {
+	elements map[xml.Name]*elementDecl
+}
+
+type elementDecl struct {
+	name    xml.Name
+	simple  *simpleType
+	complex *complexType
+}
+
+type complexType struct {
+	attributes   []attributeDecl
+	anyAttribute bool
+	content      *particle
+}
+
+type attributeDecl struct {
+	name     string
+	required bool
+	fixed    *string
+	typ      *simpleType
+}
+
+// particle is an element, wildcard, sequence or choice with its occurrence bounds; max is -1 when
+// unbounded
+type particle struct {
+	kind     string
+	element  *elementDecl
+	children []*particle
+	min, max int
+}
+
+// simpleType is a built-in type narrowed by one set of facets per restriction step
+type simpleType struct {
+	builtin string
+	steps   []facets
+}
+
+type facets struct {
+	pattern        *regexp.Regexp
+	patternText    string
+	enumeration    map[string]bool
+	whiteSpace     string
+	length         int
+	minLength      int
+	maxLength      int
+	fractionDigits int
+	totalDigits    int
+	minInclusive   *decimal.Decimal
+	maxInclusive   *decimal.Decimal
+	minExclusive   *decimal.Decimal
+	maxExclusive   *decimal.Decimal
+}
+
+var (
+	decimalLexical  = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)$`)
+	integerLexical  = regexp.MustCompile(`^[+-]?[0-9]+$`)
+	dateTimeLexical = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}:[0-9]{2}(\.[0-9]+)?(Z|[+-][0-9]{2}:[0-9]{2})?$`)
+	dateLexical     = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}(Z|[+-][0-9]{2}:[0-9]{2})?$`)
+
+	integerRanges = map[string][2]int64{
+		"long":  {math.MinInt64, math.MaxInt64},
+		"int":   {math.MinInt32, math.MaxInt32},
+		"short": {math.MinInt16, math.MaxInt16},
+	}
+	builtinTypes = map[string]bool{
+		"string": true, "normalizedString": true, "token": true, "decimal": true, "integer": true,
+		"long": true, "int": true, "short": true, "dateTime": true, "date": true,
+	}
+)
+
+// node is a parsed XML element with the namespace prefixes in scope, which are needed to resolve
+// the QName values of schema attributes
+type node struct {
+	name     xml.Name
+	attrs    []xml.Attr
+	children []*node
+	text     string
+	prefixes map[string]string
+}
+
+func (n *node) attr(name string) (string, bool) {
+	for _, a := range n.attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+func (n *node) value(name string) string {
+	v, _ := n.attr(name)
+	return v
+}
+
+func parseXML(document []byte) (*node, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	var root *node
+	var stack []*node
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			n := &node{name: t.Name, attrs: t.Attr, prefixes: map[string]string{}}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				for prefix, ns := range parent.prefixes {
+					n.prefixes[prefix] = ns
+				}
+				parent.children = append(parent.children, n)
+			} else {
+				root = n
+			}
+			for _, a := range t.Attr {
+				if a.Name.Space == "xmlns" {
+					n.prefixes[a.Name.Local] = a.Value
+				} else if a.Name.Space == "" && a.Name.Local == "xmlns" {
+					n.prefixes[""] = a.Value
+				}
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(t)
+			}
+		}
+	}
+	if root == nil {
+		return nil, errors.New("document has no root element")
+	}
+	return root, nil
+}
+
+// schemaChildren returns the schema components under n, skipping annotations
+func schemaChildren(n *node) []*node {
+	var children []*node
+	for _, child := range n.children {
+		if child.name.Space == xsdNamespace && child.name.Local != "annotation" {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+func resolveQName(n *node, value string) (xml.Name, error) {
+	prefix, local, found := strings.Cut(value, ":")
+	if !found {
+		prefix, local = "", value
+	}
+	ns, ok := n.prefixes[prefix]
+	if !ok {
+		return xml.Name{}, fmt.Errorf("undeclared prefix in %q", value)
+	}
+	return xml.Name{Space: ns, Local: local}, nil
+}
+
+// scope is the target namespace of the schema a definition comes from
+type scope struct {
+	namespace string
+	qualified bool
+}
+
+type definition struct {
+	node  *node
+	scope scope
+}
+
+type compiler struct {
+	loaded       map[string]bool
+	elements     map[xml.Name]definition
+	simpleDefs   map[xml.Name]definition
+	complexDefs  map[xml.Name]definition
+	simpleTypes  map[xml.Name]*simpleType
+	complexTypes map[xml.Name]*complexType
+}
+
+func loadSchema(file string) (*schema, error) {
+	c := &compiler{
+		loaded:       map[string]bool{},
+		elements:     map[xml.Name]definition{},
+		simpleDefs:   map[xml.Name]definition{},
+		complexDefs:  map[xml.Name]definition{},
+		simpleTypes:  map[xml.Name]*simpleType{},
+		complexTypes: map[xml.Name]*complexType{},
+	}
+	if err := c.load(file); err != nil {
+		return nil, err
+	}
+	s := &schema{elements: map[xml.Name]*elementDecl{}}
+	for name, def := range c.elements {
+		decl, err := c.element(def.node, def.scope, true)
+		if err != nil {
+			return nil, fmt.Errorf("element %s: %w", name.Local, err)
+		}
+		s.elements[name] = decl
+	}
+	for name := range c.simpleDefs {
+		if _, err := c.namedSimple(name); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (c *compiler) load(file string) error {
+	if c.loaded[file] {
+		return nil
+	}
+	c.loaded[file] = true
+	data, err := structureFiles.ReadFile("structure/" + file)
+	if err != nil {
+		return err
+	}
+	root, err := parseXML(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	if root.name != (xml.Name{Space: xsdNamespace, Local: "schema"}) {
+		return fmt.Errorf("%s is not an XML schema", file)
+	}
+	sc := scope{namespace: root.value("targetNamespace"), qualified: root.value("elementFormDefault") == "qualified"}
+	for _, child := range schemaChildren(root) {
+		name := xml.Name{Space: sc.namespace, Local: child.value("name")}
+		switch child.name.Local {
+		case "import", "include":
+			if err := c.load(path.Base(child.value("schemaLocation"))); err != nil {
+				return err
+			}
+		case "element":
+			c.elements[name] = definition{child, sc}
+		case "simpleType":
+			c.simpleDefs[name] = definition{child, sc}
+		case "complexType":
+			c.complexDefs[name] = definition{child, sc}
+		default:
+			return fmt.Errorf("%s: unsupported schema component xs:%s", file, child.name.Local)
+		}
+	}
+	return nil
+}
+
+func (c *compiler) element(n *node, sc scope, global bool) (*elementDecl, error) {
+	if _, ok := n.attr("ref"); ok {
+		return nil, errors.New("element references are not supported")
+	}
+	decl := &elementDecl{name: xml.Name{Local: n.value("name")}}
+	if global || sc.qualified {
+		decl.name.Space = sc.namespace
+	}
+	if typeName, ok := n.attr("type"); ok {
+		name, err := resolveQName(n, typeName)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := c.complexDefs[name]; ok {
+			decl.complex, err = c.namedComplex(name)
+		} else {
+			decl.simple, err = c.typeByName(name)
+		}
+		return decl, err
+	}
+	for _, child := range schemaChildren(n) {
+		var err error
+		switch child.name.Local {
+		case "complexType":
+			decl.complex, err = c.complexType(child, sc)
+		case "simpleType":
+			decl.simple, err = c.simpleType(child)
+		default:
+			err = fmt.Errorf("unsupported xs:%s in element %s", child.name.Local, decl.name.Local)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if decl.complex == nil && decl.simple == nil {
+		return nil, fmt.Errorf("element %s has no type", decl.name.Local)
+	}
+	return decl, nil
+}
+
+func (c *compiler) namedComplex(name xml.Name) (*complexType, error) {
+	if ct, ok := c.complexTypes[name]; ok {
+		return ct, nil
+	}
+	def := c.complexDefs[name]
+	// Register the type before compiling it so recursive content models resolve to it
+	ct := &complexType{}
+	c.complexTypes[name] = ct
+	compiled, err := c.complexType(def.node, def.scope)
+	if err != nil {
+		return nil, fmt.Errorf("type %s: %w", name.Local, err)
+	}
+	*ct = *compiled
+	return ct, nil
+}
+
+func (c *compiler) complexType(n *node, sc scope) (*complexType, error) {
+	ct := &complexType{}
+	for _, child := range schemaChildren(n) {
+		switch child.name.Local {
+		case "sequence", "choice":
+			content, err := c.particle(child, sc)
+			if err != nil {
+				return nil, err
+			}
+			ct.content = content
+		case "attribute":
+			attribute, err := c.attribute(child)
+			if err != nil {
+				return nil, err
+			}
+			ct.attributes = append(ct.attributes, attribute)
+		case "anyAttribute":
+			ct.anyAttribute = true
+		default:
+			return nil, fmt.Errorf("unsupported xs:%s in a complex type", child.name.Local)
+		}
+	}
+	return ct, nil
+}
+
+func (c *compiler) particle(n *node, sc scope) (*particle, error) {
+	p := &particle{kind: n.name.Local, min: 1, max: 1}
+	if v, ok := n.attr("minOccurs"); ok {
+		min, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid minOccurs %q", v)
+		}
+		p.min = min
+	}
+	if v, ok := n.attr("maxOccurs"); ok {
+		if v == "unbounded" {
+			p.max = -1
+		} else {
+			max, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid maxOccurs %q", v)
+			}
+			p.max = max
+		}
+	}
+	switch p.kind {
+	case "element":
+		element, err := c.element(n, sc, false)
+		if err != nil {
+			return nil, err
+		}
+		p.element = element
+	case "any":
+	case "sequence", "choice":
+		for _, child := range schemaChildren(n) {
+			cp, err := c.particle(child, sc)
+			if err != nil {
+				return nil, err
+			}
+			p.children = append(p.children, cp)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported xs:%s in a content model", p.kind)
+	}
+	return p, nil
+}
+
+func (c *compiler) attribute(n *node) (attributeDecl, error) {
+	a := attributeDecl{name: n.value("name"), required: n.value("use") == "required"}
+	if fixed, ok := n.attr("fixed"); ok {
+		a.fixed = &fixed
+	}
+	var err error
+	if typeName, ok := n.attr("type"); ok {
+		var name xml.Name
+		if name, err = resolveQName(n, typeName); err == nil {
+			a.typ, err = c.typeByName(name)
+		}
+	} else if children := schemaChildren(n); len(children) == 1 && children[0].name.Local == "simpleType" {
+		a.typ, err = c.simpleType(children[0])
+	} else {
+		a.typ = &simpleType{builtin: "string"}
+	}
+	if err != nil {
+		return a, fmt.Errorf("attribute %s: %w", a.name, err)
+	}
+	return a, nil
+}
+
+// typeByName resolves a simple type, either built-in or defined in one of the loaded schemas
+func (c *compiler) typeByName(name xml.Name) (*simpleType, error) {
+	if name.Space == xsdNamespace {
+		if !builtinTypes[name.Local] {
+			return nil, fmt.Errorf("unsupported built-in type xs:%s", name.Local)
+		}
+		return &simpleType{builtin: name.Local}, nil
+	}
+	return c.namedSimple(name)
+}
+
+func (c *compiler) namedSimple(name xml.Name) (*simpleType, error) {
+	if st, ok := c.simpleTypes[name]; ok {
+		return st, nil
+	}
+	def, ok := c.simpleDefs[name]
+	if !ok {
+		return nil, fmt.Errorf("type {%s}%s is not defined", name.Space, name.Local)
+	}
+	st, err := c.simpleType(def.node)
+	if err != nil {
+		return nil, fmt.Errorf("type %s: %w", name.Local, err)
+	}
+	c.simpleTypes[name] = st
+	return st, nil
+}
+
+func (c *compiler) simpleType(n *node) (*simpleType, error) {
+	children := schemaChildren(n)
+	if len(children) != 1 || children[0].name.Local != "restriction" {
+		return nil, errors.New("only simple types derived by restriction are supported")
+	}
+	restriction := children[0]
+	baseName, err := resolveQName(restriction, restriction.value("base"))
+	if err != nil {
+		return nil, err
+	}
+	base, err := c.typeByName(baseName)
+	if err != nil {
+		return nil, err
+	}
+	f, err := compileFacets(restriction)
+	if err != nil {
+		return nil, err
+	}
+	steps := append(append([]facets(nil), base.steps...), f)
+	return &simpleType{builtin: base.builtin, steps: steps}, nil
+}
+
+func compileFacets(restriction *node) (facets, error) {
+	f := facets{length: -1, minLength: -1, maxLength: -1, fractionDigits: -1, totalDigits: -1}
+	counts := map[string]*int{
+		"length": &f.length, "minLength": &f.minLength, "maxLength": &f.maxLength,
+		"fractionDigits": &f.fractionDigits, "totalDigits": &f.totalDigits,
+	}
+	bounds := map[string]**decimal.Decimal{
+		"minInclusive": &f.minInclusive, "maxInclusive": &f.maxInclusive,
+		"minExclusive": &f.minExclusive, "maxExclusive": &f.maxExclusive,
+	}
+	var patterns []string
+	for _, facet := range schemaChildren(restriction) {
+		value := facet.value("value")
+		name := facet.name.Local
+		switch {
+		case name == "pattern":
+			patterns = append(patterns, value)
+		case name == "enumeration":
+			if f.enumeration == nil {
+				f.enumeration = map[string]bool{}
+			}
+			f.enumeration[value] = true
+		case name == "whiteSpace":
+			f.whiteSpace = value
+		case counts[name] != nil:
+			count, err := strconv.Atoi(value)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s %q", name, value)
+			}
+			*counts[name] = count
+		case bounds[name] != nil:
+			bound, err := decimal.NewFromString(value)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s %q", name, value)
+			}
+			*bounds[name] = &bound
+		default:
+			return f, fmt.Errorf("unsupported facet xs:%s", name)
+		}
+	}
+	if len(patterns) > 0 {
+		// Patterns of one restriction step are alternatives and always match the whole value
+		f.patternText = strings.Join(patterns, "|")
+		pattern, err := regexp.Compile("^(?:(?:" + strings.Join(patterns, ")|(?:") + "))$")
+		if err != nil {
+			return f, fmt.Errorf("invalid pattern %q: %w", f.patternText, err)
+		}
+		f.pattern = pattern
+	}
+	return f, nil
+}
+
+// check returns why value is not valid for the type, or an empty string
+func (t *simpleType) check(value string) string {
+	whiteSpace := "collapse"
+	if t.builtin == "string" {
+		whiteSpace = "preserve"
+	} else if t.builtin == "normalizedString" {
+		whiteSpace = "replace"
+	}
+	for _, f := range t.steps {
+		if f.whiteSpace != "" {
+			whiteSpace = f.whiteSpace
+		}
+	}
+	switch whiteSpace {
+	case "replace":
+		value = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ").Replace(value)
+	case "collapse":
+		value = strings.Join(strings.Fields(value), " ")
+	}
+
+	numeric := false
+	switch t.builtin {
+	case "decimal":
+		numeric = true
+		if !decimalLexical.MatchString(value) {
+			return fmt.Sprintf("%q is not a decimal", value)
+		}
+	case "integer", "long", "int", "short":
+		numeric = true
+		if !integerLexical.MatchString(value) {
+			return fmt.Sprintf("%q is not an integer", value)
+		}
+		if r, ok := integerRanges[t.builtin]; ok {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < r[0] || n > r[1] {
+				return fmt.Sprintf("%q is out of range for xs:%s", value, t.builtin)
+			}
+		}
+	case "dateTime":
+		if !dateTimeLexical.MatchString(value) {
+			return fmt.Sprintf("%q is not a date-time", value)
+		}
+		if _, err := time.Parse("2006-01-02T15:04:05", value[:19]); err != nil {
+			return fmt.Sprintf("%q is not a valid date-time", value)
+		}
+	case "date":
+		if !dateLexical.MatchString(value) {
+			return fmt.Sprintf("%q is not a date", value)
+		}
+		if _, err := time.Parse("2006-01-02", value[:10]); err != nil {
+			return fmt.Sprintf("%q is not a valid date", value)
+		}
+	}
+	for _, f := range t.steps {
+		if problem := f.check(value, numeric); problem != "" {
+			return problem
+		}
+	}
+	return ""
+}
+
+func (f *facets) check(value string, numeric bool) string {
+	if f.enumeration != nil && !f.enumeration[value] {
+		return fmt.Sprintf("%q is not one of the allowed values", value)
+	}
+	if f.pattern != nil && !f.pattern.MatchString(value) {
+		return fmt.Sprintf("%q does not match the pattern %s", value, f.patternText)
+	}
+	n := utf8.RuneCountInString(value)
+	if f.length >= 0 && n != f.length {
+		return fmt.Sprintf("%q must have %d characters", value, f.length)
+	}
+	if f.minLength >= 0 && n < f.minLength {
+		return fmt.Sprintf("%q must have at least %d characters", value, f.minLength)
+	}
+	if f.maxLength >= 0 && n > f.maxLength {
+		return fmt.Sprintf("%q must have at most %d characters", value, f.maxLength)
+	}
+	if !numeric {
+		return ""
+	}
+	d, err := decimal.NewFromString(value)
+	if err != nil {
+		return fmt.Sprintf("%q is not a number", value)
+	}
+	switch {
+	case f.minInclusive != nil && d.LessThan(*f.minInclusive):
+		return fmt.Sprintf("%q must be at least %s", value, f.minInclusive)
+	case f.maxInclusive != nil && d.GreaterThan(*f.maxInclusive):
+		return fmt.Sprintf("%q must be at most %s", value, f.maxInclusive)
+	case f.minExclusive != nil && !d.GreaterThan(*f.minExclusive):
+		return fmt.Sprintf("%q must be greater than %s", value, f.minExclusive)
+	case f.maxExclusive != nil && !d.LessThan(*f.maxExclusive):
+		return fmt.Sprintf("%q must be less than %s", value, f.maxExclusive)
+	}
+	integer, fraction, _ := strings.Cut(strings.TrimLeft(value, "+-"), ".")
+	integer = strings.TrimLeft(integer, "0")
+	fraction = strings.TrimRight(fraction, "0")
+	if f.fractionDigits >= 0 && len(fraction) > f.fractionDigits {
+		return fmt.Sprintf("%q must have at most %d decimals", value, f.fractionDigits)
+	}
+	if f.totalDigits >= 0 && len(integer)+len(fraction) > f.totalDigits {
+		return fmt.Sprintf("%q must have at most %d digits", value, f.totalDigits)
+	}
+	return ""
+}
+
+func (s *schema) validate(document []byte) error {
+	root, err := parseXML(document)
+	if err != nil {
+		return &ValidationError{Problems: []string{"malformed XML: " + err.Error()}}
+	}
+	decl, ok := s.elements[root.name]
+	if !ok {
+		return &ValidationError{Problems: []string{fmt.Sprintf("root element %s is not a CFDI Comprobante", root.name.Local)}}
+	}
+	v := &validator{}
+	v.element(root, decl, root.name.Local)
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+func (v *validator) element(n *node, decl *elementDecl, field string) {
+	if decl.simple != nil {
+		v.attributes(n, &complexType{}, field)
+		v.check(len(n.children) == 0, "%s must not have child elements", field)
+		if problem := decl.simple.check(n.text); problem != "" {
+			v.problems = append(v.problems, field+" "+problem)
+		}
+		return
+	}
+	v.attributes(n, decl.complex, field)
+
+	m := &matcher{nodes: n.children}
+	end, ok := 0, true
+	if decl.complex.content != nil {
+		end, ok = m.repeat(decl.complex.content, 0)
+	}
+	if !ok || end < len(n.children) {
+		if m.reached < len(n.children) {
+			v.problems = append(v.problems, fmt.Sprintf("%s element %s is not allowed here", field, n.children[m.reached].name.Local))
+		} else {
+			v.problems = append(v.problems, field+" is missing required child elements")
+		}
+		return
+	}
+	for _, b := range m.matched {
+		if b.decl != nil {
+			v.element(b.node, b.decl, field+" "+b.node.name.Local)
+		}
+	}
+}
+
+func (v *validator) attributes(n *node, ct *complexType, field string) {
+	seen := map[string]bool{}
+	for _, a := range n.attrs {
+		if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") || a.Name.Space == XSINamespace {
+			continue
+		}
+		var decl *attributeDecl
+		for i := range ct.attributes {
+			if a.Name.Space == "" && ct.attributes[i].name == a.Name.Local {
+				decl = &ct.attributes[i]
+			}
+		}
+		if decl == nil {
+			v.check(ct.anyAttribute, "%s attribute %s is not allowed", field, a.Name.Local)
+			continue
+		}
+		seen[decl.name] = true
+		if decl.fixed != nil {
+			v.check(a.Value == *decl.fixed, "%s attribute %s must be %q", field, decl.name, *decl.fixed)
+		} else if problem := decl.typ.check(a.Value); problem != "" {
+			v.problems = append(v.problems, fmt.Sprintf("%s attribute %s %s", field, decl.name, problem))
+		}
+	}
+	for _, decl := range ct.attributes {
+		v.check(!decl.required || seen[decl.name], "%s attribute %s is required", field, decl.name)
+	}
+}
+
+// matcher assigns child elements to the particles of a content model. The SAT content models are
+// deterministic, so matching greedily is enough.
+type matcher struct {
+	nodes   []*node
+	matched []binding
+	// reached is the number of leading children matched by some particle, so the first one that
+	// could not be placed can be reported
+	reached int
+}
+
+// binding pairs a child element with its declaration; decl is nil for wildcards, whose contents
+// are not validated
+type binding struct {
+	node *node
+	decl *elementDecl
+}
+
+// repeat matches p between its minimum and maximum number of times starting at nodes[i]
+func (m *matcher) repeat(p *particle, i int) (int, bool) {
+	count := 0
+	for p.max < 0 || count < p.max {
+		j, ok := m.once(p, i)
+		if !ok {
+			break
+		}
+		if j == i {
+			// An empty match satisfies any number of remaining occurrences
+			count = max(count, p.min)
+			break
+		}
+		i = j
+		count++
+	}
+	return i, count >= p.min
+}
+
+func (m *matcher) once(p *particle, i int) (int, bool) {
+	switch p.kind {
+	case "element":
+		if i < len(m.nodes) && m.nodes[i].name == p.element.name {
+			m.matched = append(m.matched, binding{m.nodes[i], p.element})
+			m.reached = max(m.reached, i+1)
+			return i + 1, true
+		}
+	case "any":
+		if i < len(m.nodes) {
+			m.matched = append(m.matched, binding{m.nodes[i], nil})
+			m.reached = max(m.reached, i+1)
+			return i + 1, true
+		}
+	case "sequence":
+		mark := len(m.matched)
+		j := i
+		for _, child := range p.children {
+			var ok bool
+			if j, ok = m.repeat(child, j); !ok {
+				m.matched = m.matched[:mark]
+				return i, false
+			}
+		}
+		return j, true
+	case "choice":
+		mark := len(m.matched)
+		for _, child := range p.children {
+			if j, ok := m.repeat(child, i); ok && j > i {
+				return j, true
+			}
+			m.matched = m.matched[:mark]
+		}
+		for _, child := range p.children {
+			if j, ok := m.repeat(child, i); ok {
+				return j, true
+			}
+		}
+	}
+	return i, false
+}
@@ -0,0 +1,183 @@
+package cfdi
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// Patterns and catalogs below mirror the structural rules of comprobante.xsd and catalogos.xsd for the
+// nodes this package emits, so problems are reported per field before the document is checked by
+// CheckStructure
+var (
+	rfcPattern        = regexp.MustCompile(`^[A-ZÑ&]{3,4}[0-9]{2}(0[1-9]|1[012])(0[1-9]|[12][0-9]|3[01])[A-Z0-9]{2}[0-9A]$`)
+	fechaPattern      = regexp.MustCompile(`^(20[1-9][0-9])-(0[1-9]|1[0-2])-(0[1-9]|[12][0-9]|3[01])T(([01][0-9]|2[0-3]):[0-5][0-9]:[0-5][0-9])$`)
+	importePattern    = regexp.MustCompile(`^[0-9]{1,18}(\.[0-9]{1,6})?$`)
+	cantidadPattern   = regexp.MustCompile(`^[0-9]{1,18}(\.[0-9]{1,6})?$`)
+	codigoPostal      = regexp.MustCompile(`^[0-9]{5}$`)
+	noCertificado     = regexp.MustCompile(`^[0-9]{20}$`)
+	claveProdServ     = regexp.MustCompile(`^[0-9]{8}$`)
+	claveUnidad       = regexp.MustCompile(`^[A-Z0-9]{1,3}$`)
+	monedaPattern     = regexp.MustCompile(`^[A-Z]{3}$`)
+	tasaOCuotaPattern = regexp.MustCompile(`^[0-9]\.[0-9]{6}$`)
+
+	formasPago = catalog("01", "02", "03", "04", "05", "06", "08", "12", "13", "14", "15", "17",
+		"23", "24", "25", "26", "27", "28", "29", "30", "31", "99")
+	metodosPago       = catalog(MetodoPagoUnaExhibicion, MetodoPagoParcialidades)
+	regimenesFiscales = catalog("601", "603", "605", "606", "607", "608", "610", "611", "612", "614",
+		"615", "616", "620", "621", "622", "623", "624", "625", "626")
+	usosCFDI = catalog("G01", "G02", "G03", "I01", "I02", "I03", "I04", "I05", "I06", "I07", "I08",
+		"D01", "D02", "D03", "D04", "D05", "D06", "D07", "D08", "D09", "D10", "S01", "CP01", "CN01")
+	tasasIVA = catalog("0.000000", "0.080000", "0.160000")
+)
+
+func catalog(values ...string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// ValidationError lists every problem found in a comprobante
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid CFDI: " + strings.Join(e.Problems, "; ")
+}
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		v.problems = append(v.problems, fmt.Sprintf(format, args...))
+	}
+}
+
+func (v *validator) length(value, field string, min, max int) {
+	n := len([]rune(value))
+	v.check(n >= min && n <= max && !strings.Contains(value, "|"),
+		"%s must have between %d and %d characters and no '|'", field, min, max)
+}
+
+func (v *validator) amount(value, field string) decimal.Decimal {
+	if !importePattern.MatchString(value) {
+		v.problems = append(v.problems, fmt.Sprintf("%s must be a non negative amount with up to 6 decimals", field))
+		return decimal.Zero
+	}
+	return decimal.RequireFromString(value)
+}
+
+// Validate checks a sealed comprobante against the structural rules of CFDI 4.0 and the
+// arithmetic rules the SAT applies to totals and taxes
+func Validate(c *Comprobante) error {
+	v := &validator{}
+
+	v.check(c.Version == Version, "Version must be %s", Version)
+	if c.Serie != "" {
+		v.length(c.Serie, "Serie", 1, 25)
+	}
+	if c.Folio != "" {
+		v.length(c.Folio, "Folio", 1, 40)
+	}
+	v.check(fechaPattern.MatchString(c.Fecha), "Fecha must have the format YYYY-MM-DDThh:mm:ss")
+	v.check(c.Sello != "", "Sello is required")
+	v.check(noCertificado.MatchString(c.NoCertificado), "NoCertificado must have 20 digits")
+	v.check(c.Certificado != "", "Certificado is required")
+	v.check(c.FormaPago == "" || formasPago[c.FormaPago], "FormaPago %q is not in c_FormaPago", c.FormaPago)
+	v.check(metodosPago[c.MetodoPago], "MetodoPago must be PUE or PPD")
+	v.check(c.MetodoPago != MetodoPagoParcialidades || c.FormaPago == FormaPagoPorDefinir,
+		"FormaPago must be 99 when MetodoPago is PPD")
+	v.check(monedaPattern.MatchString(c.Moneda) && c.Moneda != "XXX", "Moneda %q is not valid", c.Moneda)
+	v.check(c.TipoDeComprobante == TipoComprobanteIngreso, "TipoDeComprobante must be I")
+	v.check(c.Exportacion == ExportacionNoAplica, "Exportacion must be 01")
+	v.check(codigoPostal.MatchString(c.LugarExpedicion), "LugarExpedicion must be a 5 digit postal code")
+
+	v.check(rfcPattern.MatchString(c.Emisor.Rfc), "Emisor Rfc %q is not valid", c.Emisor.Rfc)
+	v.length(c.Emisor.Nombre, "Emisor Nombre", 1, 300)
+	v.check(regimenesFiscales[c.Emisor.RegimenFiscal], "Emisor RegimenFiscal %q is not in c_RegimenFiscal", c.Emisor.RegimenFiscal)
+
+	v.check(rfcPattern.MatchString(c.Receptor.Rfc), "Receptor Rfc %q is not valid", c.Receptor.Rfc)
+	v.length(c.Receptor.Nombre, "Receptor Nombre", 1, 300)
+	v.check(codigoPostal.MatchString(c.Receptor.DomicilioFiscalReceptor), "Receptor DomicilioFiscalReceptor must be a 5 digit postal code")
+	v.check(regimenesFiscales[c.Receptor.RegimenFiscalReceptor], "Receptor RegimenFiscalReceptor %q is not in c_RegimenFiscal", c.Receptor.RegimenFiscalReceptor)
+	v.check(usosCFDI[c.Receptor.UsoCFDI], "Receptor UsoCFDI %q is not in c_UsoCFDI", c.Receptor.UsoCFDI)
+
+	v.check(len(c.Conceptos.Concepto) > 0, "at least one Concepto is required")
+	subtotal := decimal.Zero
+	transferred := decimal.Zero
+	for i, concepto := range c.Conceptos.Concepto {
+		field := fmt.Sprintf("Concepto %d", i+1)
+		v.check(claveProdServ.MatchString(concepto.ClaveProdServ), "%s ClaveProdServ %q must have 8 digits", field, concepto.ClaveProdServ)
+		if concepto.NoIdentificacion != "" {
+			v.length(concepto.NoIdentificacion, field+" NoIdentificacion", 1, 100)
+		}
+		v.check(claveUnidad.MatchString(concepto.ClaveUnidad), "%s ClaveUnidad %q is not valid", field, concepto.ClaveUnidad)
+		v.length(concepto.Descripcion, field+" Descripcion", 1, 1000)
+		v.check(concepto.ObjetoImp == ObjetoImpSi, "%s ObjetoImp must be 02", field)
+
+		var cantidad decimal.Decimal
+		if cantidadPattern.MatchString(concepto.Cantidad) {
+			cantidad = decimal.RequireFromString(concepto.Cantidad)
+		}
+		v.check(cantidad.IsPositive(), "%s Cantidad must be greater than zero", field)
+		valor := v.amount(concepto.ValorUnitario, field+" ValorUnitario")
+		importe := v.amount(concepto.Importe, field+" Importe")
+		v.check(cantidad.Mul(valor).Round(2).Equal(importe), "%s Importe must be Cantidad times ValorUnitario", field)
+		subtotal = subtotal.Add(importe)
+
+		if concepto.Impuestos == nil || len(concepto.Impuestos.Traslados.Traslado) == 0 {
+			v.problems = append(v.problems, field+" must declare its taxes when ObjetoImp is 02")
+			continue
+		}
+		for _, t := range concepto.Impuestos.Traslados.Traslado {
+			transferred = transferred.Add(v.traslado(t, field))
+		}
+	}
+
+	v.amount(c.SubTotal, "SubTotal")
+	v.check(subtotal.StringFixed(2) == c.SubTotal, "SubTotal must be the sum of the Conceptos Importe")
+
+	declared := decimal.Zero
+	if c.Impuestos != nil {
+		sum := decimal.Zero
+		for _, t := range c.Impuestos.Traslados.Traslado {
+			sum = sum.Add(v.traslado(t, "Impuestos"))
+		}
+		if c.Impuestos.TotalImpuestosTrasladados != "" {
+			declared = v.amount(c.Impuestos.TotalImpuestosTrasladados, "TotalImpuestosTrasladados")
+		}
+		v.check(sum.Equal(declared), "TotalImpuestosTrasladados must be the sum of the transferred taxes")
+	}
+	v.check(transferred.Equal(declared), "voucher taxes must match the sum of the Conceptos taxes")
+	v.amount(c.Total, "Total")
+	v.check(subtotal.Add(declared).StringFixed(2) == c.Total, "Total must be SubTotal plus transferred taxes")
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+// traslado validates a transferred tax and returns its amount
+func (v *validator) traslado(t Traslado, field string) decimal.Decimal {
+	v.amount(t.Base, field+" Traslado Base")
+	v.check(t.Impuesto == ImpuestoIVA, "%s Traslado Impuesto must be 002", field)
+	switch t.TipoFactor {
+	case TipoFactorExento:
+		v.check(t.TasaOCuota == "" && t.Importe == "", "%s exempt Traslado must not have TasaOCuota or Importe", field)
+		return decimal.Zero
+	case TipoFactorTasa:
+		v.check(tasaOCuotaPattern.MatchString(t.TasaOCuota) && tasasIVA[t.TasaOCuota], "%s Traslado TasaOCuota %q is not a valid IVA rate", field, t.TasaOCuota)
+		return v.amount(t.Importe, field+" Traslado Importe")
+	default:
+		v.problems = append(v.problems, fmt.Sprintf("%s Traslado TipoFactor must be Tasa or Exento", field))
+		return decimal.Zero
+	}
+}
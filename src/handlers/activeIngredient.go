@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"ia-boilerplate/src/repository"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type medicineIngredientRequest struct {
+	ActiveIngredientID int              `json:"activeIngredientId"`
+	Name               string           `json:"name"`
+	Strength           *decimal.Decimal `json:"strength"`
+	StrengthUnit       string           `json:"strengthUnit"`
+}
+
+// findIngredientByName resolves an ingredient name or any of its synonyms, ignoring case and accents
+func findIngredientByName(db *gorm.DB, name string) (repository.ActiveIngredient, error) {
+	key := repository.NormalizeIngredientName(name)
+	var ingredient repository.ActiveIngredient
+	err := db.Where("normalized_name = ?", key).First(&ingredient).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		var synonym repository.ActiveIngredientSynonym
+		if err := db.Where("normalized_name = ?", key).First(&synonym).Error; err != nil {
+			return ingredient, err
+		}
+		err = db.First(&ingredient, synonym.ActiveIngredientID).Error
+	}
+	return ingredient, err
+}
+
+// ingredientNameTaken reports whether a normalized name is already used by an ingredient or a synonym
+func ingredientNameTaken(db *gorm.DB, normalized string) (bool, error) {
+	var count int64
+	if err := db.Model(&repository.ActiveIngredient{}).Where("normalized_name = ?", normalized).Count(&count).Error; err != nil || count > 0 {
+		return count > 0, err
+	}
+	err := db.Model(&repository.ActiveIngredientSynonym{}).Where("normalized_name = ?", normalized).Count(&count).Error
+	return count > 0, err
+}
+
+// medicineIngredientLinks builds the ingredient links of a medicine. Explicit ingredients must all resolve;
+// otherwise the free-text active ingredient is parsed and the names that do not resolve are returned.
+func medicineIngredientLinks(db *gorm.DB, reqs []medicineIngredientRequest, freeText string) ([]repository.MedicineIngredient, []string, error) {
+	links := []repository.MedicineIngredient{}
+	seen := make(map[int]bool)
+	add := func(ingredientID int, strength *decimal.Decimal, unit repository.StrengthUnit) {
+		if !seen[ingredientID] {
+			seen[ingredientID] = true
+			links = append(links, repository.MedicineIngredient{ActiveIngredientID: ingredientID, Strength: strength, StrengthUnit: unit})
+		}
+	}
+
+	if len(reqs) > 0 {
+		for i, req := range reqs {
+			unit := repository.StrengthUnit(strings.ToLower(req.StrengthUnit))
+			if req.StrengthUnit != "" && !unit.IsValid() {
+				return nil, nil, repository.NewAppError(fmt.Errorf("ingredient %d: invalid strength unit, must be one of: %s", i+1, strings.Join(repository.ValidStrengthUnits, ", ")), repository.ValidationError)
+			}
+			if req.Strength != nil && !req.Strength.IsPositive() {
+				return nil, nil, repository.NewAppError(fmt.Errorf("ingredient %d: strength must be greater than zero", i+1), repository.ValidationError)
+			}
+			var (
+				ingredient repository.ActiveIngredient
+				err        error
+			)
+			switch {
+			case req.ActiveIngredientID != 0:
+				err = db.First(&ingredient, req.ActiveIngredientID).Error
+			case req.Name != "":
+				ingredient, err = findIngredientByName(db, req.Name)
+			default:
+				return nil, nil, repository.NewAppError(fmt.Errorf("ingredient %d: activeIngredientId or name is required", i+1), repository.ValidationError)
+			}
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, nil, repository.NewAppError(fmt.Errorf("ingredient %d: active ingredient not found", i+1), repository.ValidationError)
+			} else if err != nil {
+				return nil, nil, repository.NewAppError(err, repository.RepositoryError)
+			}
+			add(ingredient.ID, req.Strength, unit)
+		}
+		return links, nil, nil
+	}
+
+	var unresolved []string
+	for _, parsed := range repository.ParseIngredientText(freeText) {
+		ingredient, err := findIngredientByName(db, parsed.Name)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			unresolved = append(unresolved, parsed.Name)
+			continue
+		} else if err != nil {
+			return nil, nil, repository.NewAppError(err, repository.RepositoryError)
+		}
+		add(ingredient.ID, parsed.Strength, parsed.StrengthUnit)
+	}
+	return links, unresolved, nil
+}
+
+// replaceMedicineIngredients replaces every ingredient link of a medicine
+func replaceMedicineIngredients(tx *gorm.DB, medicineID int, links []repository.MedicineIngredient) error {
+	if err := tx.Where("medicine_id = ?", medicineID).Delete(&repository.MedicineIngredient{}).Error; err != nil {
+		return err
+	}
+	if len(links) == 0 {
+		return nil
+	}
+	for i := range links {
+		links[i].MedicineID = medicineID
+	}
+	return tx.Create(&links).Error
+}
+
+// linkIngredientsFromText links the medicines that have no ingredient links yet to the ingredients named in
+// their free-text active ingredient. It returns how many medicines were linked and the unresolved names.
+func linkIngredientsFromText(tx *gorm.DB, medicines []repository.Medicine) (int, []string, error) {
+	linked := 0
+	var unresolved []string
+	for _, m := range medicines {
+		if m.ID == 0 || strings.TrimSpace(m.ActiveIngredient) == "" {
+			continue
+		}
+		var existing int64
+		if err := tx.Model(&repository.MedicineIngredient{}).Where("medicine_id = ?", m.ID).Count(&existing).Error; err != nil {
+			return linked, unresolved, err
+		}
+		if existing > 0 {
+			continue
+		}
+		links, missing, err := medicineIngredientLinks(tx, nil, m.ActiveIngredient)
+		if err != nil {
+			return linked, unresolved, err
+		}
+		unresolved = append(unresolved, missing...)
+		if len(links) == 0 {
+			continue
+		}
+		for i := range links {
+			links[i].MedicineID = m.ID
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&links).Error; err != nil {
+			return linked, unresolved, err
+		}
+		linked++
+	}
+	return linked, unresolved, nil
+}
+
+func (h *Handler) GetActiveIngredients(c *gin.Context) {
+	query := h.db(c).Preload("Synonyms")
+	if search := repository.NormalizeIngredientName(c.Query("search")); search != "" {
+		pattern := "%" + search + "%"
+		query = query.Where("normalized_name LIKE ? OR id IN (?)", pattern,
+			h.db(c).Model(&repository.ActiveIngredientSynonym{}).Select("active_ingredient_id").Where("normalized_name LIKE ?", pattern))
+	}
+
+	var ingredients []repository.ActiveIngredient
+	if err := query.Order("name").Find(&ingredients).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve active ingredients"})
+		return
+	}
+	c.JSON(http.StatusOK, ingredients)
+}
+
+func (h *Handler) GetActiveIngredient(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var ingredient repository.ActiveIngredient
+	if err := h.db(c).Preload("Synonyms").First(&ingredient, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Active ingredient not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, ingredient)
+}
+
+type CreateActiveIngredientRequest struct {
+	Name     string   `json:"name" binding:"required"`
+	ATCCode  string   `json:"atcCode" binding:"max=7"`
+	Synonyms []string `json:"synonyms"`
+}
+
+func (h *Handler) CreateActiveIngredient(c *gin.Context) {
+	if !h.requirePlatformAdmin(c, "add active ingredients") {
+		return
+	}
+	var req CreateActiveIngredientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ingredient := repository.ActiveIngredient{
+		Name:           strings.TrimSpace(req.Name),
+		NormalizedName: repository.NormalizeIngredientName(req.Name),
+		ATCCode:        strings.ToUpper(strings.TrimSpace(req.ATCCode)),
+	}
+	if ingredient.NormalizedName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name"})
+		return
+	}
+
+	names := map[string]bool{ingredient.NormalizedName: true}
+	for _, synonym := range req.Synonyms {
+		normalized := repository.NormalizeIngredientName(synonym)
+		if normalized == "" || names[normalized] {
+			continue
+		}
+		names[normalized] = true
+		ingredient.Synonyms = append(ingredient.Synonyms, repository.ActiveIngredientSynonym{Name: strings.TrimSpace(synonym), NormalizedName: normalized})
+	}
+
+	err := h.db(c).Transaction(func(tx *gorm.DB) error {
+		for name := range names {
+			taken, err := ingredientNameTaken(tx, name)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return repository.NewAppError(fmt.Errorf("name %q already identifies an active ingredient", name), repository.ResourceAlreadyExists)
+			}
+		}
+		return tx.Create(&ingredient).Error
+	})
+	if err != nil {
+		var appErr *repository.AppError
+		if errors.As(err, &appErr) {
+			c.JSON(http.StatusConflict, gin.H{"error": appErr.Error()})
+		} else {
+			h.Logger.Error("Error creating active ingredient", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create active ingredient"})
+		}
+		return
+	}
+	c.JSON(http.StatusCreated, ingredient)
+}
+
+type AddSynonymRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+func (h *Handler) AddActiveIngredientSynonym(c *gin.Context) {
+	if !h.requirePlatformAdmin(c, "add active ingredient synonyms") {
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var req AddSynonymRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	synonym := repository.ActiveIngredientSynonym{
+		ActiveIngredientID: id,
+		Name:               strings.TrimSpace(req.Name),
+		NormalizedName:     repository.NormalizeIngredientName(req.Name),
+	}
+	if synonym.NormalizedName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name"})
+		return
+	}
+
+	var ingredient repository.ActiveIngredient
+	if err := h.db(c).First(&ingredient, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Active ingredient not found"})
+		return
+	}
+	taken, err := ingredientNameTaken(h.db(c), synonym.NormalizedName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": "Name already identifies an active ingredient"})
+		return
+	}
+	if err := h.db(c).Create(&synonym).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not add synonym"})
+		return
+	}
+	c.JSON(http.StatusCreated, synonym)
+}
+
+// LinkMedicineIngredients backfills ingredient links for every medicine of the organization that only has
+// a free-text active ingredient, e.g. after loading new ingredients or synonyms. With global=true it links
+// the global medicines instead, which only platform admins can do.
+func (h *Handler) LinkMedicineIngredients(c *gin.Context) {
+	global, err := strconv.ParseBool(c.DefaultQuery("global", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid global, must be a boolean"})
+		return
+	}
+	query := h.db(c).Where("medicines.organization_id IS NOT NULL")
+	if global {
+		if !h.writeGlobalCatalog(c, "link global medicines") {
+			return
+		}
+		query = h.db(c)
+	}
+
+	linked := 0
+	unresolved := make(map[string]bool)
+	var medicines []repository.Medicine
+	res := query.
+		Where("active_ingredient <> ''").
+		Where("NOT EXISTS (SELECT 1 FROM medicine_ingredients mi WHERE mi.medicine_id = medicines.id)").
+		FindInBatches(&medicines, defaultImportBatchSize, func(tx *gorm.DB, batch int) error {
+			n, missing, err := linkIngredientsFromText(h.db(c), medicines)
+			linked += n
+			for _, name := range missing {
+				unresolved[name] = true
+			}
+			return err
+		})
+	if res.Error != nil {
+		h.Logger.Error("Error linking medicine ingredients", zap.Error(res.Error))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not link medicine ingredients"})
+		return
+	}
+
+	names := make([]string, 0, len(unresolved))
+	for name := range unresolved {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	c.JSON(http.StatusOK, gin.H{"linked": linked, "unresolved": names})
+}
@@ -6,9 +6,12 @@ import (
 	"net/http"
 )
 
+// LoginRequest identifies a user by email. Emails are only unique within an organization, so the slug of
+// the organization is needed when the email and password match users of several.
 type LoginRequest struct {
-	Email    string `json:"email" binding:"required"`
-	Password string `json:"password" binding:"required"`
+	Email        string `json:"email" binding:"required"`
+	Password     string `json:"password" binding:"required"`
+	Organization string `json:"organization"`
 }
 
 func (h *Handler) Login(c *gin.Context) {
@@ -17,37 +20,65 @@ func (h *Handler) Login(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	var user repository.User
-	result := h.Repository.DB.Preload("Role").Preload("Devices").Where("email = ?", loginRequest.Email).First(&user)
-	if result.Error != nil {
+	query := h.db(c).Preload("Role").Preload("Devices").
+		Joins("JOIN organizations ON organizations.id = users.organization_id AND organizations.enabled = ?", true).
+		Where("users.email = ?", loginRequest.Email)
+	if loginRequest.Organization != "" {
+		query = query.Where("organizations.slug = ?", loginRequest.Organization)
+	}
+	var candidates []repository.User
+	result := query.Find(&candidates)
+	if result.Error != nil || len(candidates) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid credentials"})
 		return
 	}
 
-	if h.Auth.ComparePasswords(user.HashPassword, loginRequest.Password) != nil {
+	var matches []repository.User
+	for _, candidate := range candidates {
+		if h.Auth.ComparePasswords(candidate.HashPassword, loginRequest.Password) == nil {
+			matches = append(matches, candidate)
+		}
+	}
+	if len(matches) == 0 {
+		// each organization with a user of that email is told of the attempt on it
+		for _, candidate := range candidates {
+			db := h.db(c).WithContext(repository.WithOrganization(c.Request.Context(), candidate.OrganizationID))
+			h.queueEvent(db, repository.WebhookEventLoginFailed, gin.H{
+				"userId":    candidate.ID,
+				"email":     candidate.Email,
+				"ipAddress": c.ClientIP(),
+				"userAgent": c.Request.UserAgent(),
+			})
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
+	if len(matches) > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "organization is required, the credentials match users of several organizations"})
+		return
+	}
+	user := matches[0]
 
-	accessToken, err := h.Auth.GenerateAccessToken(user.ID)
+	accessToken, err := h.Auth.GenerateAccessToken(user.ID, user.OrganizationID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not authenticate"})
 		return
 	}
 
-	refreshToken, err := h.Auth.GenerateRefreshToken(user.ID)
+	refreshToken, err := h.Auth.GenerateRefreshToken(user.ID, user.OrganizationID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not authenticate"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"id":           user.ID,
-		"firstName":    user.FirstName,
-		"lastName":     user.LastName,
-		"email":        user.Email,
-		"accessToken":  accessToken,
-		"refreshToken": refreshToken,
+		"id":             user.ID,
+		"organizationId": user.OrganizationID,
+		"firstName":      user.FirstName,
+		"lastName":       user.LastName,
+		"email":          user.Email,
+		"accessToken":    accessToken,
+		"refreshToken":   refreshToken,
 	})
 }
 
@@ -77,13 +108,28 @@ func (h *Handler) AccessTokenByRefreshToken(c *gin.Context) {
 	userIDInt := int(userID)
 
 	var user repository.User
-	result := h.Repository.DB.Preload("Role").Preload("Devices").First(&user, userIDInt)
+	result := h.db(c).Preload("Role").Preload("Devices").First(&user, userIDInt)
 	if result.Error != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
 		return
 	}
+	// the user must still be in the organization of the token, and that organization enabled
+	organizationID, err := h.UserOrganization(userIDInt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not authenticate"})
+		return
+	}
+	claimed, err := h.TokenOrganization(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not authenticate"})
+		return
+	}
+	if organizationID == 0 || claimed != organizationID {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
 
-	accessToken, err := h.Auth.GenerateAccessToken(userIDInt)
+	accessToken, err := h.Auth.GenerateAccessToken(userIDInt, organizationID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not authenticate"})
 		return
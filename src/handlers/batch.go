@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// BatchOperation is one create, update or delete of a batch. Body is the body the single-record
+// endpoint takes; IfMatch, when given, is checked as the If-Match header of that endpoint.
+type BatchOperation struct {
+	Method  string          `json:"method" binding:"required,oneof=create update delete"`
+	ID      int             `json:"id"`
+	IfMatch string          `json:"ifMatch"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// BatchRequest lists the operations of a batch, at most 100. Atomic batches run in one transaction and
+// stop at the first failure, undoing what was done; otherwise every operation runs on its own.
+type BatchRequest struct {
+	Atomic     bool             `json:"atomic"`
+	Operations []BatchOperation `json:"operations" binding:"required,min=1,max=100,dive"`
+}
+
+// BatchResult is the outcome of an operation, in the position of the operation: the status and body the
+// single-record endpoint answered, or its error
+type BatchResult struct {
+	Index  int             `json:"index"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// batchResource holds the endpoints a batch runs the operations of a resource with
+type batchResource struct {
+	create, update, delete func(*Handler, *gin.Context)
+}
+
+var (
+	roleBatch     = batchResource{create: (*Handler).CreateRole, update: (*Handler).UpdateRole, delete: (*Handler).DeleteRole}
+	userBatch     = batchResource{create: (*Handler).CreateUser, update: (*Handler).UpdateUser, delete: (*Handler).DeleteUser}
+	deviceBatch   = batchResource{create: (*Handler).CreateDevice, update: (*Handler).UpdateDevice, delete: (*Handler).DeleteDevice}
+	medicineBatch = batchResource{create: (*Handler).CreateMedicine, update: (*Handler).UpdateMedicine, delete: (*Handler).DeleteMedicine}
+	icdCieBatch   = batchResource{create: (*Handler).CreateICDCie, update: (*Handler).UpdateICDCie, delete: (*Handler).DeleteICDCie}
+)
+
+func (h *Handler) BatchRoles(c *gin.Context)     { h.batch(c, roleBatch) }
+func (h *Handler) BatchUsers(c *gin.Context)     { h.batch(c, userBatch) }
+func (h *Handler) BatchDevices(c *gin.Context)   { h.batch(c, deviceBatch) }
+func (h *Handler) BatchMedicines(c *gin.Context) { h.batch(c, medicineBatch) }
+func (h *Handler) BatchICDCies(c *gin.Context)   { h.batch(c, icdCieBatch) }
+
+// errBatchFailed rolls back an atomic batch
+var errBatchFailed = errors.New("batch operation failed")
+
+// batch runs the operations of a request through the single-record endpoints of a resource, so that
+// they are validated and answered exactly as those are. Best-effort batches answer 200 whatever the
+// outcome of each operation. An atomic batch that fails answers with the status of the failed operation;
+// the operations before it are reported as rolled back and the ones after it as not executed, both 424.
+func (h *Handler) batch(c *gin.Context, resource batchResource) {
+	var req BatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	results := make([]BatchResult, len(req.Operations))
+	if !req.Atomic {
+		for i, op := range req.Operations {
+			results[i] = h.runBatchOperation(c, nil, resource, i, op)
+		}
+		c.JSON(http.StatusOK, gin.H{"atomic": false, "results": results})
+		return
+	}
+
+	failed := -1
+	err := h.db(c).Transaction(func(tx *gorm.DB) error {
+		for i, op := range req.Operations {
+			results[i] = h.runBatchOperation(c, tx, resource, i, op)
+			if results[i].Status >= http.StatusBadRequest {
+				failed = i
+				return errBatchFailed
+			}
+		}
+		return nil
+	})
+	if err != nil && failed < 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not run the batch"})
+		return
+	}
+	if failed < 0 {
+		c.JSON(http.StatusOK, gin.H{"atomic": true, "committed": true, "results": results})
+		return
+	}
+	for i := range results {
+		switch {
+		case i < failed:
+			results[i] = BatchResult{Index: i, Status: http.StatusFailedDependency, Error: fmt.Sprintf("Rolled back, operation %d failed", failed)}
+		case i > failed:
+			results[i] = BatchResult{Index: i, Status: http.StatusFailedDependency, Error: fmt.Sprintf("Not executed, operation %d failed", failed)}
+		}
+	}
+	c.JSON(results[failed].Status, gin.H{"atomic": true, "committed": false, "results": results})
+}
+
+// runBatchOperation answers an operation with the endpoint of its method, on a request of its own that
+// keeps the authenticated user of the batch and, when tx is given, runs its queries in that transaction
+func (h *Handler) runBatchOperation(c *gin.Context, tx *gorm.DB, resource batchResource, index int, op BatchOperation) BatchResult {
+	result := BatchResult{Index: index}
+	var (
+		endpoint func(*Handler, *gin.Context)
+		method   string
+	)
+	switch op.Method {
+	case "create":
+		endpoint, method = resource.create, http.MethodPost
+	case "update":
+		endpoint, method = resource.update, http.MethodPut
+	case "delete":
+		endpoint, method = resource.delete, http.MethodDelete
+	}
+	if op.Method != "create" && op.ID <= 0 {
+		result.Status, result.Error = http.StatusBadRequest, "id is required to "+op.Method
+		return result
+	}
+
+	request, err := http.NewRequestWithContext(c.Request.Context(), method, c.Request.URL.Path, bytes.NewReader(op.Body))
+	if err != nil {
+		result.Status, result.Error = http.StatusInternalServerError, "Could not run the operation"
+		return result
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if op.IfMatch != "" {
+		request.Header.Set("If-Match", op.IfMatch)
+	}
+
+	// The operation is served by a router of its own, which gives the endpoint a context set up like the
+	// one of a real request
+	router := gin.New()
+	router.Handle(method, request.URL.Path, func(sub *gin.Context) {
+		for key, value := range c.Keys {
+			sub.Set(key, value)
+		}
+		if op.Method != "create" {
+			sub.Params = gin.Params{{Key: "id", Value: strconv.Itoa(op.ID)}}
+		}
+		if tx != nil {
+			SetRequestDB(sub, tx)
+		}
+		endpoint(h, sub)
+	})
+	response := &batchResponse{header: http.Header{}}
+	router.ServeHTTP(response, request)
+
+	result.Status = response.status
+	body := response.body.Bytes()
+	if result.Status >= http.StatusBadRequest {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(body, &failure); err == nil && failure.Error != "" {
+			result.Error = failure.Error
+		} else if text := strings.TrimSpace(string(body)); text != "" {
+			result.Error = text
+		} else {
+			result.Error = http.StatusText(result.Status)
+		}
+	} else if json.Valid(body) {
+		result.Body = body
+	}
+	return result
+}
+
+// batchResponse keeps the status and body an endpoint answers an operation of a batch with
+type batchResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *batchResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *batchResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *batchResponse) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(data)
+}
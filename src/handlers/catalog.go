@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"ia-boilerplate/src/repository"
+)
+
+// writeGlobalCatalog makes the rest of the request work on the global records of the shared catalogs,
+// once the user is checked to be a platform admin; what is what only they can do. It answers 403 or 500
+// and returns false otherwise.
+func (h *Handler) writeGlobalCatalog(c *gin.Context, what string) bool {
+	if !h.requirePlatformAdmin(c, what) {
+		return false
+	}
+	c.Request = c.Request.WithContext(repository.WithGlobalCatalog(c.Request.Context()))
+	return true
+}
+
+// catalogRecord is the organization and version of a record of a shared catalog
+type catalogRecord struct {
+	OrganizationID *int
+	Version        int
+}
+
+// findCatalogRecord looks up the organization and version of the record of model with the id parameter,
+// deleted or not, as the organization of the request sees it
+func (h *Handler) findCatalogRecord(c *gin.Context, model interface{}, id int) (catalogRecord, error) {
+	var record catalogRecord
+	err := h.db(c).Unscoped().Model(model).Select("organization_id", "version").Where("id = ?", id).Take(&record).Error
+	return record, err
+}
+
+// guardCatalogRecord gets a request ready to change the record of a shared catalog with the id parameter.
+// A global record can only be changed by platform admins, and the rest of the request then works on the
+// global catalog, where the record has no overrides. The version of the override their organization has
+// is kept, so that the record is still compared with If-Match and tagged at the version they read it at.
+// It answers 403 or 500 and returns false otherwise; an invalid id or a record that does not exist is left
+// for the handler to answer.
+func (h *Handler) guardCatalogRecord(c *gin.Context, model interface{}, what string) bool {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return true
+	}
+	record, err := h.findCatalogRecord(c, model, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return true
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if record.OrganizationID != nil {
+		return true
+	}
+	override, err := repository.OverrideVersion(h.db(c), model, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if !h.writeGlobalCatalog(c, what) {
+		return false
+	}
+	c.Set(overrideVersionKey, override)
+	return true
+}
+
+// overriddenRecord looks up the global record of model with the id parameter that the organization of
+// the request overrides, answering 400 when it is not global, 404 when it does not exist and returning
+// false. The If-Match of the request is checked against the version of the record as the organization
+// sees it.
+func (h *Handler) overriddenRecord(c *gin.Context, model interface{}, name string) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return 0, false
+	}
+	record, err := h.findCatalogRecord(c, model, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": name + " not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return 0, false
+	}
+	if record.OrganizationID != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only global records can be overridden, update the " + strings.ToLower(name) + " instead"})
+		return 0, false
+	}
+	if c.Request.Method != http.MethodGet && !checkIfMatch(c, record.Version) {
+		return 0, false
+	}
+	return id, true
+}
+
+// saveOverride creates the override of the organization of db or replaces the fields of the one it has;
+// key is the column referencing the record and columns the fields it overrides
+func saveOverride(db *gorm.DB, override interface{}, key string, columns []string) error {
+	table := clause.Table{Name: clause.CurrentTable}
+	updates := append(clause.AssignmentColumns(append(columns, "updated_at")),
+		clause.Assignment{Column: clause.Column{Name: "version"}, Value: clause.Expr{SQL: "?.version + 1", Vars: []interface{}{table}}})
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "organization_id"}, {Name: key}},
+		DoUpdates: updates,
+	}).Create(override).Error
+}
+
+// errNoOverride is returned when the organization has no override of a record to delete
+var errNoOverride = errors.New("no override")
+
+// deleteOverride removes the override of the organization of db of the record with id, returning
+// errNoOverride when it has none
+func deleteOverride(db *gorm.DB, override interface{}, key string, id int) error {
+	res := db.Where(key+" = ?", id).Delete(override)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errNoOverride
+	}
+	return nil
+}
+
+// respondOverrideDeleted answers the deletion of the override of a record, 404 when there was none
+func respondOverrideDeleted(c *gin.Context, err error, name string) {
+	switch {
+	case errors.Is(err, errNoOverride):
+		c.JSON(http.StatusNotFound, gin.H{"error": name + " override not found"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete " + strings.ToLower(name) + " override"})
+	default:
+		c.JSON(http.StatusOK, gin.H{"message": name + " override deleted successfully"})
+	}
+}
+
+// MedicineOverrideRequest is what an organization changes of a global medicine for itself; the fields
+// left out keep the value of the global catalog
+type MedicineOverrideRequest struct {
+	Description *string `json:"description"`
+	Laboratory  *string `json:"laboratory"`
+}
+
+func (h *Handler) GetMedicineOverride(c *gin.Context) {
+	id, ok := h.overriddenRecord(c, &repository.Medicine{}, "Medicine")
+	if !ok {
+		return
+	}
+	var override repository.MedicineOverride
+	if err := h.db(c).Where("medicine_id = ?", id).First(&override).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Medicine override not found"})
+		return
+	}
+	c.JSON(http.StatusOK, override)
+}
+
+// SetMedicineOverride overrides a global medicine for the organization of the request, answering the
+// medicine as it now sees it
+func (h *Handler) SetMedicineOverride(c *gin.Context) {
+	var req MedicineOverrideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Description == nil && req.Laboratory == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to override"})
+		return
+	}
+	id, ok := h.overriddenRecord(c, &repository.Medicine{}, "Medicine")
+	if !ok {
+		return
+	}
+	override := repository.MedicineOverride{MedicineID: id, Description: req.Description, Laboratory: req.Laboratory}
+	var (
+		m      repository.Medicine
+		queued int
+	)
+	err := h.db(c).Transaction(func(tx *gorm.DB) error {
+		if err := saveOverride(tx, &override, "medicine_id", []string{"description", "laboratory"}); err != nil {
+			return err
+		}
+		if err := tx.Preload("TaxRate").Preload("Ingredients.ActiveIngredient").Where("id = ?", id).First(&m).Error; err != nil {
+			return err
+		}
+		n, err := queueWebhookEvent(tx, repository.WebhookEventMedicineUpdated, m)
+		queued = n
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not override medicine"})
+		return
+	}
+	h.wakeWebhooks(queued)
+	c.Header("ETag", etag(m.Version))
+	c.JSON(http.StatusOK, m)
+}
+
+// DeleteMedicineOverride brings a global medicine back to the values of the global catalog for the
+// organization of the request
+func (h *Handler) DeleteMedicineOverride(c *gin.Context) {
+	id, ok := h.overriddenRecord(c, &repository.Medicine{}, "Medicine")
+	if !ok {
+		return
+	}
+	var queued int
+	err := h.db(c).Transaction(func(tx *gorm.DB) error {
+		if err := deleteOverride(tx, &repository.MedicineOverride{}, "medicine_id", id); err != nil {
+			return err
+		}
+		var m repository.Medicine
+		if err := tx.Preload("TaxRate").Preload("Ingredients.ActiveIngredient").Where("id = ?", id).First(&m).Error; err != nil {
+			return err
+		}
+		n, err := queueWebhookEvent(tx, repository.WebhookEventMedicineUpdated, m)
+		queued = n
+		return err
+	})
+	if err == nil {
+		h.wakeWebhooks(queued)
+	}
+	respondOverrideDeleted(c, err, "Medicine")
+}
+
+// ICDCieOverrideRequest is the description an organization gives a global ICD record for itself
+type ICDCieOverrideRequest struct {
+	Description string `json:"description" binding:"required"`
+}
+
+func (h *Handler) GetICDCieOverride(c *gin.Context) {
+	id, ok := h.overriddenRecord(c, &repository.ICDCie{}, "ICDCie record")
+	if !ok {
+		return
+	}
+	var override repository.ICDCieOverride
+	if err := h.db(c).Where("icd_cie_id = ?", id).First(&override).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ICDCie record override not found"})
+		return
+	}
+	c.JSON(http.StatusOK, override)
+}
+
+// SetICDCieOverride overrides the description of a global ICD record for the organization of the
+// request, answering the record as it now sees it
+func (h *Handler) SetICDCieOverride(c *gin.Context) {
+	var req ICDCieOverrideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id, ok := h.overriddenRecord(c, &repository.ICDCie{}, "ICDCie record")
+	if !ok {
+		return
+	}
+	override := repository.ICDCieOverride{ICDCieID: id, Description: &req.Description}
+	var (
+		record repository.ICDCie
+		queued int
+	)
+	err := h.db(c).Transaction(func(tx *gorm.DB) error {
+		if err := saveOverride(tx, &override, "icd_cie_id", []string{"description"}); err != nil {
+			return err
+		}
+		if err := tx.First(&record, id).Error; err != nil {
+			return err
+		}
+		n, err := queueWebhookEvent(tx, repository.WebhookEventICDUpdated, record)
+		queued = n
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not override ICDCie record"})
+		return
+	}
+	h.wakeWebhooks(queued)
+	c.Header("ETag", etag(record.Version))
+	c.JSON(http.StatusOK, record)
+}
+
+// DeleteICDCieOverride brings a global ICD record back to its description in the classification for the
+// organization of the request
+func (h *Handler) DeleteICDCieOverride(c *gin.Context) {
+	id, ok := h.overriddenRecord(c, &repository.ICDCie{}, "ICDCie record")
+	if !ok {
+		return
+	}
+	var queued int
+	err := h.db(c).Transaction(func(tx *gorm.DB) error {
+		if err := deleteOverride(tx, &repository.ICDCieOverride{}, "icd_cie_id", id); err != nil {
+			return err
+		}
+		var record repository.ICDCie
+		if err := tx.First(&record, id).Error; err != nil {
+			return err
+		}
+		n, err := queueWebhookEvent(tx, repository.WebhookEventICDUpdated, record)
+		queued = n
+		return err
+	})
+	if err == nil {
+		h.wakeWebhooks(queued)
+	}
+	respondOverrideDeleted(c, err, "ICDCie record")
+}
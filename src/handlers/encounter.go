@@ -0,0 +1,394 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"ia-boilerplate/src/repository"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type EncounterDiagnosisRequest struct {
+	ICDCieID int `json:"icdCieId" binding:"required"`
+	// Rank is primary or secondary; when no diagnosis is marked primary the first one is
+	Rank string `json:"rank"`
+}
+
+type CreateEncounterRequest struct {
+	PatientID int `json:"patientId" binding:"required"`
+	// OccurredAt defaults to now
+	OccurredAt *time.Time                  `json:"occurredAt"`
+	Reason     string                      `json:"reason" binding:"max=255"`
+	Notes      string                      `json:"notes"`
+	Diagnoses  []EncounterDiagnosisRequest `json:"diagnoses" binding:"required,min=1,dive"`
+}
+
+type UpdateEncounterRequest struct {
+	OccurredAt *time.Time `json:"occurredAt"`
+	Reason     *string    `json:"reason" binding:"omitempty,max=255"`
+	Notes      *string    `json:"notes"`
+	// Diagnoses replaces the diagnoses of the encounter
+	Diagnoses *[]EncounterDiagnosisRequest `json:"diagnoses" binding:"omitempty,min=1,dive"`
+}
+
+// encounterDiagnoses validates the diagnoses of an encounter: each ICD record listed once, in effect,
+// and exactly one of them primary
+func encounterDiagnoses(db *gorm.DB, requests []EncounterDiagnosisRequest) ([]repository.EncounterDiagnosis, error) {
+	diagnoses := make([]repository.EncounterDiagnosis, 0, len(requests))
+	ids := make([]int, 0, len(requests))
+	seen := make(map[int]bool, len(requests))
+	primaries := 0
+	for _, req := range requests {
+		if seen[req.ICDCieID] {
+			return nil, repository.NewAppError(fmt.Errorf("diagnosis %d is listed more than once", req.ICDCieID), repository.ValidationError)
+		}
+		seen[req.ICDCieID] = true
+		rank := repository.DiagnosisRank(req.Rank)
+		if req.Rank == "" {
+			rank = repository.DiagnosisRankSecondary
+		} else if !rank.IsValid() {
+			return nil, repository.NewAppError(errors.New("Invalid rank, must be one of: "+strings.Join(repository.ValidDiagnosisRanks, ", ")), repository.ValidationError)
+		}
+		if rank == repository.DiagnosisRankPrimary {
+			primaries++
+		}
+		ids = append(ids, req.ICDCieID)
+		diagnoses = append(diagnoses, repository.EncounterDiagnosis{ICDCieID: req.ICDCieID, Rank: rank})
+	}
+	switch {
+	case primaries == 0:
+		diagnoses[0].Rank = repository.DiagnosisRankPrimary
+	case primaries > 1:
+		return nil, repository.NewAppError(errors.New("an encounter has a single primary diagnosis"), repository.ValidationError)
+	}
+
+	var found []int
+	if err := db.Model(&repository.ICDCie{}).Where("id IN ? AND retired = ?", ids, false).Pluck("id", &found).Error; err != nil {
+		return nil, err
+	}
+	if len(found) != len(ids) {
+		inEffect := make(map[int]bool, len(found))
+		for _, id := range found {
+			inEffect[id] = true
+		}
+		var missing []string
+		for _, id := range ids {
+			if !inEffect[id] {
+				missing = append(missing, strconv.Itoa(id))
+			}
+		}
+		return nil, repository.NewAppError(errors.New("ICD records not found or retired: "+strings.Join(missing, ", ")), repository.ValidationError)
+	}
+	return diagnoses, nil
+}
+
+// loadEncounter reads an encounter with its patient, author, diagnoses and prescriptions
+func loadEncounter(db *gorm.DB, id int) (repository.Encounter, error) {
+	var encounter repository.Encounter
+	err := db.Preload("Patient").Preload("Author").
+		Preload("Diagnoses", func(tx *gorm.DB) *gorm.DB { return tx.Order("rank, id") }).
+		Preload("Diagnoses.ICDCie").
+		Preload("Prescriptions.Items.Medicine").
+		First(&encounter, id).Error
+	return encounter, err
+}
+
+func (h *Handler) findEncounter(c *gin.Context) (repository.Encounter, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return repository.Encounter{}, false
+	}
+	encounter, err := loadEncounter(h.db(c), id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Encounter not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return encounter, false
+	}
+	return encounter, true
+}
+
+// encounterFields are the fields and relations encounters can be read with; expand=diagnoses brings their
+// ICD records and expand=prescriptions their medicines
+var encounterFields = searchSpec{
+	model: &repository.Encounter{},
+	fields: map[string]searchField{
+		"id":          {column: "id", kind: searchInt},
+		"patient_id":  {column: "patient_id", kind: searchInt},
+		"author_id":   {column: "author_id", kind: searchInt},
+		"occurred_at": {column: "occurred_at", kind: searchTime},
+		"reason":      {column: "reason"},
+		"notes":       {column: "notes"},
+		"created_at":  {column: "created_at", kind: searchTime},
+		"updated_at":  {column: "updated_at", kind: searchTime},
+	},
+	expand: map[string]expansion{
+		"patient": {preloads: []string{"Patient"}, columns: []string{"patient_id"}},
+		"author":  {preloads: []string{"Author"}, columns: []string{"author_id"}},
+		"diagnoses": {
+			preloads: []string{"Diagnoses", "Diagnoses.ICDCie"},
+			scope:    func(_ *gin.Context, tx *gorm.DB) *gorm.DB { return tx.Order("rank, id") },
+		},
+		"prescriptions": {preloads: []string{"Prescriptions.Items.Medicine"}},
+	},
+}
+
+func (h *Handler) GetEncounter(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	sel, err := encounterFields.selection(c, h.db(c), "patient", "author", "diagnoses", "prescriptions")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var encounter repository.Encounter
+	if err := sel.apply(c, h.db(c), "version").First(&encounter, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Encounter not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+	respondVersioned(c, encounter.Version, sel.render(encounter))
+}
+
+// CreateEncounter records a consultation of a patient authored by the authenticated user
+func (h *Handler) CreateEncounter(c *gin.Context) {
+	var req CreateEncounterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var patient repository.Patient
+	if err := h.db(c).Where("id = ?", req.PatientID).First(&patient).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create encounter"})
+		}
+		return
+	}
+	diagnoses, err := encounterDiagnoses(h.db(c), req.Diagnoses)
+	if err != nil {
+		respondPatientError(c, err, "Could not create encounter")
+		return
+	}
+
+	encounter := repository.Encounter{
+		PatientID:  patient.ID,
+		AuthorID:   c.GetInt("user_id"),
+		OccurredAt: time.Now(),
+		Reason:     strings.TrimSpace(req.Reason),
+		Notes:      req.Notes,
+		Diagnoses:  diagnoses,
+	}
+	if req.OccurredAt != nil {
+		encounter.OccurredAt = *req.OccurredAt
+	}
+	if err := h.db(c).Create(&encounter).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create encounter"})
+		return
+	}
+
+	created, err := loadEncounter(h.db(c), encounter.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve created encounter"})
+		return
+	}
+	c.JSON(http.StatusCreated, created)
+}
+
+// UpdateEncounter changes the details or replaces the diagnoses of an encounter; only its author can
+func (h *Handler) UpdateEncounter(c *gin.Context) {
+	encounter, ok := h.findEncounter(c)
+	if !ok {
+		return
+	}
+	if encounter.AuthorID != c.GetInt("user_id") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the author can update the encounter"})
+		return
+	}
+	if !checkIfMatch(c, encounter.Version) {
+		return
+	}
+	var req UpdateEncounterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Prepare fields to update
+	updates := make(map[string]interface{})
+	updates["updated_at"] = time.Now()
+
+	if req.OccurredAt != nil {
+		updates["occurred_at"] = *req.OccurredAt
+	}
+	if req.Reason != nil {
+		updates["reason"] = strings.TrimSpace(*req.Reason)
+	}
+	if req.Notes != nil {
+		updates["notes"] = *req.Notes
+	}
+	var diagnoses []repository.EncounterDiagnosis
+	if req.Diagnoses != nil {
+		var err error
+		if diagnoses, err = encounterDiagnoses(h.db(c), *req.Diagnoses); err != nil {
+			respondPatientError(c, err, "Could not update encounter")
+			return
+		}
+	}
+
+	// Return an error if there are no fields to update
+	if len(updates) <= 1 && req.Diagnoses == nil { // Solo updated_at
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	updates["version"] = nextVersion
+	err := h.db(c).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&repository.Encounter{}).Where("id = ? AND version = ?", encounter.ID, encounter.Version).Updates(updates)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errVersionConflict
+		}
+		if req.Diagnoses == nil {
+			return nil
+		}
+		if err := tx.Where("encounter_id = ?", encounter.ID).Delete(&repository.EncounterDiagnosis{}).Error; err != nil {
+			return err
+		}
+		for i := range diagnoses {
+			diagnoses[i].EncounterID = encounter.ID
+		}
+		return tx.Create(&diagnoses).Error
+	})
+	if errors.Is(err, errVersionConflict) {
+		respondVersionConflict(c, 0)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update encounter"})
+		return
+	}
+
+	updated, err := loadEncounter(h.db(c), encounter.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve updated encounter"})
+		return
+	}
+	c.Header("ETag", etag(updated.Version))
+	c.JSON(http.StatusOK, updated)
+}
+
+// encounterSearchQuery builds the encounter query filtered by the _like and _match parameters of the
+// request. icd_code_match keeps the encounters with any of the given diagnosis codes, and occurred_from
+// and occurred_to bound the date of the encounter.
+func (h *Handler) encounterSearchQuery(c *gin.Context) (*gorm.DB, error) {
+	likeFilters := map[string]string{
+		"reason": c.Query("reason_like"),
+	}
+
+	matches := map[string][]string{
+		"patient_id": c.QueryArray("patient_id_match"),
+		"author_id":  c.QueryArray("author_id_match"),
+	}
+
+	query := h.db(c).Model(&repository.Encounter{})
+
+	for col, val := range likeFilters {
+		if val != "" {
+			query = query.Where(col+" ILIKE ?", "%"+val+"%")
+		}
+	}
+
+	for col, vals := range matches {
+		if len(vals) > 0 {
+			query = query.Where(col+" IN (?)", vals)
+		}
+	}
+
+	if codes := c.QueryArray("icd_code_match"); len(codes) > 0 {
+		for i, code := range codes {
+			codes[i] = repository.NormalizeICDCode(code)
+		}
+		query = query.Where("EXISTS (SELECT 1 FROM encounter_diagnoses d JOIN icd_cies i ON i.id = d.icd_cie_id "+
+			"WHERE d.encounter_id = encounters.id AND i.code IN (?))", codes)
+	}
+	if value := c.Query("occurred_from"); value != "" {
+		from, err := parseInstant(value)
+		if err != nil {
+			return nil, errors.New("Invalid occurred_from, must be RFC3339 or YYYY-MM-DD")
+		}
+		query = query.Where("occurred_at >= ?", from)
+	}
+	if value := c.Query("occurred_to"); value != "" {
+		to, err := parseInstant(value)
+		if err != nil {
+			return nil, errors.New("Invalid occurred_to, must be RFC3339 or YYYY-MM-DD")
+		}
+		query = query.Where("occurred_at < ?", to)
+	}
+
+	return query, nil
+}
+
+func (h *Handler) SearchEncountersPaginated(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 10
+	}
+
+	var (
+		encounters []repository.Encounter
+		total      int64
+	)
+
+	query, err := h.encounterSearchQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sel, err := encounterFields.selection(c, h.db(c), "patient", "diagnoses")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query.Count(&total)
+
+	offset := (page - 1) * limit
+	if err := sel.apply(c, query).
+		Order("occurred_at DESC, id DESC").Offset(offset).Limit(limit).Find(&encounters).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not perform search"})
+		return
+	}
+
+	totalPages := int((total + int64(limit) - 1) / int64(limit))
+	c.JSON(http.StatusOK, gin.H{
+		"current_page":  page,
+		"encounters":    sel.render(encounters),
+		"page_size":     limit,
+		"total_pages":   totalPages,
+		"total_records": total,
+	})
+}
@@ -0,0 +1,367 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"ia-boilerplate/src/repository"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	EquivalenceMatchAutomatic = "automatic"
+	EquivalenceMatchOverride  = "override"
+)
+
+// dosageFormGroup returns the group of dosage forms a medicine can be swapped within:
+// tablets and capsules are both oral solids, anything else only matches its own type
+func dosageFormGroup(m repository.Medicine) string {
+	switch m.Type {
+	case repository.MedicineTypeTablet, repository.MedicineTypeCapsule:
+		return "oral-solid"
+	case "":
+		return m.UnitType.String()
+	}
+	return m.Type.String()
+}
+
+// unitBasis is what UnitQuantity counts: millilitres and grams are measures, the rest are units
+func unitBasis(u repository.UnitType) string {
+	if u == repository.UnitTypeMilliliter || u == repository.UnitTypeGram {
+		return u.String()
+	}
+	return "unit"
+}
+
+func compatibleForms(a, b repository.Medicine) bool {
+	return dosageFormGroup(a) == dosageFormGroup(b) && unitBasis(a.UnitType) == unitBasis(b.UnitType)
+}
+
+// ingredientSignature identifies the composition of a medicine: its ingredients with their strengths.
+// Two medicines are automatic equivalents only when their signatures are equal.
+func ingredientSignature(links []repository.MedicineIngredient) string {
+	parts := make([]string, 0, len(links))
+	for _, link := range links {
+		strength := ""
+		if link.Strength != nil {
+			strength = link.Strength.String()
+		}
+		parts = append(parts, fmt.Sprintf("%d:%s%s", link.ActiveIngredientID, strength, link.StrengthUnit))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "|")
+}
+
+type EquivalentMedicine struct {
+	ID           int                     `json:"id"`
+	EANCode      string                  `json:"eanCode"`
+	Description  string                  `json:"description"`
+	Laboratory   string                  `json:"laboratory"`
+	Type         repository.MedicineType `json:"type"`
+	UnitQuantity float64                 `json:"unitQuantity"`
+	UnitType     repository.UnitType     `json:"unitType"`
+	Match        string                  `json:"match,omitempty"`
+	Reason       string                  `json:"reason,omitempty"`
+	Available    bool                    `json:"available"`
+	Price        *decimal.Decimal        `json:"price"`
+	UnitPrice    *decimal.Decimal        `json:"unitPrice"`
+}
+
+type EquivalentsResult struct {
+	Medicine    EquivalentMedicine   `json:"medicine"`
+	PriceListID int                  `json:"priceListId"`
+	Date        time.Time            `json:"date"`
+	Equivalents []EquivalentMedicine `json:"equivalents"`
+}
+
+func newEquivalentMedicine(m repository.Medicine) EquivalentMedicine {
+	return EquivalentMedicine{
+		ID:           m.ID,
+		EANCode:      m.EANCode,
+		Description:  m.Description,
+		Laboratory:   m.Laboratory,
+		Type:         m.Type,
+		UnitQuantity: m.UnitQuantity,
+		UnitType:     m.UnitType,
+	}
+}
+
+// effectivePrices returns the price of each medicine in a price list at the given instant,
+// skipping medicines that have none
+func (h *Handler) effectivePrices(db *gorm.DB, priceListID int, medicineIDs []int, at time.Time) (map[int]decimal.Decimal, error) {
+	var rows []repository.MedicinePrice
+	if err := db.Where("price_list_id = ? AND medicine_id IN ? AND valid_from <= ? AND (valid_to IS NULL OR valid_to > ?)",
+		priceListID, medicineIDs, at, at).
+		Where("price_list_id IN (?)", ownPriceLists(db)).
+		Order("medicine_id, valid_from DESC").
+		Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	prices := make(map[int]decimal.Decimal, len(rows))
+	for _, row := range rows {
+		if _, ok := prices[row.MedicineID]; !ok {
+			prices[row.MedicineID] = row.Price
+		}
+	}
+	return prices, nil
+}
+
+// GetMedicineEquivalents lists the products that can be dispensed instead of a medicine: the same
+// active ingredients and strengths in a compatible dosage form, plus the pairs marked equivalent by an
+// administrator and minus those marked as not equivalent. Results with a current price in the price list
+// come first, cheapest per unit first.
+func (h *Handler) GetMedicineEquivalents(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	priceListID, err := strconv.Atoi(c.Query("price_list_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "price_list_id is required"})
+		return
+	}
+	at, err := parseAtParam(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid at, must be RFC3339 or YYYY-MM-DD"})
+		return
+	}
+
+	db := h.db(c)
+	var medicine repository.Medicine
+	if err := db.Preload("Ingredients").Where("id = ?", id).First(&medicine).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Medicine not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+	var list repository.PriceList
+	if err := db.First(&list, priceListID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Price list not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+
+	var overrides []repository.TherapeuticEquivalence
+	if err := db.Where("medicine_a_id = ? OR medicine_b_id = ?", id, id).Find(&overrides).Error; err != nil {
+		h.Logger.Error("Error loading therapeutic equivalences", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not load equivalences"})
+		return
+	}
+	decisions := make(map[int]repository.TherapeuticEquivalence, len(overrides))
+	var overrideIDs []int
+	for _, o := range overrides {
+		other := o.MedicineAID
+		if other == id {
+			other = o.MedicineBID
+		}
+		decisions[other] = o
+		if o.Equivalent {
+			overrideIDs = append(overrideIDs, other)
+		}
+	}
+
+	// candidates share every ingredient of the medicine; composition and form are checked below.
+	// Without normalized ingredients only explicit equivalences can be offered.
+	var candidates []repository.Medicine
+	if len(medicine.Ingredients) > 0 || len(overrideIDs) > 0 {
+		candidateQuery := db.Preload("Ingredients").Where("id <> ?", id)
+		if len(medicine.Ingredients) > 0 {
+			ingredientIDs := make([]int, 0, len(medicine.Ingredients))
+			for _, link := range medicine.Ingredients {
+				ingredientIDs = append(ingredientIDs, link.ActiveIngredientID)
+			}
+			sharing := db.Model(&repository.MedicineIngredient{}).Select("medicine_id").
+				Where("active_ingredient_id IN ?", ingredientIDs).
+				Group("medicine_id").
+				Having("COUNT(*) = ?", len(ingredientIDs))
+			if len(overrideIDs) > 0 {
+				candidateQuery = candidateQuery.Where(db.Where("id IN (?)", sharing).Or("id IN ?", overrideIDs))
+			} else {
+				candidateQuery = candidateQuery.Where("id IN (?)", sharing)
+			}
+		} else {
+			candidateQuery = candidateQuery.Where("id IN ?", overrideIDs)
+		}
+		if err := candidateQuery.Find(&candidates).Error; err != nil {
+			h.Logger.Error("Error searching equivalent medicines", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not search equivalents"})
+			return
+		}
+	}
+
+	signature := ingredientSignature(medicine.Ingredients)
+	equivalents := []EquivalentMedicine{}
+	ids := []int{id}
+	for _, candidate := range candidates {
+		entry := newEquivalentMedicine(candidate)
+		if decision, ok := decisions[candidate.ID]; ok {
+			if !decision.Equivalent {
+				continue
+			}
+			entry.Match = EquivalenceMatchOverride
+			entry.Reason = decision.Reason
+		} else if len(medicine.Ingredients) > 0 && ingredientSignature(candidate.Ingredients) == signature && compatibleForms(medicine, candidate) {
+			entry.Match = EquivalenceMatchAutomatic
+		} else {
+			continue
+		}
+		equivalents = append(equivalents, entry)
+		ids = append(ids, candidate.ID)
+	}
+
+	prices, err := h.effectivePrices(db, priceListID, ids, at)
+	if err != nil {
+		h.Logger.Error("Error loading equivalent prices", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not load prices"})
+		return
+	}
+	setPrice := func(entry *EquivalentMedicine) {
+		price, ok := prices[entry.ID]
+		if !ok {
+			return
+		}
+		entry.Available = true
+		entry.Price = &price
+		unitPrice := price
+		if entry.UnitQuantity > 0 {
+			unitPrice = price.Div(decimal.NewFromFloat(entry.UnitQuantity)).Round(4)
+		}
+		entry.UnitPrice = &unitPrice
+	}
+	for i := range equivalents {
+		setPrice(&equivalents[i])
+	}
+	sort.SliceStable(equivalents, func(i, j int) bool {
+		a, b := equivalents[i], equivalents[j]
+		if a.Available != b.Available {
+			return a.Available
+		}
+		if a.Available && !a.UnitPrice.Equal(*b.UnitPrice) {
+			return a.UnitPrice.LessThan(*b.UnitPrice)
+		}
+		return a.Description < b.Description
+	})
+
+	result := EquivalentsResult{
+		Medicine:    newEquivalentMedicine(medicine),
+		PriceListID: priceListID,
+		Date:        at,
+		Equivalents: equivalents,
+	}
+	setPrice(&result.Medicine)
+	c.JSON(http.StatusOK, result)
+}
+
+type TherapeuticEquivalenceRequest struct {
+	MedicineID           int    `json:"medicineId" binding:"required"`
+	EquivalentMedicineID int    `json:"equivalentMedicineId" binding:"required"`
+	Equivalent           *bool  `json:"equivalent" binding:"required"`
+	Reason               string `json:"reason"`
+}
+
+func (h *Handler) GetTherapeuticEquivalences(c *gin.Context) {
+	query := h.db(c).Preload("MedicineA").Preload("MedicineB").Order("id")
+	if medicineID := c.Query("medicine_id"); medicineID != "" {
+		id, err := strconv.Atoi(medicineID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid medicine_id"})
+			return
+		}
+		query = query.Where("medicine_a_id = ? OR medicine_b_id = ?", id, id)
+	}
+	var equivalences []repository.TherapeuticEquivalence
+	if err := query.Find(&equivalences).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve equivalences"})
+		return
+	}
+	c.JSON(http.StatusOK, equivalences)
+}
+
+// SetTherapeuticEquivalence records whether two medicines are interchangeable, replacing any previous
+// decision for the same pair in either order
+func (h *Handler) SetTherapeuticEquivalence(c *gin.Context) {
+	if !h.requireAdmin(c, "manage therapeutic equivalences") {
+		return
+	}
+	var req TherapeuticEquivalenceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.MedicineID == req.EquivalentMedicineID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "medicineId and equivalentMedicineId must be different"})
+		return
+	}
+
+	db := h.db(c)
+	var found int64
+	if err := db.Model(&repository.Medicine{}).
+		Where("id IN ?", []int{req.MedicineID, req.EquivalentMedicineID}).
+		Count(&found).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if found != 2 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Medicine not found"})
+		return
+	}
+
+	a, b := req.MedicineID, req.EquivalentMedicineID
+	if a > b {
+		a, b = b, a
+	}
+	var equivalence repository.TherapeuticEquivalence
+	status := http.StatusOK
+	err := db.Where("medicine_a_id = ? AND medicine_b_id = ?", a, b).First(&equivalence).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		equivalence = repository.TherapeuticEquivalence{MedicineAID: a, MedicineBID: b}
+		status = http.StatusCreated
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	equivalence.Equivalent = *req.Equivalent
+	equivalence.Reason = req.Reason
+	equivalence.CreatedBy = c.GetInt("user_id")
+	if err := db.Save(&equivalence).Error; err != nil {
+		h.Logger.Error("Error saving therapeutic equivalence", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save equivalence"})
+		return
+	}
+	c.JSON(status, equivalence)
+}
+
+func (h *Handler) DeleteTherapeuticEquivalence(c *gin.Context) {
+	if !h.requireAdmin(c, "manage therapeutic equivalences") {
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	res := h.db(c).Delete(&repository.TherapeuticEquivalence{}, id)
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete equivalence"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Equivalence not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Equivalence deleted successfully"})
+}
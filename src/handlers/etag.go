@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// errVersionConflict is returned from a transaction when the record changed after it was read
+var errVersionConflict = errors.New("version conflict")
+
+// nextVersion bumps the version column of the records an update writes
+var nextVersion = gorm.Expr("version + 1")
+
+// ifMatchRequired tells whether PUT and DELETE requests must carry If-Match, set with IF_MATCH_REQUIRED
+func ifMatchRequired() bool {
+	required, _ := strconv.ParseBool(os.Getenv("IF_MATCH_REQUIRED"))
+	return required
+}
+
+// overrideVersionKey is the key of the gin context holding the version of the override of the global
+// record a platform admin changes, which the version of the record they read includes
+const overrideVersionKey = "overrideVersion"
+
+// readVersion is the version a record at version is read at by the user of the request: the one of a
+// global record their organization overrides adds the version of the override
+func readVersion(c *gin.Context, version int) int {
+	return version + c.GetInt(overrideVersionKey)
+}
+
+// etag is the entity tag of a version of a record
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// bodyETag is the entity tag of a read: the version of the record followed by a hash of the body, so it
+// changes when the embedded relations or the expanded fields do even if the record itself did not
+func bodyETag(version int, body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + strconv.Itoa(version) + "-" + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// matchesETag tells whether a list of entity tags sent in If-None-Match names tag, with the weak
+// comparison it uses
+func matchesETag(header, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesVersion tells whether a list of entity tags sent in If-Match names version. Only the version of
+// the tag is compared, so the tag of a read matches while the record is unchanged whatever it embedded.
+func matchesVersion(header string, version int) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		tag, _, _ := strings.Cut(strings.Trim(candidate, `"`), "-")
+		if tag == strconv.Itoa(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// respondVersioned answers a record read at version with its ETag, or with 304 when If-None-Match shows
+// the client already has that body
+func respondVersioned(c *gin.Context, version int, body interface{}) {
+	content, err := json.Marshal(body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not render the response"})
+		return
+	}
+	tag := bodyETag(version, content)
+	c.Header("ETag", tag)
+	if header := c.GetHeader("If-None-Match"); header != "" && matchesETag(header, tag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", content)
+}
+
+// checkIfMatch compares the If-Match header of a write with the version the record is at, as the user
+// reads it, answering 412 when it names another version and 428 when it is missing but required. It
+// returns false when it answered.
+func checkIfMatch(c *gin.Context, version int) bool {
+	version = readVersion(c, version)
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		if ifMatchRequired() {
+			c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match is required, send the ETag the record was read with"})
+			return false
+		}
+		return true
+	}
+	if !matchesVersion(header, version) {
+		respondVersionConflict(c, version)
+		return false
+	}
+	return true
+}
+
+// respondVersionConflict answers 412 with the ETag of the version the record is at
+func respondVersionConflict(c *gin.Context, version int) {
+	if version > 0 {
+		c.Header("ETag", etag(version))
+	}
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": "The record was modified since it was read"})
+}
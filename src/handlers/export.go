@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	ExportFormatCSV    = "csv"
+	ExportFormatXLSX   = "xlsx"
+	ExportFormatNDJSON = "ndjson"
+
+	exportFlushEvery = 500
+)
+
+var exportContentTypes = map[string]string{
+	ExportFormatCSV:    "text/csv; charset=utf-8",
+	ExportFormatXLSX:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	ExportFormatNDJSON: "application/x-ndjson",
+}
+
+// exportWriter serializes exported rows one at a time into the response
+type exportWriter interface {
+	WriteHeader(columns []string) error
+	WriteRow(values []interface{}) error
+	Close() error
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (e *csvExportWriter) WriteHeader(columns []string) error {
+	return e.w.Write(columns)
+}
+
+func (e *csvExportWriter) WriteRow(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		record[i] = formatExportValue(v)
+	}
+	return e.w.Write(record)
+}
+
+func (e *csvExportWriter) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonExportWriter struct {
+	enc     *json.Encoder
+	columns []string
+}
+
+func (e *ndjsonExportWriter) WriteHeader(columns []string) error {
+	e.columns = columns
+	return nil
+}
+
+func (e *ndjsonExportWriter) WriteRow(values []interface{}) error {
+	record := make(map[string]interface{}, len(values))
+	for i, v := range values {
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		record[e.columns[i]] = v
+	}
+	return e.enc.Encode(record)
+}
+
+func (e *ndjsonExportWriter) Close() error {
+	return nil
+}
+
+type xlsxExportWriter struct {
+	out  io.Writer
+	file *excelize.File
+	sw   *excelize.StreamWriter
+	row  int
+}
+
+func newXLSXExportWriter(out io.Writer, sheet string) (*xlsxExportWriter, error) {
+	f := excelize.NewFile()
+	if err := f.SetSheetName("Sheet1", sheet); err != nil {
+		return nil, err
+	}
+	sw, err := f.NewStreamWriter(sheet)
+	if err != nil {
+		return nil, err
+	}
+	return &xlsxExportWriter{out: out, file: f, sw: sw, row: 1}, nil
+}
+
+func (e *xlsxExportWriter) WriteHeader(columns []string) error {
+	values := make([]interface{}, len(columns))
+	for i, col := range columns {
+		values[i] = col
+	}
+	return e.WriteRow(values)
+}
+
+func (e *xlsxExportWriter) WriteRow(values []interface{}) error {
+	for i, v := range values {
+		if b, ok := v.([]byte); ok {
+			values[i] = string(b)
+		}
+	}
+	cell, err := excelize.CoordinatesToCellName(1, e.row)
+	if err != nil {
+		return err
+	}
+	e.row++
+	return e.sw.SetRow(cell, values)
+}
+
+func (e *xlsxExportWriter) Close() error {
+	defer e.file.Close()
+	if err := e.sw.Flush(); err != nil {
+		return err
+	}
+	return e.file.Write(e.out)
+}
+
+func formatExportValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(val)
+	case string:
+		return val
+	case time.Time:
+		return val.Format(time.RFC3339)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// parseExportColumns returns the requested columns validated against the resource whitelist,
+// or the whole whitelist when the columns parameter is empty
+func parseExportColumns(requested string, allowed []string) ([]string, error) {
+	if strings.TrimSpace(requested) == "" {
+		return allowed, nil
+	}
+	allowedSet := make(map[string]bool, len(allowed))
+	for _, col := range allowed {
+		allowedSet[col] = true
+	}
+	var columns []string
+	for _, col := range strings.Split(requested, ",") {
+		col = strings.TrimSpace(col)
+		if col == "" {
+			continue
+		}
+		if !allowedSet[col] {
+			return nil, fmt.Errorf("invalid column %q, must be one of: %s", col, strings.Join(allowed, ", "))
+		}
+		columns = append(columns, col)
+	}
+	return columns, nil
+}
+
+// streamExport writes every row matched by query to the response in the requested format,
+// reading them from the database cursor one at a time
+func (h *Handler) streamExport(c *gin.Context, query *gorm.DB, resource string, allowedColumns []string) {
+	format := strings.ToLower(c.DefaultQuery("format", ExportFormatCSV))
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format, must be one of: " + strings.Join([]string{ExportFormatCSV, ExportFormatXLSX, ExportFormatNDJSON}, ", ")})
+		return
+	}
+
+	columns, err := parseExportColumns(c.Query("columns"), allowedColumns)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := query.Select(columns).Order("id").Rows()
+	if err != nil {
+		h.Logger.Error("Error querying export rows", zap.String("resource", resource), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not export " + resource})
+		return
+	}
+	defer rows.Close()
+
+	var writer exportWriter
+	switch format {
+	case ExportFormatCSV:
+		writer = &csvExportWriter{w: csv.NewWriter(c.Writer)}
+	case ExportFormatNDJSON:
+		writer = &ndjsonExportWriter{enc: json.NewEncoder(c.Writer)}
+	case ExportFormatXLSX:
+		writer, err = newXLSXExportWriter(c.Writer, resource)
+		if err != nil {
+			h.Logger.Error("Error creating XLSX export", zap.String("resource", resource), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not export " + resource})
+			return
+		}
+	}
+
+	filename := fmt.Sprintf("%s-%s.%s", resource, time.Now().Format("20060102-150405"), format)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(http.StatusOK)
+
+	if err := writer.WriteHeader(columns); err != nil {
+		h.Logger.Error("Error writing export header", zap.String("resource", resource), zap.Error(err))
+		c.Abort()
+		return
+	}
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	count := 0
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			h.Logger.Error("Error scanning export row", zap.String("resource", resource), zap.Error(err))
+			c.Abort()
+			return
+		}
+		if err := writer.WriteRow(values); err != nil {
+			h.Logger.Error("Error writing export row", zap.String("resource", resource), zap.Error(err))
+			c.Abort()
+			return
+		}
+		count++
+		if count%exportFlushEvery == 0 && format != ExportFormatXLSX {
+			if cw, ok := writer.(*csvExportWriter); ok {
+				cw.w.Flush()
+			}
+			c.Writer.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		h.Logger.Error("Error iterating export rows", zap.String("resource", resource), zap.Error(err))
+		c.Abort()
+		return
+	}
+
+	if err := writer.Close(); err != nil {
+		h.Logger.Error("Error finishing export", zap.String("resource", resource), zap.Error(err))
+		c.Abort()
+		return
+	}
+	h.Logger.Info("Export completed", zap.String("resource", resource), zap.String("format", format), zap.Int("rows", count))
+}
@@ -1,14 +1,32 @@
 package handlers
 
 import (
+	"net/http"
+
+	"ia-boilerplate/src/cfdi"
 	"ia-boilerplate/src/infrastructure"
 	"ia-boilerplate/src/repository"
+	"ia-boilerplate/src/webhook"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
+// adminRole is the role whose users administer the API
+const adminRole = "admin"
+
 type Handler struct {
 	Repository *repository.Repository
 	Auth       *infrastructure.Auth
 	Logger     *infrastructure.Logger
+	// Webhooks, when set, is woken to send the webhook events the requests queue
+	Webhooks *webhook.Dispatcher
+	// Invoicer issues the CFDI invoices; invoicing answers 503 while it is not set
+	Invoicer *cfdi.Invoicer
+	// CursorKey signs the search cursors; paging by cursor answers 503 while it is not set
+	CursorKey []byte
+
+	organizations organizationCache
 }
 
 func NewHandler(repository *repository.Repository, logger *infrastructure.Logger, auth *infrastructure.Auth) *Handler {
@@ -18,3 +36,45 @@ func NewHandler(repository *repository.Repository, logger *infrastructure.Logger
 		Auth:       auth,
 	}
 }
+
+// requestDBKey is the key of the gin context holding the database a request runs its queries on, when it
+// is not the one of the repository, e.g. the transaction of an atomic batch
+const requestDBKey = "requestDB"
+
+// SetRequestDB makes the queries of a request run on db
+func SetRequestDB(c *gin.Context, db *gorm.DB) {
+	c.Set(requestDBKey, db)
+}
+
+// db is the database of a request, scoped to the organization of its user
+func (h *Handler) db(c *gin.Context) *gorm.DB {
+	if db, ok := c.Get(requestDBKey); ok {
+		return db.(*gorm.DB).WithContext(c.Request.Context())
+	}
+	return h.Repository.DB.WithContext(c.Request.Context())
+}
+
+// isAdmin tells whether the user of the request has the admin role
+func (h *Handler) isAdmin(c *gin.Context) (bool, error) {
+	var count int64
+	err := h.db(c).Model(&repository.User{}).
+		Joins("JOIN role_users ON role_users.id = users.role_id AND role_users.deleted_at IS NULL").
+		Where("users.id = ? AND role_users.name = ? AND role_users.enabled = ?", c.GetInt("user_id"), adminRole, true).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// requireAdmin answers 403 unless the user of the request has the admin role, returning false when it
+// answered; what is what only admins can do, e.g. "manage webhooks"
+func (h *Handler) requireAdmin(c *gin.Context, what string) bool {
+	admin, err := h.isAdmin(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not check the role of the user"})
+		return false
+	}
+	if !admin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can " + what})
+		return false
+	}
+	return true
+}
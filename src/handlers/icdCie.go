@@ -6,32 +6,76 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 func (h *Handler) GetICDCies(c *gin.Context) {
+	view, err := parseICDView(c)
+	if err != nil {
+		respondICDError(c, err, "Could not retrieve ICDCie records")
+		return
+	}
+	sel, err := icdCieSearchFields.selection(c, h.db(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	var records []repository.ICDCie
-	if result := h.Repository.DB.Find(&records); result.Error != nil {
+	if result := sel.apply(c, view.query(h.db(c))).Find(&records); result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve ICDCie records"})
 		return
 	}
-	c.JSON(http.StatusOK, records)
+	c.JSON(http.StatusOK, sel.render(records))
 }
 
+// GetICDCie returns a record, retired or not, with its parent; with as_of, both as they were at that time
 func (h *Handler) GetICDCie(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
+	view, err := parseICDView(c)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		respondICDError(c, err, "Could not retrieve ICDCie record")
 		return
 	}
-	var record repository.ICDCie
-	if result := h.Repository.DB.First(&record, id); result.Error != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "ICDCie record not found"})
+	sel, err := icdCieSearchFields.selection(c, h.db(c), "parent")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, record)
+	record, ok := h.findICDCie(c, view)
+	if !ok {
+		return
+	}
+	if record.ParentID != nil && sel.expands("parent") {
+		var parent repository.ICDCie
+		if err := view.anyRetired().query(h.db(c)).Where("id = ?", *record.ParentID).First(&parent).Error; err == nil {
+			record.Parent = &parent
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+	translations, err := translateICDCodes(h.db(c), record.CieVersion, otherCieVersion(record.CieVersion), []string{record.Code})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve ICD mapping"})
+		return
+	}
+	detail := sel.render(ICDCieDetail{ICDCie: record, Mapping: translations[0]})
+	// past states have no version of their own, only the current one is tagged
+	if view.asOf != nil {
+		c.JSON(http.StatusOK, detail)
+		return
+	}
+	respondVersioned(c, record.Version, detail)
+}
+
+// ICDCieDetail is an ICD record with its translation to the other CieVersion
+type ICDCieDetail struct {
+	repository.ICDCie
+	Mapping ICDTranslation `json:"mapping"`
 }
 
 type CreateICDCieRequest struct {
@@ -40,6 +84,10 @@ type CreateICDCieRequest struct {
 	Description  string `json:"description"`
 	ChapterNo    string `json:"chapterNo"`
 	ChapterTitle string `json:"chapterTitle"`
+	Kind         string `json:"kind"`
+	ParentID     *int   `json:"parentId"`
+	// Global adds the code to the global classification instead of the organization, for platform admins
+	Global bool `json:"global"`
 }
 
 func (h *Handler) CreateICDCie(c *gin.Context) {
@@ -48,14 +96,32 @@ func (h *Handler) CreateICDCie(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if req.Global && !h.writeGlobalCatalog(c, "add global ICD codes") {
+		return
+	}
 	cieVersion := repository.CieVersionType(req.CieVersion)
 	if !cieVersion.IsValid() {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid CieVersion, must be one of:" + strings.Join(repository.ValidCieVersions, ", ")})
 		return
 	}
+	kind := repository.ICDKind(req.Kind)
+	if req.Kind != "" && !kind.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid kind, must be one of: " + strings.Join(repository.ValidICDKinds, ", ")})
+		return
+	}
+	code := repository.NormalizeICDCode(req.Code)
+	kind, err := repository.ValidateICDCode(cieVersion, code, kind)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	var existing repository.ICDCie
-	if err := h.Repository.DB.Where("code = ?", req.Code).First(&existing).Error; err == nil {
+	if err := h.db(c).Where("cie_version = ? AND code = ?", cieVersion, code).First(&existing).Error; err == nil {
+		if existing.Retired {
+			c.JSON(http.StatusConflict, gin.H{"error": "Could not create ICDCie record: the code was retired"})
+			return
+		}
 		c.JSON(http.StatusConflict, gin.H{"error": "Could not create ICDCie record: duplicate code"})
 		return
 	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
@@ -64,15 +130,33 @@ func (h *Handler) CreateICDCie(c *gin.Context) {
 	}
 	record := repository.ICDCie{
 		CieVersion:   cieVersion,
-		Code:         req.Code,
+		Code:         code,
 		Description:  req.Description,
 		ChapterNo:    req.ChapterNo,
 		ChapterTitle: req.ChapterTitle,
+		Kind:         kind,
+		ValidFrom:    time.Now(),
+	}
+	if err := placeICDNode(h.db(c), &record, req.ParentID); err != nil {
+		respondICDError(c, err, "Could not create ICDCie record")
+		return
 	}
-	if result := h.Repository.DB.Create(&record); result.Error != nil {
+	var queued int
+	if err := h.db(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&record).Error; err != nil {
+			return err
+		}
+		if err := repository.RecordICDVersions(tx, []repository.ICDCie{record}, record.ValidFrom); err != nil {
+			return err
+		}
+		n, err := queueWebhookEvent(tx, repository.WebhookEventICDCreated, record)
+		queued = n
+		return err
+	}); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create ICDCie record"})
 		return
 	}
+	h.wakeWebhooks(queued)
 	c.JSON(http.StatusCreated, record)
 }
 
@@ -82,6 +166,9 @@ type UpdateICDCieRequest struct {
 	Description  *string `json:"description"`
 	ChapterNo    *string `json:"chapterNo"`
 	ChapterTitle *string `json:"chapterTitle"`
+	Kind         *string `json:"kind"`
+	// ParentID places the record under another one; 0 places it again by its code
+	ParentID *int `json:"parentId"`
 }
 
 func (h *Handler) UpdateICDCie(c *gin.Context) {
@@ -90,6 +177,10 @@ func (h *Handler) UpdateICDCie(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
 		return
 	}
+
+	if !h.guardCatalogRecord(c, &repository.ICDCie{}, "change global ICD codes") {
+		return
+	}
 	var req UpdateICDCieRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -98,13 +189,71 @@ func (h *Handler) UpdateICDCie(c *gin.Context) {
 
 	// Verify the record exists
 	var existingRecord repository.ICDCie
-	if err := h.Repository.DB.First(&existingRecord, id).Error; err != nil {
+	if err := h.db(c).First(&existingRecord, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ICDCie record not found"})
+		return
+	}
+	if existingRecord.Retired {
+		c.JSON(http.StatusConflict, gin.H{"error": "Could not update ICDCie record: it is retired"})
+		return
+	}
+	if !checkIfMatch(c, existingRecord.Version) {
+		return
+	}
+	h.updateICDCie(c, existingRecord, req)
+}
+
+// PatchICDCie updates an ICD record with a JSON Merge Patch or a JSON Patch of its fields; removing
+// parentId places the record again by its code
+func (h *Handler) PatchICDCie(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	if !h.guardCatalogRecord(c, &repository.ICDCie{}, "change global ICD codes") {
+		return
+	}
+	var existingRecord repository.ICDCie
+	if err := h.db(c).First(&existingRecord, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "ICDCie record not found"})
 		return
 	}
+	if existingRecord.Retired {
+		c.JSON(http.StatusConflict, gin.H{"error": "Could not update ICDCie record: it is retired"})
+		return
+	}
+	if !checkIfMatch(c, existingRecord.Version) {
+		return
+	}
+	r := existingRecord
+	current := UpdateICDCieRequest{
+		CieVersion:   (*string)(&r.CieVersion),
+		Code:         &r.Code,
+		Description:  &r.Description,
+		ChapterNo:    &r.ChapterNo,
+		ChapterTitle: &r.ChapterTitle,
+		Kind:         (*string)(&r.Kind),
+		ParentID:     r.ParentID,
+	}
+	var req UpdateICDCieRequest
+	if !patchRequest(c, current, &req) {
+		return
+	}
+	h.updateICDCie(c, existingRecord, req)
+}
+
+// updateICDCie writes the fields given in req to existingRecord, keeping the hierarchy consistent and
+// recording the version it closes
+func (h *Handler) updateICDCie(c *gin.Context, existingRecord repository.ICDCie, req UpdateICDCieRequest) {
+	id := existingRecord.ID
+	var err error
 
 	// Prepare fields to update
 	updates := make(map[string]interface{})
+	// the record as it will be after the update, used to validate its code and place it in the hierarchy
+	updated := existingRecord
 
 	// Validate and add each field if present in the request
 	if req.CieVersion != nil {
@@ -114,13 +263,37 @@ func (h *Handler) UpdateICDCie(c *gin.Context) {
 			return
 		}
 		updates["cie_version"] = cieVersion
+		updated.CieVersion = cieVersion
 	}
 
 	if req.Code != nil {
+		updated.Code = repository.NormalizeICDCode(*req.Code)
+		updates["code"] = updated.Code
+	}
+
+	if req.Kind != nil {
+		updated.Kind = repository.ICDKind(*req.Kind)
+		if !updated.Kind.IsValid() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid kind, must be one of: " + strings.Join(repository.ValidICDKinds, ", ")})
+			return
+		}
+	}
+
+	if req.CieVersion != nil || req.Code != nil || req.Kind != nil {
+		kind := updated.Kind
+		if req.Kind == nil {
+			kind = ""
+		}
+		if updated.Kind, err = repository.ValidateICDCode(updated.CieVersion, updated.Code, kind); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		updates["kind"] = updated.Kind
+
 		// Check that the code is not duplicated (excluding the current record)
-		if *req.Code != existingRecord.Code {
+		if updated.Code != existingRecord.Code || updated.CieVersion != existingRecord.CieVersion {
 			var duplicateCheck repository.ICDCie
-			if err := h.Repository.DB.Where("code = ?", *req.Code).First(&duplicateCheck).Error; err == nil {
+			if err := h.db(c).Where("cie_version = ? AND code = ?", updated.CieVersion, updated.Code).First(&duplicateCheck).Error; err == nil {
 				c.JSON(http.StatusConflict, gin.H{"error": "Could not update ICDCie record: duplicate code"})
 				return
 			} else if !errors.Is(err, gorm.ErrRecordNotFound) {
@@ -128,7 +301,40 @@ func (h *Handler) UpdateICDCie(c *gin.Context) {
 				return
 			}
 		}
-		updates["code"] = *req.Code
+
+		// The children must still fit under the record
+		var children []repository.ICDCie
+		if err := h.db(c).Where("parent_id = ?", id).Find(&children).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update ICDCie record"})
+			return
+		}
+		for _, child := range children {
+			if child.CieVersion != updated.CieVersion || !repository.CanContainICDNode(updated.Kind, child.Kind) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Could not update ICDCie record: it no longer fits its child code " + child.Code})
+				return
+			}
+		}
+	}
+
+	// A new code may move the record, so its parent is placed again unless one is given
+	if req.ParentID != nil || req.CieVersion != nil || req.Code != nil || req.Kind != nil {
+		if req.ChapterNo != nil {
+			updated.ChapterNo = *req.ChapterNo
+		}
+		if req.ChapterTitle != nil {
+			updated.ChapterTitle = *req.ChapterTitle
+		}
+		parentID := req.ParentID
+		if parentID != nil && *parentID == 0 {
+			parentID = nil
+		}
+		if err := placeICDNode(h.db(c), &updated, parentID); err != nil {
+			respondICDError(c, err, "Could not update ICDCie record")
+			return
+		}
+		updates["parent_id"] = updated.ParentID
+		updates["chapter_no"] = updated.ChapterNo
+		updates["chapter_title"] = updated.ChapterTitle
 	}
 
 	if req.Description != nil {
@@ -149,21 +355,41 @@ func (h *Handler) UpdateICDCie(c *gin.Context) {
 		return
 	}
 
-	// Perform the update
-	if err := h.Repository.DB.Model(&repository.ICDCie{}).
-		Where("id = ?", id).
-		Updates(updates).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update ICDCie record"})
+	// Perform the update, closing the version the record had until now
+	updates["version"] = nextVersion
+	var (
+		updatedRecord repository.ICDCie
+		queued        int
+	)
+	err = h.db(c).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&repository.ICDCie{}).Where("id = ? AND version = ?", id, existingRecord.Version).Updates(updates)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errVersionConflict
+		}
+		if err := tx.First(&updatedRecord, id).Error; err != nil {
+			return err
+		}
+		if err := repository.RecordICDVersions(tx, []repository.ICDCie{updatedRecord}, time.Now()); err != nil {
+			return err
+		}
+		n, err := queueWebhookEvent(tx, repository.WebhookEventICDUpdated, updatedRecord)
+		queued = n
+		return err
+	})
+	if errors.Is(err, errVersionConflict) {
+		respondVersionConflict(c, 0)
 		return
 	}
-
-	// Retrieve the updated record
-	var updatedRecord repository.ICDCie
-	if err := h.Repository.DB.First(&updatedRecord, id).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve updated ICDCie record"})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update ICDCie record"})
 		return
 	}
 
+	h.wakeWebhooks(queued)
+	c.Header("ETag", etag(readVersion(c, updatedRecord.Version)))
 	c.JSON(http.StatusOK, updatedRecord)
 }
 
@@ -173,71 +399,290 @@ func (h *Handler) DeleteICDCie(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
 		return
 	}
-	if res := h.Repository.DB.Delete(&repository.ICDCie{}, id); res.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete ICDCie record"})
+
+	if !h.guardCatalogRecord(c, &repository.ICDCie{}, "change global ICD codes") {
+		return
+	}
+	var record repository.ICDCie
+	if err := h.db(c).First(&record, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "ICDCie record not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retire ICDCie record"})
+		}
+		return
+	}
+	if !checkIfMatch(c, record.Version) {
+		return
+	}
+	if record.Retired {
+		c.JSON(http.StatusOK, gin.H{"message": "ICDCie record retired successfully"})
+		return
+	}
+	var children int64
+	if err := h.db(c).Model(&repository.ICDCie{}).Where("parent_id = ? AND retired = ?", id, false).Count(&children).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retire ICDCie record"})
+		return
+	}
+	if children > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Could not retire ICDCie record: it has child codes in effect"})
+		return
+	}
+
+	// The record is kept so that whatever referenced the code can still resolve it
+	now := time.Now()
+	record.Retired, record.ValidTo = true, &now
+	var queued int
+	err = h.db(c).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&repository.ICDCie{}).Where("id = ? AND version = ?", id, record.Version).
+			Updates(map[string]interface{}{"retired": true, "valid_to": now, "version": nextVersion})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errVersionConflict
+		}
+		if err := repository.RecordICDVersions(tx, []repository.ICDCie{record}, now); err != nil {
+			return err
+		}
+		n, err := queueWebhookEvent(tx, repository.WebhookEventICDDeleted, gin.H{"id": id})
+		queued = n
+		return err
+	})
+	if errors.Is(err, errVersionConflict) {
+		respondVersionConflict(c, 0)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retire ICDCie record"})
+		return
+	}
+	h.wakeWebhooks(queued)
+	c.JSON(http.StatusOK, gin.H{"message": "ICDCie record retired successfully"})
+}
+
+// RestoreICDCie puts a retired ICD record back in effect, opening a new version of it. Its parent must be
+// in effect.
+func (h *Handler) RestoreICDCie(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	if !h.guardCatalogRecord(c, &repository.ICDCie{}, "change global ICD codes") {
+		return
+	}
+	var record repository.ICDCie
+	if err := h.db(c).First(&record, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "ICDCie record not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not restore ICDCie record"})
+		}
+		return
+	}
+	if !checkIfMatch(c, record.Version) {
+		return
+	}
+	if record.Retired {
+		if record.ParentID != nil {
+			var parent repository.ICDCie
+			if err := h.db(c).Select("retired").First(&parent, *record.ParentID).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not restore ICDCie record"})
+				return
+			}
+			if parent.Retired {
+				c.JSON(http.StatusConflict, gin.H{"error": "Could not restore ICDCie record: its parent is retired"})
+				return
+			}
+		}
+		now := time.Now()
+		record.Retired, record.ValidTo = false, nil
+		err = h.db(c).Transaction(func(tx *gorm.DB) error {
+			res := tx.Model(&repository.ICDCie{}).Where("id = ? AND version = ?", id, record.Version).
+				Updates(map[string]interface{}{"retired": false, "valid_to": nil, "version": nextVersion})
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				return errVersionConflict
+			}
+			return repository.RecordICDVersions(tx, []repository.ICDCie{record}, now)
+		})
+		if errors.Is(err, errVersionConflict) {
+			respondVersionConflict(c, 0)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not restore ICDCie record"})
+			return
+		}
+	}
+	if err := h.db(c).First(&record, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve restored ICDCie record"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "ICDCie record deleted successfully"})
+	c.Header("ETag", etag(readVersion(c, record.Version)))
+	c.JSON(http.StatusOK, record)
 }
 
-func (h *Handler) SearchICDCiePaginated(c *gin.Context) {
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
-	if page < 1 {
-		page = 1
+// icdCieSearchFields are the fields ICD records can be filtered, sorted and read by; titles are compared
+// without accents, backed by the trigram indexes
+var icdCieSearchFields = searchSpec{
+	model: &repository.ICDCie{},
+	fields: map[string]searchField{
+		"id":              {column: "id", kind: searchInt},
+		"organization_id": {column: "organization_id", kind: searchInt, nullable: true},
+		"cie_version":     {column: "cie_version"},
+		"code":            {column: "code"},
+		"description":     {column: "description", unaccent: true},
+		"chapter_no":      {column: "chapter_no"},
+		"chapter_title":   {column: "chapter_title", unaccent: true},
+		"kind":            {column: "kind"},
+		"parent_id":       {column: "parent_id", kind: searchInt, nullable: true},
+		"release":         {column: "release"},
+		"retired":         {column: "retired", kind: searchBool},
+		"valid_from":      {column: "valid_from", kind: searchTime},
+		"valid_to":        {column: "valid_to", kind: searchTime, nullable: true},
+	},
+	expand: map[string]expansion{
+		"parent": {preloads: []string{"Parent"}, columns: []string{"parent_id"}, scope: icdParentScope},
+	},
+	defaultSort: "id",
+}
+
+// icdParentScope reads parents retired or not and, with as_of, as they were at that time
+func icdParentScope(c *gin.Context, tx *gorm.DB) *gorm.DB {
+	view, err := parseICDView(c)
+	if err != nil || view.asOf == nil {
+		return tx
 	}
-	if limit < 1 {
-		limit = 10
+	return tx.Table("(?) AS icd_cies", view.source(tx.Session(&gorm.Session{NewDB: true})))
+}
+
+// icdCieSearchQuery builds the ICDCie query over a view filtered by the parameters of the request, q
+// searching the text of the records
+func (h *Handler) icdCieSearchQuery(c *gin.Context, view icdView) (*gorm.DB, error) {
+	query, err := icdCieSearchFields.filter(c, view.query(h.db(c)))
+	if err != nil {
+		return nil, err
 	}
 
-	likeFilters := map[string]string{
-		"cie_version":   c.Query("cie_version_like"),
-		"code":          c.Query("code_like"),
-		"description":   c.Query("description_like"),
-		"chapter_no":    c.Query("chapter_no_like"),
-		"chapter_title": c.Query("chapter_title_like"),
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		query = query.Where("(search_vector @@ to_tsquery('es_unaccent', ?) OR f_unaccent(lower(?)) <% f_unaccent(lower(description)) OR code ILIKE ?)",
+			icdTSQuery(q), q, q+"%")
 	}
 
-	matches := map[string][]string{
-		"cie_version":   c.QueryArray("cie_version_match"),
-		"code":          c.QueryArray("code_match"),
-		"description":   c.QueryArray("description_match"),
-		"chapter_no":    c.QueryArray("chapter_no_match"),
-		"chapter_title": c.QueryArray("chapter_title_match"),
+	return query, nil
+}
+
+// icdTSQuery turns free text into a tsquery matching every word as a prefix, e.g. "neumonía bact" becomes
+// "neumonía:* & bact:*". The es_unaccent configuration stems the words and drops their accents.
+func icdTSQuery(text string) string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, word := range words {
+		words[i] = word + ":*"
 	}
+	return strings.Join(words, " & ")
+}
 
-	var total int64
-	query := h.Repository.DB.Model(&repository.ICDCie{})
+// ICDSearchHit is a record found by the q parameter with its relevance and its description with the
+// matched words wrapped in <mark>
+type ICDSearchHit struct {
+	repository.ICDCie
+	Rank      float64 `json:"rank"`
+	Highlight string  `json:"highlight"`
+}
 
-	for col, val := range likeFilters {
-		if val != "" {
-			query = query.Where(col+" ILIKE ?", "%"+val+"%")
-		}
+func (h *Handler) SearchICDCiePaginated(c *gin.Context) {
+	view, err := parseICDView(c)
+	if err != nil {
+		respondICDError(c, err, "Could not search ICDCie records")
+		return
+	}
+	query, err := h.icdCieSearchQuery(c, view)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	for col, vals := range matches {
-		if len(vals) > 0 {
-			query = query.Where(col+" IN (?)", vals)
-		}
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		var records []repository.ICDCie
+		h.search(c, icdCieSearchFields, query, &records)
+		return
+	}
+	sel, err := icdCieSearchFields.selection(c, h.db(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	query.Count(&total)
+	// Text searches are ordered by relevance unless the request sorts them
+	if _, ok := c.GetQuery("cursor"); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Text searches are paged with page, not cursor"})
+		return
+	}
+	sorts, err := icdCieSearchFields.order(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	orders := []string{"rank DESC", "code ASC", "id ASC"}
+	if c.Query("sort") != "" {
+		orders = orders[:0]
+		for _, by := range sorts {
+			orders = append(orders, by.clause())
+		}
+	}
+	page := parseSearchPage(c)
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+		return
+	}
 
-	offset := (page - 1) * limit
-	var records []repository.ICDCie
-	if res := query.Offset(offset).Limit(limit).Find(&records); res.Error != nil {
+	// full-text rank, plus word similarity for misspellings and a boost for codes starting with q
+	tsquery := icdTSQuery(q)
+	columns := "icd_cies.*"
+	if sel.columns != nil {
+		columns = "icd_cies." + strings.Join(sel.columns, ", icd_cies.")
+	}
+	query = query.Select(columns+`,
+		ts_rank_cd(search_vector, to_tsquery('es_unaccent', ?))
+			+ word_similarity(f_unaccent(lower(?)), f_unaccent(lower(description)))
+			+ CASE WHEN code ILIKE ? THEN 1 ELSE 0 END AS rank,
+		ts_headline('es_unaccent', description, to_tsquery('es_unaccent', ?),
+			'StartSel=<mark>, StopSel=</mark>, HighlightAll=true') AS highlight`, tsquery, q, q+"%", tsquery)
+	query = sel.preload(c, query)
+	for _, clause := range orders {
+		query = query.Order(clause)
+	}
+	var hits []ICDSearchHit
+	if err := query.Offset(page.offset()).Limit(page.limit).Find(&hits).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
 		return
 	}
+	page.respond(c, sel.render(hits), total)
+}
 
-	totalPages := int((total + int64(limit) - 1) / int64(limit))
-	c.JSON(http.StatusOK, gin.H{
-		"current_page":  page,
-		"records":       records,
-		"page_size":     limit,
-		"total_pages":   totalPages,
-		"total_records": total,
-	})
+var icdCieExportColumns = []string{"id", "cie_version", "code", "description", "chapter_no", "chapter_title", "kind", "parent_id", "release", "retired"}
+
+func (h *Handler) ExportICDCies(c *gin.Context) {
+	view, err := parseICDView(c)
+	if err != nil {
+		respondICDError(c, err, "Could not export ICDCie records")
+		return
+	}
+	query, err := h.icdCieSearchQuery(c, view)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.streamExport(c, query, "icd-cie", icdCieExportColumns)
 }
 
 func (h *Handler) SearchIcdCoincidencesByProperty(c *gin.Context) {
@@ -248,12 +693,27 @@ func (h *Handler) SearchIcdCoincidencesByProperty(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid property or search_text"})
 		return
 	}
+	view, err := parseICDView(c)
+	if err != nil {
+		respondICDError(c, err, "Query failed")
+		return
+	}
+	query := view.query(h.db(c))
+	if property == "description" || property == "chapter_title" {
+		// titles containing the text or similar words regardless of accents, closest first
+		normalized := "f_unaccent(lower(" + property + "))"
+		query = query.Where("("+normalized+" LIKE '%' || f_unaccent(lower(?)) || '%' OR f_unaccent(lower(?)) <% "+normalized+")", searchText, searchText).
+			Group(property).
+			Order(clause.OrderBy{Expression: clause.Expr{
+				SQL:                "MAX(word_similarity(f_unaccent(lower(?)), " + normalized + ")) DESC",
+				Vars:               []interface{}{searchText},
+				WithoutParentheses: true,
+			}})
+	} else {
+		query = query.Distinct(property).Where(property+" ILIKE ?", "%"+searchText+"%")
+	}
 	var results []string
-	if res := h.Repository.DB.Model(&repository.ICDCie{}).
-		Distinct(property).
-		Where(property+" ILIKE ?", "%"+searchText+"%").
-		Limit(20).
-		Pluck(property, &results); res.Error != nil {
+	if res := query.Limit(20).Pluck(property, &results); res.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Query failed"})
 		return
 	}
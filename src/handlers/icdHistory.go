@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"errors"
+	"ia-boilerplate/src/repository"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// icdVersionColumns lay an ICD record version out as an icd_cies row, so the queries written for the
+// table run unchanged over the classification of a past date
+const icdVersionColumns = `icd_cie_id AS id, organization_id, cie_version, code, description, chapter_no, chapter_title, kind,
+	parent_id, release, FALSE AS retired, valid_from, valid_to,
+	setweight(to_tsvector('es_unaccent', coalesce(code, '')), 'A') ||
+	setweight(to_tsvector('es_unaccent', coalesce(description, '')), 'B') ||
+	setweight(to_tsvector('es_unaccent', coalesce(chapter_title, '')), 'C') AS search_vector`
+
+// icdView is the set of ICD records a read works on: the current classification, by default without the
+// retired codes, or with as_of the classification as it was at that time, rebuilt from the record versions
+type icdView struct {
+	asOf *time.Time
+	// retired is "false", "true" or "any"; it does not apply to past dates, where only the codes in
+	// effect are returned
+	retired string
+}
+
+// parseICDView reads the as_of and retired parameters of an ICD read
+func parseICDView(c *gin.Context) (icdView, error) {
+	view := icdView{retired: strings.ToLower(c.DefaultQuery("retired", "false"))}
+	if view.retired != "false" && view.retired != "true" && view.retired != "any" {
+		return view, repository.NewAppError(errors.New("Invalid retired, must be true, false or any"), repository.ValidationError)
+	}
+	if value := c.Query("as_of"); value != "" {
+		asOf, err := parseInstant(value)
+		if err != nil {
+			return view, repository.NewAppError(errors.New("Invalid as_of, must be RFC3339 or YYYY-MM-DD"), repository.ValidationError)
+		}
+		view.asOf = &asOf
+	}
+	return view, nil
+}
+
+// anyRetired returns the view including retired codes, used to look a record up by id
+func (v icdView) anyRetired() icdView {
+	v.retired = "any"
+	return v
+}
+
+// source returns the rows of the view, to be used as a subquery named icd_cies. Past dates read the
+// classification as it was recorded, without the overrides of the organization.
+func (v icdView) source(db *gorm.DB) *gorm.DB {
+	if v.asOf != nil {
+		return db.Model(&repository.ICDCieVersion{}).Select(icdVersionColumns).
+			Where("valid_from <= ? AND (valid_to IS NULL OR valid_to > ?)", *v.asOf, *v.asOf)
+	}
+	query := db.Model(&repository.ICDCie{})
+	if v.retired != "any" {
+		query = query.Where("retired = ?", v.retired == "true")
+	}
+	return query
+}
+
+// query starts an ICDCie query over the view
+func (v icdView) query(db *gorm.DB) *gorm.DB {
+	if v.asOf != nil {
+		return db.Model(&repository.ICDCie{}).Table("(?) AS icd_cies", v.source(db))
+	}
+	query := db.Model(&repository.ICDCie{})
+	if v.retired != "any" {
+		query = query.Where("retired = ?", v.retired == "true")
+	}
+	return query
+}
+
+// GetICDCieHistory returns the versions of a record, oldest first
+func (h *Handler) GetICDCieHistory(c *gin.Context) {
+	record, ok := h.findICDCie(c, icdView{retired: "any"})
+	if !ok {
+		return
+	}
+	var versions []repository.ICDCieVersion
+	if err := h.db(c).Where("icd_cie_id = ?", record.ID).Order("valid_from, id").Find(&versions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve ICDCie history"})
+		return
+	}
+	c.JSON(http.StatusOK, versions)
+}
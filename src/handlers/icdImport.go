@@ -0,0 +1,396 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"ia-boilerplate/src/icd"
+	"ia-boilerplate/src/repository"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+type ICDImportOptions struct {
+	CieVersion repository.CieVersionType
+	// Release labels the release; when empty the one declared by the file is used
+	Release  string
+	Format   string
+	FileName string
+	// EffectiveFrom is when the release takes effect; now when zero. It cannot precede the releases of the
+	// CieVersion already imported.
+	EffectiveFrom time.Time
+	DryRun        bool
+	ImportedBy    int
+}
+
+type ICDImportResult struct {
+	DryRun          bool                      `json:"dry_run"`
+	AlreadyImported bool                      `json:"already_imported"`
+	CieVersion      repository.CieVersionType `json:"cie_version"`
+	Release         string                    `json:"release"`
+	EffectiveFrom   time.Time                 `json:"effective_from"`
+	Format          string                    `json:"format"`
+	TotalCodes      int                       `json:"total_codes"`
+	Added           int                       `json:"added"`
+	Changed         int                       `json:"changed"`
+	Retired         int                       `json:"retired"`
+	Unchanged       int                       `json:"unchanged"`
+	AddedCodes      []string                  `json:"added_codes"`
+	ChangedCodes    []string                  `json:"changed_codes"`
+	RetiredCodes    []string                  `json:"retired_codes"`
+	Errors          []icd.EntryError          `json:"errors"`
+}
+
+// ImportICDRelease loads an official release file of a CieVersion. Codes are matched by code: new ones are
+// added, those whose title or position changed are updated, and those of an earlier release missing from
+// this one are marked as retired; codes created through the API are left alone. Every change opens a record
+// version from EffectiveFrom. The codes added, changed and retired are sent in icd.imported events, to the
+// subscriptions of every organization. Importing a release already loaded with the same file changes
+// nothing, and nothing is written when DryRun is set.
+func (h *Handler) ImportICDRelease(r io.Reader, opts ICDImportOptions) (ICDImportResult, error) {
+	result := ICDImportResult{
+		DryRun:       opts.DryRun,
+		CieVersion:   opts.CieVersion,
+		Format:       opts.Format,
+		AddedCodes:   []string{},
+		ChangedCodes: []string{},
+		RetiredCodes: []string{},
+		Errors:       []icd.EntryError{},
+	}
+	if !opts.CieVersion.IsValid() {
+		return result, repository.NewAppError(errors.New("Invalid cie_version, must be one of: "+strings.Join(repository.ValidCieVersions, ", ")), repository.ValidationError)
+	}
+
+	hasher := sha256.New()
+	file, err := icd.Parse(io.TeeReader(r, hasher), opts.Format, opts.CieVersion)
+	if err != nil {
+		return result, repository.NewAppError(fmt.Errorf("could not parse release file: %w", err), repository.ValidationError)
+	}
+	// drain what the parser did not read so the checksum covers the whole file
+	if _, err := io.Copy(hasher, r); err != nil {
+		return result, err
+	}
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	result.Release = strings.TrimSpace(opts.Release)
+	if result.Release == "" {
+		result.Release = file.Release
+	}
+	if result.Release == "" {
+		return result, repository.NewAppError(errors.New("release is required, the file does not declare one"), repository.ValidationError)
+	}
+
+	db := h.Repository.DB
+	var previous repository.ICDRelease
+	err = db.Where("cie_version = ? AND release = ?", opts.CieVersion, result.Release).First(&previous).Error
+	if err == nil {
+		if previous.Checksum != checksum {
+			return result, repository.NewAppError(fmt.Errorf("release %s of %s was already imported from a different file", result.Release, opts.CieVersion), repository.ResourceAlreadyExists)
+		}
+		result.AlreadyImported = true
+		result.EffectiveFrom = previous.EffectiveFrom
+		result.Added, result.Changed, result.Retired, result.Unchanged = previous.Added, previous.Changed, previous.Retired, previous.Unchanged
+		result.TotalCodes = previous.Added + previous.Changed + previous.Unchanged
+		return result, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return result, err
+	}
+
+	result.EffectiveFrom = opts.EffectiveFrom
+	if result.EffectiveFrom.IsZero() {
+		result.EffectiveFrom = time.Now()
+	}
+	var latest repository.ICDRelease
+	err = db.Where("cie_version = ?", opts.CieVersion).Order("effective_from DESC").First(&latest).Error
+	if err == nil && result.EffectiveFrom.Before(latest.EffectiveFrom) {
+		return result, repository.NewAppError(fmt.Errorf("the release cannot take effect before release %s, in effect since %s",
+			latest.Release, latest.EffectiveFrom.Format(time.RFC3339)), repository.ValidationError)
+	} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return result, err
+	}
+
+	entries, hierarchyErrs := file.Hierarchy()
+	result.Errors = append(append(result.Errors, file.Errors...), hierarchyErrs...)
+	result.TotalCodes = len(entries)
+	if len(entries) == 0 {
+		return result, repository.NewAppError(errors.New("the release file has no valid codes"), repository.ValidationError)
+	}
+
+	// releases load the global classification, the codes added by organizations are left as they are
+	var records []repository.ICDCie
+	if err := db.Where("cie_version = ? AND organization_id IS NULL", opts.CieVersion).Find(&records).Error; err != nil {
+		return result, err
+	}
+	existing := make(map[string]*repository.ICDCie, len(records))
+	codeByID := make(map[int]string, len(records))
+	for i := range records {
+		existing[records[i].Code] = &records[i]
+		codeByID[records[i].ID] = records[i].Code
+	}
+
+	inRelease := make(map[string]bool, len(entries))
+	var changed []icd.Entry
+	var unchangedIDs []int
+	for _, entry := range entries {
+		inRelease[entry.Code] = true
+		record, ok := existing[entry.Code]
+		if !ok {
+			result.AddedCodes = append(result.AddedCodes, entry.Code)
+			continue
+		}
+		parentCode := ""
+		if record.ParentID != nil {
+			parentCode = codeByID[*record.ParentID]
+		}
+		if record.Description != entry.Title || record.Kind != entry.Kind || parentCode != entry.ParentCode ||
+			record.ChapterNo != entry.ChapterNo || record.ChapterTitle != entry.ChapterTitle || record.Retired {
+			result.ChangedCodes = append(result.ChangedCodes, entry.Code)
+			changed = append(changed, entry)
+		} else {
+			unchangedIDs = append(unchangedIDs, record.ID)
+		}
+	}
+	var retiredIDs []int
+	var retiredRecords []repository.ICDCie
+	for _, record := range records {
+		if !inRelease[record.Code] && !record.Retired && record.Release != "" {
+			result.RetiredCodes = append(result.RetiredCodes, record.Code)
+			retiredIDs = append(retiredIDs, record.ID)
+			record.Retired = true
+			retiredRecords = append(retiredRecords, record)
+		}
+	}
+	result.Added, result.Changed, result.Retired, result.Unchanged = len(result.AddedCodes), len(changed), len(retiredIDs), len(unchangedIDs)
+	if opts.DryRun {
+		return result, nil
+	}
+
+	isChanged := make(map[string]bool, len(changed))
+	for _, entry := range changed {
+		isChanged[entry.Code] = true
+	}
+	effective := result.EffectiveFrom
+	queued := 0
+	err = db.Transaction(func(tx *gorm.DB) error {
+		ids := make(map[string]int, len(records)+len(result.AddedCodes))
+		for _, record := range records {
+			ids[record.Code] = record.ID
+		}
+		// records whose state changed, to open their new versions once all of them are written
+		var versioned []repository.ICDCie
+		// new records wait in pending until one of them is needed as a parent; entries come parents first
+		var pending []repository.ICDCie
+		flush := func() error {
+			if len(pending) == 0 {
+				return nil
+			}
+			if err := tx.CreateInBatches(&pending, defaultImportBatchSize).Error; err != nil {
+				return err
+			}
+			for _, record := range pending {
+				ids[record.Code] = record.ID
+			}
+			versioned = append(versioned, pending...)
+			pending = nil
+			return nil
+		}
+
+		for _, entry := range entries {
+			_, known := existing[entry.Code]
+			if known && !isChanged[entry.Code] {
+				continue
+			}
+			var parentID *int
+			if entry.ParentCode != "" {
+				if _, ok := ids[entry.ParentCode]; !ok {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
+				id := ids[entry.ParentCode]
+				parentID = &id
+			}
+			if !known {
+				pending = append(pending, repository.ICDCie{
+					CieVersion:   opts.CieVersion,
+					Code:         entry.Code,
+					Description:  entry.Title,
+					ChapterNo:    entry.ChapterNo,
+					ChapterTitle: entry.ChapterTitle,
+					Kind:         entry.Kind,
+					ParentID:     parentID,
+					Release:      result.Release,
+					ValidFrom:    effective,
+				})
+				continue
+			}
+			if err := tx.Model(&repository.ICDCie{}).Where("id = ?", ids[entry.Code]).Updates(map[string]interface{}{
+				"description":   entry.Title,
+				"kind":          entry.Kind,
+				"parent_id":     parentID,
+				"chapter_no":    entry.ChapterNo,
+				"chapter_title": entry.ChapterTitle,
+				"release":       result.Release,
+				"retired":       false,
+				"valid_to":      nil,
+				"version":       nextVersion,
+			}).Error; err != nil {
+				return err
+			}
+			record := *existing[entry.Code]
+			record.Description, record.Kind, record.ParentID = entry.Title, entry.Kind, parentID
+			record.ChapterNo, record.ChapterTitle, record.Release, record.Retired = entry.ChapterNo, entry.ChapterTitle, result.Release, false
+			versioned = append(versioned, record)
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+
+		for start := 0; start < len(unchangedIDs); start += defaultImportBatchSize {
+			chunk := unchangedIDs[start:min(start+defaultImportBatchSize, len(unchangedIDs))]
+			if err := tx.Model(&repository.ICDCie{}).Where("id IN ?", chunk).
+				Updates(map[string]interface{}{"release": result.Release, "version": nextVersion}).Error; err != nil {
+				return err
+			}
+		}
+		for start := 0; start < len(retiredIDs); start += defaultImportBatchSize {
+			chunk := retiredIDs[start:min(start+defaultImportBatchSize, len(retiredIDs))]
+			if err := tx.Model(&repository.ICDCie{}).Where("id IN ?", chunk).
+				Updates(map[string]interface{}{"retired": true, "valid_to": effective, "version": nextVersion}).Error; err != nil {
+				return err
+			}
+		}
+		if err := repository.RecordICDVersions(tx, append(versioned, retiredRecords...), effective); err != nil {
+			return err
+		}
+
+		for _, data := range icdImportEvents(result) {
+			n, err := queueWebhookEvent(tx, repository.WebhookEventICDImported, data)
+			if err != nil {
+				return err
+			}
+			queued += n
+		}
+
+		return tx.Create(&repository.ICDRelease{
+			CieVersion:    opts.CieVersion,
+			Release:       result.Release,
+			Format:        opts.Format,
+			FileName:      opts.FileName,
+			Checksum:      checksum,
+			EffectiveFrom: effective,
+			Added:         result.Added,
+			Changed:       result.Changed,
+			Retired:       result.Retired,
+			Unchanged:     result.Unchanged,
+			ImportedBy:    opts.ImportedBy,
+		}).Error
+	})
+	if err != nil {
+		h.Logger.Error("Error importing ICD release", zap.String("release", result.Release), zap.Error(err))
+		return result, repository.NewAppError(err, repository.RepositoryError)
+	}
+	h.wakeWebhooks(queued)
+	return result, nil
+}
+
+// icdImportEvents splits the codes a release added, changed and retired into the data of icd.imported
+// events of up to defaultImportBatchSize codes each; a release that changed nothing still makes one
+func icdImportEvents(result ICDImportResult) []gin.H {
+	var events []gin.H
+	lists := [3][]string{result.AddedCodes, result.ChangedCodes, result.RetiredCodes}
+	event, size := [3][]string{{}, {}, {}}, 0
+	flush := func() {
+		events = append(events, gin.H{"cieVersion": result.CieVersion, "release": result.Release,
+			"added": event[0], "changed": event[1], "retired": event[2]})
+		event, size = [3][]string{{}, {}, {}}, 0
+	}
+	for i, codes := range lists {
+		for _, code := range codes {
+			event[i] = append(event[i], code)
+			if size++; size == defaultImportBatchSize {
+				flush()
+			}
+		}
+	}
+	if size > 0 || len(events) == 0 {
+		flush()
+	}
+	return events
+}
+
+func (h *Handler) ImportICDReleaseFile(c *gin.Context) {
+	if !h.requirePlatformAdmin(c, "import ICD releases") {
+		return
+	}
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A ClaML or tab-delimited release file is required in the \"file\" field"})
+		return
+	}
+	format, err := icd.FormatFromFilename(fileHeader.Filename, c.Query("format"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dry_run, must be a boolean"})
+		return
+	}
+	var effectiveFrom time.Time
+	if value := c.Query("effective_date"); value != "" {
+		if effectiveFrom, err = parseInstant(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid effective_date, must be RFC3339 or YYYY-MM-DD"})
+			return
+		}
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read uploaded file"})
+		return
+	}
+	defer file.Close()
+
+	result, err := h.ImportICDRelease(file, ICDImportOptions{
+		CieVersion:    repository.CieVersionType(c.Query("cie_version")),
+		Release:       c.Query("release"),
+		Format:        format,
+		FileName:      fileHeader.Filename,
+		EffectiveFrom: effectiveFrom,
+		DryRun:        dryRun,
+		ImportedBy:    c.GetInt("user_id"),
+	})
+	if err != nil {
+		var appErr *repository.AppError
+		if errors.As(err, &appErr) && appErr.Type == repository.ValidationError {
+			c.JSON(http.StatusBadRequest, gin.H{"error": appErr.Error()})
+		} else if errors.As(err, &appErr) && appErr.Type == repository.ResourceAlreadyExists {
+			c.JSON(http.StatusConflict, gin.H{"error": appErr.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not import ICD release"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func (h *Handler) GetICDReleases(c *gin.Context) {
+	query := h.db(c).Order("imported_at DESC")
+	if version := c.Query("cie_version"); version != "" {
+		query = query.Where("cie_version = ?", version)
+	}
+	var releases []repository.ICDRelease
+	if err := query.Find(&releases).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve ICD releases"})
+		return
+	}
+	c.JSON(http.StatusOK, releases)
+}
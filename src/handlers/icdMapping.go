@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"ia-boilerplate/src/icd"
+	"ia-boilerplate/src/repository"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// maxICDTranslateCodes bounds the codes translated by a single request
+const maxICDTranslateCodes = 500
+
+// Status of the translation of a code to the other CieVersion
+const (
+	ICDMapped    = "mapped"
+	ICDOneToMany = "one_to_many"
+	ICDNoMap     = "no_map"
+	ICDUnmapped  = "not_in_mapping"
+)
+
+type ICDMappingTarget struct {
+	Code string `json:"code"`
+	// ID and Description are set when the target code is loaded in the catalog
+	ID          *int   `json:"id"`
+	Description string `json:"description"`
+}
+
+type ICDTranslation struct {
+	Code          string                    `json:"code"`
+	SourceVersion repository.CieVersionType `json:"sourceVersion"`
+	TargetVersion repository.CieVersionType `json:"targetVersion"`
+	Status        string                    `json:"status"`
+	Targets       []ICDMappingTarget        `json:"targets"`
+}
+
+type ICDMappingImportOptions struct {
+	Release string
+	DryRun  bool
+}
+
+type ICDMappingImportResult struct {
+	DryRun        bool                      `json:"dry_run"`
+	SourceVersion repository.CieVersionType `json:"source_version"`
+	TargetVersion repository.CieVersionType `json:"target_version"`
+	Release       string                    `json:"release"`
+	SourceCodes   int                       `json:"source_codes"`
+	Mapped        int                       `json:"mapped"`
+	OneToMany     int                       `json:"one_to_many"`
+	NoMap         int                       `json:"no_map"`
+	Changed       int                       `json:"changed"`
+	Unchanged     int                       `json:"unchanged"`
+	Errors        []icd.EntryError          `json:"errors"`
+}
+
+// otherCieVersion returns the version codes of version are translated to by default
+func otherCieVersion(version repository.CieVersionType) repository.CieVersionType {
+	if version == repository.CIE10 {
+		return repository.CIE11
+	}
+	return repository.CIE10
+}
+
+// ImportICDMappings loads a WHO transition table. The targets of every source code in the file replace
+// the ones stored for it, so loading the same table again changes nothing and codes the table leaves out
+// keep their mappings. Nothing is written when DryRun is set.
+func (h *Handler) ImportICDMappings(db *gorm.DB, r io.Reader, opts ICDMappingImportOptions) (ICDMappingImportResult, error) {
+	result := ICDMappingImportResult{DryRun: opts.DryRun, Release: strings.TrimSpace(opts.Release), Errors: []icd.EntryError{}}
+	file, err := icd.ParseMapping(r)
+	if err != nil {
+		return result, repository.NewAppError(fmt.Errorf("could not parse mapping file: %w", err), repository.ValidationError)
+	}
+	result.SourceVersion, result.TargetVersion = file.SourceVersion, file.TargetVersion
+	result.Errors = append(result.Errors, file.Errors...)
+
+	// targets of each source code, in file order; a code listed both with and without a target is mapped
+	var codes []string
+	targets := make(map[string][]string)
+	for _, mapping := range file.Mappings {
+		current, seen := targets[mapping.SourceCode]
+		if !seen {
+			codes = append(codes, mapping.SourceCode)
+		}
+		if mapping.TargetCode != "" && !slices.Contains(current, mapping.TargetCode) {
+			current = append(current, mapping.TargetCode)
+		}
+		targets[mapping.SourceCode] = current
+	}
+	result.SourceCodes = len(codes)
+	if len(codes) == 0 {
+		return result, repository.NewAppError(errors.New("the mapping file has no valid rows"), repository.ValidationError)
+	}
+
+	stored := make(map[string][]string, len(codes))
+	for start := 0; start < len(codes); start += defaultImportBatchSize {
+		chunk := codes[start:min(start+defaultImportBatchSize, len(codes))]
+		var rows []repository.ICDMapping
+		if err := db.Where("source_version = ? AND target_version = ? AND source_code IN ?", file.SourceVersion, file.TargetVersion, chunk).
+			Find(&rows).Error; err != nil {
+			return result, err
+		}
+		for _, row := range rows {
+			stored[row.SourceCode] = append(stored[row.SourceCode], row.TargetCode)
+		}
+	}
+
+	var changedCodes []string
+	for _, code := range codes {
+		switch len(targets[code]) {
+		case 0:
+			result.NoMap++
+		case 1:
+			result.Mapped++
+		default:
+			result.OneToMany++
+		}
+		want := targets[code]
+		if len(want) == 0 {
+			want = []string{""}
+		}
+		have := slices.Clone(stored[code])
+		slices.Sort(have)
+		sortedWant := slices.Clone(want)
+		slices.Sort(sortedWant)
+		if slices.Equal(have, sortedWant) {
+			result.Unchanged++
+		} else {
+			changedCodes = append(changedCodes, code)
+		}
+	}
+	result.Changed = len(changedCodes)
+	if opts.DryRun || len(changedCodes) == 0 {
+		return result, nil
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for start := 0; start < len(changedCodes); start += defaultImportBatchSize {
+			chunk := changedCodes[start:min(start+defaultImportBatchSize, len(changedCodes))]
+			if err := tx.Where("source_version = ? AND target_version = ? AND source_code IN ?", file.SourceVersion, file.TargetVersion, chunk).
+				Delete(&repository.ICDMapping{}).Error; err != nil {
+				return err
+			}
+			var rows []repository.ICDMapping
+			for _, code := range chunk {
+				want := targets[code]
+				if len(want) == 0 {
+					want = []string{""}
+				}
+				for _, target := range want {
+					rows = append(rows, repository.ICDMapping{
+						SourceVersion: file.SourceVersion,
+						SourceCode:    code,
+						TargetVersion: file.TargetVersion,
+						TargetCode:    target,
+						Release:       result.Release,
+					})
+				}
+			}
+			if err := tx.CreateInBatches(&rows, defaultImportBatchSize).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		h.Logger.Error("Error importing ICD mappings", zap.Error(err))
+		return result, repository.NewAppError(err, repository.RepositoryError)
+	}
+	return result, nil
+}
+
+// translateICDCodes returns the translation of each code from one version to the other, in the order the
+// codes were given, with the targets that are loaded in the catalog resolved to their records
+func translateICDCodes(db *gorm.DB, from, to repository.CieVersionType, codes []string) ([]ICDTranslation, error) {
+	translations := make([]ICDTranslation, len(codes))
+	if len(codes) == 0 {
+		return translations, nil
+	}
+	var rows []repository.ICDMapping
+	if err := db.Where("source_version = ? AND target_version = ? AND source_code IN ?", from, to, codes).
+		Order("id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	bySource := make(map[string][]string)
+	var targetCodes []string
+	for _, row := range rows {
+		bySource[row.SourceCode] = append(bySource[row.SourceCode], row.TargetCode)
+		if row.TargetCode != "" {
+			targetCodes = append(targetCodes, row.TargetCode)
+		}
+	}
+	records := make(map[string]repository.ICDCie)
+	if len(targetCodes) > 0 {
+		var found []repository.ICDCie
+		if err := db.Where("cie_version = ? AND code IN ?", to, targetCodes).Find(&found).Error; err != nil {
+			return nil, err
+		}
+		for _, record := range found {
+			records[record.Code] = record
+		}
+	}
+
+	for i, code := range codes {
+		translation := ICDTranslation{Code: code, SourceVersion: from, TargetVersion: to, Targets: []ICDMappingTarget{}}
+		mapped, ok := bySource[code]
+		for _, target := range mapped {
+			if target == "" {
+				continue
+			}
+			entry := ICDMappingTarget{Code: target}
+			if record, loaded := records[target]; loaded {
+				entry.ID = &record.ID
+				entry.Description = record.Description
+			}
+			translation.Targets = append(translation.Targets, entry)
+		}
+		switch {
+		case !ok:
+			translation.Status = ICDUnmapped
+		case len(translation.Targets) == 0:
+			translation.Status = ICDNoMap
+		case len(translation.Targets) == 1:
+			translation.Status = ICDMapped
+		default:
+			translation.Status = ICDOneToMany
+		}
+		translations[i] = translation
+	}
+	return translations, nil
+}
+
+// TranslateICDCodes translates the codes given as repeated code parameters or a comma separated codes
+// parameter. to defaults to the other version.
+func (h *Handler) TranslateICDCodes(c *gin.Context) {
+	from := repository.CieVersionType(c.Query("from"))
+	if !from.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from, must be one of: " + strings.Join(repository.ValidCieVersions, ", ")})
+		return
+	}
+	to := otherCieVersion(from)
+	if value := c.Query("to"); value != "" {
+		to = repository.CieVersionType(value)
+		if !to.IsValid() || to == from {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to, must be the other CIE version"})
+			return
+		}
+	}
+
+	var codes []string
+	seen := make(map[string]bool)
+	values := append(c.QueryArray("code"), strings.Split(c.Query("codes"), ",")...)
+	for _, value := range values {
+		code := icd.NormalizeCode(from, value)
+		if code != "" && !seen[code] {
+			seen[code] = true
+			codes = append(codes, code)
+		}
+	}
+	if len(codes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one code is required"})
+		return
+	}
+	if len(codes) > maxICDTranslateCodes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d codes can be translated at once", maxICDTranslateCodes)})
+		return
+	}
+
+	translations, err := translateICDCodes(h.db(c), from, to, codes)
+	if err != nil {
+		h.Logger.Error("Error translating ICD codes", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not translate ICD codes"})
+		return
+	}
+	c.JSON(http.StatusOK, translations)
+}
+
+func (h *Handler) ImportICDMappingFile(c *gin.Context) {
+	if !h.requirePlatformAdmin(c, "import ICD mappings") {
+		return
+	}
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A tab-delimited transition table is required in the \"file\" field"})
+		return
+	}
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dry_run, must be a boolean"})
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read uploaded file"})
+		return
+	}
+	defer file.Close()
+
+	result, err := h.ImportICDMappings(h.db(c), file, ICDMappingImportOptions{Release: c.Query("release"), DryRun: dryRun})
+	if err != nil {
+		var appErr *repository.AppError
+		if errors.As(err, &appErr) && appErr.Type == repository.ValidationError {
+			c.JSON(http.StatusBadRequest, gin.H{"error": appErr.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not import ICD mappings"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
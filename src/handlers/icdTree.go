@@ -0,0 +1,371 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"ia-boilerplate/src/repository"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxICDDepth bounds the recursive hierarchy queries; real classifications are at most seven levels deep
+const maxICDDepth = 12
+
+// respondICDError writes the status that matches an error returned by the ICD hierarchy helpers
+func respondICDError(c *gin.Context, err error, fallback string) {
+	var appErr *repository.AppError
+	if errors.As(err, &appErr) {
+		switch appErr.Type {
+		case repository.NotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": appErr.Error()})
+			return
+		case repository.ValidationError:
+			c.JSON(http.StatusBadRequest, gin.H{"error": appErr.Error()})
+			return
+		case repository.ResourceAlreadyExists:
+			c.JSON(http.StatusConflict, gin.H{"error": appErr.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+}
+
+// icdParentCandidate guesses the parent of a record from its code among the codes in effect: the enclosing
+// subcategory or category for subcategories, the narrowest enclosing block for categories and blocks, and
+// otherwise the chapter named by ChapterNo
+func icdParentCandidate(db *gorm.DB, record repository.ICDCie) (*repository.ICDCie, error) {
+	if record.Kind == repository.ICDKindChapter {
+		return nil, nil
+	}
+	if record.Kind == repository.ICDKindSubcategory {
+		category, suffix, _ := strings.Cut(record.Code, ".")
+		codes := []string{category}
+		for i := len(suffix) - 1; i > 0; i-- {
+			codes = append([]string{category + "." + suffix[:i]}, codes...)
+		}
+		for _, code := range codes {
+			var parent repository.ICDCie
+			err := db.Where("cie_version = ? AND code = ? AND id <> ? AND retired = ?", record.CieVersion, code, record.ID, false).First(&parent).Error
+			if err == nil {
+				return &parent, nil
+			} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+
+	var blocks []repository.ICDCie
+	if err := db.Where("cie_version = ? AND kind = ? AND id <> ? AND retired = ?", record.CieVersion, repository.ICDKindBlock, record.ID, false).
+		Find(&blocks).Error; err != nil {
+		return nil, err
+	}
+	var narrowest *repository.ICDCie
+	for i, block := range blocks {
+		if !repository.ICDBlockContains(block.Code, record.Code) {
+			continue
+		}
+		if narrowest == nil || repository.ICDBlockContains(narrowest.Code, block.Code) {
+			narrowest = &blocks[i]
+		}
+	}
+	if narrowest != nil || record.ChapterNo == "" {
+		return narrowest, nil
+	}
+
+	var chapter repository.ICDCie
+	err := db.Where("cie_version = ? AND code = ? AND kind = ? AND retired = ?", record.CieVersion, record.ChapterNo, repository.ICDKindChapter, false).
+		First(&chapter).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &chapter, err
+}
+
+// placeICDNode sets the parent of a record, either the one given or the one its code implies, and fills
+// in the chapter fields from it. The parent must belong to the same version and be able to contain the
+// record's kind.
+func placeICDNode(db *gorm.DB, record *repository.ICDCie, parentID *int) error {
+	var parent *repository.ICDCie
+	if parentID != nil {
+		var explicit repository.ICDCie
+		if err := db.First(&explicit, *parentID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return repository.NewAppError(errors.New("parent ICDCie record not found"), repository.NotFound)
+			}
+			return err
+		}
+		if explicit.CieVersion != record.CieVersion {
+			return repository.NewAppError(fmt.Errorf("parent %s belongs to %s, not %s", explicit.Code, explicit.CieVersion, record.CieVersion), repository.ValidationError)
+		}
+		if explicit.Retired {
+			return repository.NewAppError(fmt.Errorf("parent %s is retired", explicit.Code), repository.ValidationError)
+		}
+		parent = &explicit
+	} else {
+		candidate, err := icdParentCandidate(db, *record)
+		if err != nil {
+			return err
+		}
+		parent = candidate
+	}
+
+	if parent != nil && record.ID != 0 {
+		ancestors, err := icdAncestors(db, icdView{retired: "any"}, parent.ID)
+		if err != nil {
+			return err
+		}
+		for _, ancestor := range append(ancestors, *parent) {
+			if ancestor.ID == record.ID {
+				return repository.NewAppError(errors.New("a code cannot be placed under itself or its descendants"), repository.ValidationError)
+			}
+		}
+	}
+	if parent == nil {
+		record.ParentID = nil
+	} else {
+		if !repository.CanContainICDNode(parent.Kind, record.Kind) {
+			return repository.NewAppError(fmt.Errorf("a %s cannot contain a %s", parent.Kind, record.Kind), repository.ValidationError)
+		}
+		record.ParentID = &parent.ID
+		if record.ChapterNo == "" {
+			record.ChapterNo = parent.ChapterNo
+		}
+		if record.ChapterTitle == "" {
+			record.ChapterTitle = parent.ChapterTitle
+		}
+	}
+	if record.Kind == repository.ICDKindChapter {
+		if record.ChapterNo == "" {
+			record.ChapterNo = record.Code
+		}
+		if record.ChapterTitle == "" {
+			record.ChapterTitle = record.Description
+		}
+	}
+	return nil
+}
+
+// icdAncestors returns the ancestors of a record in a view, from its chapter down to its parent
+func icdAncestors(db *gorm.DB, view icdView, id int) ([]repository.ICDCie, error) {
+	var ancestors []repository.ICDCie
+	err := db.Raw(`WITH RECURSIVE nodes AS (SELECT * FROM (?) AS n), chain AS (
+			SELECT id, parent_id, 0 AS depth FROM nodes WHERE id = ?
+			UNION ALL
+			SELECT p.id, p.parent_id, chain.depth + 1 FROM nodes p JOIN chain ON p.id = chain.parent_id
+			WHERE chain.depth < ?
+		)
+		SELECT nodes.* FROM nodes JOIN chain ON chain.id = nodes.id
+		WHERE chain.depth > 0 ORDER BY chain.depth DESC`, view.source(db), id, maxICDDepth).
+		Scan(&ancestors).Error
+	return ancestors, err
+}
+
+type ICDNode struct {
+	repository.ICDCie
+	Depth      int   `json:"depth,omitempty"`
+	ChildCount int64 `json:"childCount"`
+}
+
+// withChildCounts wraps records as tree nodes with the number of direct children of each in the view
+func withChildCounts(db *gorm.DB, view icdView, records []repository.ICDCie) ([]ICDNode, error) {
+	nodes := make([]ICDNode, len(records))
+	if len(records) == 0 {
+		return nodes, nil
+	}
+	ids := make([]int, len(records))
+	for i, r := range records {
+		ids[i] = r.ID
+	}
+	var counts []struct {
+		ParentID int
+		Count    int64
+	}
+	if err := view.query(db).
+		Select("parent_id, COUNT(*) AS count").
+		Where("parent_id IN ?", ids).
+		Group("parent_id").
+		Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	byParent := make(map[int]int64, len(counts))
+	for _, row := range counts {
+		byParent[row.ParentID] = row.Count
+	}
+	for i, r := range records {
+		nodes[i] = ICDNode{ICDCie: r, ChildCount: byParent[r.ID]}
+	}
+	return nodes, nil
+}
+
+// findICDCie looks up the record of the id parameter in a view, retired or not
+func (h *Handler) findICDCie(c *gin.Context, view icdView) (repository.ICDCie, bool) {
+	var record repository.ICDCie
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return record, false
+	}
+	if err := view.anyRetired().query(h.db(c)).Where("id = ?", id).First(&record).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "ICDCie record not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return record, false
+	}
+	return record, true
+}
+
+// GetICDTree browses the classification one level at a time: the chapters of a version, or the direct
+// children of the node given by parent_id or parent_code
+func (h *Handler) GetICDTree(c *gin.Context) {
+	version := repository.CieVersionType(c.Query("cie_version"))
+	if !version.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cie_version, must be one of: " + strings.Join(repository.ValidCieVersions, ", ")})
+		return
+	}
+	view, err := parseICDView(c)
+	if err != nil {
+		respondICDError(c, err, "Could not retrieve ICDCie records")
+		return
+	}
+
+	db := h.db(c)
+	query := view.query(db).Where("cie_version = ?", version).Order("code")
+	var parent *repository.ICDCie
+	if c.Query("parent_id") != "" || c.Query("parent_code") != "" {
+		var node repository.ICDCie
+		lookup := view.anyRetired().query(db).Where("cie_version = ?", version)
+		if parentID := c.Query("parent_id"); parentID != "" {
+			id, err := strconv.Atoi(parentID)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parent_id"})
+				return
+			}
+			lookup = lookup.Where("id = ?", id)
+		} else {
+			lookup = lookup.Where("code = ?", repository.NormalizeICDCode(c.Query("parent_code")))
+		}
+		if err := lookup.First(&node).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "ICDCie record not found"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			}
+			return
+		}
+		parent = &node
+		query = query.Where("parent_id = ?", node.ID)
+	} else {
+		query = query.Where("parent_id IS NULL AND kind = ?", repository.ICDKindChapter)
+	}
+
+	var records []repository.ICDCie
+	if err := query.Find(&records).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve ICDCie records"})
+		return
+	}
+	nodes, err := withChildCounts(db, view, records)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve ICDCie records"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"parent": parent, "children": nodes})
+}
+
+func (h *Handler) GetICDChildren(c *gin.Context) {
+	view, err := parseICDView(c)
+	if err != nil {
+		respondICDError(c, err, "Could not retrieve ICDCie records")
+		return
+	}
+	record, ok := h.findICDCie(c, view)
+	if !ok {
+		return
+	}
+	var children []repository.ICDCie
+	if err := view.query(h.db(c)).Where("parent_id = ?", record.ID).Order("code").Find(&children).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve ICDCie records"})
+		return
+	}
+	nodes, err := withChildCounts(h.db(c), view, children)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve ICDCie records"})
+		return
+	}
+	c.JSON(http.StatusOK, nodes)
+}
+
+func (h *Handler) GetICDAncestors(c *gin.Context) {
+	view, err := parseICDView(c)
+	if err != nil {
+		respondICDError(c, err, "Could not retrieve ICDCie records")
+		return
+	}
+	record, ok := h.findICDCie(c, view)
+	if !ok {
+		return
+	}
+	// the chain to the chapter is followed whether or not the ancestors are retired
+	ancestors, err := icdAncestors(h.db(c), view.anyRetired(), record.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve ICDCie records"})
+		return
+	}
+	c.JSON(http.StatusOK, ancestors)
+}
+
+// GetICDDescendants returns every node below a record, ordered by code, with its depth relative to
+// the record; max_depth limits how many levels are returned
+func (h *Handler) GetICDDescendants(c *gin.Context) {
+	view, err := parseICDView(c)
+	if err != nil {
+		respondICDError(c, err, "Could not retrieve ICDCie records")
+		return
+	}
+	record, ok := h.findICDCie(c, view)
+	if !ok {
+		return
+	}
+	maxDepth, err := strconv.Atoi(c.DefaultQuery("max_depth", strconv.Itoa(maxICDDepth)))
+	if err != nil || maxDepth < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid max_depth, must be a positive integer"})
+		return
+	}
+	maxDepth = min(maxDepth, maxICDDepth)
+
+	var rows []struct {
+		repository.ICDCie
+		Depth int
+	}
+	if err := h.db(c).Raw(`WITH RECURSIVE nodes AS (SELECT * FROM (?) AS n), tree AS (
+			SELECT id, 1 AS depth FROM nodes WHERE parent_id = ?
+			UNION ALL
+			SELECT c.id, tree.depth + 1 FROM nodes c JOIN tree ON c.parent_id = tree.id
+			WHERE tree.depth < ?
+		)
+		SELECT nodes.*, tree.depth FROM nodes JOIN tree ON tree.id = nodes.id
+		ORDER BY nodes.code`, view.source(h.db(c)), record.ID, maxDepth).
+		Scan(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve ICDCie records"})
+		return
+	}
+	records := make([]repository.ICDCie, len(rows))
+	for i, row := range rows {
+		records[i] = row.ICDCie
+	}
+	nodes, err := withChildCounts(h.db(c), view, records)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve ICDCie records"})
+		return
+	}
+	for i, row := range rows {
+		nodes[i].Depth = row.Depth
+	}
+	c.JSON(http.StatusOK, nodes)
+}
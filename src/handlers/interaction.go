@@ -0,0 +1,383 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"ia-boilerplate/src/repository"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var interactionImportColumns = []string{"ingredienta", "ingredientb", "severity", "description", "source"}
+
+var interactionImportRequiredColumns = []string{"ingredienta", "ingredientb", "severity"}
+
+type InteractionImportRowError struct {
+	Row    int      `json:"row"`
+	Errors []string `json:"errors"`
+}
+
+type InteractionImportResult struct {
+	DryRun             bool                        `json:"dry_run"`
+	TotalRows          int                         `json:"total_rows"`
+	ValidRows          int                         `json:"valid_rows"`
+	InvalidRows        int                         `json:"invalid_rows"`
+	Created            int                         `json:"created"`
+	Updated            int                         `json:"updated"`
+	CreatedIngredients []string                    `json:"created_ingredients"`
+	IgnoredColumns     []string                    `json:"ignored_columns"`
+	Errors             []InteractionImportRowError `json:"errors"`
+}
+
+// ImportInteractionRows loads an interaction dataset (header first) with the columns ingredient_a,
+// ingredient_b, severity, description and source. Ingredients are matched by name or synonym and
+// created when unknown; existing pairs are updated. Nothing is written when dryRun is set.
+func (h *Handler) ImportInteractionRows(db *gorm.DB, rows [][]string, dryRun bool) (InteractionImportResult, error) {
+	result := InteractionImportResult{DryRun: dryRun, CreatedIngredients: []string{}, IgnoredColumns: []string{}, Errors: []InteractionImportRowError{}}
+	if len(rows) == 0 {
+		return result, repository.NewAppError(errors.New("file is empty"), repository.ValidationError)
+	}
+
+	known := make(map[string]bool, len(interactionImportColumns))
+	for _, name := range interactionImportColumns {
+		known[name] = true
+	}
+	columns := make(map[string]int)
+	for i, header := range rows[0] {
+		name := normalizeImportHeader(header)
+		if _, dup := columns[name]; known[name] && !dup {
+			columns[name] = i
+		} else if strings.TrimSpace(header) != "" {
+			result.IgnoredColumns = append(result.IgnoredColumns, header)
+		}
+	}
+	for _, name := range interactionImportRequiredColumns {
+		if _, ok := columns[name]; !ok {
+			return result, repository.NewAppError(fmt.Errorf("missing required column %q", name), repository.ValidationError)
+		}
+	}
+	cell := func(row []string, name string) string {
+		idx, ok := columns[name]
+		if !ok || idx >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[idx])
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// ingredients resolved so far by normalized name; new ones get negative ids during a dry run
+		resolved := make(map[string]int)
+		nextDryRunID := -1
+		lookup := func(name string) (int, bool, error) {
+			key := repository.NormalizeIngredientName(name)
+			if id, ok := resolved[key]; ok {
+				return id, true, nil
+			}
+			ingredient, err := findIngredientByName(tx, name)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return 0, false, nil
+			} else if err != nil {
+				return 0, false, err
+			}
+			resolved[key] = ingredient.ID
+			return ingredient.ID, true, nil
+		}
+		create := func(name string) (int, error) {
+			key := repository.NormalizeIngredientName(name)
+			result.CreatedIngredients = append(result.CreatedIngredients, name)
+			if dryRun {
+				resolved[key] = nextDryRunID
+				nextDryRunID--
+				return resolved[key], nil
+			}
+			ingredient := repository.ActiveIngredient{Name: name, NormalizedName: key}
+			if err := tx.Create(&ingredient).Error; err != nil {
+				return 0, err
+			}
+			resolved[key] = ingredient.ID
+			return ingredient.ID, nil
+		}
+
+		seenPairs := make(map[[2]int]int)
+		for i, row := range rows[1:] {
+			rowNumber := i + 2
+			if isBlankImportRow(row) {
+				continue
+			}
+			result.TotalRows++
+
+			var rowErrs []string
+			nameA, nameB := cell(row, "ingredienta"), cell(row, "ingredientb")
+			if repository.NormalizeIngredientName(nameA) == "" {
+				rowErrs = append(rowErrs, "ingredient_a is required")
+			}
+			if repository.NormalizeIngredientName(nameB) == "" {
+				rowErrs = append(rowErrs, "ingredient_b is required")
+			}
+			severity := repository.InteractionSeverity(strings.ToLower(cell(row, "severity")))
+			if !severity.IsValid() {
+				rowErrs = append(rowErrs, "severity must be one of: "+strings.Join(repository.ValidInteractionSeverities, ", "))
+			}
+			if len(rowErrs) > 0 {
+				result.Errors = append(result.Errors, InteractionImportRowError{Row: rowNumber, Errors: rowErrs})
+				continue
+			}
+
+			idA, foundA, err := lookup(nameA)
+			if err != nil {
+				return err
+			}
+			idB, foundB, err := lookup(nameB)
+			if err != nil {
+				return err
+			}
+			if repository.NormalizeIngredientName(nameA) == repository.NormalizeIngredientName(nameB) || (foundA && foundB && idA == idB) {
+				result.Errors = append(result.Errors, InteractionImportRowError{Row: rowNumber, Errors: []string{"ingredient_a and ingredient_b are the same active ingredient"}})
+				continue
+			}
+			if !foundA {
+				if idA, err = create(nameA); err != nil {
+					return err
+				}
+			}
+			if !foundB {
+				if idB, err = create(nameB); err != nil {
+					return err
+				}
+			}
+			idA, idB = repository.OrderedIngredientPair(idA, idB)
+			if firstRow, ok := seenPairs[[2]int{idA, idB}]; ok {
+				result.Errors = append(result.Errors, InteractionImportRowError{Row: rowNumber, Errors: []string{fmt.Sprintf("interaction duplicated in file, first seen on row %d", firstRow)}})
+				continue
+			}
+			seenPairs[[2]int{idA, idB}] = rowNumber
+			result.ValidRows++
+
+			var existing int64
+			if idA > 0 {
+				if err := tx.Model(&repository.DrugInteraction{}).
+					Where("ingredient_a_id = ? AND ingredient_b_id = ?", idA, idB).
+					Count(&existing).Error; err != nil {
+					return err
+				}
+			}
+			if existing > 0 {
+				result.Updated++
+			} else {
+				result.Created++
+			}
+			if dryRun {
+				continue
+			}
+
+			interaction := repository.DrugInteraction{
+				IngredientAID: idA,
+				IngredientBID: idB,
+				Severity:      severity,
+				Description:   cell(row, "description"),
+				Source:        cell(row, "source"),
+			}
+			if err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "ingredient_a_id"}, {Name: "ingredient_b_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"severity", "description", "source", "updated_at"}),
+			}).Create(&interaction).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	result.InvalidRows = len(result.Errors)
+	if err != nil {
+		h.Logger.Error("Error importing drug interactions", zap.Error(err))
+		return result, repository.NewAppError(err, repository.RepositoryError)
+	}
+	return result, nil
+}
+
+func (h *Handler) ImportInteractions(c *gin.Context) {
+	if !h.requirePlatformAdmin(c, "import interactions") {
+		return
+	}
+	rows, ok := readUploadedImportRows(c)
+	if !ok {
+		return
+	}
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dry_run, must be a boolean"})
+		return
+	}
+
+	result, err := h.ImportInteractionRows(h.db(c), rows, dryRun)
+	if err != nil {
+		var appErr *repository.AppError
+		if errors.As(err, &appErr) && appErr.Type == repository.ValidationError {
+			c.JSON(http.StatusBadRequest, gin.H{"error": appErr.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not import interactions"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+type InteractionCheckRequest struct {
+	MedicineIDs []int `json:"medicineIds" binding:"required,min=1"`
+}
+
+type interactionMedicine struct {
+	ID          int    `json:"id"`
+	Description string `json:"description"`
+}
+
+type InteractionFinding struct {
+	MedicineA   interactionMedicine            `json:"medicineA"`
+	MedicineB   interactionMedicine            `json:"medicineB"`
+	IngredientA string                         `json:"ingredientA"`
+	IngredientB string                         `json:"ingredientB"`
+	Severity    repository.InteractionSeverity `json:"severity"`
+	Description string                         `json:"description"`
+	Source      string                         `json:"source"`
+}
+
+type DuplicateIngredient struct {
+	Ingredient  string `json:"ingredient"`
+	MedicineIDs []int  `json:"medicineIds"`
+}
+
+type InteractionCheckResult struct {
+	Interactions          []InteractionFinding  `json:"interactions"`
+	DuplicateIngredients  []DuplicateIngredient `json:"duplicateIngredients"`
+	UnresolvedMedicineIDs []int                 `json:"unresolvedMedicineIds"`
+	CheckedAt             time.Time             `json:"checkedAt"`
+}
+
+// CheckInteractions returns the known interactions between the active ingredients of the given medicines,
+// most severe first. Medicines without normalized ingredients cannot be checked and are reported apart.
+func (h *Handler) CheckInteractions(c *gin.Context) {
+	var req InteractionCheckRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var ids []int
+	seen := make(map[int]bool)
+	for _, id := range req.MedicineIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	var medicines []repository.Medicine
+	if err := h.db(c).Preload("Ingredients.ActiveIngredient").
+		Where("id IN ?", ids).
+		Order("id").Find(&medicines).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not check interactions"})
+		return
+	}
+	if len(medicines) != len(ids) {
+		found := make(map[int]bool, len(medicines))
+		for _, m := range medicines {
+			found[m.ID] = true
+		}
+		var missing []string
+		for _, id := range ids {
+			if !found[id] {
+				missing = append(missing, strconv.Itoa(id))
+			}
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Medicines not found: " + strings.Join(missing, ", ")})
+		return
+	}
+
+	result := InteractionCheckResult{
+		Interactions:          []InteractionFinding{},
+		DuplicateIngredients:  []DuplicateIngredient{},
+		UnresolvedMedicineIDs: []int{},
+		CheckedAt:             time.Now(),
+	}
+	// medicines containing each ingredient, in request order
+	holders := make(map[int][]int)
+	names := make(map[int]string)
+	var ingredientIDs []int
+	for i, m := range medicines {
+		if len(m.Ingredients) == 0 {
+			result.UnresolvedMedicineIDs = append(result.UnresolvedMedicineIDs, m.ID)
+			continue
+		}
+		for _, link := range m.Ingredients {
+			if _, ok := holders[link.ActiveIngredientID]; !ok {
+				ingredientIDs = append(ingredientIDs, link.ActiveIngredientID)
+			}
+			holders[link.ActiveIngredientID] = append(holders[link.ActiveIngredientID], i)
+			if link.ActiveIngredient != nil {
+				names[link.ActiveIngredientID] = link.ActiveIngredient.Name
+			}
+		}
+	}
+	for _, id := range ingredientIDs {
+		if len(holders[id]) > 1 {
+			dup := DuplicateIngredient{Ingredient: names[id]}
+			for _, idx := range holders[id] {
+				dup.MedicineIDs = append(dup.MedicineIDs, medicines[idx].ID)
+			}
+			result.DuplicateIngredients = append(result.DuplicateIngredients, dup)
+		}
+	}
+
+	if len(ingredientIDs) > 1 {
+		var interactions []repository.DrugInteraction
+		if err := h.db(c).
+			Where("ingredient_a_id IN ? AND ingredient_b_id IN ?", ingredientIDs, ingredientIDs).
+			Find(&interactions).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not check interactions"})
+			return
+		}
+		for _, interaction := range interactions {
+			for _, a := range holders[interaction.IngredientAID] {
+				for _, b := range holders[interaction.IngredientBID] {
+					if a == b {
+						continue
+					}
+					first, second := a, b
+					ingredientA, ingredientB := interaction.IngredientAID, interaction.IngredientBID
+					if first > second {
+						first, second = second, first
+						ingredientA, ingredientB = ingredientB, ingredientA
+					}
+					result.Interactions = append(result.Interactions, InteractionFinding{
+						MedicineA:   interactionMedicine{ID: medicines[first].ID, Description: medicines[first].Description},
+						MedicineB:   interactionMedicine{ID: medicines[second].ID, Description: medicines[second].Description},
+						IngredientA: names[ingredientA],
+						IngredientB: names[ingredientB],
+						Severity:    interaction.Severity,
+						Description: interaction.Description,
+						Source:      interaction.Source,
+					})
+				}
+			}
+		}
+	}
+	sort.SliceStable(result.Interactions, func(i, j int) bool {
+		a, b := result.Interactions[i], result.Interactions[j]
+		if a.Severity.Rank() != b.Severity.Rank() {
+			return a.Severity.Rank() > b.Severity.Rank()
+		}
+		if a.MedicineA.ID != b.MedicineA.ID {
+			return a.MedicineA.ID < b.MedicineA.ID
+		}
+		return a.MedicineB.ID < b.MedicineB.ID
+	})
+
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"ia-boilerplate/src/cfdi"
+	"ia-boilerplate/src/repository"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// satUnits maps medicine unit types to the SAT c_ClaveUnidad catalog and its unit name
+var satUnits = map[repository.UnitType][2]string{
+	repository.UnitTypeMilliliter: {"MLT", "Mililitro"},
+	repository.UnitTypeGram:       {"GRM", "Gramo"},
+	repository.UnitTypePiece:      {"H87", "Pieza"},
+	repository.UnitTypeTablet:     {"H87", "Pieza"},
+	repository.UnitTypeCapsule:    {"H87", "Pieza"},
+}
+
+type InvoiceReceiverRequest struct {
+	RFC       string `json:"rfc" binding:"required"`
+	Name      string `json:"name" binding:"required"`
+	ZipCode   string `json:"zipCode" binding:"required"`
+	TaxRegime string `json:"taxRegime" binding:"required"`
+	CFDIUse   string `json:"cfdiUse" binding:"required"`
+}
+
+type CreateInvoiceRequest struct {
+	PriceListID   int                    `json:"priceListId" binding:"required"`
+	Serie         string                 `json:"serie" binding:"max=25"`
+	Folio         string                 `json:"folio" binding:"max=40"`
+	PaymentForm   string                 `json:"paymentForm" binding:"required"`
+	PaymentMethod string                 `json:"paymentMethod" binding:"required"`
+	Receiver      InvoiceReceiverRequest `json:"receiver" binding:"required"`
+	Items         []QuoteItemRequest     `json:"items" binding:"required,min=1,dive"`
+}
+
+// invoicer returns the invoicing setup loaded at startup, answering 503 when invoicing is disabled
+func (h *Handler) invoicer(c *gin.Context) (*cfdi.Invoicer, bool) {
+	if h.Invoicer == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Invoicing is not configured"})
+		return nil, false
+	}
+	return h.Invoicer, true
+}
+
+// CreateInvoice prices the sale with the price list, builds and seals its CFDI 4.0 document,
+// stores it and sends it to the configured PAC to be stamped
+func (h *Handler) CreateInvoice(c *gin.Context) {
+	var req CreateInvoiceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	invoicer, ok := h.invoicer(c)
+	if !ok {
+		return
+	}
+
+	issuedAt := cfdi.Now()
+	quote, err := h.buildQuote(h.db(c), req.PriceListID, issuedAt, req.Items)
+	if err != nil {
+		var appErr *repository.AppError
+		if errors.As(err, &appErr) {
+			switch appErr.Type {
+			case repository.NotFound:
+				c.JSON(http.StatusNotFound, gin.H{"error": "Price list not found"})
+				return
+			case repository.ValidationError:
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Could not invoice sale: " + appErr.Error()})
+				return
+			}
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not invoice sale"})
+		return
+	}
+
+	sale := cfdi.Sale{
+		Serie:      req.Serie,
+		Folio:      req.Folio,
+		Fecha:      issuedAt,
+		FormaPago:  req.PaymentForm,
+		MetodoPago: strings.ToUpper(req.PaymentMethod),
+		Moneda:     quote.Currency,
+		Customer: cfdi.Customer{
+			Rfc:             strings.ToUpper(strings.TrimSpace(req.Receiver.RFC)),
+			Nombre:          strings.ToUpper(strings.TrimSpace(req.Receiver.Name)),
+			DomicilioFiscal: req.Receiver.ZipCode,
+			RegimenFiscal:   req.Receiver.TaxRegime,
+			UsoCFDI:         strings.ToUpper(req.Receiver.CFDIUse),
+		},
+	}
+	for _, line := range quote.Lines {
+		unit, ok := satUnits[repository.UnitType(line.UnitType)]
+		if !ok {
+			unit = satUnits[repository.UnitTypePiece]
+		}
+		sale.Items = append(sale.Items, cfdi.SaleItem{
+			ClaveProdServ:    line.SatKey,
+			NoIdentificacion: line.EANCode,
+			ClaveUnidad:      unit[0],
+			Unidad:           unit[1],
+			Descripcion:      line.Description,
+			Cantidad:         decimal.NewFromInt(int64(line.Quantity)),
+			ValorUnitario:    line.UnitPrice,
+			Importe:          line.Subtotal,
+			TasaIVA:          line.TaxRate,
+			Exento:           line.TaxExempt,
+			IVA:              line.Tax,
+		})
+	}
+
+	comprobante := cfdi.NewComprobante(invoicer.Config.Issuer, sale)
+	cadena, err := invoicer.Signer.Seal(comprobante)
+	if err != nil {
+		h.Logger.Error("Error sealing invoice", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not seal invoice"})
+		return
+	}
+	if err := cfdi.Validate(comprobante); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	document, err := comprobante.Marshal()
+	if err != nil {
+		h.Logger.Error("Error rendering invoice XML", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not render invoice"})
+		return
+	}
+	if err := cfdi.CheckStructure(document); err != nil {
+		var invalid *cfdi.ValidationError
+		if !errors.As(err, &invalid) {
+			h.Logger.Error("Error checking the structure of the invoice", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not validate invoice"})
+			return
+		}
+		h.Logger.Error("Invoice does not match the CFDI structure", zap.Error(err))
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	invoice := repository.Invoice{
+		Serie:          comprobante.Serie,
+		Folio:          comprobante.Folio,
+		IssuerRFC:      comprobante.Emisor.Rfc,
+		ReceiverRFC:    comprobante.Receptor.Rfc,
+		ReceiverName:   comprobante.Receptor.Nombre,
+		PriceListID:    quote.PriceListID,
+		Currency:       quote.Currency,
+		Subtotal:       quote.Subtotal,
+		Tax:            quote.Tax,
+		Total:          quote.Total,
+		NoCertificado:  comprobante.NoCertificado,
+		Status:         repository.InvoiceStatusSealed,
+		CadenaOriginal: cadena,
+		XML:            string(document),
+		CreatedBy:      c.GetInt("user_id"),
+	}
+	if err := h.db(c).Create(&invoice).Error; err != nil {
+		h.Logger.Error("Error storing invoice", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not store invoice"})
+		return
+	}
+
+	h.stampInvoice(c, &invoice, invoicer.PAC)
+	c.JSON(http.StatusCreated, invoice)
+}
+
+// stampInvoice sends a sealed invoice to the PAC and records the outcome. A PAC failure leaves the
+// invoice as failed so it can be stamped again later.
+func (h *Handler) stampInvoice(c *gin.Context, invoice *repository.Invoice, pac cfdi.PAC) {
+	updates := map[string]interface{}{"updated_at": time.Now()}
+	result, err := pac.Stamp(c.Request.Context(), []byte(invoice.XML))
+	if err != nil {
+		h.Logger.Error("Error stamping invoice", zap.Int("id", invoice.ID), zap.Error(err))
+		invoice.Status = repository.InvoiceStatusFailed
+		invoice.StampError = err.Error()
+	} else {
+		stampedAt := result.FechaTimbrado
+		invoice.UUID = &result.UUID
+		invoice.Status = repository.InvoiceStatusStamped
+		invoice.StampError = ""
+		invoice.StampedAt = &stampedAt
+		invoice.XML = string(result.XML)
+		updates["uuid"] = invoice.UUID
+		updates["stamped_at"] = invoice.StampedAt
+		updates["xml"] = invoice.XML
+	}
+	updates["status"] = invoice.Status
+	updates["stamp_error"] = invoice.StampError
+
+	if err := h.db(c).Model(&repository.Invoice{}).Where("id = ?", invoice.ID).Updates(updates).Error; err != nil {
+		h.Logger.Error("Error updating stamped invoice", zap.Int("id", invoice.ID), zap.Error(err))
+	}
+	invoice.UpdatedAt = updates["updated_at"].(time.Time)
+}
+
+func (h *Handler) findInvoice(c *gin.Context) (repository.Invoice, bool) {
+	var invoice repository.Invoice
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return invoice, false
+	}
+	if err := h.db(c).First(&invoice, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return invoice, false
+	}
+	return invoice, true
+}
+
+// StampInvoice retries stamping an invoice whose previous attempt failed
+func (h *Handler) StampInvoice(c *gin.Context) {
+	invoice, ok := h.findInvoice(c)
+	if !ok {
+		return
+	}
+	if invoice.Status == repository.InvoiceStatusStamped {
+		c.JSON(http.StatusConflict, gin.H{"error": "Invoice is already stamped"})
+		return
+	}
+	invoicer, ok := h.invoicer(c)
+	if !ok {
+		return
+	}
+	h.stampInvoice(c, &invoice, invoicer.PAC)
+	c.JSON(http.StatusOK, invoice)
+}
+
+func (h *Handler) GetInvoices(c *gin.Context) {
+	query := h.db(c).Model(&repository.Invoice{})
+	if rfc := c.Query("receiver_rfc"); rfc != "" {
+		query = query.Where("receiver_rfc = ?", strings.ToUpper(rfc))
+	}
+	if status := c.Query("status"); status != "" {
+		if !repository.InvoiceStatus(status).IsValid() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status, must be one of: " + strings.Join(repository.ValidInvoiceStatuses, ", ")})
+			return
+		}
+		query = query.Where("status = ?", status)
+	}
+
+	var invoices []repository.Invoice
+	if err := query.Order("id DESC").Find(&invoices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve invoices"})
+		return
+	}
+	c.JSON(http.StatusOK, invoices)
+}
+
+func (h *Handler) GetInvoice(c *gin.Context) {
+	invoice, ok := h.findInvoice(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, invoice)
+}
+
+// GetInvoiceXML downloads the CFDI document, stamped when the PAC already certified it
+func (h *Handler) GetInvoiceXML(c *gin.Context) {
+	invoice, ok := h.findInvoice(c)
+	if !ok {
+		return
+	}
+	name := strconv.Itoa(invoice.ID)
+	if invoice.UUID != nil {
+		name = *invoice.UUID
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.xml"`, name))
+	c.Data(http.StatusOK, "application/xml; charset=utf-8", []byte(invoice.XML))
+}
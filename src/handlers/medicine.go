@@ -18,8 +18,18 @@ func (h *Handler) GetMedicine(c *gin.Context) {
 		return
 	}
 
+	sel, err := medicineSearchFields.selection(c, h.db(c), "tax_rate", "ingredients")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	db, ok := h.readScope(c)
+	if !ok {
+		return
+	}
 	var m repository.Medicine
-	res := h.Repository.DB.Where("id = ? AND is_deleted = ?", id, false).First(&m)
+	res := sel.apply(c, db, "version").Where("id = ?", id).First(&m)
 	if res.Error != nil {
 		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Medicine not found"})
@@ -29,7 +39,7 @@ func (h *Handler) GetMedicine(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, m)
+	respondVersioned(c, m.Version, sel.render(m))
 }
 
 type createMedicineRequest struct {
@@ -44,49 +54,50 @@ type createMedicineRequest struct {
 	IsControlled       bool    `json:"isControlled"`
 	UnitQuantity       float64 `json:"unitQuantity"`
 	UnitType           string  `json:"unitType"`
+	// Ingredients links normalized active ingredients; when empty they are derived from ActiveIngredient
+	Ingredients []medicineIngredientRequest `json:"ingredients"`
+	// Global adds the medicine to the global catalog instead of the organization, for platform admins
+	Global bool `json:"global"`
 }
 
-func (h *Handler) CreateMedicine(c *gin.Context) {
-	var req createMedicineRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	var existing repository.Medicine
-	if err := h.Repository.DB.Where("ean_code = ? AND is_deleted = ?", req.EANCode, false).First(&existing).Error; err == nil {
-		c.JSON(http.StatusConflict, gin.H{"error": "Could not create medicine: duplicate code"})
-		return
-	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create medicine"})
-		return
+// toMedicine validates the request against the catalog rules and builds the entity to persist;
+// taxRates maps tax rate codes, as sent in the "iva" field, to their records
+func (req createMedicineRequest) toMedicine(taxRates map[string]repository.TaxRate) (repository.Medicine, error) {
+	eanCode, err := repository.NormalizeGTIN(req.EANCode)
+	if err != nil {
+		return repository.Medicine{}, errors.New("Invalid EAN code: " + err.Error())
 	}
 
 	medicineType := repository.MedicineType(req.Type)
 	if !medicineType.IsValid() {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid medicine type, must be one of: " + strings.Join(repository.ValidMedicineTypes, ", ")})
-		return
+		return repository.Medicine{}, errors.New("Invalid medicine type, must be one of: " + strings.Join(repository.ValidMedicineTypes, ", "))
 	}
 
 	temperatureControl := repository.TemperatureControlType(req.TemperatureControl)
-
 	if !temperatureControl.IsValid() {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid temperature control, must be one of: " + strings.Join(repository.ValidTemperatureCtrls, ", ")})
-		return
+		return repository.Medicine{}, errors.New("Invalid temperature control, must be one of: " + strings.Join(repository.ValidTemperatureCtrls, ", "))
 	}
 
 	unitType := repository.UnitType(req.UnitType)
 	if !unitType.IsValid() {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid unit type, must be one of: " + strings.Join(repository.ValidUnitTypes, ", ")})
-		return
+		return repository.Medicine{}, errors.New("Invalid unit type, must be one of: " + strings.Join(repository.ValidUnitTypes, ", "))
+	}
+
+	var taxRateID *int
+	if req.IVA != "" {
+		rate, ok := taxRates[strings.ToLower(req.IVA)]
+		if !ok {
+			return repository.Medicine{}, errors.New("Invalid iva, must be one of: " + strings.Join(taxRateCodes(taxRates), ", "))
+		}
+		taxRateID = &rate.ID
 	}
 
-	m := repository.Medicine{
-		EANCode:            req.EANCode,
+	return repository.Medicine{
+		EANCode:            eanCode,
 		Description:        req.Description,
 		Type:               medicineType,
 		Laboratory:         req.Laboratory,
-		IVA:                req.IVA,
+		TaxRateID:          taxRateID,
 		SatKey:             req.SatKey,
 		TemperatureControl: temperatureControl,
 		ActiveIngredient:   req.ActiveIngredient,
@@ -96,17 +107,78 @@ func (h *Handler) CreateMedicine(c *gin.Context) {
 		UnitType:           unitType,
 		CreatedAt:          time.Now(),
 		UpdatedAt:          time.Now(),
+	}, nil
+}
+
+func (h *Handler) CreateMedicine(c *gin.Context) {
+	var req createMedicineRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Global && !h.writeGlobalCatalog(c, "add global medicines") {
+		return
+	}
+
+	taxRates, err := h.taxRatesByCode()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create medicine"})
+		return
 	}
 
-	if res := h.Repository.DB.Create(&m); res.Error != nil {
-		if strings.Contains(res.Error.Error(), "duplicate key value") {
-			c.JSON(http.StatusConflict, gin.H{"error": "Could not create medicine: " + res.Error.Error()})
+	m, err := req.toMedicine(taxRates)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	m.Ingredients, _, err = medicineIngredientLinks(h.db(c), req.Ingredients, req.ActiveIngredient)
+	if err != nil {
+		var appErr *repository.AppError
+		if errors.As(err, &appErr) && appErr.Type == repository.ValidationError {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ingredients: " + appErr.Error()})
 		} else {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create medicine"})
 		}
 		return
 	}
 
+	var existing repository.Medicine
+	if err := h.db(c).Where("ean_code = ?", m.EANCode).First(&existing).Error; err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Could not create medicine: duplicate code"})
+		return
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create medicine"})
+		return
+	}
+
+	// the event is queued in the transaction of the medicine, so that it is only sent if it is created
+	var queued int
+	err = h.db(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&m).Error; err != nil {
+			return err
+		}
+		if m.TaxRateID != nil {
+			if err := tx.First(&m.TaxRate, *m.TaxRateID).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Preload("ActiveIngredient").Where("medicine_id = ?", m.ID).Find(&m.Ingredients).Error; err != nil {
+			return err
+		}
+		n, err := queueWebhookEvent(tx, repository.WebhookEventMedicineCreated, m)
+		queued = n
+		return err
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key value") {
+			c.JSON(http.StatusConflict, gin.H{"error": "Could not create medicine: " + err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create medicine"})
+		}
+		return
+	}
+	h.wakeWebhooks(queued)
 	c.JSON(http.StatusCreated, m)
 }
 
@@ -117,79 +189,116 @@ func (h *Handler) DeleteMedicine(c *gin.Context) {
 		return
 	}
 
-	if res := h.Repository.DB.Model(&repository.Medicine{}).
-		Where("id = ? AND is_deleted = ?", id, false).
-		Update("is_deleted", true); res.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete medicine"})
+	if !h.guardCatalogRecord(c, &repository.Medicine{}, "change global medicines") {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Medicine deleted successfully"})
-}
-
-func (h *Handler) SearchMedicinesPaginated(c *gin.Context) {
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
-	if page < 1 {
-		page = 1
+	var m repository.Medicine
+	if err := h.db(c).Where("id = ?", id).First(&m).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Medicine not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
 	}
-	if limit < 1 {
-		limit = 10
+	if !checkIfMatch(c, m.Version) {
+		return
 	}
 
-	likeFilters := map[string]string{
-		"description":       c.Query("description_like"),
-		"laboratory":        c.Query("laboratory_like"),
-		"ean_code":          c.Query("ean_code_like"),
-		"sat_key":           c.Query("sat_key_like"),
-		"active_ingredient": c.Query("active_ingredient_like"),
+	var queued int
+	err = h.db(c).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&repository.Medicine{}).
+			Where("id = ? AND version = ?", id, m.Version).
+			Updates(deletion(c))
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errVersionConflict
+		}
+		n, err := queueWebhookEvent(tx, repository.WebhookEventMedicineDeleted, gin.H{"id": id})
+		queued = n
+		return err
+	})
+	if errors.Is(err, errVersionConflict) {
+		respondVersionConflict(c, 0)
+		return
 	}
-
-	matches := map[string][]string{
-		"description":       c.QueryArray("description_match"),
-		"laboratory":        c.QueryArray("laboratory_match"),
-		"ean_code":          c.QueryArray("ean_code_match"),
-		"sat_key":           c.QueryArray("sat_key_match"),
-		"active_ingredient": c.QueryArray("active_ingredient_match"),
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete medicine"})
+		return
 	}
 
-	var (
-		medicines []repository.Medicine
-		total     int64
-	)
+	h.wakeWebhooks(queued)
+	c.JSON(http.StatusOK, gin.H{"message": "Medicine deleted successfully"})
+}
 
-	query := h.Repository.DB.
-		Model(&repository.Medicine{}).
-		Where("is_deleted = ?", false)
+// medicineSearchFields are the fields medicines can be filtered, sorted and read by
+var medicineSearchFields = searchSpec{
+	model: &repository.Medicine{},
+	fields: map[string]searchField{
+		"id":                  {column: "id", kind: searchInt},
+		"organization_id":     {column: "organization_id", kind: searchInt, nullable: true},
+		"ean_code":            {column: "ean_code"},
+		"description":         {column: "description"},
+		"type":                {column: "type"},
+		"laboratory":          {column: "laboratory"},
+		"tax_rate_id":         {column: "tax_rate_id", kind: searchInt, nullable: true},
+		"sat_key":             {column: "sat_key"},
+		"temperature_control": {column: "temperature_control"},
+		"active_ingredient":   {column: "active_ingredient"},
+		"cold_chain":          {column: "cold_chain", kind: searchBool},
+		"is_controlled":       {column: "is_controlled", kind: searchBool},
+		"unit_quantity":       {column: "unit_quantity", kind: searchNumber},
+		"unit_type":           {column: "unit_type"},
+		"created_at":          {column: "created_at", kind: searchTime},
+		"updated_at":          {column: "updated_at", kind: searchTime},
+		"deleted_at":          {column: "deleted_at", kind: searchTime, nullable: true},
+	},
+	expand: map[string]expansion{
+		"tax_rate":    {preloads: []string{"TaxRate"}, columns: []string{"tax_rate_id"}},
+		"ingredients": {preloads: []string{"Ingredients.ActiveIngredient"}},
+	},
+	defaultSort: "id",
+}
 
-	for col, val := range likeFilters {
-		if val != "" {
-			query = query.Where(col+" ILIKE ?", "%"+val+"%")
-		}
-	}
+// medicineSearchQuery builds the medicine query over db filtered by the parameters of the request
+func (h *Handler) medicineSearchQuery(c *gin.Context, db *gorm.DB) (*gorm.DB, error) {
+	return medicineSearchFields.filter(c, db.Model(&repository.Medicine{}))
+}
 
-	for col, vals := range matches {
-		if len(vals) > 0 {
-			query = query.Where(col+" IN (?)", vals)
-		}
+func (h *Handler) SearchMedicinesPaginated(c *gin.Context) {
+	db, ok := h.readScope(c)
+	if !ok {
+		return
+	}
+	query, err := h.medicineSearchQuery(c, db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	query.Count(&total)
+	var medicines []repository.Medicine
+	h.search(c, medicineSearchFields, query, &medicines, "tax_rate")
+}
+
+var medicineExportColumns = []string{
+	"id", "ean_code", "description", "type", "laboratory", "tax_rate_id", "sat_key", "temperature_control",
+	"active_ingredient", "cold_chain", "is_controlled", "unit_quantity", "unit_type", "created_at", "updated_at",
+}
 
-	offset := (page - 1) * limit
-	if err := query.Offset(offset).Limit(limit).Find(&medicines).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not perform search"})
+func (h *Handler) ExportMedicines(c *gin.Context) {
+	db, ok := h.readScope(c)
+	if !ok {
 		return
 	}
-
-	totalPages := int((total + int64(limit) - 1) / int64(limit))
-	c.JSON(http.StatusOK, gin.H{
-		"current_page":  page,
-		"medicines":     medicines,
-		"page_size":     limit,
-		"total_pages":   totalPages,
-		"total_records": total,
-	})
+	query, err := h.medicineSearchQuery(c, db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.streamExport(c, query, "medicines", medicineExportColumns)
 }
 
 func (h *Handler) SearchMedicineCoincidencesByProperty(c *gin.Context) {
@@ -208,10 +317,9 @@ func (h *Handler) SearchMedicineCoincidencesByProperty(c *gin.Context) {
 	}
 
 	var results []string
-	if err := h.Repository.DB.
+	if err := h.db(c).
 		Model(&repository.Medicine{}).
 		Distinct(property).
-		Where("is_deleted = ?", false).
 		Where(property+" ILIKE ?", "%"+searchText+"%").
 		Limit(20).
 		Pluck(property, &results).Error; err != nil {
@@ -234,6 +342,8 @@ type updateMedicineRequest struct {
 	IsControlled       *bool    `json:"isControlled"`
 	UnitQuantity       *float64 `json:"unitQuantity"`
 	UnitType           *string  `json:"unitType"`
+	// Ingredients replaces the ingredient links; when nil they are derived again if ActiveIngredient changes
+	Ingredients *[]medicineIngredientRequest `json:"ingredients"`
 }
 
 func (h *Handler) UpdateMedicine(c *gin.Context) {
@@ -243,9 +353,13 @@ func (h *Handler) UpdateMedicine(c *gin.Context) {
 		return
 	}
 
+	if !h.guardCatalogRecord(c, &repository.Medicine{}, "change global medicines") {
+		return
+	}
+
 	// Verify the medicine exists
 	var existingMedicine repository.Medicine
-	if err := h.Repository.DB.Where("id = ? AND is_deleted = ?", id, false).First(&existingMedicine).Error; err != nil {
+	if err := h.db(c).Where("id = ?", id).First(&existingMedicine).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Medicine not found"})
 		} else {
@@ -253,12 +367,85 @@ func (h *Handler) UpdateMedicine(c *gin.Context) {
 		}
 		return
 	}
+	if !checkIfMatch(c, existingMedicine.Version) {
+		return
+	}
 
 	var req updateMedicineRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	h.updateMedicine(c, existingMedicine, req)
+}
+
+// PatchMedicine updates a medicine with a JSON Merge Patch or a JSON Patch of its fields. The document
+// patched holds iva as the code of the tax rate, null when it has none, and the ingredient links.
+func (h *Handler) PatchMedicine(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	if !h.guardCatalogRecord(c, &repository.Medicine{}, "change global medicines") {
+		return
+	}
+
+	var existingMedicine repository.Medicine
+	if err := h.db(c).Preload("TaxRate").Preload("Ingredients.ActiveIngredient").
+		Where("id = ?", id).First(&existingMedicine).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Medicine not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+	if !checkIfMatch(c, existingMedicine.Version) {
+		return
+	}
+
+	ingredients := make([]medicineIngredientRequest, len(existingMedicine.Ingredients))
+	for i, link := range existingMedicine.Ingredients {
+		ingredients[i] = medicineIngredientRequest{
+			ActiveIngredientID: link.ActiveIngredientID,
+			Strength:           link.Strength,
+			StrengthUnit:       string(link.StrengthUnit),
+		}
+		if link.ActiveIngredient != nil {
+			ingredients[i].Name = link.ActiveIngredient.Name
+		}
+	}
+	m := existingMedicine
+	current := updateMedicineRequest{
+		EANCode:            &m.EANCode,
+		Description:        &m.Description,
+		Type:               (*string)(&m.Type),
+		Laboratory:         &m.Laboratory,
+		SatKey:             &m.SatKey,
+		ActiveIngredient:   &m.ActiveIngredient,
+		TemperatureControl: (*string)(&m.TemperatureControl),
+		IsControlled:       &m.IsControlled,
+		UnitQuantity:       &m.UnitQuantity,
+		UnitType:           (*string)(&m.UnitType),
+		Ingredients:        &ingredients,
+	}
+	if m.TaxRate != nil {
+		current.IVA = &m.TaxRate.Code
+	}
+	var req updateMedicineRequest
+	if !patchRequest(c, current, &req) {
+		return
+	}
+	h.updateMedicine(c, existingMedicine, req)
+}
+
+// updateMedicine writes the fields given in req to existingMedicine, relinking its ingredients when they
+// or the active ingredient text change
+func (h *Handler) updateMedicine(c *gin.Context, existingMedicine repository.Medicine, req updateMedicineRequest) {
+	id := existingMedicine.ID
+	var err error
 
 	// Prepare fields to update
 	updates := make(map[string]interface{})
@@ -266,16 +453,21 @@ func (h *Handler) UpdateMedicine(c *gin.Context) {
 
 	// Validate and add each field if present in the request
 	if req.EANCode != nil {
+		eanCode, err := repository.NormalizeGTIN(*req.EANCode)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid EAN code: " + err.Error()})
+			return
+		}
 		// Check that the EAN code is not duplicated (excluding the current record)
 		var duplicateCheck repository.Medicine
-		if err := h.Repository.DB.Where("ean_code = ? AND id != ? AND is_deleted = ?", *req.EANCode, id, false).First(&duplicateCheck).Error; err == nil {
+		if err := h.db(c).Where("ean_code = ? AND id != ?", eanCode, id).First(&duplicateCheck).Error; err == nil {
 			c.JSON(http.StatusConflict, gin.H{"error": "EAN code already exists"})
 			return
 		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error checking EAN code"})
 			return
 		}
-		updates["ean_code"] = *req.EANCode
+		updates["ean_code"] = eanCode
 	}
 
 	if req.Description != nil {
@@ -296,7 +488,21 @@ func (h *Handler) UpdateMedicine(c *gin.Context) {
 	}
 
 	if req.IVA != nil {
-		updates["iva"] = *req.IVA
+		if *req.IVA == "" {
+			updates["tax_rate_id"] = nil
+		} else {
+			taxRates, err := h.taxRatesByCode()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+			rate, ok := taxRates[strings.ToLower(*req.IVA)]
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid iva, must be one of: " + strings.Join(taxRateCodes(taxRates), ", ")})
+				return
+			}
+			updates["tax_rate_id"] = rate.ID
+		}
 	}
 
 	if req.SatKey != nil {
@@ -333,26 +539,74 @@ func (h *Handler) UpdateMedicine(c *gin.Context) {
 		updates["unit_type"] = unitType
 	}
 
+	var ingredientLinks []repository.MedicineIngredient
+	relink := req.Ingredients != nil || req.ActiveIngredient != nil
+	if relink {
+		var explicit []medicineIngredientRequest
+		if req.Ingredients != nil {
+			explicit = *req.Ingredients
+		}
+		freeText := existingMedicine.ActiveIngredient
+		if req.ActiveIngredient != nil {
+			freeText = *req.ActiveIngredient
+		}
+		ingredientLinks, _, err = medicineIngredientLinks(h.db(c), explicit, freeText)
+		if err != nil {
+			var appErr *repository.AppError
+			if errors.As(err, &appErr) && appErr.Type == repository.ValidationError {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ingredients: " + appErr.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			}
+			return
+		}
+	}
+
 	// Return an error if there are no fields to update
-	if len(updates) <= 1 { // Solo updated_at
+	if len(updates) <= 1 && !relink { // Solo updated_at
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
 		return
 	}
 
-	// Perform the update
-	if err := h.Repository.DB.Model(&repository.Medicine{}).
-		Where("id = ? AND is_deleted = ?", id, false).
-		Updates(updates).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update medicine"})
+	// Perform the update, as long as nobody changed the medicine since it was read
+	updates["version"] = nextVersion
+	var (
+		updatedMedicine repository.Medicine
+		queued          int
+	)
+	err = h.db(c).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&repository.Medicine{}).
+			Where("id = ? AND version = ?", id, existingMedicine.Version).
+			Updates(updates)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errVersionConflict
+		}
+		if relink {
+			if err := replaceMedicineIngredients(tx, id, ingredientLinks); err != nil {
+				return err
+			}
+		}
+		// Retrieve the updated medicine for the event and the response
+		if err := tx.Preload("TaxRate").Preload("Ingredients.ActiveIngredient").Where("id = ?", id).First(&updatedMedicine).Error; err != nil {
+			return err
+		}
+		n, err := queueWebhookEvent(tx, repository.WebhookEventMedicineUpdated, updatedMedicine)
+		queued = n
+		return err
+	})
+	if errors.Is(err, errVersionConflict) {
+		respondVersionConflict(c, 0)
 		return
 	}
-
-	// Retrieve the updated medicine
-	var updatedMedicine repository.Medicine
-	if err := h.Repository.DB.Where("id = ? AND is_deleted = ?", id, false).First(&updatedMedicine).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve updated medicine"})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update medicine"})
 		return
 	}
 
+	h.wakeWebhooks(queued)
+	c.Header("ETag", etag(readVersion(c, updatedMedicine.Version)))
 	c.JSON(http.StatusOK, updatedMedicine)
 }
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"ia-boilerplate/src/repository"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/ean"
+	"github.com/boombuler/barcode/twooffive"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultBarcodeWidth  = 300
+	defaultBarcodeHeight = 120
+	maxBarcodeDimension  = 2000
+)
+
+func (h *Handler) GetMedicineByBarcode(c *gin.Context) {
+	code, err := repository.NormalizeGTIN(c.Param("code"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid barcode: " + err.Error()})
+		return
+	}
+
+	sel, err := medicineSearchFields.selection(c, h.db(c), "tax_rate", "ingredients")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var m repository.Medicine
+	res := sel.apply(c, h.db(c), "version").Where("ean_code = ?", code).First(&m)
+	if res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Medicine not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+
+	respondVersioned(c, m.Version, sel.render(m))
+}
+
+// encodeGTIN renders EAN-8/EAN-13 codes with the EAN symbology and GTIN-14 codes as ITF-14
+func encodeGTIN(code string) (barcode.Barcode, error) {
+	if len(code) == 14 {
+		return twooffive.Encode(code, true)
+	}
+	return ean.Encode(code)
+}
+
+func (h *Handler) GetMedicineBarcode(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	format := strings.ToLower(c.DefaultQuery("format", "png"))
+	if format != "png" && format != "svg" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format, must be one of: png, svg"})
+		return
+	}
+	width, errW := strconv.Atoi(c.DefaultQuery("width", strconv.Itoa(defaultBarcodeWidth)))
+	height, errH := strconv.Atoi(c.DefaultQuery("height", strconv.Itoa(defaultBarcodeHeight)))
+	if errW != nil || errH != nil || width < 1 || height < 1 || width > maxBarcodeDimension || height > maxBarcodeDimension {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid width or height, must be between 1 and %d", maxBarcodeDimension)})
+		return
+	}
+
+	var m repository.Medicine
+	res := h.db(c).Where("id = ?", id).First(&m)
+	if res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Medicine not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+
+	code, err := repository.NormalizeGTIN(m.EANCode)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Medicine has an invalid EAN code: " + err.Error()})
+		return
+	}
+
+	bc, err := encodeGTIN(code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not render barcode"})
+		return
+	}
+	// Barcodes cannot be narrower than one pixel per module
+	if width < bc.Bounds().Dx() {
+		width = bc.Bounds().Dx()
+	}
+	scaled, err := barcode.Scale(bc, width, height)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not render barcode"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`inline; filename="%s.%s"`, code, format))
+	if format == "svg" {
+		c.Data(http.StatusOK, "image/svg+xml", renderBarcodeSVG(bc, width, height))
+		return
+	}
+
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "image/png")
+	if err := png.Encode(c.Writer, scaled); err != nil {
+		c.Abort()
+	}
+}
+
+// renderBarcodeSVG draws each dark module of a 1D barcode as a rectangle scaled to the requested size
+func renderBarcodeSVG(bc barcode.Barcode, width, height int) []byte {
+	modules := bc.Bounds().Dx()
+	moduleWidth := float64(width) / float64(modules)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, width, height, width, height)
+	fmt.Fprintf(&sb, `<rect width="%d" height="%d" fill="#fff"/>`, width, height)
+	for x := 0; x < modules; {
+		if !isDarkModule(bc.At(bc.Bounds().Min.X+x, bc.Bounds().Min.Y)) {
+			x++
+			continue
+		}
+		start := x
+		for x < modules && isDarkModule(bc.At(bc.Bounds().Min.X+x, bc.Bounds().Min.Y)) {
+			x++
+		}
+		fmt.Fprintf(&sb, `<rect x="%.3f" y="0" width="%.3f" height="%d" fill="#000"/>`, float64(start)*moduleWidth, float64(x-start)*moduleWidth, height)
+	}
+	sb.WriteString(`</svg>`)
+	return []byte(sb.String())
+}
+
+func isDarkModule(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r+g+b < 3*0x8000
+}
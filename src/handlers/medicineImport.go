@@ -0,0 +1,380 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"ia-boilerplate/src/repository"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ImportFormatCSV  = "csv"
+	ImportFormatXLSX = "xlsx"
+
+	defaultImportBatchSize = 500
+)
+
+// medicineImportColumns maps a normalized header name to the createMedicineRequest field it fills
+var medicineImportColumns = map[string]func(req *createMedicineRequest, value string) error{
+	"eancode":            func(req *createMedicineRequest, v string) error { req.EANCode = v; return nil },
+	"description":        func(req *createMedicineRequest, v string) error { req.Description = v; return nil },
+	"type":               func(req *createMedicineRequest, v string) error { req.Type = v; return nil },
+	"laboratory":         func(req *createMedicineRequest, v string) error { req.Laboratory = v; return nil },
+	"iva":                func(req *createMedicineRequest, v string) error { req.IVA = v; return nil },
+	"satkey":             func(req *createMedicineRequest, v string) error { req.SatKey = v; return nil },
+	"activeingredient":   func(req *createMedicineRequest, v string) error { req.ActiveIngredient = v; return nil },
+	"temperaturecontrol": func(req *createMedicineRequest, v string) error { req.TemperatureControl = v; return nil },
+	"unittype":           func(req *createMedicineRequest, v string) error { req.UnitType = v; return nil },
+	"iscontrolled": func(req *createMedicineRequest, v string) error {
+		if v == "" {
+			return nil
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("isControlled must be a boolean")
+		}
+		req.IsControlled = b
+		return nil
+	},
+	"unitquantity": func(req *createMedicineRequest, v string) error {
+		if v == "" {
+			return nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return errors.New("unitQuantity must be a number")
+		}
+		req.UnitQuantity = f
+		return nil
+	},
+}
+
+var medicineImportRequiredColumns = []string{"eancode", "description", "type"}
+
+// medicineImportUpsertColumns are overwritten when an imported EAN code already exists
+var medicineImportUpsertColumns = []string{
+	"description", "type", "laboratory", "tax_rate_id", "sat_key", "temperature_control",
+	"active_ingredient", "is_controlled", "unit_quantity", "unit_type", "updated_at",
+}
+
+type MedicineImportRowError struct {
+	Row     int      `json:"row"`
+	EANCode string   `json:"ean_code"`
+	Errors  []string `json:"errors"`
+}
+
+type MedicineImportResult struct {
+	DryRun         bool                     `json:"dry_run"`
+	TotalRows      int                      `json:"total_rows"`
+	ValidRows      int                      `json:"valid_rows"`
+	InvalidRows    int                      `json:"invalid_rows"`
+	Created        int                      `json:"created"`
+	Updated        int                      `json:"updated"`
+	IgnoredColumns []string                 `json:"ignored_columns"`
+	Errors         []MedicineImportRowError `json:"errors"`
+}
+
+// ImportFormatFromFilename resolves the import format from an explicit value or the file extension
+func ImportFormatFromFilename(filename, format string) (string, error) {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	}
+	switch strings.ToLower(format) {
+	case ImportFormatCSV:
+		return ImportFormatCSV, nil
+	case ImportFormatXLSX:
+		return ImportFormatXLSX, nil
+	default:
+		return "", fmt.Errorf("unsupported import format %q, must be one of: %s, %s", format, ImportFormatCSV, ImportFormatXLSX)
+	}
+}
+
+// ReadImportRows reads every row of a CSV file or of the first sheet of an XLSX workbook
+func ReadImportRows(r io.Reader, format string) ([][]string, error) {
+	switch format {
+	case ImportFormatCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		return reader.ReadAll()
+	case ImportFormatXLSX:
+		f, err := excelize.OpenReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		sheets := f.GetSheetList()
+		if len(sheets) == 0 {
+			return nil, errors.New("workbook has no sheets")
+		}
+		return f.GetRows(sheets[0])
+	default:
+		return nil, fmt.Errorf("unsupported import format %q", format)
+	}
+}
+
+func normalizeImportHeader(header string) string {
+	replacer := strings.NewReplacer("_", "", "-", "", " ", "", "\ufeff", "")
+	return strings.ToLower(replacer.Replace(strings.TrimSpace(header)))
+}
+
+// ImportMedicineRows validates the given rows (header first) and, unless dryRun is set,
+// upserts the valid ones by EAN code in transactions of batchSize records, in the organization db is
+// scoped to or, with repository.WithGlobalCatalog, in the global catalog. Medicines of the global catalog
+// are reported as invalid rows when importing into an organization, which overrides them instead. Each
+// batch queues a medicine.imported event with the ids of the medicines it created and updated.
+func (h *Handler) ImportMedicineRows(db *gorm.DB, rows [][]string, dryRun bool, batchSize int) (MedicineImportResult, error) {
+	result := MedicineImportResult{DryRun: dryRun, IgnoredColumns: []string{}, Errors: []MedicineImportRowError{}}
+	if batchSize < 1 {
+		batchSize = defaultImportBatchSize
+	}
+	if len(rows) == 0 {
+		return result, repository.NewAppError(errors.New("file is empty"), repository.ValidationError)
+	}
+
+	columns := make([]string, len(rows[0]))
+	present := make(map[string]bool)
+	for i, header := range rows[0] {
+		name := normalizeImportHeader(header)
+		if _, ok := medicineImportColumns[name]; ok && !present[name] {
+			columns[i] = name
+			present[name] = true
+		} else if strings.TrimSpace(header) != "" {
+			result.IgnoredColumns = append(result.IgnoredColumns, header)
+		}
+	}
+	for _, name := range medicineImportRequiredColumns {
+		if !present[name] {
+			return result, repository.NewAppError(fmt.Errorf("missing required column %q", name), repository.ValidationError)
+		}
+	}
+
+	taxRates, err := h.taxRatesByCode()
+	if err != nil {
+		return result, repository.NewAppError(err, repository.RepositoryError)
+	}
+
+	var (
+		valid    []repository.Medicine
+		seenEANs = make(map[string]int)
+	)
+	for i, row := range rows[1:] {
+		rowNumber := i + 2
+		if isBlankImportRow(row) {
+			continue
+		}
+		result.TotalRows++
+
+		var (
+			req     createMedicineRequest
+			rowErrs []string
+		)
+		for idx, name := range columns {
+			if name == "" {
+				continue
+			}
+			value := ""
+			if idx < len(row) {
+				value = strings.TrimSpace(row[idx])
+			}
+			if err := medicineImportColumns[name](&req, value); err != nil {
+				rowErrs = append(rowErrs, err.Error())
+			}
+		}
+
+		if req.EANCode == "" {
+			rowErrs = append(rowErrs, "eanCode is required")
+		}
+		if req.Description == "" {
+			rowErrs = append(rowErrs, "description is required")
+		}
+
+		m, err := req.toMedicine(taxRates)
+		if err != nil {
+			rowErrs = append(rowErrs, err.Error())
+		} else if firstRow, ok := seenEANs[m.EANCode]; ok {
+			rowErrs = append(rowErrs, fmt.Sprintf("eanCode duplicated in file, first seen on row %d", firstRow))
+		} else {
+			seenEANs[m.EANCode] = rowNumber
+		}
+
+		if len(rowErrs) > 0 {
+			result.Errors = append(result.Errors, MedicineImportRowError{Row: rowNumber, EANCode: req.EANCode, Errors: rowErrs})
+			continue
+		}
+		valid = append(valid, m)
+	}
+
+	global := repository.GlobalCatalog(db.Statement.Context)
+	if !global {
+		var kept []repository.Medicine
+		for start := 0; start < len(valid); start += batchSize {
+			batch := valid[start:min(start+batchSize, len(valid))]
+			codes := make([]string, len(batch))
+			for i, m := range batch {
+				codes[i] = m.EANCode
+			}
+			var globalCodes []string
+			if err := db.Model(&repository.Medicine{}).Where("ean_code IN ? AND organization_id IS NULL", codes).
+				Pluck("ean_code", &globalCodes).Error; err != nil {
+				return result, repository.NewAppError(err, repository.RepositoryError)
+			}
+			for _, m := range batch {
+				if slices.Contains(globalCodes, m.EANCode) {
+					result.Errors = append(result.Errors, MedicineImportRowError{Row: seenEANs[m.EANCode], EANCode: m.EANCode,
+						Errors: []string{"eanCode belongs to the global catalog, override the medicine instead"}})
+				} else {
+					kept = append(kept, m)
+				}
+			}
+		}
+		valid = kept
+		sort.Slice(result.Errors, func(i, j int) bool { return result.Errors[i].Row < result.Errors[j].Row })
+	}
+	result.ValidRows = len(valid)
+	result.InvalidRows = len(result.Errors)
+
+	queued := 0
+	for start := 0; start < len(valid); start += batchSize {
+		end := start + batchSize
+		if end > len(valid) {
+			end = len(valid)
+		}
+		batch := valid[start:end]
+
+		codes := make([]string, len(batch))
+		for i, m := range batch {
+			codes[i] = m.EANCode
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var existing []string
+			if err := tx.Model(&repository.Medicine{}).Where("ean_code IN ?", codes).Pluck("ean_code", &existing).Error; err != nil {
+				return err
+			}
+			if !dryRun {
+				// overwritten medicines get a new version, so that edits read before the import fail If-Match
+				updates := append(clause.AssignmentColumns(medicineImportUpsertColumns),
+					clause.Assignment{Column: clause.Column{Name: "version"}, Value: gorm.Expr("medicines.version + 1")})
+				conflict := clause.OnConflict{
+					Columns:     []clause.Column{{Name: "organization_id"}, {Name: "ean_code"}},
+					TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "deleted_at IS NULL"}}},
+					DoUpdates:   updates,
+				}
+				if global {
+					conflict.Columns = []clause.Column{{Name: "ean_code"}}
+					conflict.TargetWhere = clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "organization_id IS NULL AND deleted_at IS NULL"}}}
+				}
+				if err := tx.Clauses(conflict).Create(&batch).Error; err != nil {
+					return err
+				}
+				if _, _, err := linkIngredientsFromText(tx, batch); err != nil {
+					return err
+				}
+				// one event tells about the whole batch, in its transaction so that it is only sent if it commits
+				created, updated := []int{}, []int{}
+				for _, m := range batch {
+					if slices.Contains(existing, m.EANCode) {
+						updated = append(updated, m.ID)
+					} else {
+						created = append(created, m.ID)
+					}
+				}
+				n, err := queueWebhookEvent(tx, repository.WebhookEventMedicineImported, gin.H{"created": created, "updated": updated})
+				if err != nil {
+					return err
+				}
+				queued += n
+			}
+			result.Updated += len(existing)
+			result.Created += len(batch) - len(existing)
+			return nil
+		})
+		if err != nil {
+			h.Logger.Error("Error importing medicine batch", zap.Int("from_row", start), zap.Error(err))
+			return result, repository.NewAppError(err, repository.RepositoryError)
+		}
+	}
+	h.wakeWebhooks(queued)
+
+	return result, nil
+}
+
+func isBlankImportRow(row []string) bool {
+	for _, v := range row {
+		if strings.TrimSpace(v) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// readUploadedImportRows reads the CSV or XLSX file uploaded in the "file" field, writing the error
+// response and returning false when it is missing or cannot be parsed
+func readUploadedImportRows(c *gin.Context) ([][]string, bool) {
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A CSV or XLSX file is required in the \"file\" field"})
+		return nil, false
+	}
+
+	format, err := ImportFormatFromFilename(fileHeader.Filename, c.Query("format"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read uploaded file"})
+		return nil, false
+	}
+	defer file.Close()
+
+	rows, err := ReadImportRows(file, format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not parse file: " + err.Error()})
+		return nil, false
+	}
+	return rows, true
+}
+
+func (h *Handler) ImportMedicines(c *gin.Context) {
+	rows, ok := readUploadedImportRows(c)
+	if !ok {
+		return
+	}
+
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dry_run, must be a boolean"})
+		return
+	}
+	batchSize, _ := strconv.Atoi(c.DefaultQuery("batch_size", strconv.Itoa(defaultImportBatchSize)))
+
+	result, err := h.ImportMedicineRows(h.db(c), rows, dryRun, batchSize)
+	if err != nil {
+		var appErr *repository.AppError
+		if errors.As(err, &appErr) && appErr.Type == repository.ValidationError {
+			c.JSON(http.StatusBadRequest, gin.H{"error": appErr.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not import medicines", "result": result})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"ia-boilerplate/src/repository"
+)
+
+// organizationSlugPattern is what slugs look like: lowercase words of letters and digits joined by
+// hyphens, e.g. clinica-norte
+var organizationSlugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// userOrganizationTTL is how long the organization of a user is reused before it is looked up again, and
+// so how long a deleted user or a disabled organization can go on using its tokens on other instances
+const userOrganizationTTL = 30 * time.Second
+
+// organizationCache keeps the organizations of the users of the last requests and the id of the default
+// organization, so that requests do not look them up every time
+type organizationCache struct {
+	mu        sync.Mutex
+	users     map[int]cachedOrganization
+	defaultID int
+}
+
+// cachedOrganization is the organization of a user and until when it can be reused
+type cachedOrganization struct {
+	id      int
+	expires time.Time
+}
+
+// UserOrganization is the organization of a user, or 0 when the user is deleted or its organization is
+// disabled. It looks across every organization, as it is what the organization of a request is resolved
+// with.
+func (h *Handler) UserOrganization(userID int) (int, error) {
+	h.organizations.mu.Lock()
+	cached, ok := h.organizations.users[userID]
+	h.organizations.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.id, nil
+	}
+
+	var user repository.User
+	err := h.Repository.DB.Select("users.organization_id").
+		Joins("JOIN organizations ON organizations.id = users.organization_id AND organizations.enabled = ?", true).
+		Where("users.id = ?", userID).
+		Take(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	h.organizations.mu.Lock()
+	defer h.organizations.mu.Unlock()
+	if h.organizations.users == nil {
+		h.organizations.users = make(map[int]cachedOrganization)
+	}
+	h.organizations.users[userID] = cachedOrganization{id: user.OrganizationID, expires: time.Now().Add(userOrganizationTTL)}
+	return user.OrganizationID, nil
+}
+
+// forgetUserOrganizations makes the organizations of the users be looked up again, or the ones of all of
+// them when no user is given
+func (h *Handler) forgetUserOrganizations(userIDs ...int) {
+	h.organizations.mu.Lock()
+	defer h.organizations.mu.Unlock()
+	if len(userIDs) == 0 {
+		clear(h.organizations.users)
+	}
+	for _, userID := range userIDs {
+		delete(h.organizations.users, userID)
+	}
+}
+
+// TokenOrganization is the organization a token was issued for. Tokens from before organizations do not
+// name one: they were issued for the default organization, and are taken as such until they expire.
+func (h *Handler) TokenOrganization(claims map[string]interface{}) (int, error) {
+	if claimed, ok := claims["org_id"].(float64); ok {
+		return int(claimed), nil
+	}
+	h.organizations.mu.Lock()
+	defer h.organizations.mu.Unlock()
+	if h.organizations.defaultID == 0 {
+		var organization repository.Organization
+		if err := h.Repository.DB.Select("id").Where("slug = ?", repository.DefaultOrganizationSlug).
+			Take(&organization).Error; err != nil {
+			return 0, err
+		}
+		h.organizations.defaultID = organization.ID
+	}
+	return h.organizations.defaultID, nil
+}
+
+// isPlatformAdmin tells whether the user of the request is an admin of the default organization, the
+// ones who run the platform
+func (h *Handler) isPlatformAdmin(c *gin.Context) (bool, error) {
+	var count int64
+	err := h.db(c).Model(&repository.User{}).
+		Joins("JOIN role_users ON role_users.id = users.role_id AND role_users.deleted_at IS NULL").
+		Joins("JOIN organizations ON organizations.id = users.organization_id").
+		Where("users.id = ? AND role_users.name = ? AND role_users.enabled = ? AND organizations.slug = ?",
+			c.GetInt("user_id"), adminRole, true, repository.DefaultOrganizationSlug).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// requirePlatformAdmin answers 403 unless the user of the request is a platform admin, returning false
+// when it answered; what is what only they can do, e.g. "manage organizations"
+func (h *Handler) requirePlatformAdmin(c *gin.Context, what string) bool {
+	admin, err := h.isPlatformAdmin(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not check the role of the user"})
+		return false
+	}
+	if !admin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only platform admins can " + what})
+		return false
+	}
+	return true
+}
+
+// GetCurrentOrganization answers the organization of the user of the request
+func (h *Handler) GetCurrentOrganization(c *gin.Context) {
+	var organization repository.Organization
+	if err := h.db(c).First(&organization, c.GetInt("organization_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return
+	}
+	respondVersioned(c, organization.Version, organization)
+}
+
+func (h *Handler) GetOrganizations(c *gin.Context) {
+	if !h.requirePlatformAdmin(c, "manage organizations") {
+		return
+	}
+	var organizations []repository.Organization
+	if err := h.db(c).Order("id").Find(&organizations).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve organizations"})
+		return
+	}
+	c.JSON(http.StatusOK, organizations)
+}
+
+func (h *Handler) GetOrganization(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	if !h.requirePlatformAdmin(c, "manage organizations") {
+		return
+	}
+	var organization repository.Organization
+	if err := h.db(c).First(&organization, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return
+	}
+	respondVersioned(c, organization.Version, organization)
+}
+
+// OrganizationAdminRequest is the first user of a new organization, who gets its admin role
+type OrganizationAdminRequest struct {
+	Username    string `json:"username" binding:"required"`
+	FirstName   string `json:"firstName"`
+	LastName    string `json:"lastName"`
+	Email       string `json:"email" binding:"required"`
+	Password    string `json:"password" binding:"required"`
+	JobPosition string `json:"jobPosition"`
+}
+
+type CreateOrganizationRequest struct {
+	Name  string                   `json:"name" binding:"required"`
+	Slug  string                   `json:"slug" binding:"required,max=60"`
+	Admin OrganizationAdminRequest `json:"admin" binding:"required"`
+}
+
+// CreateOrganization opens an organization with its admin role and its first user, who has that role,
+// answering the organization with that user in admin
+func (h *Handler) CreateOrganization(c *gin.Context) {
+	var req CreateOrganizationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !organizationSlugPattern.MatchString(req.Slug) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slug, must be lowercase letters and digits separated by hyphens"})
+		return
+	}
+	if !h.requirePlatformAdmin(c, "manage organizations") {
+		return
+	}
+	hashedPassword, err := h.Auth.HashPassword(req.Admin.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error encrypting password"})
+		return
+	}
+
+	organization := repository.Organization{Name: req.Name, Slug: req.Slug, Enabled: true}
+	var admin repository.User
+	err = h.db(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&organization).Error; err != nil {
+			return err
+		}
+		// the role and the user belong to the new organization, not to the one of the request
+		tx = tx.WithContext(repository.WithOrganization(c.Request.Context(), organization.ID))
+		role := repository.RoleUser{Name: adminRole, Description: "Administrator", Enabled: true}
+		if err := tx.Create(&role).Error; err != nil {
+			return err
+		}
+		admin = repository.User{
+			Username:     req.Admin.Username,
+			FirstName:    req.Admin.FirstName,
+			LastName:     req.Admin.LastName,
+			Email:        req.Admin.Email,
+			HashPassword: hashedPassword,
+			JobPosition:  req.Admin.JobPosition,
+			RoleID:       role.ID,
+			Enabled:      true,
+		}
+		if err := tx.Create(&admin).Error; err != nil {
+			return err
+		}
+		admin.Role = role
+		return nil
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key value") {
+			c.JSON(http.StatusConflict, gin.H{"error": "An organization with this slug already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create organization"})
+		return
+	}
+	c.Header("ETag", etag(organization.Version))
+	c.JSON(http.StatusCreated, struct {
+		repository.Organization
+		Admin repository.User `json:"admin"`
+	}{organization, admin})
+}
+
+type UpdateOrganizationRequest struct {
+	Name    *string `json:"name"`
+	Enabled *bool   `json:"enabled"`
+}
+
+// UpdateOrganization renames, disables or enables an organization. The users of a disabled organization
+// cannot log in, and the tokens they hold are turned down.
+func (h *Handler) UpdateOrganization(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var req UpdateOrganizationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.requirePlatformAdmin(c, "manage organizations") {
+		return
+	}
+	var organization repository.Organization
+	if err := h.db(c).First(&organization, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return
+	}
+	if !checkIfMatch(c, organization.Version) {
+		return
+	}
+
+	updates := map[string]interface{}{"updated_at": time.Now()}
+	if req.Name != nil {
+		updates["name"] = *req.Name
+	}
+	if req.Enabled != nil {
+		if !*req.Enabled && organization.Slug == repository.DefaultOrganizationSlug {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The default organization cannot be disabled"})
+			return
+		}
+		updates["enabled"] = *req.Enabled
+	}
+	if len(updates) <= 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	updates["version"] = nextVersion
+	result := h.db(c).Model(&repository.Organization{}).
+		Where("id = ? AND version = ?", id, organization.Version).
+		Updates(updates)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update organization"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		respondVersionConflict(c, 0)
+		return
+	}
+	if req.Enabled != nil && !*req.Enabled {
+		h.forgetUserOrganizations()
+	}
+	if err := h.db(c).First(&organization, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve updated organization"})
+		return
+	}
+	c.Header("ETag", etag(organization.Version))
+	c.JSON(http.StatusOK, organization)
+}
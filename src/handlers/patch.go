@@ -0,0 +1,425 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// The media types a PATCH request body can be written in
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+// errPatchTestFailed is returned when a test operation of a JSON Patch does not hold
+var errPatchTestFailed = errors.New("test failed")
+
+// decodeJSON reads JSON keeping numbers as written, so that they compare and re-encode exactly
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// patchRequest applies the body of a PATCH request to current, the update request of a record filled in
+// with its present values, and decodes into req the fields the patch changed. A field the patch removes
+// or sets to null is sent empty, which clears it. The result is validated with the binding rules of req,
+// as ShouldBindJSON does. It answers and returns false when the patch cannot be applied.
+func patchRequest(c *gin.Context, current, req interface{}) bool {
+	raw, err := json.Marshal(current)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read the record"})
+		return false
+	}
+	var original map[string]interface{}
+	if err := decodeJSON(raw, &original); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read the record"})
+		return false
+	}
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read the patch"})
+		return false
+	}
+
+	var patched interface{}
+	switch c.ContentType() {
+	case mergePatchContentType:
+		var patch interface{}
+		if err := decodeJSON(body, &patch); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid patch: " + err.Error()})
+			return false
+		}
+		if _, ok := patch.(map[string]interface{}); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid patch, a merge patch must be a JSON object"})
+			return false
+		}
+		patched = mergePatch(deepCopyJSON(original), patch)
+	case jsonPatchContentType:
+		var operations []map[string]json.RawMessage
+		if err := json.Unmarshal(body, &operations); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid patch, a JSON Patch must be an array of operations"})
+			return false
+		}
+		patched, err = applyJSONPatch(deepCopyJSON(original), operations)
+		if errors.Is(err, errPatchTestFailed) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Could not apply the patch: " + err.Error()})
+			return false
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid patch: " + err.Error()})
+			return false
+		}
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "PATCH requests must be " + mergePatchContentType + " or " + jsonPatchContentType})
+		return false
+	}
+
+	result, ok := patched.(map[string]interface{})
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid patch, the record must remain a JSON object"})
+		return false
+	}
+	changed := make(map[string]interface{})
+	for key, value := range result {
+		before, known := original[key]
+		if !known {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid patch, " + key + " cannot be patched"})
+			return false
+		}
+		if value != nil && !jsonEqual(before, value) {
+			changed[key] = value
+		}
+	}
+	for key, before := range original {
+		if after, ok := result[key]; before == nil || (ok && after != nil) {
+			continue
+		}
+		changed[key] = emptyJSON(before)
+	}
+
+	raw, _ = json.Marshal(changed)
+	if err := json.Unmarshal(raw, req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid patch: " + err.Error()})
+		return false
+	}
+	if err := binding.Validator.ValidateStruct(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// mergePatch applies a JSON Merge Patch (RFC 7386) to target
+func mergePatch(target, patch interface{}) interface{} {
+	fields, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	doc, ok := target.(map[string]interface{})
+	if !ok {
+		doc = make(map[string]interface{})
+	}
+	for key, value := range fields {
+		if value == nil {
+			delete(doc, key)
+			continue
+		}
+		doc[key] = mergePatch(doc[key], value)
+	}
+	return doc
+}
+
+// applyJSONPatch applies the operations of a JSON Patch (RFC 6902) to doc, one after the other; the first
+// one that fails stops the patch
+func applyJSONPatch(doc interface{}, operations []map[string]json.RawMessage) (interface{}, error) {
+	for i, operation := range operations {
+		var op, path, from string
+		if err := json.Unmarshal(operation["op"], &op); err != nil {
+			return nil, fmt.Errorf("operation %d has no op", i)
+		}
+		if err := json.Unmarshal(operation["path"], &path); err != nil {
+			return nil, fmt.Errorf("operation %d has no path", i)
+		}
+		tokens, err := jsonPointer(path)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %v", i, err)
+		}
+		var value interface{}
+		rawValue, hasValue := operation["value"]
+		if hasValue {
+			if err := decodeJSON(rawValue, &value); err != nil {
+				return nil, fmt.Errorf("operation %d has an invalid value", i)
+			}
+		}
+		var fromTokens []string
+		if op == "move" || op == "copy" {
+			if err := json.Unmarshal(operation["from"], &from); err != nil {
+				return nil, fmt.Errorf("operation %d has no from", i)
+			}
+			if fromTokens, err = jsonPointer(from); err != nil {
+				return nil, fmt.Errorf("operation %d: %v", i, err)
+			}
+		}
+
+		switch op {
+		case "add", "replace", "test":
+			if !hasValue {
+				return nil, fmt.Errorf("operation %d has no value", i)
+			}
+		case "remove", "move", "copy":
+		default:
+			return nil, fmt.Errorf("operation %d has an unknown op %q", i, op)
+		}
+
+		switch op {
+		case "add":
+			doc, err = patchAdd(doc, tokens, value)
+		case "remove":
+			doc, _, err = patchRemove(doc, tokens)
+		case "replace":
+			if _, err = jsonLookup(doc, tokens); err == nil {
+				doc, _, err = patchRemove(doc, tokens)
+			}
+			if err == nil {
+				doc, err = patchAdd(doc, tokens, value)
+			}
+		case "move":
+			if strings.HasPrefix(path+"/", from+"/") && path != from {
+				return nil, fmt.Errorf("operation %d moves %s into itself", i, from)
+			}
+			var moved interface{}
+			if doc, moved, err = patchRemove(doc, fromTokens); err == nil {
+				doc, err = patchAdd(doc, tokens, moved)
+			}
+		case "copy":
+			var copied interface{}
+			if copied, err = jsonLookup(doc, fromTokens); err == nil {
+				doc, err = patchAdd(doc, tokens, deepCopyJSON(copied))
+			}
+		case "test":
+			var actual interface{}
+			if actual, err = jsonLookup(doc, tokens); err == nil && !jsonEqual(actual, value) {
+				return nil, fmt.Errorf("%w at %s", errPatchTestFailed, path)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %v", i, err)
+		}
+	}
+	return doc, nil
+}
+
+// jsonPointer splits a JSON Pointer (RFC 6901) into its unescaped tokens; the empty pointer is the whole
+// document
+func jsonPointer(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid path %q, it must start with /", path)
+	}
+	tokens := strings.Split(path[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex reads the index a token names in an array of the given length; "-" names the end, only
+// valid when adding
+func arrayIndex(token string, length int, adding bool) (int, error) {
+	if token == "-" && adding {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if index > length || (index == length && !adding) {
+		return 0, fmt.Errorf("array index %d out of range", index)
+	}
+	return index, nil
+}
+
+// jsonLookup reads the value the tokens point to
+func jsonLookup(doc interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path not found at %s", token)
+			}
+			doc = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, fmt.Errorf("path not found at %s", token)
+		}
+	}
+	return doc, nil
+}
+
+// patchAt replaces the container holding the last token with what edit makes of it, returning the
+// document with the change
+func patchAt(doc interface{}, tokens []string, edit func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return edit(doc, tokens[0])
+	}
+	child, err := jsonLookup(doc, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	updated, err := patchAt(child, tokens[1:], edit)
+	if err != nil {
+		return nil, err
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[tokens[0]] = updated
+	case []interface{}:
+		index, _ := arrayIndex(tokens[0], len(node), false)
+		node[index] = updated
+	}
+	return doc, nil
+}
+
+// patchAdd sets the member the tokens point to, or inserts it when it is an array position
+func patchAdd(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return patchAt(doc, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch node := container.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("path not found at %s", token)
+	})
+}
+
+// patchRemove deletes the member the tokens point to and returns it
+func patchRemove(doc interface{}, tokens []string) (interface{}, interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, nil, errors.New("the whole document cannot be removed")
+	}
+	var removed interface{}
+	doc, err := patchAt(doc, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch node := container.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path not found at %s", token)
+			}
+			removed = value
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[index]
+			return append(node[:index], node[index+1:]...), nil
+		}
+		return nil, fmt.Errorf("path not found at %s", token)
+	})
+	return doc, removed, err
+}
+
+// deepCopyJSON copies a decoded JSON value so that patching it leaves the original alone
+func deepCopyJSON(value interface{}) interface{} {
+	switch node := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(node))
+		for key, child := range node {
+			copied[key] = deepCopyJSON(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(node))
+		for i, child := range node {
+			copied[i] = deepCopyJSON(child)
+		}
+		return copied
+	}
+	return value
+}
+
+// jsonEqual compares decoded JSON values, numbers by their value rather than by how they are written
+func jsonEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for key, value := range x {
+			other, ok := y[key]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fx, errX := x.Float64()
+		fy, errY := y.Float64()
+		return errX == nil && errY == nil && fx == fy
+	}
+	return a == b
+}
+
+// emptyJSON is the empty value of the JSON type of value, what a removed field is cleared to
+func emptyJSON(value interface{}) interface{} {
+	switch value.(type) {
+	case string:
+		return ""
+	case bool:
+		return false
+	case json.Number:
+		return json.Number("0")
+	case []interface{}:
+		return []interface{}{}
+	case map[string]interface{}:
+		return map[string]interface{}{}
+	}
+	return nil
+}
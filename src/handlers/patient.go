@@ -0,0 +1,390 @@
+package handlers
+
+import (
+	"errors"
+	"ia-boilerplate/src/repository"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type CreatePatientRequest struct {
+	FirstName string `json:"firstName" binding:"required,max=100"`
+	LastName  string `json:"lastName" binding:"required,max=100"`
+	// BirthDate is a YYYY-MM-DD date
+	BirthDate string `json:"birthDate" binding:"required"`
+	Sex       string `json:"sex" binding:"required"`
+	CURP      string `json:"curp"`
+	Email     string `json:"email" binding:"omitempty,email,max=150"`
+	Phone     string `json:"phone" binding:"max=20"`
+}
+
+type UpdatePatientRequest struct {
+	FirstName *string `json:"firstName" binding:"omitempty,max=100"`
+	LastName  *string `json:"lastName" binding:"omitempty,max=100"`
+	BirthDate *string `json:"birthDate"`
+	Sex       *string `json:"sex"`
+	CURP      *string `json:"curp"`
+	Email     *string `json:"email" binding:"omitempty,max=150"`
+	Phone     *string `json:"phone" binding:"omitempty,max=20"`
+}
+
+// parseBirthDate reads a YYYY-MM-DD birth date, which cannot be in the future
+func parseBirthDate(value string) (time.Time, error) {
+	birthDate, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, errors.New("Invalid birthDate, must be YYYY-MM-DD")
+	}
+	if birthDate.After(time.Now()) {
+		return time.Time{}, errors.New("Invalid birthDate, cannot be in the future")
+	}
+	return birthDate, nil
+}
+
+// patientCURP validates a CURP and checks that no other patient of db has it; an empty CURP is stored as
+// NULL
+func (h *Handler) patientCURP(db *gorm.DB, value string, excludeID int) (*string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	curp, err := repository.NormalizeCURP(value)
+	if err != nil {
+		return nil, repository.NewAppError(errors.New("Invalid CURP: "+err.Error()), repository.ValidationError)
+	}
+	var existing repository.Patient
+	if err := db.Where("curp = ? AND id != ?", curp, excludeID).First(&existing).Error; err == nil {
+		return nil, repository.NewAppError(errors.New("CURP already belongs to another patient"), repository.ResourceAlreadyExists)
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	return &curp, nil
+}
+
+// respondPatientError answers with the status matching the type of an AppError, or 500 with fallback
+func respondPatientError(c *gin.Context, err error, fallback string) {
+	var appErr *repository.AppError
+	if errors.As(err, &appErr) {
+		switch appErr.Type {
+		case repository.ValidationError:
+			c.JSON(http.StatusBadRequest, gin.H{"error": appErr.Error()})
+			return
+		case repository.ResourceAlreadyExists:
+			c.JSON(http.StatusConflict, gin.H{"error": appErr.Error()})
+			return
+		case repository.NotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": appErr.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+}
+
+func (h *Handler) findPatient(c *gin.Context) (repository.Patient, bool) {
+	var patient repository.Patient
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return patient, false
+	}
+	if err := h.db(c).Where("id = ?", id).First(&patient).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return patient, false
+	}
+	return patient, true
+}
+
+// patientFields are the fields patients can be read with
+var patientFields = searchSpec{
+	model: &repository.Patient{},
+	fields: map[string]searchField{
+		"id":         {column: "id", kind: searchInt},
+		"first_name": {column: "first_name"},
+		"last_name":  {column: "last_name"},
+		"birth_date": {column: "birth_date", kind: searchTime},
+		"sex":        {column: "sex"},
+		"curp":       {column: "curp", nullable: true},
+		"email":      {column: "email"},
+		"phone":      {column: "phone"},
+		"created_by": {column: "created_by", kind: searchInt},
+		"created_at": {column: "created_at", kind: searchTime},
+		"updated_at": {column: "updated_at", kind: searchTime},
+		"deleted_at": {column: "deleted_at", kind: searchTime, nullable: true},
+	},
+}
+
+func (h *Handler) GetPatient(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	sel, err := patientFields.selection(c, h.db(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	db, ok := h.readScope(c)
+	if !ok {
+		return
+	}
+	var patient repository.Patient
+	if err := sel.apply(c, db, "version").Where("id = ?", id).First(&patient).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+	respondVersioned(c, patient.Version, sel.render(patient))
+}
+
+func (h *Handler) CreatePatient(c *gin.Context) {
+	var req CreatePatientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	birthDate, err := parseBirthDate(req.BirthDate)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sex := repository.PatientSex(req.Sex)
+	if !sex.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sex, must be one of: " + strings.Join(repository.ValidPatientSexes, ", ")})
+		return
+	}
+	curp, err := h.patientCURP(h.db(c), req.CURP, 0)
+	if err != nil {
+		respondPatientError(c, err, "Could not create patient")
+		return
+	}
+
+	patient := repository.Patient{
+		FirstName: strings.TrimSpace(req.FirstName),
+		LastName:  strings.TrimSpace(req.LastName),
+		BirthDate: birthDate,
+		Sex:       sex,
+		CURP:      curp,
+		Email:     strings.TrimSpace(req.Email),
+		Phone:     strings.TrimSpace(req.Phone),
+		CreatedBy: c.GetInt("user_id"),
+	}
+	if err := h.db(c).Create(&patient).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create patient"})
+		return
+	}
+	c.JSON(http.StatusCreated, patient)
+}
+
+func (h *Handler) UpdatePatient(c *gin.Context) {
+	patient, ok := h.findPatient(c)
+	if !ok || !checkIfMatch(c, patient.Version) {
+		return
+	}
+	var req UpdatePatientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Prepare fields to update
+	updates := make(map[string]interface{})
+	updates["updated_at"] = time.Now()
+
+	if req.FirstName != nil {
+		updates["first_name"] = strings.TrimSpace(*req.FirstName)
+	}
+	if req.LastName != nil {
+		updates["last_name"] = strings.TrimSpace(*req.LastName)
+	}
+	if req.BirthDate != nil {
+		birthDate, err := parseBirthDate(*req.BirthDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		updates["birth_date"] = birthDate
+	}
+	if req.Sex != nil {
+		sex := repository.PatientSex(*req.Sex)
+		if !sex.IsValid() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sex, must be one of: " + strings.Join(repository.ValidPatientSexes, ", ")})
+			return
+		}
+		updates["sex"] = sex
+	}
+	if req.CURP != nil {
+		curp, err := h.patientCURP(h.db(c), *req.CURP, patient.ID)
+		if err != nil {
+			respondPatientError(c, err, "Could not update patient")
+			return
+		}
+		updates["curp"] = curp
+	}
+	if req.Email != nil {
+		updates["email"] = strings.TrimSpace(*req.Email)
+	}
+	if req.Phone != nil {
+		updates["phone"] = strings.TrimSpace(*req.Phone)
+	}
+
+	// Return an error if there are no fields to update
+	if len(updates) <= 1 { // Solo updated_at
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	updates["version"] = nextVersion
+	res := h.db(c).Model(&repository.Patient{}).Where("id = ? AND version = ?", patient.ID, patient.Version).Updates(updates)
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update patient"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		respondVersionConflict(c, 0)
+		return
+	}
+	if err := h.db(c).First(&patient, patient.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve updated patient"})
+		return
+	}
+	c.Header("ETag", etag(patient.Version))
+	c.JSON(http.StatusOK, patient)
+}
+
+// DeletePatient hides the patient from searches; encounters and prescriptions keep referencing it
+func (h *Handler) DeletePatient(c *gin.Context) {
+	patient, ok := h.findPatient(c)
+	if !ok || !checkIfMatch(c, patient.Version) {
+		return
+	}
+	res := h.db(c).Model(&repository.Patient{}).Where("id = ? AND version = ?", patient.ID, patient.Version).
+		Updates(deletion(c))
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete patient"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		respondVersionConflict(c, 0)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Patient deleted successfully"})
+}
+
+// patientSearchQuery builds the patient query over db filtered by the _like and _match parameters of the
+// request
+func (h *Handler) patientSearchQuery(c *gin.Context, db *gorm.DB) *gorm.DB {
+	likeFilters := map[string]string{
+		"first_name": c.Query("first_name_like"),
+		"last_name":  c.Query("last_name_like"),
+		"curp":       c.Query("curp_like"),
+		"email":      c.Query("email_like"),
+		"phone":      c.Query("phone_like"),
+	}
+
+	matches := map[string][]string{
+		"first_name": c.QueryArray("first_name_match"),
+		"last_name":  c.QueryArray("last_name_match"),
+		"curp":       c.QueryArray("curp_match"),
+		"sex":        c.QueryArray("sex_match"),
+		"birth_date": c.QueryArray("birth_date_match"),
+	}
+
+	query := db.Model(&repository.Patient{})
+
+	for col, val := range likeFilters {
+		if val != "" {
+			query = query.Where(col+" ILIKE ?", "%"+val+"%")
+		}
+	}
+
+	for col, vals := range matches {
+		if len(vals) > 0 {
+			query = query.Where(col+" IN (?)", vals)
+		}
+	}
+
+	return query
+}
+
+func (h *Handler) SearchPatientsPaginated(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 10
+	}
+
+	var (
+		patients []repository.Patient
+		total    int64
+	)
+
+	sel, err := patientFields.selection(c, h.db(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	db, ok := h.readScope(c)
+	if !ok {
+		return
+	}
+	query := h.patientSearchQuery(c, db)
+
+	query.Count(&total)
+
+	offset := (page - 1) * limit
+	if err := sel.apply(c, query).Order("last_name, first_name, id").Offset(offset).Limit(limit).Find(&patients).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not perform search"})
+		return
+	}
+
+	totalPages := int((total + int64(limit) - 1) / int64(limit))
+	c.JSON(http.StatusOK, gin.H{
+		"current_page":  page,
+		"patients":      sel.render(patients),
+		"page_size":     limit,
+		"total_pages":   totalPages,
+		"total_records": total,
+	})
+}
+
+func (h *Handler) SearchPatientCoincidencesByProperty(c *gin.Context) {
+	property := c.Query("property")
+	searchText := c.Query("search_text")
+	allowed := map[string]bool{
+		"first_name": true,
+		"last_name":  true,
+		"curp":       true,
+		"email":      true,
+	}
+	if !allowed[property] || searchText == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid property or search_text"})
+		return
+	}
+
+	var results []string
+	if err := h.db(c).
+		Model(&repository.Patient{}).
+		Distinct(property).
+		Where(property+" ILIKE ?", "%"+searchText+"%").
+		Limit(20).
+		Pluck(property, &results).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not query coincidences"})
+		return
+	}
+
+	c.JSON(http.StatusOK, results)
+}
@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"ia-boilerplate/src/repository"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+type PrescriptionItemRequest struct {
+	MedicineID     int              `json:"medicineId" binding:"required"`
+	Dose           *decimal.Decimal `json:"dose" binding:"required"`
+	DoseUnit       string           `json:"doseUnit" binding:"required,max=30"`
+	Route          string           `json:"route" binding:"max=50"`
+	FrequencyHours int              `json:"frequencyHours" binding:"required,gt=0"`
+	DurationDays   int              `json:"durationDays" binding:"required,gt=0"`
+	Quantity       int              `json:"quantity" binding:"required,gt=0"`
+	Instructions   string           `json:"instructions"`
+}
+
+type CreatePrescriptionRequest struct {
+	EncounterID int                       `json:"encounterId" binding:"required"`
+	Notes       string                    `json:"notes"`
+	Items       []PrescriptionItemRequest `json:"items" binding:"required,min=1,dive"`
+}
+
+// prescriptionItems validates the items of a prescription: a positive dose of a catalog medicine, each
+// medicine listed once
+func prescriptionItems(db *gorm.DB, requests []PrescriptionItemRequest) ([]repository.PrescriptionItem, error) {
+	items := make([]repository.PrescriptionItem, 0, len(requests))
+	ids := make([]int, 0, len(requests))
+	seen := make(map[int]bool, len(requests))
+	for _, req := range requests {
+		if seen[req.MedicineID] {
+			return nil, repository.NewAppError(fmt.Errorf("medicine %d is listed more than once", req.MedicineID), repository.ValidationError)
+		}
+		seen[req.MedicineID] = true
+		if !req.Dose.IsPositive() {
+			return nil, repository.NewAppError(fmt.Errorf("the dose of medicine %d must be positive", req.MedicineID), repository.ValidationError)
+		}
+		ids = append(ids, req.MedicineID)
+		items = append(items, repository.PrescriptionItem{
+			MedicineID:     req.MedicineID,
+			Dose:           *req.Dose,
+			DoseUnit:       strings.TrimSpace(req.DoseUnit),
+			Route:          strings.TrimSpace(req.Route),
+			FrequencyHours: req.FrequencyHours,
+			DurationDays:   req.DurationDays,
+			Quantity:       req.Quantity,
+			Instructions:   req.Instructions,
+		})
+	}
+
+	var found []int
+	if err := db.Model(&repository.Medicine{}).Where("id IN ?", ids).Pluck("id", &found).Error; err != nil {
+		return nil, err
+	}
+	if len(found) != len(ids) {
+		exists := make(map[int]bool, len(found))
+		for _, id := range found {
+			exists[id] = true
+		}
+		var missing []string
+		for _, id := range ids {
+			if !exists[id] {
+				missing = append(missing, strconv.Itoa(id))
+			}
+		}
+		return nil, repository.NewAppError(errors.New("Medicines not found: "+strings.Join(missing, ", ")), repository.ValidationError)
+	}
+	return items, nil
+}
+
+// prescriptionFields are the fields and relations prescriptions can be read with; expand=items brings the
+// medicines of the items
+var prescriptionFields = searchSpec{
+	model: &repository.Prescription{},
+	fields: map[string]searchField{
+		"id":           {column: "id", kind: searchInt},
+		"encounter_id": {column: "encounter_id", kind: searchInt},
+		"patient_id":   {column: "patient_id", kind: searchInt},
+		"author_id":    {column: "author_id", kind: searchInt},
+		"notes":        {column: "notes"},
+		"issued_at":    {column: "issued_at", kind: searchTime},
+		"created_at":   {column: "created_at", kind: searchTime},
+	},
+	expand: map[string]expansion{
+		"patient": {preloads: []string{"Patient"}, columns: []string{"patient_id"}},
+		"author":  {preloads: []string{"Author"}, columns: []string{"author_id"}},
+		"items": {
+			preloads: []string{"Items", "Items.Medicine"},
+			scope:    func(_ *gin.Context, tx *gorm.DB) *gorm.DB { return tx.Order("id") },
+		},
+	},
+}
+
+// loadPrescription reads a prescription with its patient, author and medicines
+func loadPrescription(db *gorm.DB, id int) (repository.Prescription, error) {
+	var prescription repository.Prescription
+	err := db.Preload("Patient").Preload("Author").
+		Preload("Items", func(tx *gorm.DB) *gorm.DB { return tx.Order("id") }).
+		Preload("Items.Medicine").
+		First(&prescription, id).Error
+	return prescription, err
+}
+
+func (h *Handler) GetPrescription(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	sel, err := prescriptionFields.selection(c, h.db(c), "patient", "author", "items")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var prescription repository.Prescription
+	if err := sel.apply(c, h.db(c)).First(&prescription, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Prescription not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, sel.render(prescription))
+}
+
+// CreatePrescription issues a prescription in an encounter; only the author of the encounter can
+func (h *Handler) CreatePrescription(c *gin.Context) {
+	var req CreatePrescriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var encounter repository.Encounter
+	if err := h.db(c).First(&encounter, req.EncounterID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Encounter not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create prescription"})
+		}
+		return
+	}
+	authorID := c.GetInt("user_id")
+	if encounter.AuthorID != authorID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the author of the encounter can prescribe in it"})
+		return
+	}
+	items, err := prescriptionItems(h.db(c), req.Items)
+	if err != nil {
+		respondPatientError(c, err, "Could not create prescription")
+		return
+	}
+
+	prescription := repository.Prescription{
+		EncounterID: encounter.ID,
+		PatientID:   encounter.PatientID,
+		AuthorID:    authorID,
+		Notes:       req.Notes,
+		Items:       items,
+		IssuedAt:    time.Now(),
+	}
+	if err := h.db(c).Create(&prescription).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create prescription"})
+		return
+	}
+
+	created, err := loadPrescription(h.db(c), prescription.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve created prescription"})
+		return
+	}
+	c.JSON(http.StatusCreated, created)
+}
+
+// prescriptionSearchQuery builds the prescription query filtered by the _match parameters of the request.
+// medicine_id_match keeps the prescriptions with any of the given medicines, and issued_from and issued_to
+// bound their issue date.
+func (h *Handler) prescriptionSearchQuery(c *gin.Context) (*gorm.DB, error) {
+	matches := map[string][]string{
+		"patient_id":   c.QueryArray("patient_id_match"),
+		"author_id":    c.QueryArray("author_id_match"),
+		"encounter_id": c.QueryArray("encounter_id_match"),
+	}
+
+	query := h.db(c).Model(&repository.Prescription{})
+
+	for col, vals := range matches {
+		if len(vals) > 0 {
+			query = query.Where(col+" IN (?)", vals)
+		}
+	}
+
+	if medicines := c.QueryArray("medicine_id_match"); len(medicines) > 0 {
+		query = query.Where("EXISTS (SELECT 1 FROM prescription_items i WHERE i.prescription_id = prescriptions.id AND i.medicine_id IN (?))", medicines)
+	}
+	if value := c.Query("issued_from"); value != "" {
+		from, err := parseInstant(value)
+		if err != nil {
+			return nil, errors.New("Invalid issued_from, must be RFC3339 or YYYY-MM-DD")
+		}
+		query = query.Where("issued_at >= ?", from)
+	}
+	if value := c.Query("issued_to"); value != "" {
+		to, err := parseInstant(value)
+		if err != nil {
+			return nil, errors.New("Invalid issued_to, must be RFC3339 or YYYY-MM-DD")
+		}
+		query = query.Where("issued_at < ?", to)
+	}
+
+	return query, nil
+}
+
+func (h *Handler) SearchPrescriptionsPaginated(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 10
+	}
+
+	var (
+		prescriptions []repository.Prescription
+		total         int64
+	)
+
+	query, err := h.prescriptionSearchQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sel, err := prescriptionFields.selection(c, h.db(c), "patient", "items")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query.Count(&total)
+
+	offset := (page - 1) * limit
+	if err := sel.apply(c, query).
+		Order("issued_at DESC, id DESC").Offset(offset).Limit(limit).Find(&prescriptions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not perform search"})
+		return
+	}
+
+	totalPages := int((total + int64(limit) - 1) / int64(limit))
+	c.JSON(http.StatusOK, gin.H{
+		"current_page":  page,
+		"prescriptions": sel.render(prescriptions),
+		"page_size":     limit,
+		"total_pages":   totalPages,
+		"total_records": total,
+	})
+}
@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"ia-boilerplate/src/pdf"
+	"ia-boilerplate/src/repository"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boombuler/barcode/qr"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	prescriptionMargin   = 50.0
+	prescriptionQRSize   = 110.0
+	prescriptionBodySize = 10.0
+)
+
+// prescriptionSigningKey reads the secret the verification codes of prescriptions are signed with
+func prescriptionSigningKey() ([]byte, error) {
+	key := os.Getenv("PRESCRIPTION_SIGNING_KEY")
+	if key == "" {
+		return nil, errors.New("missing environment variable: PRESCRIPTION_SIGNING_KEY")
+	}
+	return []byte(key), nil
+}
+
+// prescriptionSignature is the HMAC-SHA256 of the contents of a prescription: changing the prescriber,
+// the patient, the issue date or any medicine, dose or quantity invalidates the signature. Items are
+// expected in the order loadPrescription reads them.
+func prescriptionSignature(key []byte, p repository.Prescription) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "prescription|%d|%d|%d|%d|%s", p.ID, p.EncounterID, p.PatientID, p.AuthorID, p.IssuedAt.UTC().Format(time.RFC3339))
+	for _, item := range p.Items {
+		fmt.Fprintf(&sb, "|%d:%s:%s:%d:%d:%d", item.MedicineID, item.Dose.String(), item.DoseUnit, item.FrequencyHours, item.DurationDays, item.Quantity)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(sb.String()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// prescriptionBaseURL reads the public address of the API the verification links point to. It is never
+// taken from the request, whose Host and X-Forwarded-Proto headers the client controls.
+func prescriptionBaseURL() (string, error) {
+	base := strings.TrimRight(os.Getenv("PUBLIC_BASE_URL"), "/")
+	if base == "" {
+		return "", errors.New("missing environment variable: PUBLIC_BASE_URL")
+	}
+	return base, nil
+}
+
+// prescriptionVerificationURL is the public address the QR code of a prescription points to
+func prescriptionVerificationURL(base string, id int, signature string) string {
+	return fmt.Sprintf("%s/prescriptions/%d/verify?signature=%s", base, id, signature)
+}
+
+// prescriberName is the name printed for the author of a prescription
+func prescriberName(u *repository.User) string {
+	if u == nil {
+		return ""
+	}
+	name := strings.TrimSpace(u.FirstName + " " + u.LastName)
+	if name == "" {
+		name = u.Username
+	}
+	return name
+}
+
+// GetPrescriptionPDF renders a printable prescription with the prescriber, the patient, the diagnoses
+// of the encounter, the medicines and a QR code with its signed verification URL
+func (h *Handler) GetPrescriptionPDF(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	key, err := prescriptionSigningKey()
+	if err != nil {
+		h.Logger.Error("Prescription signing is not configured", zap.Error(err))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Prescription signing is not configured"})
+		return
+	}
+	base, err := prescriptionBaseURL()
+	if err != nil {
+		h.Logger.Error("Prescription verification links are not configured", zap.Error(err))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Prescription verification links are not configured"})
+		return
+	}
+	prescription, err := loadPrescription(h.db(c), id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Prescription not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+	var diagnoses []repository.EncounterDiagnosis
+	if err := h.db(c).Preload("ICDCie").Where("encounter_id = ?", prescription.EncounterID).
+		Order("rank, id").Find(&diagnoses).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	verifyURL := prescriptionVerificationURL(base, prescription.ID, prescriptionSignature(key, prescription))
+	content, err := renderPrescriptionPDF(prescription, diagnoses, verifyURL)
+	if err != nil {
+		h.Logger.Error("Could not render prescription", zap.Int("id", prescription.ID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not render prescription"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`inline; filename="prescription-%d.pdf"`, prescription.ID))
+	c.Data(http.StatusOK, "application/pdf", content)
+}
+
+// VerifyPrescription is the public endpoint behind the QR code of a printed prescription. It confirms
+// who issued the prescription, when and what it dispenses, and never answers with patient data.
+// Unknown prescriptions and wrong signatures are reported alike.
+func (h *Handler) VerifyPrescription(c *gin.Context) {
+	key, err := prescriptionSigningKey()
+	if err != nil {
+		h.Logger.Error("Prescription signing is not configured", zap.Error(err))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Prescription signing is not configured"})
+		return
+	}
+	unverified := gin.H{"valid": false, "error": "Prescription could not be verified"}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, unverified)
+		return
+	}
+	signature := strings.ToLower(c.Query("signature"))
+	if signature == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"valid": false, "error": "Missing signature"})
+		return
+	}
+
+	prescription, err := loadPrescription(h.db(c), id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, unverified)
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+	if !hmac.Equal([]byte(signature), []byte(prescriptionSignature(key, prescription))) {
+		c.JSON(http.StatusNotFound, unverified)
+		return
+	}
+
+	items := make([]gin.H, 0, len(prescription.Items))
+	for _, item := range prescription.Items {
+		medicine := ""
+		if item.Medicine != nil {
+			medicine = item.Medicine.Description
+		}
+		items = append(items, gin.H{"medicine": medicine, "quantity": item.Quantity})
+	}
+	prescriber := gin.H{"name": prescriberName(prescription.Author), "jobPosition": ""}
+	if prescription.Author != nil {
+		prescriber["jobPosition"] = prescription.Author.JobPosition
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"valid":          true,
+		"prescriptionId": prescription.ID,
+		"issuedAt":       prescription.IssuedAt,
+		"prescriber":     prescriber,
+		"items":          items,
+	})
+}
+
+// prescriptionLayout writes the lines of a prescription top to bottom, starting a new page when the
+// current one is full
+type prescriptionLayout struct {
+	doc  *pdf.Document
+	page *pdf.Page
+	y    float64
+}
+
+func (l *prescriptionLayout) newPage() {
+	l.page = l.doc.AddPage()
+	l.y = l.doc.Height - prescriptionMargin
+}
+
+// reserve starts a new page unless height points fit above the bottom margin
+func (l *prescriptionLayout) reserve(height float64) {
+	if l.y-height < prescriptionMargin {
+		l.newPage()
+	}
+}
+
+// text writes wrapped text indented from the left margin
+func (l *prescriptionLayout) text(font pdf.Font, size, indent float64, text string) {
+	width := l.doc.Width - 2*prescriptionMargin - indent
+	for _, line := range pdf.Wrap(font, size, width, text) {
+		l.reserve(size * 1.4)
+		l.y -= size * 1.4
+		l.page.Text(prescriptionMargin+indent, l.y, font, size, line)
+	}
+}
+
+func (l *prescriptionLayout) heading(text string) {
+	l.reserve(40)
+	l.y -= 10
+	l.text(pdf.HelveticaBold, 12, 0, text)
+	l.y -= 4
+	l.page.Line(prescriptionMargin, l.y, l.doc.Width-prescriptionMargin, l.y, 0.5)
+	l.y -= 2
+}
+
+// renderPrescriptionPDF lays out a prescription on Letter pages
+func renderPrescriptionPDF(p repository.Prescription, diagnoses []repository.EncounterDiagnosis, verifyURL string) ([]byte, error) {
+	doc := pdf.New(pdf.LetterWidth, pdf.LetterHeight)
+	doc.Title = fmt.Sprintf("Prescription %d", p.ID)
+	l := &prescriptionLayout{doc: doc}
+	l.newPage()
+
+	l.text(pdf.HelveticaBold, 18, 0, "Medical prescription")
+	l.text(pdf.Helvetica, prescriptionBodySize, 0, fmt.Sprintf("Folio %d - issued %s", p.ID, p.IssuedAt.Format("2006-01-02 15:04")))
+
+	l.heading("Prescriber")
+	l.text(pdf.HelveticaBold, prescriptionBodySize, 0, prescriberName(p.Author))
+	if p.Author != nil {
+		if p.Author.JobPosition != "" {
+			l.text(pdf.Helvetica, prescriptionBodySize, 0, p.Author.JobPosition)
+		}
+		l.text(pdf.Helvetica, prescriptionBodySize, 0, p.Author.Email)
+	}
+
+	if p.Patient != nil {
+		l.heading("Patient")
+		l.text(pdf.HelveticaBold, prescriptionBodySize, 0, p.Patient.FirstName+" "+p.Patient.LastName)
+		details := fmt.Sprintf("Born %s, %s", p.Patient.BirthDate.Format("2006-01-02"), p.Patient.Sex)
+		if p.Patient.CURP != nil {
+			details += ", CURP " + *p.Patient.CURP
+		}
+		l.text(pdf.Helvetica, prescriptionBodySize, 0, details)
+	}
+
+	if len(diagnoses) > 0 {
+		l.heading("Diagnoses")
+		for _, d := range diagnoses {
+			if d.ICDCie == nil {
+				continue
+			}
+			l.text(pdf.Helvetica, prescriptionBodySize, 0, fmt.Sprintf("%s - %s (%s)", d.ICDCie.Code, d.ICDCie.Description, d.Rank))
+		}
+	}
+
+	l.heading("Medicines")
+	for i, item := range p.Items {
+		medicine := fmt.Sprintf("medicine %d", item.MedicineID)
+		if item.Medicine != nil {
+			medicine = item.Medicine.Description
+		}
+		l.text(pdf.HelveticaBold, prescriptionBodySize, 0, fmt.Sprintf("%d. %s", i+1, medicine))
+		dosage := fmt.Sprintf("%s %s every %d hours for %d days", item.Dose.String(), item.DoseUnit, item.FrequencyHours, item.DurationDays)
+		if item.Route != "" {
+			dosage += ", " + item.Route
+		}
+		l.text(pdf.Helvetica, prescriptionBodySize, 14, dosage+fmt.Sprintf(". Dispense %d.", item.Quantity))
+		if item.Instructions != "" {
+			l.text(pdf.Helvetica, prescriptionBodySize, 14, item.Instructions)
+		}
+	}
+
+	if p.Notes != "" {
+		l.heading("Notes")
+		l.text(pdf.Helvetica, prescriptionBodySize, 0, p.Notes)
+	}
+
+	// The QR code and the signature line share the last block of the document
+	code, err := qr.Encode(verifyURL, qr.M, qr.Auto)
+	if err != nil {
+		return nil, err
+	}
+	l.reserve(prescriptionQRSize + 30)
+	l.y -= prescriptionQRSize + 20
+	modules := code.Bounds().Dx()
+	module := prescriptionQRSize / float64(modules)
+	for row := 0; row < modules; row++ {
+		for col := 0; col < modules; {
+			if !isDarkModule(code.At(col, row)) {
+				col++
+				continue
+			}
+			start := col
+			for col < modules && isDarkModule(code.At(col, row)) {
+				col++
+			}
+			l.page.Rect(prescriptionMargin+float64(start)*module, l.y+prescriptionQRSize-float64(row+1)*module, float64(col-start)*module, module)
+		}
+	}
+
+	right := prescriptionMargin + prescriptionQRSize + 20
+	signatureY := l.y + prescriptionQRSize - 50
+	l.page.Line(right, signatureY, doc.Width-prescriptionMargin, signatureY, 0.5)
+	l.page.Text(right, signatureY-12, pdf.Helvetica, prescriptionBodySize, prescriberName(p.Author))
+	l.page.Gray(0.4)
+	captionY := l.y + 24
+	for _, line := range pdf.Wrap(pdf.Helvetica, 7, doc.Width-prescriptionMargin-right, "Scan the code or open "+verifyURL+" to verify this prescription") {
+		l.page.Text(right, captionY, pdf.Helvetica, 7, line)
+		captionY -= 9
+	}
+
+	return doc.Bytes()
+}
@@ -0,0 +1,547 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"ia-boilerplate/src/repository"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// taxRatesByCode loads every tax rate keyed by its lowercase code
+func (h *Handler) taxRatesByCode() (map[string]repository.TaxRate, error) {
+	var rates []repository.TaxRate
+	if err := h.Repository.DB.Find(&rates).Error; err != nil {
+		return nil, err
+	}
+	byCode := make(map[string]repository.TaxRate, len(rates))
+	for _, rate := range rates {
+		byCode[strings.ToLower(rate.Code)] = rate
+	}
+	return byCode, nil
+}
+
+func taxRateCodes(rates map[string]repository.TaxRate) []string {
+	codes := make([]string, 0, len(rates))
+	for _, rate := range rates {
+		codes = append(codes, rate.Code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func (h *Handler) GetTaxRates(c *gin.Context) {
+	var rates []repository.TaxRate
+	if err := h.db(c).Order("id").Find(&rates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve tax rates"})
+		return
+	}
+	c.JSON(http.StatusOK, rates)
+}
+
+type CreateTaxRateRequest struct {
+	Code        string           `json:"code" binding:"required"`
+	Description string           `json:"description"`
+	Rate        *decimal.Decimal `json:"rate" binding:"required"`
+	Exempt      bool             `json:"exempt"`
+}
+
+func (h *Handler) CreateTaxRate(c *gin.Context) {
+	var req CreateTaxRateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.requirePlatformAdmin(c, "create tax rates") {
+		return
+	}
+	if req.Rate.IsNegative() || req.Rate.GreaterThanOrEqual(decimal.NewFromInt(1)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rate, must be a fraction between 0 and 1"})
+		return
+	}
+	if req.Exempt && !req.Rate.IsZero() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Exempt tax rates must have a zero rate"})
+		return
+	}
+
+	rate := repository.TaxRate{
+		Code:        strings.ToLower(req.Code),
+		Description: req.Description,
+		Rate:        *req.Rate,
+		Exempt:      req.Exempt,
+	}
+	if err := h.db(c).Create(&rate).Error; err != nil {
+		if strings.Contains(err.Error(), "duplicate key value") {
+			c.JSON(http.StatusConflict, gin.H{"error": "Could not create tax rate: duplicate code"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create tax rate"})
+		}
+		return
+	}
+	c.JSON(http.StatusCreated, rate)
+}
+
+func (h *Handler) GetPriceLists(c *gin.Context) {
+	var lists []repository.PriceList
+	if err := h.db(c).Order("id").Find(&lists).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve price lists"})
+		return
+	}
+	c.JSON(http.StatusOK, lists)
+}
+
+func (h *Handler) GetPriceList(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var list repository.PriceList
+	if err := h.db(c).First(&list, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Price list not found"})
+		return
+	}
+	respondVersioned(c, list.Version, list)
+}
+
+type CreatePriceListRequest struct {
+	Name         string `json:"name" binding:"required"`
+	CustomerType string `json:"customerType" binding:"required"`
+	Institution  string `json:"institution"`
+	Currency     string `json:"currency"`
+	Enabled      *bool  `json:"enabled"`
+}
+
+func (h *Handler) CreatePriceList(c *gin.Context) {
+	var req CreatePriceListRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	customerType := repository.CustomerType(req.CustomerType)
+	if !customerType.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid customer type, must be one of: " + strings.Join(repository.ValidCustomerTypes, ", ")})
+		return
+	}
+	if customerType == repository.CustomerTypeInstitution && req.Institution == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Institution is required for institution price lists"})
+		return
+	}
+	currency := strings.ToUpper(req.Currency)
+	if currency == "" {
+		currency = "MXN"
+	}
+	enabled := true
+	if req.Enabled != nil {
+		enabled = *req.Enabled
+	}
+
+	list := repository.PriceList{
+		Name:         req.Name,
+		CustomerType: customerType,
+		Institution:  req.Institution,
+		Currency:     currency,
+		Enabled:      enabled,
+	}
+	if err := h.db(c).Create(&list).Error; err != nil {
+		if strings.Contains(err.Error(), "duplicate key value") {
+			c.JSON(http.StatusConflict, gin.H{"error": "Could not create price list: duplicate name"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create price list"})
+		}
+		return
+	}
+	c.JSON(http.StatusCreated, list)
+}
+
+type UpdatePriceListRequest struct {
+	Name         *string `json:"name"`
+	CustomerType *string `json:"customerType"`
+	Institution  *string `json:"institution"`
+	Currency     *string `json:"currency"`
+	Enabled      *bool   `json:"enabled"`
+}
+
+func (h *Handler) UpdatePriceList(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var req UpdatePriceListRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var existing repository.PriceList
+	if err := h.db(c).First(&existing, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Price list not found"})
+		return
+	}
+	if !checkIfMatch(c, existing.Version) {
+		return
+	}
+
+	updates := make(map[string]interface{})
+	updates["updated_at"] = time.Now()
+
+	if req.Name != nil {
+		updates["name"] = *req.Name
+	}
+	if req.CustomerType != nil {
+		customerType := repository.CustomerType(*req.CustomerType)
+		if !customerType.IsValid() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid customer type, must be one of: " + strings.Join(repository.ValidCustomerTypes, ", ")})
+			return
+		}
+		updates["customer_type"] = customerType
+	}
+	if req.Institution != nil {
+		updates["institution"] = *req.Institution
+	}
+	if req.Currency != nil {
+		updates["currency"] = strings.ToUpper(*req.Currency)
+	}
+	if req.Enabled != nil {
+		updates["enabled"] = *req.Enabled
+	}
+
+	if len(updates) <= 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	updates["version"] = nextVersion
+	res := h.db(c).Model(&repository.PriceList{}).Where("id = ? AND version = ?", id, existing.Version).Updates(updates)
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update price list"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		respondVersionConflict(c, 0)
+		return
+	}
+
+	var updated repository.PriceList
+	if err := h.db(c).First(&updated, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve updated price list"})
+		return
+	}
+	c.Header("ETag", etag(updated.Version))
+	c.JSON(http.StatusOK, updated)
+}
+
+type SetMedicinePriceRequest struct {
+	MedicineID int              `json:"medicineId" binding:"required"`
+	Price      *decimal.Decimal `json:"price" binding:"required"`
+	ValidFrom  *time.Time       `json:"validFrom"`
+}
+
+// SetMedicinePrice records a new effective-dated price, closing the currently open one at ValidFrom
+func (h *Handler) SetMedicinePrice(c *gin.Context) {
+	priceListID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var req SetMedicinePriceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Price.IsNegative() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid price, must not be negative"})
+		return
+	}
+	validFrom := time.Now()
+	if req.ValidFrom != nil {
+		validFrom = *req.ValidFrom
+	}
+
+	var list repository.PriceList
+	if err := h.db(c).First(&list, priceListID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Price list not found"})
+		return
+	}
+	var medicine repository.Medicine
+	if err := h.db(c).Where("id = ?", req.MedicineID).First(&medicine).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Medicine not found"})
+		return
+	}
+
+	price := repository.MedicinePrice{
+		PriceListID: priceListID,
+		MedicineID:  req.MedicineID,
+		Price:       req.Price.Round(4),
+		ValidFrom:   validFrom,
+		CreatedBy:   c.GetInt("user_id"),
+	}
+
+	err = h.db(c).Transaction(func(tx *gorm.DB) error {
+		var current repository.MedicinePrice
+		err := tx.Where("price_list_id = ? AND medicine_id = ? AND valid_to IS NULL", priceListID, req.MedicineID).
+			First(&current).Error
+		if err == nil {
+			if !validFrom.After(current.ValidFrom) {
+				return repository.NewAppError(errors.New("validFrom must be after the current price's validFrom "+current.ValidFrom.Format(time.RFC3339)), repository.ResourceAlreadyExists)
+			}
+			if err := tx.Model(&current).Update("valid_to", validFrom).Error; err != nil {
+				return err
+			}
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		return tx.Create(&price).Error
+	})
+	if err != nil {
+		var appErr *repository.AppError
+		switch {
+		case errors.As(err, &appErr):
+			c.JSON(http.StatusConflict, gin.H{"error": appErr.Error()})
+		case strings.Contains(err.Error(), "duplicate key value"):
+			// another request opened a price for the medicine in the list since the current one was read
+			c.JSON(http.StatusConflict, gin.H{"error": "Could not set medicine price: another price was set at the same time, retry"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not set medicine price"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, price)
+}
+
+// GetMedicinePriceHistory lists every price a medicine has had, newest first per price list
+func (h *Handler) GetMedicinePriceHistory(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	query := h.db(c).Where("medicine_id = ? AND price_list_id IN (?)", id, ownPriceLists(h.db(c)))
+	if priceListID := c.Query("price_list_id"); priceListID != "" {
+		listID, err := strconv.Atoi(priceListID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid price_list_id"})
+			return
+		}
+		query = query.Where("price_list_id = ?", listID)
+	}
+
+	var prices []repository.MedicinePrice
+	if err := query.Order("price_list_id, valid_from DESC").Find(&prices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve price history"})
+		return
+	}
+	c.JSON(http.StatusOK, prices)
+}
+
+// ownPriceLists selects the price lists of the organization db is scoped to. Prices belong to the
+// organization of their price list, so they are only read through these.
+func ownPriceLists(db *gorm.DB) *gorm.DB {
+	return db.Session(&gorm.Session{NewDB: true}).Model(&repository.PriceList{}).Select("id")
+}
+
+// effectivePrice returns the price of a medicine in a price list at the given instant
+func (h *Handler) effectivePrice(db *gorm.DB, priceListID, medicineID int, at time.Time) (repository.MedicinePrice, error) {
+	var price repository.MedicinePrice
+	err := db.Where("price_list_id = ? AND medicine_id = ? AND valid_from <= ? AND (valid_to IS NULL OR valid_to > ?)",
+		priceListID, medicineID, at, at).
+		Where("price_list_id IN (?)", ownPriceLists(db)).
+		Order("valid_from DESC").
+		First(&price).Error
+	return price, err
+}
+
+func parseAtParam(c *gin.Context) (time.Time, error) {
+	at := c.Query("at")
+	if at == "" {
+		return time.Now(), nil
+	}
+	return parseInstant(at)
+}
+
+// parseInstant reads an RFC3339 timestamp or a YYYY-MM-DD date, taken as the start of that day in UTC
+func parseInstant(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func (h *Handler) GetMedicineCurrentPrice(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	priceListID, err := strconv.Atoi(c.Query("price_list_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "price_list_id is required"})
+		return
+	}
+	at, err := parseAtParam(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid at, must be RFC3339 or YYYY-MM-DD"})
+		return
+	}
+
+	price, err := h.effectivePrice(h.db(c), priceListID, id, at)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No price found for this medicine in the price list"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, price)
+}
+
+type QuoteItemRequest struct {
+	MedicineID int `json:"medicineId" binding:"required"`
+	Quantity   int `json:"quantity" binding:"required,gt=0"`
+}
+
+type QuoteRequest struct {
+	PriceListID int                `json:"priceListId" binding:"required"`
+	Date        *time.Time         `json:"date"`
+	Items       []QuoteItemRequest `json:"items" binding:"required,min=1,dive"`
+}
+
+type QuoteLine struct {
+	MedicineID  int             `json:"medicineId"`
+	EANCode     string          `json:"eanCode"`
+	Description string          `json:"description"`
+	SatKey      string          `json:"satKey"`
+	UnitType    string          `json:"unitType"`
+	Quantity    int             `json:"quantity"`
+	UnitPrice   decimal.Decimal `json:"unitPrice"`
+	Subtotal    decimal.Decimal `json:"subtotal"`
+	TaxRateCode string          `json:"taxRate"`
+	TaxRate     decimal.Decimal `json:"taxRateValue"`
+	TaxExempt   bool            `json:"taxExempt"`
+	Tax         decimal.Decimal `json:"iva"`
+	Total       decimal.Decimal `json:"total"`
+}
+
+type Quote struct {
+	PriceListID int             `json:"priceListId"`
+	Currency    string          `json:"currency"`
+	Date        time.Time       `json:"date"`
+	Lines       []QuoteLine     `json:"items"`
+	Subtotal    decimal.Decimal `json:"subtotal"`
+	Tax         decimal.Decimal `json:"iva"`
+	Total       decimal.Decimal `json:"total"`
+}
+
+// buildQuote prices a basket against a price list of db at the given date. Amounts are rounded to
+// cents per line, as required for CFDI concepts, and totals are the sum of the rounded lines.
+func (h *Handler) buildQuote(db *gorm.DB, priceListID int, at time.Time, items []QuoteItemRequest) (Quote, error) {
+	var list repository.PriceList
+	if err := db.First(&list, priceListID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return Quote{}, repository.NewAppError(errors.New("price list not found"), repository.NotFound)
+		}
+		return Quote{}, repository.NewAppError(err, repository.RepositoryError)
+	}
+	if !list.Enabled {
+		return Quote{}, repository.NewAppError(errors.New("price list is disabled"), repository.ValidationError)
+	}
+
+	quote := Quote{
+		PriceListID: list.ID,
+		Currency:    list.Currency,
+		Date:        at,
+		Subtotal:    decimal.Zero,
+		Tax:         decimal.Zero,
+		Total:       decimal.Zero,
+	}
+
+	var problems []string
+	for _, item := range items {
+		var medicine repository.Medicine
+		if err := db.Preload("TaxRate").
+			Where("id = ?", item.MedicineID).
+			First(&medicine).Error; err != nil {
+			problems = append(problems, fmt.Sprintf("medicine %d not found", item.MedicineID))
+			continue
+		}
+		if medicine.TaxRate == nil {
+			problems = append(problems, fmt.Sprintf("medicine %d has no tax rate", item.MedicineID))
+			continue
+		}
+		price, err := h.effectivePrice(db, list.ID, medicine.ID, at)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("medicine %d has no price in price list %d", item.MedicineID, list.ID))
+			continue
+		}
+
+		quantity := decimal.NewFromInt(int64(item.Quantity))
+		subtotal := price.Price.Mul(quantity).Round(2)
+		tax := subtotal.Mul(medicine.TaxRate.Rate).Round(2)
+		line := QuoteLine{
+			MedicineID:  medicine.ID,
+			EANCode:     medicine.EANCode,
+			Description: medicine.Description,
+			SatKey:      medicine.SatKey,
+			UnitType:    medicine.UnitType.String(),
+			Quantity:    item.Quantity,
+			UnitPrice:   price.Price,
+			Subtotal:    subtotal,
+			TaxRateCode: medicine.TaxRate.Code,
+			TaxRate:     medicine.TaxRate.Rate,
+			TaxExempt:   medicine.TaxRate.Exempt,
+			Tax:         tax,
+			Total:       subtotal.Add(tax),
+		}
+		quote.Lines = append(quote.Lines, line)
+		quote.Subtotal = quote.Subtotal.Add(line.Subtotal)
+		quote.Tax = quote.Tax.Add(line.Tax)
+		quote.Total = quote.Total.Add(line.Total)
+	}
+
+	if len(problems) > 0 {
+		return quote, repository.NewAppError(errors.New(strings.Join(problems, "; ")), repository.ValidationError)
+	}
+	return quote, nil
+}
+
+func (h *Handler) QuoteBasket(c *gin.Context) {
+	var req QuoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	at := time.Now()
+	if req.Date != nil {
+		at = *req.Date
+	}
+
+	quote, err := h.buildQuote(h.db(c), req.PriceListID, at, req.Items)
+	if err != nil {
+		var appErr *repository.AppError
+		if errors.As(err, &appErr) {
+			switch appErr.Type {
+			case repository.NotFound:
+				c.JSON(http.StatusNotFound, gin.H{"error": "Price list not found"})
+				return
+			case repository.ValidationError:
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Could not quote basket: " + appErr.Error()})
+				return
+			}
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not quote basket"})
+		return
+	}
+
+	c.JSON(http.StatusOK, quote)
+}
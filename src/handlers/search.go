@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// searchFieldKind is how the values of a filter are parsed
+type searchFieldKind int
+
+const (
+	searchText searchFieldKind = iota
+	searchInt
+	searchNumber
+	searchBool
+	searchTime
+)
+
+// searchField is a column a search endpoint can filter and sort by
+type searchField struct {
+	column string
+	kind   searchFieldKind
+	// unaccent makes _like compare without accents nor case, through f_unaccent
+	unaccent bool
+	// nullable columns cannot page by cursor, as NULLs have no place in a keyset comparison
+	nullable bool
+}
+
+// searchSpec whitelists the fields of a search endpoint by their name in the query string. Filters are
+// written as the field name followed by an operator, e.g. code_like=J45, created_at_between=2024-01-01,2024-02-01
+// or parent_id_is_null=true, and sort takes a comma-separated list of fields, each one descending when
+// prefixed with "-". The read endpoints of the resource take the same names in fields, and the names of
+// expand in expand.
+type searchSpec struct {
+	// model is the record the fields belong to
+	model  interface{}
+	fields map[string]searchField
+	expand map[string]expansion
+	// defaultSort orders the results when the request has no sort parameter
+	defaultSort string
+}
+
+// searchOperators are the suffixes of the filter parameters; _match is the original name of _in
+var searchOperators = []string{"_is_null", "_between", "_match", "_like", "_in", "_eq", "_ne", "_gt", "_lt"}
+
+// searchValue parses a filter value according to the kind of its field
+func searchValue(field searchField, raw string) (interface{}, error) {
+	switch field.kind {
+	case searchInt:
+		return strconv.ParseInt(raw, 10, 64)
+	case searchNumber:
+		return strconv.ParseFloat(raw, 64)
+	case searchBool:
+		return strconv.ParseBool(raw)
+	case searchTime:
+		return parseInstant(raw)
+	}
+	return raw, nil
+}
+
+// filter adds the filters of the request to query. Parameters without an operator suffix belong to the
+// endpoint and are left alone; an operator on a field out of the whitelist is an error.
+func (s searchSpec) filter(c *gin.Context, query *gorm.DB) (*gorm.DB, error) {
+	params := c.Request.URL.Query()
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	// a stable order keeps the generated SQL the same for the same request
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var operator string
+		for _, suffix := range searchOperators {
+			if strings.HasSuffix(key, suffix) {
+				operator = suffix[1:]
+				break
+			}
+		}
+		if operator == "" {
+			continue
+		}
+		name := strings.TrimSuffix(key, "_"+operator)
+		field, ok := s.fields[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown filter %s, %s cannot be filtered", key, name)
+		}
+		values := params[key]
+		col := field.column
+
+		switch operator {
+		case "like":
+			if field.kind != searchText {
+				return nil, fmt.Errorf("Invalid filter %s, like applies to text fields", key)
+			}
+			for _, val := range values {
+				if val == "" {
+					continue
+				}
+				if field.unaccent {
+					query = query.Where("f_unaccent(lower("+col+")) LIKE f_unaccent(lower(?))", "%"+val+"%")
+				} else {
+					query = query.Where(col+" ILIKE ?", "%"+val+"%")
+				}
+			}
+		case "in", "match":
+			parsed := make([]interface{}, 0, len(values))
+			for _, val := range values {
+				v, err := searchValue(field, val)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid value %q for %s", val, key)
+				}
+				parsed = append(parsed, v)
+			}
+			if len(parsed) > 0 {
+				query = query.Where(col+" IN (?)", parsed)
+			}
+		case "eq", "ne", "gt", "lt":
+			comparison := map[string]string{"eq": " = ?", "ne": " <> ?", "gt": " > ?", "lt": " < ?"}[operator]
+			for _, val := range values {
+				v, err := searchValue(field, val)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid value %q for %s", val, key)
+				}
+				query = query.Where(col+comparison, v)
+			}
+		case "between":
+			for _, val := range values {
+				bounds := strings.SplitN(val, ",", 2)
+				if len(bounds) != 2 {
+					return nil, fmt.Errorf("Invalid value %q for %s, must be two comma-separated bounds", val, key)
+				}
+				from, errFrom := searchValue(field, strings.TrimSpace(bounds[0]))
+				to, errTo := searchValue(field, strings.TrimSpace(bounds[1]))
+				if errFrom != nil || errTo != nil {
+					return nil, fmt.Errorf("Invalid value %q for %s", val, key)
+				}
+				query = query.Where(col+" BETWEEN ? AND ?", from, to)
+			}
+		case "is_null":
+			for _, val := range values {
+				isNull, err := strconv.ParseBool(val)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid value %q for %s, must be true or false", val, key)
+				}
+				if isNull {
+					query = query.Where(col + " IS NULL")
+				} else {
+					query = query.Where(col + " IS NOT NULL")
+				}
+			}
+		}
+	}
+	return query, nil
+}
+
+// searchSort is a column of the order of a search
+type searchSort struct {
+	name  string
+	field searchField
+	desc  bool
+}
+
+// clause renders the sort as an ORDER BY clause
+func (s searchSort) clause() string {
+	if s.desc {
+		return s.field.column + " DESC"
+	}
+	return s.field.column + " ASC"
+}
+
+// order reads the sort parameter. id is appended to break ties so that pages never overlap nor skip
+// records.
+func (s searchSpec) order(c *gin.Context) ([]searchSort, error) {
+	value := c.DefaultQuery("sort", s.defaultSort)
+	var sorts []searchSort
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		desc := strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		field, ok := s.fields[name]
+		if !ok {
+			return nil, errors.New("Invalid sort, cannot sort by " + name)
+		}
+		if seen[field.column] {
+			continue
+		}
+		seen[field.column] = true
+		sorts = append(sorts, searchSort{name: name, field: field, desc: desc})
+	}
+	if !seen["id"] {
+		sorts = append(sorts, searchSort{name: "id", field: searchField{column: "id", kind: searchInt}})
+	}
+	return sorts, nil
+}
+
+// searchPage is the page of results requested with the page and limit parameters
+type searchPage struct {
+	number int
+	limit  int
+}
+
+// defaultMaxPageSize bounds limit unless SEARCH_MAX_PAGE_SIZE says otherwise
+const defaultMaxPageSize = 100
+
+// searchMaxPageSize is the largest limit a search answers with
+func searchMaxPageSize() int {
+	if max, err := strconv.Atoi(os.Getenv("SEARCH_MAX_PAGE_SIZE")); err == nil && max > 0 {
+		return max
+	}
+	return defaultMaxPageSize
+}
+
+// parseSearchPage reads page and limit; a limit above the maximum page size is lowered to it
+func parseSearchPage(c *gin.Context) searchPage {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 10
+	}
+	if max := searchMaxPageSize(); limit > max {
+		limit = max
+	}
+	return searchPage{number: page, limit: limit}
+}
+
+func (p searchPage) offset() int {
+	return (p.number - 1) * p.limit
+}
+
+// respond writes the envelope every search endpoint answers with
+func (p searchPage) respond(c *gin.Context, records interface{}, total int64) {
+	totalPages := int((total + int64(p.limit) - 1) / int64(p.limit))
+	c.JSON(http.StatusOK, gin.H{
+		"current_page":  p.number,
+		"records":       records,
+		"page_size":     p.limit,
+		"total_pages":   totalPages,
+		"total_records": total,
+	})
+}
+
+// search counts the records of query, which must already be filtered, reads the requested page sorted
+// as the request asks into records, a pointer to a slice, with the fields and relations the request
+// selects, expand defaulting to the given relations, and answers with the search envelope. Requests with
+// a cursor parameter are paged by cursor instead.
+func (h *Handler) search(c *gin.Context, spec searchSpec, query *gorm.DB, records interface{}, expand ...string) {
+	sorts, err := spec.order(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sel, err := spec.selection(c, h.db(c), expand...)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, ok := c.GetQuery("cursor"); ok {
+		h.searchByCursor(c, query, sorts, sel, records)
+		return
+	}
+	page := parseSearchPage(c)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+		return
+	}
+
+	query = sel.apply(c, query)
+	for _, by := range sorts {
+		query = query.Order(by.clause())
+	}
+	if err := query.Offset(page.offset()).Limit(page.limit).Find(records).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+		return
+	}
+
+	page.respond(c, sel.render(records), total)
+}
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// searchCursor is the position a cursor token points to: the sort values of a record of the previous
+// page, with the route and order they belong to so that a token cannot be replayed elsewhere
+type searchCursor struct {
+	Route  string   `json:"r"`
+	Sort   string   `json:"s"`
+	Values []string `json:"v"`
+	// Backwards reads the page before the record instead of the one after it
+	Backwards bool `json:"b,omitempty"`
+}
+
+// LoadSearchCursorKey reads the secret cursor tokens are signed with: SEARCH_CURSOR_KEY, or else a key
+// derived from ACCESS_SECRET_KEY, so that the access token secret itself never signs anything but tokens
+func LoadSearchCursorKey() ([]byte, error) {
+	if key := os.Getenv("SEARCH_CURSOR_KEY"); key != "" {
+		return []byte(key), nil
+	}
+	secret := os.Getenv("ACCESS_SECRET_KEY")
+	if secret == "" {
+		return nil, errors.New("missing environment variable: SEARCH_CURSOR_KEY")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("search-cursor"))
+	return mac.Sum(nil), nil
+}
+
+// encode serializes the cursor as an opaque token: its JSON and HMAC-SHA256 with key, both base64url
+// encoded
+func (sc searchCursor) encode(key []byte) string {
+	payload, _ := json.Marshal(sc)
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(body))
+	return body + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+var errInvalidCursor = errors.New("Invalid cursor")
+
+// decodeSearchCursor verifies the signature of a token with key and reads its cursor
+func decodeSearchCursor(key []byte, token string) (searchCursor, error) {
+	var sc searchCursor
+	body, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return sc, errInvalidCursor
+	}
+	got, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return sc, errInvalidCursor
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(body))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return sc, errInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil || json.Unmarshal(payload, &sc) != nil {
+		return sc, errInvalidCursor
+	}
+	return sc, nil
+}
+
+// sortSignature names an order, e.g. "-code,id", to tie cursors to it
+func sortSignature(sorts []searchSort) string {
+	names := make([]string, len(sorts))
+	for i, by := range sorts {
+		names[i] = by.name
+		if by.desc {
+			names[i] = "-" + by.name
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// keysetCondition selects the rows after values in the order of sorts, or before them when backwards:
+// (a > ?) OR (a = ? AND b > ?) OR ...
+func keysetCondition(sorts []searchSort, values []interface{}, backwards bool) (string, []interface{}) {
+	var (
+		terms []string
+		args  []interface{}
+	)
+	for i, by := range sorts {
+		var parts []string
+		for j := 0; j < i; j++ {
+			parts = append(parts, sorts[j].field.column+" = ?")
+			args = append(args, values[j])
+		}
+		operator := " > ?"
+		if by.desc != backwards {
+			operator = " < ?"
+		}
+		parts = append(parts, by.field.column+operator)
+		args = append(args, values[i])
+		terms = append(terms, "("+strings.Join(parts, " AND ")+")")
+	}
+	return "(" + strings.Join(terms, " OR ") + ")", args
+}
+
+// cursorValues reads the sort values of a record as strings, the form searchValue parses them from
+func cursorValues(tx *gorm.DB, record reflect.Value, sorts []searchSort) ([]string, error) {
+	values := make([]string, len(sorts))
+	for i, by := range sorts {
+		field := tx.Statement.Schema.LookUpField(by.field.column)
+		if field == nil {
+			return nil, fmt.Errorf("cannot read %s from the records", by.field.column)
+		}
+		value, _ := field.ValueOf(tx.Statement.Context, record)
+		if t, ok := value.(time.Time); ok {
+			values[i] = t.Format(time.RFC3339Nano)
+		} else {
+			values[i] = fmt.Sprint(value)
+		}
+	}
+	return values, nil
+}
+
+// estimateCount reads the number of rows the planner expects query to return, far cheaper than
+// counting them on large tables
+func estimateCount(db *gorm.DB, query *gorm.DB) (int64, error) {
+	var plan string
+	if err := db.Raw("EXPLAIN (FORMAT JSON) ?", query.Session(&gorm.Session{}).Select("1")).Row().Scan(&plan); err != nil {
+		return 0, err
+	}
+	var explained []struct {
+		Plan struct {
+			Rows float64 `json:"Plan Rows"`
+		} `json:"Plan"`
+	}
+	if err := json.Unmarshal([]byte(plan), &explained); err != nil || len(explained) == 0 {
+		return 0, errors.New("unexpected query plan")
+	}
+	return int64(explained[0].Plan.Rows), nil
+}
+
+// searchByCursor reads the page after, or before, the record a cursor points to. An empty cursor reads
+// the first page. The response carries the cursors of the next and previous pages, null at either end,
+// and the total only when asked for with count=exact or count=estimate.
+func (h *Handler) searchByCursor(c *gin.Context, query *gorm.DB, sorts []searchSort, sel selection, records interface{}) {
+	if len(h.CursorKey) == 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Paging by cursor is not configured"})
+		return
+	}
+	signature := sortSignature(sorts)
+	for _, by := range sorts {
+		if by.field.nullable {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot page by cursor when sorting by " + by.name + ", use page"})
+			return
+		}
+	}
+	limit := parseSearchPage(c).limit
+
+	response := gin.H{"page_size": limit, "next_cursor": nil, "prev_cursor": nil}
+	switch c.Query("count") {
+	case "":
+	case "exact":
+		var total int64
+		if err := query.Count(&total).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+			return
+		}
+		response["total_records"] = total
+	case "estimate":
+		total, err := estimateCount(h.db(c), query)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+			return
+		}
+		response["estimated_total"] = total
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid count, must be exact or estimate"})
+		return
+	}
+
+	var position *searchCursor
+	if token := c.Query("cursor"); token != "" {
+		sc, err := decodeSearchCursor(h.CursorKey, token)
+		if err != nil || sc.Route != c.FullPath() || sc.Sort != signature || len(sc.Values) != len(sorts) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor, it does not belong to this search"})
+			return
+		}
+		values := make([]interface{}, len(sorts))
+		for i, by := range sorts {
+			v, err := searchValue(by.field, sc.Values[i])
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidCursor.Error()})
+				return
+			}
+			values[i] = v
+		}
+		condition, args := keysetCondition(sorts, values, sc.Backwards)
+		query = query.Where(condition, args...)
+		position = &sc
+	}
+	backwards := position != nil && position.Backwards
+
+	// the sort columns are read even when fields leaves them out, the next cursors are made of them
+	columns := make([]string, len(sorts))
+	for i, by := range sorts {
+		columns[i] = by.field.column
+	}
+	query = sel.apply(c, query, columns...)
+	// Backwards pages are read in the reverse order and flipped; one extra row tells whether there
+	// is more beyond the page
+	for _, by := range sorts {
+		if backwards {
+			by.desc = !by.desc
+		}
+		query = query.Order(by.clause())
+	}
+	tx := query.Limit(limit + 1).Find(records)
+	if tx.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+		return
+	}
+	rows := reflect.ValueOf(records).Elem()
+	more := rows.Len() > limit
+	if more {
+		rows.Set(rows.Slice(0, limit))
+	}
+	if backwards {
+		for i, j := 0, rows.Len()-1; i < j; i, j = i+1, j-1 {
+			a, b := rows.Index(i).Interface(), rows.Index(j).Interface()
+			rows.Index(i).Set(reflect.ValueOf(b))
+			rows.Index(j).Set(reflect.ValueOf(a))
+		}
+	}
+
+	if rows.Len() > 0 {
+		hasNext, hasPrev := more, position != nil
+		if backwards {
+			hasNext, hasPrev = true, more
+		}
+		if hasNext {
+			values, err := cursorValues(tx, rows.Index(rows.Len()-1), sorts)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+				return
+			}
+			response["next_cursor"] = searchCursor{Route: c.FullPath(), Sort: signature, Values: values}.encode(h.CursorKey)
+		}
+		if hasPrev {
+			values, err := cursorValues(tx, rows.Index(0), sorts)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+				return
+			}
+			response["prev_cursor"] = searchCursor{Route: c.FullPath(), Sort: signature, Values: values, Backwards: true}.encode(h.CursorKey)
+		}
+	}
+
+	response["records"] = sel.render(records)
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// expansion is a relation the read endpoints of a resource load when the request names it in expand
+type expansion struct {
+	// preloads are the relations to load, nested ones written as "Items.Medicine"
+	preloads []string
+	// columns the relation is joined through, read even when fields leaves them out
+	columns []string
+	// scope, when set, narrows or orders the first of preloads
+	scope func(c *gin.Context, tx *gorm.DB) *gorm.DB
+}
+
+// selection is the part of a resource a read request asks for with fields and expand
+type selection struct {
+	// columns are read instead of every column when the request has fields
+	columns []string
+	// expansions are the relations to load by their name in expand
+	expansions map[string]expansion
+	// hidden are the JSON keys of the columns and relations left out, removed from the response; nil
+	// when the request has neither fields nor expand and the records are answered as they are
+	hidden map[string]bool
+}
+
+// jsonName is the key a field is written with in the JSON of its record
+func jsonName(field *schema.Field) string {
+	if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); name != "" {
+		return name
+	}
+	return field.Name
+}
+
+// splitList reads a comma-separated parameter, skipping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// selection reads the fields and expand parameters. fields is a comma-separated list of the names in the
+// whitelist of the resource, id being always returned; expand lists the relations to load and, when the
+// request does not have it, the endpoint loads the defaults.
+func (s searchSpec) selection(c *gin.Context, db *gorm.DB, defaults ...string) (selection, error) {
+	sel := selection{expansions: make(map[string]expansion)}
+	expand, expandGiven := c.GetQuery("expand")
+	names := defaults
+	if expandGiven {
+		names = splitList(expand)
+	}
+	for _, name := range names {
+		e, ok := s.expand[name]
+		if !ok {
+			return sel, errors.New("Invalid expand, cannot expand " + name)
+		}
+		sel.expansions[name] = e
+	}
+
+	fields := splitList(c.Query("fields"))
+	if len(fields) == 0 && !expandGiven {
+		return sel, nil
+	}
+
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(s.model); err != nil {
+		return sel, err
+	}
+	sel.hidden = make(map[string]bool)
+
+	loaded := make(map[string]bool)
+	for _, e := range sel.expansions {
+		for _, relation := range e.preloads {
+			top, _, _ := strings.Cut(relation, ".")
+			loaded[top] = true
+		}
+	}
+	for name, relation := range stmt.Schema.Relationships.Relations {
+		if !loaded[name] {
+			sel.hidden[jsonName(relation.Field)] = true
+		}
+	}
+
+	if len(fields) == 0 {
+		return sel, nil
+	}
+	asked := map[string]bool{"id": true}
+	for _, name := range fields {
+		field, ok := s.fields[name]
+		if !ok {
+			return sel, errors.New("Invalid fields, cannot select " + name)
+		}
+		asked[field.column] = true
+	}
+	read := make(map[string]bool, len(asked))
+	for column := range asked {
+		read[column] = true
+	}
+	for _, e := range sel.expansions {
+		for _, column := range e.columns {
+			read[column] = true
+		}
+	}
+	for _, field := range stmt.Schema.Fields {
+		if field.DBName == "" {
+			continue
+		}
+		if read[field.DBName] {
+			sel.columns = append(sel.columns, field.DBName)
+		}
+		if !asked[field.DBName] {
+			sel.hidden[jsonName(field)] = true
+		}
+	}
+	return sel, nil
+}
+
+// expands tells whether the request asked for a relation, or the endpoint loads it by default
+func (sel selection) expands(name string) bool {
+	_, ok := sel.expansions[name]
+	return ok
+}
+
+// apply reads the selected columns, plus the given ones, and loads the expanded relations
+func (sel selection) apply(c *gin.Context, query *gorm.DB, columns ...string) *gorm.DB {
+	if sel.columns != nil {
+		selected := append([]string{}, sel.columns...)
+		for _, column := range columns {
+			if !slices.Contains(selected, column) {
+				selected = append(selected, column)
+			}
+		}
+		query = query.Select(selected)
+	}
+	return sel.preload(c, query)
+}
+
+// preload loads the expanded relations
+func (sel selection) preload(c *gin.Context, query *gorm.DB) *gorm.DB {
+	for _, e := range sel.expansions {
+		for i, relation := range e.preloads {
+			if i == 0 && e.scope != nil {
+				scope := e.scope
+				query = query.Preload(relation, func(tx *gorm.DB) *gorm.DB { return scope(c, tx) })
+			} else {
+				query = query.Preload(relation)
+			}
+		}
+	}
+	return query
+}
+
+// render removes the hidden keys from a record or a slice of records
+func (sel selection) render(v interface{}) interface{} {
+	if len(sel.hidden) == 0 {
+		return v
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	// numbers are kept as written so that large ids and amounts keep their precision
+	decoder.UseNumber()
+	var out interface{}
+	if err := decoder.Decode(&out); err != nil {
+		return v
+	}
+	trim := func(record interface{}) {
+		if fields, ok := record.(map[string]interface{}); ok {
+			for key := range sel.hidden {
+				delete(fields, key)
+			}
+		}
+	}
+	if records, ok := out.([]interface{}); ok {
+		for _, record := range records {
+			trim(record)
+		}
+	} else {
+		trim(out)
+	}
+	return out
+}
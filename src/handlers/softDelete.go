@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"ia-boilerplate/src/repository"
+)
+
+// readScope is the database the reads of a request go through: deleted records are left out unless
+// include_deleted=true is given by an admin. It answers 400, 403 or 500 and returns false when
+// include_deleted cannot be honored.
+func (h *Handler) readScope(c *gin.Context) (*gorm.DB, bool) {
+	value, given := c.GetQuery("include_deleted")
+	if !given {
+		return h.db(c), true
+	}
+	include, err := strconv.ParseBool(value)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid include_deleted, must be a boolean"})
+		return nil, false
+	}
+	if !include {
+		return h.db(c), true
+	}
+	admin, err := h.isAdmin(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not check the role of the user"})
+		return nil, false
+	}
+	if !admin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can read deleted records"})
+		return nil, false
+	}
+	return h.db(c).Unscoped(), true
+}
+
+// deletion are the columns a soft delete writes: when and by whom the record was deleted, and its next
+// version
+func deletion(c *gin.Context) map[string]interface{} {
+	return map[string]interface{}{"deleted_at": time.Now(), "deleted_by": c.GetInt("user_id"), "version": nextVersion}
+}
+
+// restoration are the columns a restore writes
+func restoration() map[string]interface{} {
+	return map[string]interface{}{"deleted_at": nil, "deleted_by": nil, "version": nextVersion}
+}
+
+// restoreHook runs in the transaction of a restore, with the id of the record and the time it had been
+// deleted at. An AppError of type ValidationError it returns answers 409 with its message.
+type restoreHook func(tx *gorm.DB, id int, deletedAt time.Time) error
+
+// restore brings back the deleted record of model with the id of the request, answering it as it is
+// then. Restoring a record that is not deleted changes nothing; restoring one whose unique values were
+// taken by another record since it was deleted answers 409.
+func (h *Handler) restore(c *gin.Context, model interface{}, name string, hook restoreHook) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var state struct {
+		Version   int
+		DeletedAt gorm.DeletedAt
+	}
+	if err := h.db(c).Unscoped().Model(model).Select("version", "deleted_at").Where("id = ?", id).Take(&state).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": name + " not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not restore " + strings.ToLower(name)})
+		}
+		return
+	}
+	if !checkIfMatch(c, state.Version) {
+		return
+	}
+
+	if state.DeletedAt.Valid {
+		err := h.db(c).Transaction(func(tx *gorm.DB) error {
+			res := tx.Unscoped().Model(model).Where("id = ? AND version = ?", id, state.Version).Updates(restoration())
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				return errVersionConflict
+			}
+			if hook != nil {
+				return hook(tx, id, state.DeletedAt.Time)
+			}
+			return nil
+		})
+		var appErr *repository.AppError
+		switch {
+		case errors.Is(err, errVersionConflict):
+			respondVersionConflict(c, 0)
+			return
+		case errors.As(err, &appErr) && appErr.Type == repository.ValidationError:
+			c.JSON(http.StatusConflict, gin.H{"error": "Could not restore " + strings.ToLower(name) + ": " + appErr.Error()})
+			return
+		case err != nil && strings.Contains(err.Error(), "duplicate key value"):
+			c.JSON(http.StatusConflict, gin.H{"error": "Could not restore " + strings.ToLower(name) + ": another record took its unique values"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not restore " + strings.ToLower(name)})
+			return
+		}
+	}
+
+	if err := h.db(c).First(model, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve restored " + strings.ToLower(name)})
+		return
+	}
+	c.Header("ETag", etag(readVersion(c, int(reflect.ValueOf(model).Elem().FieldByName("Version").Int()))))
+	c.JSON(http.StatusOK, model)
+}
+
+func (h *Handler) RestoreRole(c *gin.Context) {
+	h.restore(c, &repository.RoleUser{}, "Role", nil)
+}
+
+func (h *Handler) RestoreUser(c *gin.Context) {
+	h.restore(c, &repository.User{}, "User", restoreUserDevices)
+}
+
+func (h *Handler) RestoreDevice(c *gin.Context) {
+	h.restore(c, &repository.DeviceDetails{}, "Device", checkDeviceUser)
+}
+
+func (h *Handler) RestoreMedicine(c *gin.Context) {
+	if !h.guardCatalogRecord(c, &repository.Medicine{}, "change global medicines") {
+		return
+	}
+	h.restore(c, &repository.Medicine{}, "Medicine", nil)
+}
+
+func (h *Handler) RestorePatient(c *gin.Context) {
+	h.restore(c, &repository.Patient{}, "Patient", nil)
+}
+
+// restoreUserDevices brings back the devices deleted along with a user, once its role is checked to be
+// in use
+func restoreUserDevices(tx *gorm.DB, id int, deletedAt time.Time) error {
+	var roles int64
+	if err := tx.Model(&repository.RoleUser{}).Where("id = (?)", tx.Model(&repository.User{}).Select("role_id").Where("id = ?", id)).
+		Count(&roles).Error; err != nil {
+		return err
+	}
+	if roles == 0 {
+		return repository.NewAppError(errors.New("its role is deleted, restore the role first"), repository.ValidationError)
+	}
+	return tx.Unscoped().Model(&repository.DeviceDetails{}).Where("user_id = ? AND deleted_at = ?", id, deletedAt).
+		Updates(restoration()).Error
+}
+
+// checkDeviceUser keeps a device from being restored while its user is deleted
+func checkDeviceUser(tx *gorm.DB, id int, _ time.Time) error {
+	var users int64
+	if err := tx.Model(&repository.User{}).Where("id = (?)", tx.Model(&repository.DeviceDetails{}).Select("user_id").Where("id = ?", id)).
+		Count(&users).Error; err != nil {
+		return err
+	}
+	if users == 0 {
+		return repository.NewAppError(errors.New("its user is deleted"), repository.ValidationError)
+	}
+	return nil
+}
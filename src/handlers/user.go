@@ -1,22 +1,49 @@
 package handlers
 
 import (
+	"errors"
 	"ia-boilerplate/src/repository"
+	"maps"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// roleFields are the fields roles can be read with
+var roleFields = searchSpec{
+	model: &repository.RoleUser{},
+	fields: map[string]searchField{
+		"id":          {column: "id", kind: searchInt},
+		"name":        {column: "name"},
+		"description": {column: "description"},
+		"enabled":     {column: "enabled", kind: searchBool},
+		"created_at":  {column: "created_at", kind: searchTime},
+		"updated_at":  {column: "updated_at", kind: searchTime},
+		"deleted_at":  {column: "deleted_at", kind: searchTime, nullable: true},
+	},
+}
+
 func (h *Handler) GetRoles(c *gin.Context) {
+	sel, err := roleFields.selection(c, h.db(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	db, ok := h.readScope(c)
+	if !ok {
+		return
+	}
 	var roles []repository.RoleUser
-	result := h.Repository.DB.Find(&roles)
+	result := sel.apply(c, db).Find(&roles)
 	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve roles"})
 		return
 	}
-	c.JSON(http.StatusOK, roles)
+	c.JSON(http.StatusOK, sel.render(roles))
 }
 
 func (h *Handler) GetRole(c *gin.Context) {
@@ -26,13 +53,22 @@ func (h *Handler) GetRole(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
 		return
 	}
+	sel, err := roleFields.selection(c, h.db(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	db, ok := h.readScope(c)
+	if !ok {
+		return
+	}
 	var role repository.RoleUser
-	result := h.Repository.DB.First(&role, id)
+	result := sel.apply(c, db, "version").First(&role, id)
 	if result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
 		return
 	}
-	c.JSON(http.StatusOK, role)
+	respondVersioned(c, role.Version, sel.render(role))
 }
 
 type CreateRoleRequest struct {
@@ -54,7 +90,7 @@ func (h *Handler) CreateRole(c *gin.Context) {
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
 	}
-	result := h.Repository.DB.Create(&newRole)
+	result := h.db(c).Create(&newRole)
 	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create role"})
 		return
@@ -83,11 +119,43 @@ func (h *Handler) UpdateRole(c *gin.Context) {
 	}
 
 	var role repository.RoleUser
-	result := h.Repository.DB.First(&role, id)
+	result := h.db(c).First(&role, id)
 	if result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
 		return
 	}
+	if !checkIfMatch(c, role.Version) {
+		return
+	}
+	h.updateRole(c, role, req)
+}
+
+// PatchRole updates a role with a JSON Merge Patch or a JSON Patch of its fields
+func (h *Handler) PatchRole(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID, must be an integer"})
+		return
+	}
+	var role repository.RoleUser
+	if err := h.db(c).First(&role, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		return
+	}
+	if !checkIfMatch(c, role.Version) {
+		return
+	}
+	current := UpdateRoleRequest{Name: &role.Name, Description: &role.Description, Enabled: &role.Enabled}
+	var req UpdateRoleRequest
+	if !patchRequest(c, current, &req) {
+		return
+	}
+	h.updateRole(c, role, req)
+}
+
+// updateRole writes the fields given in req to role
+func (h *Handler) updateRole(c *gin.Context, role repository.RoleUser, req UpdateRoleRequest) {
+	id := role.ID
 
 	// Prepare fields to update
 	updates := make(map[string]interface{})
@@ -110,21 +178,40 @@ func (h *Handler) UpdateRole(c *gin.Context) {
 		return
 	}
 
-	// Perform the update
-	if err := h.Repository.DB.Model(&repository.RoleUser{}).
-		Where("id = ?", id).
-		Updates(updates).Error; err != nil {
+	if (req.Name != nil && *req.Name != role.Name) || (req.Enabled != nil && !*req.Enabled) {
+		defaultAdmin, err := isDefaultAdminRole(h.db(c), role)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update role"})
+			return
+		}
+		if defaultAdmin {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The admin role of the default organization cannot be renamed or disabled"})
+			return
+		}
+	}
+
+	// Perform the update, as long as nobody changed the role since it was read
+	updates["version"] = nextVersion
+	result := h.db(c).Model(&repository.RoleUser{}).
+		Where("id = ? AND version = ?", id, role.Version).
+		Updates(updates)
+	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update role"})
 		return
 	}
+	if result.RowsAffected == 0 {
+		respondVersionConflict(c, 0)
+		return
+	}
 
 	// Obtener el rol actualizado
 	var updatedRole repository.RoleUser
-	if err := h.Repository.DB.First(&updatedRole, id).Error; err != nil {
+	if err := h.db(c).First(&updatedRole, id).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve updated role"})
 		return
 	}
 
+	c.Header("ETag", etag(updatedRole.Version))
 	c.JSON(http.StatusOK, updatedRole)
 }
 
@@ -135,12 +222,130 @@ func (h *Handler) DeleteRole(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
 		return
 	}
-	result := h.Repository.DB.Delete(&repository.RoleUser{}, id)
-	if result.Error != nil {
+	var role repository.RoleUser
+	if err := h.db(c).First(&role, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		return
+	}
+	if !checkIfMatch(c, role.Version) {
+		return
+	}
+
+	reassignTo := 0
+	if value := c.Query("reassign_to"); value != "" {
+		if reassignTo, err = strconv.Atoi(value); err != nil || reassignTo == id {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reassign_to, must be the ID of another role"})
+			return
+		}
+	}
+
+	// The role is locked until the delete commits, so that no user is given it after its users were
+	// checked; deleted users are reassigned too, so that nothing keeps the role from being purged
+	var users []RoleDependent
+	var total, reassigned int64
+	err = h.db(c).Transaction(func(tx *gorm.DB) error {
+		var locked repository.RoleUser
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("version = ?", role.Version).First(&locked, id).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errVersionConflict
+		}
+		if err != nil {
+			return err
+		}
+		defaultAdmin, err := isDefaultAdminRole(tx, locked)
+		if err != nil {
+			return err
+		}
+		if defaultAdmin {
+			return errDefaultAdminRole
+		}
+		if reassignTo != 0 {
+			if err := lockAssignableRole(tx, reassignTo); err != nil {
+				return err
+			}
+			res := tx.Unscoped().Model(&repository.User{}).Where("role_id = ?", id).
+				Updates(map[string]interface{}{"role_id": reassignTo, "version": nextVersion})
+			if res.Error != nil {
+				return res.Error
+			}
+			reassigned = res.RowsAffected
+		} else {
+			if err := tx.Model(&repository.User{}).Select("id", "username", "email").
+				Where("role_id = ?", id).Order("id").Limit(maxRoleDependents + 1).Find(&users).Error; err != nil {
+				return err
+			}
+			if len(users) > 0 {
+				if err := tx.Model(&repository.User{}).Where("role_id = ?", id).Count(&total).Error; err != nil {
+					return err
+				}
+				return errRoleInUse
+			}
+		}
+		return tx.Model(&repository.RoleUser{}).Where("id = ?", id).Updates(deletion(c)).Error
+	})
+	switch {
+	case errors.Is(err, errVersionConflict):
+		respondVersionConflict(c, 0)
+		return
+	case errors.Is(err, errDefaultAdminRole):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The admin role of the default organization cannot be deleted"})
+		return
+	case errors.Is(err, errRoleNotAssignable):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role not found"})
+		return
+	case errors.Is(err, errRoleInUse):
+		c.JSON(http.StatusConflict, gin.H{
+			"error":      "Could not delete role: it is assigned to users, reassign them with reassign_to",
+			"dependents": gin.H{"users": users[:min(len(users), maxRoleDependents)], "total": total},
+		})
+		return
+	case err != nil:
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete role"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Role deleted successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "Role deleted successfully", "reassignedUsers": reassigned})
+}
+
+// maxRoleDependents is how many of the users of a role a failed delete lists
+const maxRoleDependents = 100
+
+// RoleDependent is a user that keeps a role from being deleted
+type RoleDependent struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+var (
+	// errRoleInUse is returned when a role to delete is assigned to users
+	errRoleInUse = errors.New("role is assigned to users")
+	// errDefaultAdminRole is returned when a change would take the platform admins their role
+	errDefaultAdminRole = errors.New("admin role of the default organization")
+	// errRoleNotAssignable is returned when users are given a role that is deleted or does not exist
+	errRoleNotAssignable = errors.New("role not found")
+)
+
+// lockAssignableRole keeps roleID from being deleted until tx ends, returning errRoleNotAssignable unless
+// it is a role in use, so that users are never given a deleted role
+func lockAssignableRole(tx *gorm.DB, roleID int) error {
+	var role repository.RoleUser
+	err := tx.Clauses(clause.Locking{Strength: "SHARE"}).Select("id").Take(&role, roleID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errRoleNotAssignable
+	}
+	return err
+}
+
+// isDefaultAdminRole reports whether role is the admin role of the default organization, the one that
+// makes its users platform admins
+func isDefaultAdminRole(db *gorm.DB, role repository.RoleUser) (bool, error) {
+	if role.Name != adminRole {
+		return false, nil
+	}
+	var count int64
+	err := db.Model(&repository.Organization{}).
+		Where("id = ? AND slug = ?", role.OrganizationID, repository.DefaultOrganizationSlug).Count(&count).Error
+	return count > 0, err
 }
 
 type CreateUserRequest struct {
@@ -165,14 +370,24 @@ type UpdateUserRequest struct {
 	Enabled     *bool   `json:"enabled"`
 }
 
+// GetUsers returns every user with their role and devices, unless expand asks for fewer relations
 func (h *Handler) GetUsers(c *gin.Context) {
+	sel, err := userSearchFields.selection(c, h.db(c), "role", "devices")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	db, ok := h.readScope(c)
+	if !ok {
+		return
+	}
 	var users []repository.User
-	result := h.Repository.DB.Preload("Role").Preload("Devices").Find(&users)
+	result := sel.apply(c, db).Find(&users)
 	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve users"})
 		return
 	}
-	c.JSON(http.StatusOK, users)
+	c.JSON(http.StatusOK, sel.render(users))
 }
 
 func (h *Handler) GetUser(c *gin.Context) {
@@ -182,13 +397,22 @@ func (h *Handler) GetUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
 		return
 	}
+	sel, err := userSearchFields.selection(c, h.db(c), "role", "devices")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	db, ok := h.readScope(c)
+	if !ok {
+		return
+	}
 	var user repository.User
-	result := h.Repository.DB.Preload("Role").Preload("Devices").First(&user, id)
+	result := sel.apply(c, db, "version").First(&user, id)
 	if result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
-	c.JSON(http.StatusOK, user)
+	respondVersioned(c, user.Version, sel.render(user))
 }
 
 func (h *Handler) CreateUser(c *gin.Context) {
@@ -214,11 +438,27 @@ func (h *Handler) CreateUser(c *gin.Context) {
 		CreatedAt:    time.Now(),
 		UpdatedAt:    time.Now(),
 	}
-	result := h.Repository.DB.Create(&newUser)
-	if result.Error != nil {
+	var queued int
+	err = h.db(c).Transaction(func(tx *gorm.DB) error {
+		if err := lockAssignableRole(tx, req.RoleID); err != nil {
+			return err
+		}
+		if err := tx.Create(&newUser).Error; err != nil {
+			return err
+		}
+		n, err := queueWebhookEvent(tx, repository.WebhookEventUserCreated, newUser)
+		queued = n
+		return err
+	})
+	if errors.Is(err, errRoleNotAssignable) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role not found"})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create user"})
 		return
 	}
+	h.wakeWebhooks(queued)
 	c.JSON(http.StatusCreated, newUser)
 }
 
@@ -237,10 +477,51 @@ func (h *Handler) UpdateUser(c *gin.Context) {
 
 	// Verify the user exists
 	var existingUser repository.User
-	if err := h.Repository.DB.Preload("Role").Preload("Devices").First(&existingUser, id).Error; err != nil {
+	if err := h.db(c).Preload("Role").Preload("Devices").First(&existingUser, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if !checkIfMatch(c, existingUser.Version) {
+		return
+	}
+	h.updateUser(c, existingUser, req)
+}
+
+// PatchUser updates a user with a JSON Merge Patch or a JSON Patch of its fields; password is null in the
+// document patched, it can only be set
+func (h *Handler) PatchUser(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var existingUser repository.User
+	if err := h.db(c).First(&existingUser, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
+	if !checkIfMatch(c, existingUser.Version) {
+		return
+	}
+	current := UpdateUserRequest{
+		Username:    &existingUser.Username,
+		FirstName:   &existingUser.FirstName,
+		LastName:    &existingUser.LastName,
+		Email:       &existingUser.Email,
+		JobPosition: &existingUser.JobPosition,
+		RoleID:      &existingUser.RoleID,
+		Enabled:     &existingUser.Enabled,
+	}
+	var req UpdateUserRequest
+	if !patchRequest(c, current, &req) {
+		return
+	}
+	h.updateUser(c, existingUser, req)
+}
+
+// updateUser writes the fields given in req to existingUser
+func (h *Handler) updateUser(c *gin.Context, existingUser repository.User, req UpdateUserRequest) {
+	id := existingUser.ID
 
 	// Prepare fields to update
 	updates := make(map[string]interface{})
@@ -276,7 +557,7 @@ func (h *Handler) UpdateUser(c *gin.Context) {
 		updates["job_position"] = *req.JobPosition
 	}
 
-	if req.RoleID != nil {
+	if req.RoleID != nil && *req.RoleID != existingUser.RoleID {
 		updates["role_id"] = *req.RoleID
 	}
 
@@ -290,21 +571,49 @@ func (h *Handler) UpdateUser(c *gin.Context) {
 		return
 	}
 
-	// Perform the update
-	if err := h.Repository.DB.Model(&repository.User{}).
-		Where("id = ?", id).
-		Updates(updates).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update user"})
+	// Perform the update, as long as nobody changed the user since it was read
+	updates["version"] = nextVersion
+	var (
+		updatedUser repository.User
+		queued      int
+	)
+	err := h.db(c).Transaction(func(tx *gorm.DB) error {
+		if roleID, ok := updates["role_id"].(int); ok {
+			if err := lockAssignableRole(tx, roleID); err != nil {
+				return err
+			}
+		}
+		result := tx.Model(&repository.User{}).
+			Where("id = ? AND version = ?", id, existingUser.Version).
+			Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errVersionConflict
+		}
+		// Retrieve the updated user for the event and the response
+		if err := tx.Preload("Role").Preload("Devices").First(&updatedUser, id).Error; err != nil {
+			return err
+		}
+		n, err := queueWebhookEvent(tx, repository.WebhookEventUserUpdated, updatedUser)
+		queued = n
+		return err
+	})
+	switch {
+	case errors.Is(err, errRoleNotAssignable):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role not found"})
 		return
-	}
-
-	// Retrieve the updated user
-	var updatedUser repository.User
-	if err := h.Repository.DB.Preload("Role").Preload("Devices").First(&updatedUser, id).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve updated user"})
+	case errors.Is(err, errVersionConflict):
+		respondVersionConflict(c, 0)
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update user"})
 		return
 	}
 
+	h.wakeWebhooks(queued)
+	c.Header("ETag", etag(updatedUser.Version))
 	c.JSON(http.StatusOK, updatedUser)
 }
 
@@ -315,75 +624,108 @@ func (h *Handler) DeleteUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
 		return
 	}
-	result := h.Repository.DB.Delete(&repository.User{}, id)
-	if result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not delete user"})
+	var user repository.User
+	if err := h.db(c).First(&user, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "user deleted successfully"})
-}
-
-func (h *Handler) SearchUsersPaginated(c *gin.Context) {
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
-	if page < 1 {
-		page = 1
-	}
-	if limit < 1 {
-		limit = 10
+	if !checkIfMatch(c, user.Version) {
+		return
 	}
-
-	likeFilters := map[string]string{
-		"username":     c.Query("username_like"),
-		"first_name":   c.Query("first_name_like"),
-		"last_name":    c.Query("last_name_like"),
-		"email":        c.Query("email_like"),
-		"job_position": c.Query("job_position_like"),
+	// The devices of the user are deleted with it, at the same time, so that restoring the user brings
+	// them back; its tokens stop being accepted as soon as it is deleted
+	deleted := deletion(c)
+	var devices int64
+	var queued int
+	err = h.db(c).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&repository.User{}).Where("id = ? AND version = ?", id, user.Version).Updates(deleted)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errVersionConflict
+		}
+		res = tx.Model(&repository.DeviceDetails{}).Where("user_id = ?", id).Updates(maps.Clone(deleted))
+		if res.Error != nil {
+			return res.Error
+		}
+		devices = res.RowsAffected
+		n, err := queueWebhookEvent(tx, repository.WebhookEventUserDeleted, gin.H{"id": id})
+		queued = n
+		return err
+	})
+	if errors.Is(err, errVersionConflict) {
+		respondVersionConflict(c, 0)
+		return
 	}
-
-	matches := map[string][]string{
-		"username":     c.QueryArray("username_match"),
-		"first_name":   c.QueryArray("first_name_match"),
-		"last_name":    c.QueryArray("last_name_match"),
-		"email":        c.QueryArray("email_match"),
-		"job_position": c.QueryArray("job_position_match"),
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not delete user"})
+		return
 	}
+	h.forgetUserOrganizations(id)
+	h.wakeWebhooks(queued)
+	c.JSON(http.StatusOK, gin.H{"message": "user deleted successfully", "deletedDevices": devices})
+}
 
-	var (
-		total int64
-		users []repository.User
-	)
+// userSearchFields are the fields users can be filtered, sorted and read by; hash_password is never one
+var userSearchFields = searchSpec{
+	model: &repository.User{},
+	fields: map[string]searchField{
+		"id":           {column: "id", kind: searchInt},
+		"username":     {column: "username"},
+		"first_name":   {column: "first_name"},
+		"last_name":    {column: "last_name"},
+		"email":        {column: "email"},
+		"job_position": {column: "job_position"},
+		"role_id":      {column: "role_id", kind: searchInt},
+		"enabled":      {column: "enabled", kind: searchBool},
+		"created_at":   {column: "created_at", kind: searchTime},
+		"updated_at":   {column: "updated_at", kind: searchTime},
+		"deleted_at":   {column: "deleted_at", kind: searchTime, nullable: true},
+	},
+	expand: map[string]expansion{
+		"role":    {preloads: []string{"Role"}, columns: []string{"role_id"}},
+		"devices": {preloads: []string{"Devices"}},
+	},
+	defaultSort: "id",
+}
 
-	query := h.Repository.DB.Model(&repository.User{})
+// userSearchQuery builds the user query over db filtered by the parameters of the request
+func (h *Handler) userSearchQuery(c *gin.Context, db *gorm.DB) (*gorm.DB, error) {
+	return userSearchFields.filter(c, db.Model(&repository.User{}))
+}
 
-	for col, val := range likeFilters {
-		if val != "" {
-			query = query.Where(col+" ILIKE ?", "%"+val+"%")
-		}
+func (h *Handler) SearchUsersPaginated(c *gin.Context) {
+	db, ok := h.readScope(c)
+	if !ok {
+		return
 	}
-	for col, vals := range matches {
-		if len(vals) > 0 {
-			query = query.Where(col+" IN (?)", vals)
-		}
+	query, err := h.userSearchQuery(c, db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	query.Count(&total)
-	query = query.Preload("Role").Preload("Devices")
+	var users []repository.User
+	h.search(c, userSearchFields, query, &users, "role", "devices")
+}
+
+// userExportColumns deliberately leaves out hash_password
+var userExportColumns = []string{
+	"id", "username", "first_name", "last_name", "email", "job_position", "role_id", "enabled", "created_at", "updated_at",
+}
 
-	offset := (page - 1) * limit
-	if res := query.Offset(offset).Limit(limit).Find(&users); res.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+func (h *Handler) ExportUsers(c *gin.Context) {
+	db, ok := h.readScope(c)
+	if !ok {
 		return
 	}
-
-	totalPages := int((total + int64(limit) - 1) / int64(limit))
-	c.JSON(http.StatusOK, gin.H{
-		"current_page":  page,
-		"users":         users,
-		"page_size":     limit,
-		"total_pages":   totalPages,
-		"total_records": total,
-	})
+	query, err := h.userSearchQuery(c, db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.streamExport(c, query, "users", userExportColumns)
 }
 
 func (h *Handler) SearchUserCoincidencesByProperty(c *gin.Context) {
@@ -403,7 +745,7 @@ func (h *Handler) SearchUserCoincidencesByProperty(c *gin.Context) {
 	}
 
 	var results []string
-	if res := h.Repository.DB.
+	if res := h.db(c).
 		Model(&repository.User{}).
 		Distinct(property).
 		Where(property+" ILIKE ?", "%"+searchText+"%").
@@ -444,13 +786,22 @@ func (h *Handler) GetDevicesByUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
 		return
 	}
+	sel, err := deviceSearchFields.selection(c, h.db(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	db, ok := h.readScope(c)
+	if !ok {
+		return
+	}
 	var devices []repository.DeviceDetails
-	result := h.Repository.DB.Where("user_id = ?", userID).Find(&devices)
+	result := sel.apply(c, db).Where("user_id = ?", userID).Find(&devices)
 	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve devices"})
 		return
 	}
-	c.JSON(http.StatusOK, devices)
+	c.JSON(http.StatusOK, sel.render(devices))
 }
 
 func (h *Handler) GetDevice(c *gin.Context) {
@@ -460,13 +811,22 @@ func (h *Handler) GetDevice(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
 		return
 	}
+	sel, err := deviceSearchFields.selection(c, h.db(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	db, ok := h.readScope(c)
+	if !ok {
+		return
+	}
 	var device repository.DeviceDetails
-	result := h.Repository.DB.First(&device, id)
+	result := sel.apply(c, db, "version").First(&device, id)
 	if result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
 		return
 	}
-	c.JSON(http.StatusOK, device)
+	respondVersioned(c, device.Version, sel.render(device))
 }
 
 func (h *Handler) CreateDevice(c *gin.Context) {
@@ -475,6 +835,15 @@ func (h *Handler) CreateDevice(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	var users int64
+	if err := h.db(c).Model(&repository.User{}).Where("id = ?", req.UserID).Count(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create device"})
+		return
+	}
+	if users == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
 	newDevice := repository.DeviceDetails{
 		UserID:         req.UserID,
 		IPAddress:      req.IPAddress,
@@ -487,7 +856,7 @@ func (h *Handler) CreateDevice(c *gin.Context) {
 		CreatedAt:      time.Now(),
 		UpdatedAt:      time.Now(),
 	}
-	result := h.Repository.DB.Create(&newDevice)
+	result := h.db(c).Create(&newDevice)
 	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create device"})
 		return
@@ -510,10 +879,50 @@ func (h *Handler) UpdateDevice(c *gin.Context) {
 
 	// Verify the device exists
 	var existingDevice repository.DeviceDetails
-	if err := h.Repository.DB.First(&existingDevice, id).Error; err != nil {
+	if err := h.db(c).First(&existingDevice, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+	if !checkIfMatch(c, existingDevice.Version) {
+		return
+	}
+	h.updateDevice(c, existingDevice, req)
+}
+
+// PatchDevice updates a device with a JSON Merge Patch or a JSON Patch of its fields
+func (h *Handler) PatchDevice(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var existingDevice repository.DeviceDetails
+	if err := h.db(c).First(&existingDevice, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
 		return
 	}
+	if !checkIfMatch(c, existingDevice.Version) {
+		return
+	}
+	current := UpdateDeviceRequest{
+		IPAddress:      &existingDevice.IPAddress,
+		UserAgent:      &existingDevice.UserAgent,
+		DeviceType:     &existingDevice.DeviceType,
+		Browser:        &existingDevice.Browser,
+		BrowserVersion: &existingDevice.BrowserVersion,
+		OS:             &existingDevice.OS,
+		Language:       &existingDevice.Language,
+	}
+	var req UpdateDeviceRequest
+	if !patchRequest(c, current, &req) {
+		return
+	}
+	h.updateDevice(c, existingDevice, req)
+}
+
+// updateDevice writes the fields given in req to existingDevice
+func (h *Handler) updateDevice(c *gin.Context, existingDevice repository.DeviceDetails, req UpdateDeviceRequest) {
+	id := existingDevice.ID
 
 	// Prepare fields to update
 	updates := make(map[string]interface{})
@@ -554,21 +963,28 @@ func (h *Handler) UpdateDevice(c *gin.Context) {
 		return
 	}
 
-	// Perform the update
-	if err := h.Repository.DB.Model(&repository.DeviceDetails{}).
-		Where("id = ?", id).
-		Updates(updates).Error; err != nil {
+	// Perform the update, as long as nobody changed the device since it was read
+	updates["version"] = nextVersion
+	result := h.db(c).Model(&repository.DeviceDetails{}).
+		Where("id = ? AND version = ?", id, existingDevice.Version).
+		Updates(updates)
+	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update device"})
 		return
 	}
+	if result.RowsAffected == 0 {
+		respondVersionConflict(c, 0)
+		return
+	}
 
 	// Retrieve the updated device
 	var updatedDevice repository.DeviceDetails
-	if err := h.Repository.DB.First(&updatedDevice, id).Error; err != nil {
+	if err := h.db(c).First(&updatedDevice, id).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve updated device"})
 		return
 	}
 
+	c.Header("ETag", etag(updatedDevice.Version))
 	c.JSON(http.StatusOK, updatedDevice)
 }
 
@@ -579,81 +995,59 @@ func (h *Handler) DeleteDevice(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
 		return
 	}
-	result := h.Repository.DB.Delete(&repository.DeviceDetails{}, id)
-
+	var device repository.DeviceDetails
+	if err := h.db(c).First(&device, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+	if !checkIfMatch(c, device.Version) {
+		return
+	}
+	result := h.db(c).Model(&repository.DeviceDetails{}).Where("id = ? AND version = ?", id, device.Version).Updates(deletion(c))
 	if result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete device"})
 		return
 	}
+	if result.RowsAffected == 0 {
+		respondVersionConflict(c, 0)
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"message": "Device deleted successfully"})
 }
 
-func (h *Handler) SearchDeviceDetailsPaginated(c *gin.Context) {
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
-	if page < 1 {
-		page = 1
-	}
-	if limit < 1 {
-		limit = 10
-	}
-
-	likeFilters := map[string]string{
-		"ip_address":      c.Query("ip_address_like"),
-		"user_agent":      c.Query("user_agent_like"),
-		"device_type":     c.Query("device_type_like"),
-		"browser":         c.Query("browser_like"),
-		"browser_version": c.Query("browser_version_like"),
-		"os":              c.Query("os_like"),
-		"language":        c.Query("language_like"),
-	}
-
-	matches := map[string][]string{
-		"ip_address":      c.QueryArray("ip_address_match"),
-		"user_agent":      c.QueryArray("user_agent_match"),
-		"device_type":     c.QueryArray("device_type_match"),
-		"browser":         c.QueryArray("browser_match"),
-		"browser_version": c.QueryArray("browser_version_match"),
-		"os":              c.QueryArray("os_match"),
-		"language":        c.QueryArray("language_match"),
-	}
-
-	var (
-		total   int64
-		records []repository.DeviceDetails
-	)
-
-	query := h.Repository.DB.
-		Model(&repository.DeviceDetails{})
-
-	for col, val := range likeFilters {
-		if val != "" {
-			query = query.Where(col+" ILIKE ?", "%"+val+"%")
-		}
-	}
+// deviceSearchFields are the fields devices can be filtered, sorted and read by
+var deviceSearchFields = searchSpec{
+	model: &repository.DeviceDetails{},
+	fields: map[string]searchField{
+		"id":              {column: "id", kind: searchInt},
+		"user_id":         {column: "user_id", kind: searchInt},
+		"ip_address":      {column: "ip_address"},
+		"user_agent":      {column: "user_agent"},
+		"device_type":     {column: "device_type"},
+		"browser":         {column: "browser"},
+		"browser_version": {column: "browser_version"},
+		"os":              {column: "os"},
+		"language":        {column: "language"},
+		"created_at":      {column: "created_at", kind: searchTime},
+		"updated_at":      {column: "updated_at", kind: searchTime},
+		"deleted_at":      {column: "deleted_at", kind: searchTime, nullable: true},
+	},
+	defaultSort: "id",
+}
 
-	for col, vals := range matches {
-		if len(vals) > 0 {
-			query = query.Where(col+" IN (?)", vals)
-		}
+func (h *Handler) SearchDeviceDetailsPaginated(c *gin.Context) {
+	db, ok := h.readScope(c)
+	if !ok {
+		return
 	}
-
-	query.Count(&total)
-
-	offset := (page - 1) * limit
-	if res := query.Offset(offset).Limit(limit).Find(&records); res.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+	query, err := deviceSearchFields.filter(c, db.Model(&repository.DeviceDetails{}))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	totalPages := int((total + int64(limit) - 1) / int64(limit))
-	c.JSON(http.StatusOK, gin.H{
-		"current_page":  page,
-		"records":       records,
-		"page_size":     limit,
-		"total_pages":   totalPages,
-		"total_records": total,
-	})
+	var records []repository.DeviceDetails
+	h.search(c, deviceSearchFields, query, &records)
 }
 
 func (h *Handler) SearchDeviceCoincidencesByProperty(c *gin.Context) {
@@ -675,7 +1069,7 @@ func (h *Handler) SearchDeviceCoincidencesByProperty(c *gin.Context) {
 	}
 
 	var results []string
-	if res := h.Repository.DB.
+	if res := h.db(c).
 		Model(&repository.DeviceDetails{}).
 		Distinct(property).
 		Where(property+" ILIKE ?", "%"+searchText+"%").
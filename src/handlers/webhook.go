@@ -0,0 +1,435 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"ia-boilerplate/src/repository"
+	"ia-boilerplate/src/webhook"
+)
+
+// queueEvent queues event for the subscriptions db reads and wakes the dispatcher. What the event tells
+// has already been done, so a failure is only logged.
+func (h *Handler) queueEvent(db *gorm.DB, event repository.WebhookEvent, data interface{}) {
+	queued, err := queueWebhookEvent(db, event, data)
+	if err != nil {
+		h.Logger.Error("Error queueing webhook event", zap.String("event", event.String()), zap.Error(err))
+		return
+	}
+	h.wakeWebhooks(queued)
+}
+
+// queueWebhookEvent queues event, carrying data, for the subscriptions of the organization of db, or of
+// every organization when db works on the global catalog, which they all read, answering how many
+// deliveries it queued. The changes of records queue their events in their own transaction, so that an
+// event is sent if and only if its change commits, and wake the dispatcher once it did.
+func queueWebhookEvent(db *gorm.DB, event repository.WebhookEvent, data interface{}) (int, error) {
+	if !repository.GlobalCatalog(db.Statement.Context) {
+		return repository.QueueWebhookEvent(db, event, data)
+	}
+	var queued int
+	err := repository.AcrossOrganizations(db, func(tx *gorm.DB) error {
+		var err error
+		queued, err = repository.QueueWebhookEvent(tx, event, data)
+		return err
+	})
+	return queued, err
+}
+
+// wakeWebhooks wakes the dispatcher once deliveries are queued
+func (h *Handler) wakeWebhooks(queued int) {
+	if queued > 0 && h.Webhooks != nil {
+		h.Webhooks.Wake()
+	}
+}
+
+// GetWebhookEvents lists the events subscriptions can be made to
+func (h *Handler) GetWebhookEvents(c *gin.Context) {
+	c.JSON(http.StatusOK, repository.ValidWebhookEvents)
+}
+
+// validateWebhookURL checks that a subscription posts to an absolute http or https URL whose host resolves
+// to public addresses alone
+func validateWebhookURL(c *gin.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("Invalid url, must be an absolute http or https URL")
+	}
+	err = webhook.CheckHost(c.Request.Context(), u.Hostname())
+	if errors.Is(err, webhook.ErrForbiddenAddress) {
+		return errors.New("Invalid url, its host must not be a loopback, private, link-local or multicast address")
+	}
+	if err != nil {
+		return errors.New("Invalid url, its host could not be resolved")
+	}
+	return nil
+}
+
+// webhookEvents validates the events of a subscription, answering them without repeats
+func webhookEvents(names []string) ([]repository.WebhookEvent, error) {
+	events := make([]repository.WebhookEvent, 0, len(names))
+	for _, name := range names {
+		event := repository.WebhookEvent(name)
+		if !event.IsValid() {
+			return nil, errors.New("Invalid event " + name + ", must be one of: " + strings.Join(repository.ValidWebhookEvents, ", "))
+		}
+		if !slices.Contains(events, event) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// webhookSubscriptionWithSecret is a subscription along with its secret, answered only when the secret
+// is set
+type webhookSubscriptionWithSecret struct {
+	repository.WebhookSubscription
+	Secret string `json:"secret"`
+}
+
+func (h *Handler) GetWebhookSubscriptions(c *gin.Context) {
+	if !h.requireAdmin(c, "manage webhooks") {
+		return
+	}
+	var subscriptions []repository.WebhookSubscription
+	if err := h.db(c).Order("id").Find(&subscriptions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve webhook subscriptions"})
+		return
+	}
+	c.JSON(http.StatusOK, subscriptions)
+}
+
+func (h *Handler) GetWebhookSubscription(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	if !h.requireAdmin(c, "manage webhooks") {
+		return
+	}
+	var subscription repository.WebhookSubscription
+	if err := h.db(c).First(&subscription, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook subscription not found"})
+		return
+	}
+	respondVersioned(c, subscription.Version, subscription)
+}
+
+// CreateWebhookSubscriptionRequest subscribes url to events. The secret deliveries are signed with is
+// generated unless given.
+type CreateWebhookSubscriptionRequest struct {
+	URL         string   `json:"url" binding:"required,max=500"`
+	Description string   `json:"description" binding:"max=150"`
+	Events      []string `json:"events" binding:"required,min=1"`
+	Secret      string   `json:"secret" binding:"omitempty,min=16,max=100"`
+}
+
+// CreateWebhookSubscription subscribes an endpoint of the organization of the request to events,
+// answering the subscription with its secret, which is not answered again
+func (h *Handler) CreateWebhookSubscription(c *gin.Context) {
+	var req CreateWebhookSubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateWebhookURL(c, req.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	events, err := webhookEvents(req.Events)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.requireAdmin(c, "manage webhooks") {
+		return
+	}
+	secret := req.Secret
+	if secret == "" {
+		if secret, err = webhook.NewSecret(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate the webhook secret"})
+			return
+		}
+	}
+
+	subscription := repository.WebhookSubscription{
+		URL:         req.URL,
+		Description: req.Description,
+		Events:      events,
+		Secret:      secret,
+		Enabled:     true,
+	}
+	if err := h.db(c).Create(&subscription).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create webhook subscription"})
+		return
+	}
+	c.Header("ETag", etag(subscription.Version))
+	c.JSON(http.StatusCreated, webhookSubscriptionWithSecret{subscription, secret})
+}
+
+type UpdateWebhookSubscriptionRequest struct {
+	URL         *string  `json:"url" binding:"omitempty,max=500"`
+	Description *string  `json:"description" binding:"omitempty,max=150"`
+	Events      []string `json:"events"`
+	Enabled     *bool    `json:"enabled"`
+}
+
+// UpdateWebhookSubscription changes the endpoint, the events or the description of a subscription, or
+// disables or enables it. The pending deliveries of a disabled subscription fail unsent.
+func (h *Handler) UpdateWebhookSubscription(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var req UpdateWebhookSubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.requireAdmin(c, "manage webhooks") {
+		return
+	}
+	var existing repository.WebhookSubscription
+	if err := h.db(c).First(&existing, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook subscription not found"})
+		return
+	}
+	if !checkIfMatch(c, existing.Version) {
+		return
+	}
+
+	updates := map[string]interface{}{"updated_at": time.Now()}
+	if req.URL != nil {
+		if err := validateWebhookURL(c, *req.URL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		updates["url"] = *req.URL
+	}
+	if req.Description != nil {
+		updates["description"] = *req.Description
+	}
+	if req.Events != nil {
+		events, err := webhookEvents(req.Events)
+		if err != nil || len(events) == 0 {
+			if err == nil {
+				err = errors.New("Invalid events, a subscription needs at least one")
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// a map update bypasses the json serializer of the column
+		encoded, err := json.Marshal(events)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update webhook subscription"})
+			return
+		}
+		updates["events"] = string(encoded)
+	}
+	if req.Enabled != nil {
+		updates["enabled"] = *req.Enabled
+	}
+	if len(updates) <= 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	updates["version"] = nextVersion
+	res := h.db(c).Model(&repository.WebhookSubscription{}).Where("id = ? AND version = ?", id, existing.Version).Updates(updates)
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update webhook subscription"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		respondVersionConflict(c, 0)
+		return
+	}
+
+	var updated repository.WebhookSubscription
+	if err := h.db(c).First(&updated, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve updated webhook subscription"})
+		return
+	}
+	c.Header("ETag", etag(updated.Version))
+	c.JSON(http.StatusOK, updated)
+}
+
+// RotateWebhookSecret replaces the secret of a subscription with a new one, answering the subscription
+// with it. The deliveries attempted from then on are signed with the new secret, replays included.
+func (h *Handler) RotateWebhookSecret(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	if !h.requireAdmin(c, "manage webhooks") {
+		return
+	}
+	var existing repository.WebhookSubscription
+	if err := h.db(c).First(&existing, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook subscription not found"})
+		return
+	}
+	if !checkIfMatch(c, existing.Version) {
+		return
+	}
+	secret, err := webhook.NewSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate the webhook secret"})
+		return
+	}
+	res := h.db(c).Model(&repository.WebhookSubscription{}).Where("id = ? AND version = ?", id, existing.Version).
+		Updates(map[string]interface{}{"secret": secret, "updated_at": time.Now(), "version": nextVersion})
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not rotate the webhook secret"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		respondVersionConflict(c, 0)
+		return
+	}
+
+	var updated repository.WebhookSubscription
+	if err := h.db(c).First(&updated, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve updated webhook subscription"})
+		return
+	}
+	c.Header("ETag", etag(updated.Version))
+	c.JSON(http.StatusOK, webhookSubscriptionWithSecret{updated, secret})
+}
+
+// DeleteWebhookSubscription removes a subscription along with its deliveries
+func (h *Handler) DeleteWebhookSubscription(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	if !h.requireAdmin(c, "manage webhooks") {
+		return
+	}
+	var existing repository.WebhookSubscription
+	if err := h.db(c).First(&existing, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook subscription not found"})
+		return
+	}
+	if !checkIfMatch(c, existing.Version) {
+		return
+	}
+	res := h.db(c).Where("version = ?", existing.Version).Delete(&repository.WebhookSubscription{}, id)
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete webhook subscription"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		respondVersionConflict(c, 0)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook subscription deleted successfully"})
+}
+
+var webhookDeliverySearchFields = searchSpec{
+	model: &repository.WebhookDelivery{},
+	fields: map[string]searchField{
+		"id":              {column: "id", kind: searchInt},
+		"subscription_id": {column: "subscription_id", kind: searchInt},
+		"event_id":        {column: "event_id"},
+		"event":           {column: "event"},
+		"status":          {column: "status"},
+		"attempts":        {column: "attempts", kind: searchInt},
+		"response_status": {column: "response_status", kind: searchInt, nullable: true},
+		"replay_of":       {column: "replay_of", kind: searchInt, nullable: true},
+		"next_attempt_at": {column: "next_attempt_at", kind: searchTime, nullable: true},
+		"last_attempt_at": {column: "last_attempt_at", kind: searchTime, nullable: true},
+		"created_at":      {column: "created_at", kind: searchTime},
+		"updated_at":      {column: "updated_at", kind: searchTime},
+	},
+	expand: map[string]expansion{
+		"subscription": {preloads: []string{"Subscription"}, columns: []string{"subscription_id"}},
+	},
+	defaultSort: "-id",
+}
+
+// SearchWebhookDeliveries pages the delivery log of the organization of the request, newest first
+func (h *Handler) SearchWebhookDeliveries(c *gin.Context) {
+	if !h.requireAdmin(c, "manage webhooks") {
+		return
+	}
+	query, err := webhookDeliverySearchFields.filter(c, h.db(c).Model(&repository.WebhookDelivery{}))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var deliveries []repository.WebhookDelivery
+	h.search(c, webhookDeliverySearchFields, query, &deliveries)
+}
+
+func (h *Handler) GetWebhookDelivery(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	if !h.requireAdmin(c, "manage webhooks") {
+		return
+	}
+	var delivery repository.WebhookDelivery
+	if err := h.db(c).First(&delivery, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook delivery not found"})
+		return
+	}
+	c.JSON(http.StatusOK, delivery)
+}
+
+// ReplayWebhookDelivery queues the payload of a delivery again, as a new delivery to the same
+// subscription whatever the outcome of the first one, answering the new delivery
+func (h *Handler) ReplayWebhookDelivery(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	if !h.requireAdmin(c, "manage webhooks") {
+		return
+	}
+	var original repository.WebhookDelivery
+	if err := h.db(c).Preload("Subscription").First(&original, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook delivery not found"})
+		return
+	}
+	if original.Subscription == nil || !original.Subscription.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "The subscription of the delivery is disabled, enable it first"})
+		return
+	}
+
+	now := time.Now()
+	replay := repository.WebhookDelivery{
+		SubscriptionID: original.SubscriptionID,
+		EventID:        original.EventID,
+		Event:          original.Event,
+		Payload:        original.Payload,
+		Status:         repository.WebhookDeliveryPending,
+		NextAttemptAt:  &now,
+		ReplayOf:       &original.ID,
+	}
+	if err := h.db(c).Create(&replay).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not replay webhook delivery"})
+		return
+	}
+	if h.Webhooks != nil {
+		h.Webhooks.Wake()
+	}
+	c.JSON(http.StatusCreated, replay)
+}
@@ -0,0 +1,126 @@
+package icd
+
+import (
+	"encoding/csv"
+	"errors"
+	"ia-boilerplate/src/repository"
+	"io"
+	"strings"
+)
+
+// Mapping is a row of a transition table. TargetCode is empty when the source code has no equivalent.
+type Mapping struct {
+	Line       int
+	SourceCode string
+	TargetCode string
+}
+
+type MappingFile struct {
+	SourceVersion repository.CieVersionType
+	TargetVersion repository.CieVersionType
+	Mappings      []Mapping
+	Errors        []EntryError
+}
+
+// mappingColumns maps the normalized headers of the WHO transition tables (10To11MapToOneCategory,
+// 10To11MapToMultipleCategories, 11To10MapToOneCategory) to the field they fill
+var mappingColumns = map[string]string{
+	"icd10code":      "code10",
+	"10code":         "code10",
+	"cie10":          "code10",
+	"icd11code":      "code11",
+	"11code":         "code11",
+	"cie11":          "code11",
+	"10classkind":    "kind10",
+	"icd10classkind": "kind10",
+	"11classkind":    "kind11",
+	"icd11classkind": "kind11",
+	"icd10title":     "title10",
+	"10title":        "title10",
+	"icd11title":     "title11",
+	"11title":        "title11",
+}
+
+// ParseMapping reads a tab-delimited WHO transition table. The direction follows the order of the code
+// columns: a table whose ICD-10 code comes first maps CIE-10 to CIE-11. Chapter and block rows are skipped,
+// and rows without a target code, or whose target reads "No Mapping", record that the code has no
+// equivalent.
+func ParseMapping(r io.Reader) (*MappingFile, error) {
+	reader := csv.NewReader(r)
+	reader.Comma = '\t'
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("file is empty")
+	}
+
+	columns := make(map[string]int)
+	replacer := strings.NewReplacer("_", "", "-", "", " ", "", "\ufeff", "")
+	for i, header := range rows[0] {
+		name := mappingColumns[strings.ToLower(replacer.Replace(strings.TrimSpace(header)))]
+		if _, dup := columns[name]; name != "" && !dup {
+			columns[name] = i
+		}
+	}
+	code10, has10 := columns["code10"]
+	code11, has11 := columns["code11"]
+	if !has10 || !has11 {
+		return nil, errors.New("missing required columns: an ICD-10 and an ICD-11 code column are needed")
+	}
+
+	file := &MappingFile{SourceVersion: repository.CIE10, TargetVersion: repository.CIE11}
+	source, target := "10", "11"
+	if code11 < code10 {
+		file.SourceVersion, file.TargetVersion = repository.CIE11, repository.CIE10
+		source, target = "11", "10"
+	}
+	cell := func(row []string, name string) string {
+		idx, ok := columns[name]
+		if !ok || idx >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[idx])
+	}
+
+	for i, row := range rows[1:] {
+		line := i + 2
+		switch strings.ToLower(cell(row, "kind"+source)) {
+		case "chapter", "block":
+			continue
+		}
+		sourceCode := mappingCode(file.SourceVersion, cell(row, "code"+source))
+		if sourceCode == "" {
+			continue
+		}
+		if _, err := repository.ValidateICDCode(file.SourceVersion, sourceCode, ""); err != nil {
+			file.Errors = append(file.Errors, EntryError{Line: line, Code: sourceCode, Error: err.Error()})
+			continue
+		}
+		mapping := Mapping{Line: line, SourceCode: sourceCode}
+		targetCode := mappingCode(file.TargetVersion, cell(row, "code"+target))
+		noMapping := strings.EqualFold(strings.ReplaceAll(cell(row, "title"+target), " ", ""), "nomapping")
+		if targetCode != "" && !noMapping {
+			if _, err := repository.ValidateICDCode(file.TargetVersion, targetCode, ""); err != nil {
+				file.Errors = append(file.Errors, EntryError{Line: line, Code: sourceCode, Error: "target " + err.Error()})
+				continue
+			}
+			mapping.TargetCode = targetCode
+		}
+		file.Mappings = append(file.Mappings, mapping)
+	}
+	return file, nil
+}
+
+// mappingCode returns a transition table code as stored by the API. ICD-10 codes may carry the dagger and
+// asterisk marks of dual classification, and the tables spell out missing codes as "No Mapping".
+func mappingCode(version repository.CieVersionType, code string) string {
+	code = strings.TrimRight(strings.TrimSpace(code), "+*†")
+	if strings.EqualFold(strings.ReplaceAll(code, " ", ""), "nomapping") {
+		return ""
+	}
+	return NormalizeCode(version, code)
+}
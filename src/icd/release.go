@@ -0,0 +1,385 @@
+package icd
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"ia-boilerplate/src/repository"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	FormatClaML   = "claml"
+	FormatTabular = "tsv"
+)
+
+var (
+	markup     = regexp.MustCompile(`<[^>]*>`)
+	whitespace = regexp.MustCompile(`\s+`)
+	// CEMECE catalogs write CIE-10 codes without the dot and pad categories with X: A000, A00X
+	cemeceSubcategory = regexp.MustCompile(`^([A-Z][0-9]{2})([0-9A-Z]{1,2})$`)
+	cemeceCategory    = regexp.MustCompile(`^([A-Z][0-9]{2})X$`)
+)
+
+// Entry is a class of a release file. ParentCode is empty when the file does not state the parent,
+// in which case it is inferred from the code.
+type Entry struct {
+	Line         int
+	Code         string
+	Title        string
+	Kind         repository.ICDKind
+	ParentCode   string
+	ChapterNo    string
+	ChapterTitle string
+}
+
+// EntryError is a class of the release file that could not be read
+type EntryError struct {
+	Line  int    `json:"line"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+type ReleaseFile struct {
+	// Release is the release the file declares, when the format carries one
+	Release string
+	Entries []Entry
+	Errors  []EntryError
+}
+
+// FormatFromFilename returns the release format of a file: ClaML for .xml and tab-delimited otherwise,
+// unless format is given
+func FormatFromFilename(filename, format string) (string, error) {
+	if format == "" {
+		if strings.EqualFold(filepath.Ext(filename), ".xml") {
+			return FormatClaML, nil
+		}
+		return FormatTabular, nil
+	}
+	switch strings.ToLower(format) {
+	case FormatClaML, "xml":
+		return FormatClaML, nil
+	case FormatTabular, "tab", "txt":
+		return FormatTabular, nil
+	}
+	return "", fmt.Errorf("unsupported release format %q, must be one of: %s, %s", format, FormatClaML, FormatTabular)
+}
+
+// Parse reads a release file of the given format and version
+func Parse(r io.Reader, format string, version repository.CieVersionType) (*ReleaseFile, error) {
+	switch format {
+	case FormatClaML:
+		return ParseClaML(r, version)
+	case FormatTabular:
+		return ParseTabular(r, version)
+	}
+	return nil, fmt.Errorf("unsupported release format %q", format)
+}
+
+// NormalizeCode returns a release code in the form stored by the API, rewriting CEMECE style CIE-10 codes
+func NormalizeCode(version repository.CieVersionType, code string) string {
+	code = repository.NormalizeICDCode(code)
+	if version == repository.CIE10 {
+		if m := cemeceCategory.FindStringSubmatch(code); m != nil {
+			return m[1]
+		}
+		if m := cemeceSubcategory.FindStringSubmatch(code); m != nil {
+			return m[1] + "." + m[2]
+		}
+	}
+	return code
+}
+
+func cleanTitle(text string) string {
+	text = html.UnescapeString(markup.ReplaceAllString(text, " "))
+	return strings.TrimSpace(whitespace.ReplaceAllString(text, " "))
+}
+
+func (f *ReleaseFile) add(version repository.CieVersionType, entry Entry) {
+	entry.Code = NormalizeCode(version, entry.Code)
+	entry.ParentCode = NormalizeCode(version, entry.ParentCode)
+	kind, err := repository.ValidateICDCode(version, entry.Code, "")
+	if err != nil {
+		f.Errors = append(f.Errors, EntryError{Line: entry.Line, Code: entry.Code, Error: err.Error()})
+		return
+	}
+	entry.Kind = kind
+	if kind == repository.ICDKindChapter {
+		entry.ChapterNo = entry.Code
+		entry.ChapterTitle = entry.Title
+	}
+	f.Entries = append(f.Entries, entry)
+}
+
+type clamlLabel struct {
+	Inner string `xml:",innerxml"`
+}
+
+type clamlClass struct {
+	Code         string `xml:"code,attr"`
+	Kind         string `xml:"kind,attr"`
+	SuperClasses []struct {
+		Code string `xml:"code,attr"`
+	} `xml:"SuperClass"`
+	Rubrics []struct {
+		Kind   string       `xml:"kind,attr"`
+		Labels []clamlLabel `xml:"Label"`
+	} `xml:"Rubric"`
+}
+
+// ParseClaML reads a ClaML 2.0 classification, the XML format of the WHO ICD-10 releases. The title of each
+// class is its preferred rubric; the release is the version attribute of the Title element.
+func ParseClaML(r io.Reader, version repository.CieVersionType) (*ReleaseFile, error) {
+	file := &ReleaseFile{}
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "Title":
+			var title struct {
+				Version string `xml:"version,attr"`
+			}
+			if err := decoder.DecodeElement(&title, &start); err != nil {
+				return nil, err
+			}
+			file.Release = strings.TrimSpace(title.Version)
+		case "Class":
+			line, _ := decoder.InputPos()
+			var class clamlClass
+			if err := decoder.DecodeElement(&class, &start); err != nil {
+				return nil, err
+			}
+			entry := Entry{Line: line, Code: class.Code}
+			if len(class.SuperClasses) > 0 {
+				entry.ParentCode = class.SuperClasses[0].Code
+			}
+			for _, rubric := range class.Rubrics {
+				if rubric.Kind == "preferred" && len(rubric.Labels) > 0 {
+					entry.Title = cleanTitle(rubric.Labels[0].Inner)
+					break
+				}
+			}
+			file.add(version, entry)
+		}
+	}
+	if len(file.Entries) == 0 && len(file.Errors) == 0 {
+		return nil, errors.New("file has no Class elements")
+	}
+	return file, nil
+}
+
+// tabularColumns maps the normalized headers of the supported tab-delimited files to the field they fill:
+// the WHO ICD-11 SimpleTabulation, CEMECE catalogs and plain code/title/parent tables
+var tabularColumns = map[string]string{
+	"code":        "code",
+	"catalogkey":  "code",
+	"clave":       "code",
+	"codigo":      "code",
+	"title":       "title",
+	"description": "title",
+	"descripcion": "title",
+	"nombre":      "title",
+	"parent":      "parent",
+	"parentcode":  "parent",
+	"superclass":  "parent",
+	"chapterno":   "chapter",
+	"chapter":     "chapter",
+	"capitulo":    "chapter",
+	"blockid":     "block",
+	"classkind":   "kind",
+	"kind":        "kind",
+}
+
+// ParseTabular reads a tab-delimited release with a header row. ICD-11 SimpleTabulation rows without a code
+// are identified by their chapter number or block id, and their parents follow the "- " depth markers that
+// prefix the titles.
+func ParseTabular(r io.Reader, version repository.CieVersionType) (*ReleaseFile, error) {
+	reader := csv.NewReader(r)
+	reader.Comma = '\t'
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("file is empty")
+	}
+
+	columns := make(map[string]int)
+	for i, header := range rows[0] {
+		replacer := strings.NewReplacer("_", "", "-", "", " ", "", "\ufeff", "")
+		name := tabularColumns[strings.ToLower(replacer.Replace(strings.TrimSpace(header)))]
+		if _, dup := columns[name]; name != "" && !dup {
+			columns[name] = i
+		}
+	}
+	_, hasCode := columns["code"]
+	if _, ok := columns["title"]; !hasCode || !ok {
+		return nil, errors.New("missing required columns: a code and a title column are needed")
+	}
+	cell := func(row []string, name string) string {
+		idx, ok := columns[name]
+		if !ok || idx >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[idx])
+	}
+
+	file := &ReleaseFile{}
+	// codes of the last entry seen at each depth, for files that mark depth in the titles
+	var stack []string
+	for i, row := range rows[1:] {
+		line := i + 2
+		code, title := cell(row, "code"), cell(row, "title")
+		if code == "" && title == "" {
+			continue
+		}
+		kind := strings.ToLower(cell(row, "kind"))
+		if code == "" {
+			switch kind {
+			case "chapter":
+				code = cell(row, "chapter")
+			case "block":
+				code = cell(row, "block")
+			}
+		}
+
+		depth := 0
+		title = strings.TrimLeft(title, " ")
+		for strings.HasPrefix(title, "-") {
+			depth++
+			title = strings.TrimLeft(title[1:], " ")
+		}
+		entry := Entry{Line: line, Code: code, Title: title, ParentCode: cell(row, "parent"), ChapterNo: cell(row, "chapter")}
+		if entry.ParentCode == "" && depth > 0 && depth <= len(stack) {
+			entry.ParentCode = stack[depth-1]
+		}
+		stack = append(stack[:min(depth, len(stack))], code)
+		file.add(version, entry)
+	}
+	return file, nil
+}
+
+// Hierarchy returns the entries ordered so that every parent comes before its children, with the parents
+// the file leaves out inferred from the codes the same way the API places a new record, and the chapter
+// fields filled in from the chapter of each entry. Entries that repeat a code or whose parent is not in
+// the release are returned as errors.
+func (f *ReleaseFile) Hierarchy() ([]Entry, []EntryError) {
+	var errs []EntryError
+	byCode := make(map[string]*Entry, len(f.Entries))
+	var entries []*Entry
+	var blocks []string
+	for i := range f.Entries {
+		entry := &f.Entries[i]
+		if _, dup := byCode[entry.Code]; dup {
+			errs = append(errs, EntryError{Line: entry.Line, Code: entry.Code, Error: "code repeated in the release"})
+			continue
+		}
+		byCode[entry.Code] = entry
+		entries = append(entries, entry)
+		if entry.Kind == repository.ICDKindBlock {
+			blocks = append(blocks, entry.Code)
+		}
+	}
+
+	children := make(map[string][]*Entry)
+	var roots []*Entry
+	for _, entry := range entries {
+		if entry.ParentCode == "" {
+			entry.ParentCode = inferParent(*entry, byCode, blocks)
+		}
+		if entry.ParentCode == "" {
+			roots = append(roots, entry)
+			continue
+		}
+		parent, ok := byCode[entry.ParentCode]
+		if !ok {
+			errs = append(errs, EntryError{Line: entry.Line, Code: entry.Code, Error: fmt.Sprintf("parent %s is not in the release", entry.ParentCode)})
+			continue
+		}
+		if !repository.CanContainICDNode(parent.Kind, entry.Kind) {
+			errs = append(errs, EntryError{Line: entry.Line, Code: entry.Code, Error: fmt.Sprintf("a %s cannot contain a %s", parent.Kind, entry.Kind)})
+			continue
+		}
+		children[parent.Code] = append(children[parent.Code], entry)
+	}
+
+	ordered := make([]Entry, 0, len(entries))
+	for level := roots; len(level) > 0; {
+		var next []*Entry
+		for _, entry := range level {
+			if entry.Kind != repository.ICDKindChapter && entry.ParentCode != "" {
+				parent := byCode[entry.ParentCode]
+				entry.ChapterNo, entry.ChapterTitle = parent.ChapterNo, parent.ChapterTitle
+			}
+			ordered = append(ordered, *entry)
+			next = append(next, children[entry.Code]...)
+		}
+		level = next
+	}
+	if len(ordered)+len(errs) < len(f.Entries) {
+		placed := make(map[string]bool, len(ordered))
+		for _, entry := range ordered {
+			placed[entry.Code] = true
+		}
+		failed := make(map[int]bool, len(errs))
+		for _, e := range errs {
+			failed[e.Line] = true
+		}
+		for _, entry := range entries {
+			if !placed[entry.Code] && !failed[entry.Line] {
+				errs = append(errs, EntryError{Line: entry.Line, Code: entry.Code, Error: fmt.Sprintf("parent %s could not be imported", entry.ParentCode)})
+			}
+		}
+	}
+	return ordered, errs
+}
+
+// inferParent finds the parent of an entry among the codes of the release: the enclosing subcategory or
+// category of a subcategory, the narrowest block containing a category or block, or the chapter it names
+func inferParent(entry Entry, byCode map[string]*Entry, blocks []string) string {
+	switch entry.Kind {
+	case repository.ICDKindChapter:
+		return ""
+	case repository.ICDKindSubcategory:
+		category, suffix, _ := strings.Cut(entry.Code, ".")
+		for i := len(suffix) - 1; i > 0; i-- {
+			if _, ok := byCode[category+"."+suffix[:i]]; ok {
+				return category + "." + suffix[:i]
+			}
+		}
+		if _, ok := byCode[category]; ok {
+			return category
+		}
+		return ""
+	}
+	narrowest := ""
+	for _, block := range blocks {
+		if block != entry.Code && repository.ICDBlockContains(block, entry.Code) &&
+			(narrowest == "" || repository.ICDBlockContains(narrowest, block)) {
+			narrowest = block
+		}
+	}
+	if narrowest != "" {
+		return narrowest
+	}
+	if chapter, ok := byCode[entry.ChapterNo]; ok && chapter.Kind == repository.ICDKindChapter {
+		return chapter.Code
+	}
+	return ""
+}
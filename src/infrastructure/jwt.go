@@ -21,10 +21,11 @@ func NewAuth(logger *Logger) *Auth {
 	}
 }
 
-// generateToken creates a JWT token with the given user ID, issuer, secret key, and TTL
-func (a *Auth) generateToken(userID int, issuer, secretKey string, ttl time.Duration) (string, error) {
+// generateToken creates a JWT token with the given user and organization IDs, issuer, secret key, and TTL
+func (a *Auth) generateToken(userID, organizationID int, issuer, secretKey string, ttl time.Duration) (string, error) {
 	claims := jwt.MapClaims{
 		"user_id": userID,
+		"org_id":  organizationID,
 		"iss":     issuer,
 		"exp":     time.Now().Add(ttl).Unix(),
 	}
@@ -38,8 +39,8 @@ func (a *Auth) generateToken(userID int, issuer, secretKey string, ttl time.Dura
 	return signed, nil
 }
 
-// GenerateAccessToken issues a JWT access token for the given user ID
-func (a *Auth) GenerateAccessToken(userID int) (string, error) {
+// GenerateAccessToken issues a JWT access token for the given user of an organization
+func (a *Auth) GenerateAccessToken(userID, organizationID int) (string, error) {
 	issuer := os.Getenv("JWT_ISSUER")
 	if issuer == "" {
 		a.Logger.Error("Environment variable not set", zap.String("var", "JWT_ISSUER"))
@@ -59,7 +60,7 @@ func (a *Auth) GenerateAccessToken(userID int) (string, error) {
 		return "", fmt.Errorf("failed to parse ACCESS_TOKEN_TTL: %w", err)
 	}
 
-	tok, err := a.generateToken(userID, issuer, secret, ttl)
+	tok, err := a.generateToken(userID, organizationID, issuer, secret, ttl)
 	if err != nil {
 		a.Logger.Error("Failed to generate access token", zap.Error(err))
 		return "", err
@@ -67,8 +68,8 @@ func (a *Auth) GenerateAccessToken(userID int) (string, error) {
 	return tok, nil
 }
 
-// GenerateRefreshToken issues a JWT refresh token for the given user ID
-func (a *Auth) GenerateRefreshToken(userID int) (string, error) {
+// GenerateRefreshToken issues a JWT refresh token for the given user of an organization
+func (a *Auth) GenerateRefreshToken(userID, organizationID int) (string, error) {
 	issuer := os.Getenv("JWT_ISSUER")
 	if issuer == "" {
 		a.Logger.Error("Environment variable not set", zap.String("var", "JWT_ISSUER"))
@@ -87,7 +88,7 @@ func (a *Auth) GenerateRefreshToken(userID int) (string, error) {
 		return "", fmt.Errorf("failed to parse REFRESH_TOKEN_TTL: %w", err)
 	}
 
-	tok, err := a.generateToken(userID, issuer, secret, ttl)
+	tok, err := a.generateToken(userID, organizationID, issuer, secret, ttl)
 	if err != nil {
 		return "", err
 	}
@@ -2,6 +2,7 @@ package middlewares
 
 import (
 	"ia-boilerplate/src/handlers"
+	"ia-boilerplate/src/repository"
 	"net/http"
 	"os"
 	"strings"
@@ -31,9 +32,10 @@ func JWTAuthMiddleware(handler *handlers.Handler) gin.HandlerFunc {
 
 		// Check if this is a mock token for integration tests
 		if isIntegrationTest() && tokenString == "mock-test-token-for-integration-tests" {
-			// Set a mock user ID for integration tests
-			c.Set("user_id", 1)
-			c.Next()
+			// Set a mock user ID for integration tests, in the organization of that user
+			if setTenant(c, handler, 1, nil) {
+				c.Next()
+			}
 			return
 		}
 
@@ -50,8 +52,9 @@ func JWTAuthMiddleware(handler *handlers.Handler) gin.HandlerFunc {
 
 		if claims, ok := tokenClaims.Claims.(jwt.MapClaims); ok && tokenClaims.Valid {
 			userID := claims["user_id"].(float64)
-			id := int(userID)
-			c.Set("user_id", id)
+			if !setTenant(c, handler, int(userID), claims) {
+				return
+			}
 		} else {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
 			c.Abort()
@@ -62,6 +65,38 @@ func JWTAuthMiddleware(handler *handlers.Handler) gin.HandlerFunc {
 	}
 }
 
+// setTenant scopes the request to the organization of the user, answering and returning false when it cannot go on
+func setTenant(c *gin.Context, handler *handlers.Handler, userID int, claims jwt.MapClaims) bool {
+	organizationID, err := handler.UserOrganization(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not check the user of the token"})
+		c.Abort()
+		return false
+	}
+	if organizationID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token: the user no longer exists or its organization is disabled"})
+		c.Abort()
+		return false
+	}
+	if claims != nil {
+		claimed, err := handler.TokenOrganization(claims)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not check the user of the token"})
+			c.Abort()
+			return false
+		}
+		if claimed != organizationID {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token: the organization does not match the user"})
+			c.Abort()
+			return false
+		}
+	}
+	c.Set("user_id", userID)
+	c.Set("organization_id", organizationID)
+	c.Request = c.Request.WithContext(repository.WithOrganization(c.Request.Context(), organizationID))
+	return true
+}
+
 // isIntegrationTest checks if we're running integration tests
 func isIntegrationTest() bool {
 	// Check for integration test tags or environment variables
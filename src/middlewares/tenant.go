@@ -0,0 +1,57 @@
+package middlewares
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"ia-boilerplate/src/handlers"
+	"ia-boilerplate/src/repository"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// TenantConnection runs the queries of each request on a connection of its own switched to the tenant role
+// and whose app.organization_id is the organization of the user, so that the row-level security policies
+// created with TENANT_RLS keep it to the rows of that organization. It goes after JWTAuthMiddleware.
+func TenantConnection(handler *handlers.Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		organizationID := c.GetInt("organization_id")
+		err := handler.Repository.DB.WithContext(c.Request.Context()).Connection(func(conn *gorm.DB) error {
+			defer resetTenant(handler, conn)
+			if err := conn.Exec("SET ROLE " + repository.TenantRole).Error; err != nil {
+				return err
+			}
+			if err := conn.Exec("SELECT set_config(?, ?, false)", repository.TenantSetting, strconv.Itoa(organizationID)).Error; err != nil {
+				return err
+			}
+			handlers.SetRequestDB(c, conn)
+			c.Next()
+			return nil
+		})
+		if err != nil {
+			handler.Logger.Error("Could not set the organization of the connection", zap.Error(err))
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Could not connect to the database"})
+		}
+	}
+}
+
+// resetTenant clears the role and the organization of a connection before it goes back to the pool; a
+// connection whose role or organization cannot be cleared is discarded instead
+func resetTenant(handler *handlers.Handler, conn *gorm.DB) {
+	conn = conn.WithContext(context.Background())
+	err := conn.Exec("RESET ROLE").Error
+	if err == nil {
+		err = conn.Exec("RESET " + repository.TenantSetting).Error
+	}
+	if err == nil {
+		return
+	}
+	handler.Logger.Error("Could not reset the role and organization of the connection, discarding it", zap.Error(err))
+	if sqlConn, ok := conn.Statement.ConnPool.(*sql.Conn); ok {
+		_ = sqlConn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+}
@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrInvalidGTINLength     = errors.New("barcode must have 8, 12, 13 or 14 digits")
+	ErrInvalidGTINCharacters = errors.New("barcode must contain only digits")
+	ErrInvalidGTINCheckDigit = errors.New("barcode check digit is invalid")
+)
+
+// GTINCheckDigit computes the GS1 mod-10 check digit for the given digits (without check digit)
+func GTINCheckDigit(digits string) int {
+	sum := 0
+	// weights alternate 3,1,3,... starting from the rightmost digit
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if (len(digits)-1-i)%2 == 0 {
+			sum += d * 3
+		} else {
+			sum += d
+		}
+	}
+	return (10 - sum%10) % 10
+}
+
+// NormalizeGTIN validates an EAN-8, UPC-A, EAN-13 or GTIN-14 code and returns its canonical form:
+// the shortest of EAN-8, EAN-13 or GTIN-14 that represents the same GTIN once leading zeros are removed
+func NormalizeGTIN(code string) (string, error) {
+	code = strings.TrimSpace(code)
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return "", ErrInvalidGTINCharacters
+		}
+	}
+	switch len(code) {
+	case 8, 12, 13, 14:
+	default:
+		return "", ErrInvalidGTINLength
+	}
+
+	if GTINCheckDigit(code[:len(code)-1]) != int(code[len(code)-1]-'0') {
+		return "", ErrInvalidGTINCheckDigit
+	}
+
+	padded := strings.Repeat("0", 14-len(code)) + code
+	switch {
+	case strings.HasPrefix(padded, "000000"):
+		return padded[6:], nil
+	case strings.HasPrefix(padded, "0"):
+		return padded[1:], nil
+	default:
+		return padded, nil
+	}
+}
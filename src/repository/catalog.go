@@ -0,0 +1,96 @@
+package repository
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// catalogOverlay is how the overrides of an organization are laid over the global records of a shared
+// catalog
+type catalogOverlay struct {
+	// overrides is the table of the overrides and key its column referencing the record
+	overrides, key string
+	// columns are the columns an override replaces when it sets them
+	columns []string
+	// derived are the columns of the table kept out of the model, as computed for an overridden record
+	// from r, the record, and o, the override
+	derived [][2]string
+}
+
+// catalogOverlays are the shared catalogs organizations can override, by table
+var catalogOverlays = map[string]catalogOverlay{
+	"medicines": {overrides: "medicine_overrides", key: "medicine_id", columns: []string{"description", "laboratory"}},
+	"icd_cies": {overrides: "icd_cie_overrides", key: "icd_cie_id", columns: []string{"description"},
+		derived: [][2]string{{"search_vector", `setweight(to_tsvector('es_unaccent', coalesce(r.code, '')), 'A') ||
+			setweight(to_tsvector('es_unaccent', coalesce(o.description, r.description, '')), 'B') ||
+			setweight(to_tsvector('es_unaccent', coalesce(r.chapter_title, '')), 'C')`}}},
+}
+
+// overlayOverrides makes a query of a shared catalog read its table with the overrides of an organization
+// applied, laid out as the table so that the query runs unchanged. The records without overrides come
+// from a branch of their own, so the filters on them still use the indexes of the table. The version of
+// an overridden record adds the version of its override, so that its ETag changes with it. Queries that
+// read the catalog from a table expression of their own, such as the ICD classification of a past date,
+// are left as they are.
+func overlayOverrides(stmt *gorm.Statement, organizationID int) {
+	overlay, ok := catalogOverlays[stmt.Schema.Table]
+	if !ok || stmt.TableExpr != nil || stmt.Table != stmt.Schema.Table {
+		return
+	}
+	plain := make([]string, 0, len(stmt.Schema.DBNames)+len(overlay.derived))
+	merged := make([]string, 0, cap(plain))
+	for _, name := range stmt.Schema.DBNames {
+		column := stmt.Quote(name)
+		plain = append(plain, "r."+column)
+		switch {
+		case slices.Contains(overlay.columns, name):
+			merged = append(merged, fmt.Sprintf("COALESCE(o.%s, r.%s) AS %s", column, column, column))
+		case name == "version":
+			merged = append(merged, "r.version + o.version AS version")
+		default:
+			merged = append(merged, "r."+column)
+		}
+	}
+	for _, derived := range overlay.derived {
+		column := stmt.Quote(derived[0])
+		plain = append(plain, "r."+column)
+		merged = append(merged, derived[1]+" AS "+column)
+	}
+	table, overrides, key := stmt.Quote(stmt.Table), stmt.Quote(overlay.overrides), stmt.Quote(overlay.key)
+	stmt.TableExpr = &clause.Expr{
+		SQL: fmt.Sprintf(`(SELECT %s FROM %s r
+			WHERE NOT EXISTS (SELECT 1 FROM %s o WHERE o.%s = r.id AND o.organization_id = ?)
+			UNION ALL
+			SELECT %s FROM %s r JOIN %s o ON o.%s = r.id AND o.organization_id = ?) AS %s`,
+			strings.Join(plain, ", "), table, overrides, key, strings.Join(merged, ", "), table, overrides, key, table),
+		Vars: []interface{}{organizationID, organizationID},
+	}
+}
+
+// OverrideVersion is the version of the override the organization of db has of the record of model with
+// id, 0 when it has none or the catalog of model cannot be overridden
+func OverrideVersion(db *gorm.DB, model interface{}, id int) (int, error) {
+	organizationID, ok := OrganizationFrom(db.Statement.Context)
+	if !ok {
+		return 0, nil
+	}
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return 0, err
+	}
+	overlay, ok := catalogOverlays[stmt.Schema.Table]
+	if !ok {
+		return 0, nil
+	}
+	var versions []int
+	err := db.Table(overlay.overrides).Where(overlay.key+" = ? AND organization_id = ?", id, organizationID).
+		Pluck("version", &versions).Error
+	if err != nil || len(versions) == 0 {
+		return 0, err
+	}
+	return versions[0], nil
+}
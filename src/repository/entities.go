@@ -1,46 +1,82 @@
 package repository
 
 import (
+	"slices"
 	"time"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
 )
 
+// Organization is a tenant of the API, e.g. a clinic. Users, roles, devices, price lists, invoices,
+// therapeutic equivalences, patients, encounters, prescriptions and webhook subscriptions belong to one,
+// and the users of an organization only ever see its records. Medicines and ICD codes are global unless an organization adds
+// them for itself.
+type Organization struct {
+	ID        int       `gorm:"primaryKey" json:"id"`
+	Name      string    `gorm:"type:varchar(150);not null" json:"name"`
+	Slug      string    `gorm:"type:varchar(60);not null;uniqueIndex" json:"slug"`
+	Enabled   bool      `gorm:"default:true" json:"enabled"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updatedAt"`
+	Version   int       `gorm:"not null;default:1" json:"version"`
+}
+
+// RoleUser is the role of a user. Roles, like users, devices, medicines and patients, are soft deleted:
+// deleting one sets DeletedAt and DeletedBy, queries leave it out until it is restored, and it is purged
+// once the retention period is over. Their unique columns only have to be unique among the records not
+// deleted.
 type RoleUser struct {
-	ID          int       `gorm:"primaryKey" json:"id"`
-	Name        string    `gorm:"unique;not null" json:"name"`
-	Description string    `json:"description"`
-	Enabled     bool      `gorm:"default:true" json:"enabled"`
-	CreatedAt   time.Time `gorm:"autoCreateTime" json:"createdAt"`
-	UpdatedAt   time.Time `gorm:"autoUpdateTime" json:"updatedAt"`
+	ID             int            `gorm:"primaryKey" json:"id"`
+	OrganizationID int            `gorm:"<-:create;not null;uniqueIndex:idx_role_users_organization_name,priority:1" json:"organizationId"`
+	Name           string         `gorm:"not null;uniqueIndex:idx_role_users_organization_name,priority:2,where:deleted_at IS NULL" json:"name"`
+	Description    string         `json:"description"`
+	Enabled        bool           `gorm:"default:true" json:"enabled"`
+	CreatedAt      time.Time      `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt      time.Time      `gorm:"autoUpdateTime" json:"updatedAt"`
+	Version        int            `gorm:"not null;default:1" json:"version"`
+	DeletedAt      gorm.DeletedAt `gorm:"index" json:"deletedAt"`
+	DeletedBy      *int           `json:"deletedBy"`
 }
 
+// User is an account of the API. Its role cannot be removed while the user has it, and removing the
+// user removes its devices with it.
 type User struct {
-	ID           int             `gorm:"primaryKey" json:"id"`
-	Username     string          `gorm:"unique;not null" json:"username"`
-	FirstName    string          `json:"firstName"`
-	LastName     string          `json:"lastName"`
-	Email        string          `gorm:"unique;not null" json:"email"`
-	HashPassword string          `gorm:"not null" json:"-"`
-	JobPosition  string          `json:"jobPosition"`
-	RoleID       int             `json:"roleId"`
-	Role         RoleUser        `gorm:"foreignKey:RoleID" json:"role"`
-	Enabled      bool            `gorm:"default:true" json:"enabled"`
-	CreatedAt    time.Time       `gorm:"autoCreateTime" json:"createdAt"`
-	UpdatedAt    time.Time       `gorm:"autoUpdateTime" json:"updatedAt"`
-	Devices      []DeviceDetails `gorm:"foreignKey:UserID" json:"devices"`
+	ID             int             `gorm:"primaryKey" json:"id"`
+	OrganizationID int             `gorm:"<-:create;not null;uniqueIndex:idx_users_organization_username,priority:1;uniqueIndex:idx_users_organization_email,priority:1" json:"organizationId"`
+	Username       string          `gorm:"not null;uniqueIndex:idx_users_organization_username,priority:2,where:deleted_at IS NULL" json:"username"`
+	FirstName      string          `json:"firstName"`
+	LastName       string          `json:"lastName"`
+	Email          string          `gorm:"not null;uniqueIndex:idx_users_organization_email,priority:2,where:deleted_at IS NULL" json:"email"`
+	HashPassword   string          `gorm:"not null" json:"-"`
+	JobPosition    string          `json:"jobPosition"`
+	RoleID         int             `json:"roleId"`
+	Role           RoleUser        `gorm:"foreignKey:RoleID;constraint:OnUpdate:CASCADE,OnDelete:RESTRICT" json:"role"`
+	Enabled        bool            `gorm:"default:true" json:"enabled"`
+	CreatedAt      time.Time       `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt      time.Time       `gorm:"autoUpdateTime" json:"updatedAt"`
+	Version        int             `gorm:"not null;default:1" json:"version"`
+	DeletedAt      gorm.DeletedAt  `gorm:"index" json:"deletedAt"`
+	DeletedBy      *int            `json:"deletedBy"`
+	Devices        []DeviceDetails `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"devices"`
 }
 
 type DeviceDetails struct {
-	ID             int       `gorm:"primaryKey" json:"id"`
-	UserID         int       `gorm:"not null" json:"userId"`
-	IPAddress      string    `gorm:"type:varchar(45);not null" json:"ip_address"`
-	UserAgent      string    `json:"user_agent"`
-	DeviceType     string    `json:"device_type"`
-	Browser        string    `json:"browser"`
-	BrowserVersion string    `json:"browser_version"`
-	OS             string    `json:"os"`
-	Language       string    `json:"language"`
-	CreatedAt      time.Time `gorm:"autoCreateTime" json:"createdAt"`
-	UpdatedAt      time.Time `gorm:"autoUpdateTime" json:"updatedAt"`
+	ID             int            `gorm:"primaryKey" json:"id"`
+	OrganizationID int            `gorm:"<-:create;not null;index" json:"organizationId"`
+	UserID         int            `gorm:"not null" json:"userId"`
+	IPAddress      string         `gorm:"type:varchar(45);not null" json:"ip_address"`
+	UserAgent      string         `json:"user_agent"`
+	DeviceType     string         `json:"device_type"`
+	Browser        string         `json:"browser"`
+	BrowserVersion string         `json:"browser_version"`
+	OS             string         `json:"os"`
+	Language       string         `json:"language"`
+	CreatedAt      time.Time      `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt      time.Time      `gorm:"autoUpdateTime" json:"updatedAt"`
+	Version        int            `gorm:"not null;default:1" json:"version"`
+	DeletedAt      gorm.DeletedAt `gorm:"index" json:"deletedAt"`
+	DeletedBy      *int           `json:"deletedBy"`
 }
 
 type CieVersionType string
@@ -65,13 +101,130 @@ func (c CieVersionType) String() string {
 	return string(c)
 }
 
+type ICDKind string
+
+const (
+	ICDKindChapter     ICDKind = "chapter"
+	ICDKindBlock       ICDKind = "block"
+	ICDKindCategory    ICDKind = "category"
+	ICDKindSubcategory ICDKind = "subcategory"
+)
+
+var ValidICDKinds = []string{
+	ICDKindChapter.String(),
+	ICDKindBlock.String(),
+	ICDKindCategory.String(),
+	ICDKindSubcategory.String(),
+}
+
+// check if the icdKind is valid
+func (k ICDKind) IsValid() bool {
+	return k.Rank() > 0
+}
+
+// Rank is the level of the kind in the classification, from chapter (1) to subcategory (4)
+func (k ICDKind) Rank() int {
+	switch k {
+	case ICDKindChapter:
+		return 1
+	case ICDKindBlock:
+		return 2
+	case ICDKindCategory:
+		return 3
+	case ICDKindSubcategory:
+		return 4
+	}
+	return 0
+}
+
+// return string of the icdKind
+func (k ICDKind) String() string {
+	return string(k)
+}
+
+// ICDCie is a node of the ICD-10 or ICD-11 classification. Chapters are roots; blocks, categories and
+// subcategories hang from their ParentID. Codes are unique within a CieVersion. Records are never
+// deleted: a retired record keeps its code and gets a ValidTo, and its past states are kept as
+// ICDCieVersion rows. The classification is global, with no OrganizationID; the codes an organization
+// adds for itself have its OrganizationID.
 type ICDCie struct {
-	ID           int            `gorm:"primaryKey" json:"id"`
-	CieVersion   CieVersionType `gorm:"type:varchar(20)" json:"cieVersion"`
-	Code         string         `gorm:"type:varchar(20);unique" json:"code"`
-	Description  string         `gorm:"type:varchar(255)" json:"description"`
-	ChapterNo    string         `gorm:"type:varchar(10)" json:"chapterNo"`
-	ChapterTitle string         `gorm:"type:varchar(255)" json:"chapterTitle"`
+	ID             int            `gorm:"primaryKey" json:"id"`
+	OrganizationID *int           `gorm:"<-:create;uniqueIndex:idx_icd_cies_organization_version_code,priority:1" json:"organizationId"`
+	CieVersion     CieVersionType `gorm:"type:varchar(20);uniqueIndex:idx_icd_cies_global_version_code,priority:1,where:organization_id IS NULL;uniqueIndex:idx_icd_cies_organization_version_code,priority:2" json:"cieVersion"`
+	Code           string         `gorm:"type:varchar(20);uniqueIndex:idx_icd_cies_global_version_code,priority:2;uniqueIndex:idx_icd_cies_organization_version_code,priority:3" json:"code"`
+	Description    string         `gorm:"type:varchar(255)" json:"description"`
+	ChapterNo      string         `gorm:"type:varchar(10)" json:"chapterNo"`
+	ChapterTitle   string         `gorm:"type:varchar(255)" json:"chapterTitle"`
+	Kind           ICDKind        `gorm:"type:varchar(20)" json:"kind"`
+	ParentID       *int           `gorm:"index" json:"parentId"`
+	Parent         *ICDCie        `gorm:"foreignKey:ParentID" json:"parent,omitempty"`
+	Release        string         `gorm:"type:varchar(30)" json:"release"`
+	Retired        bool           `gorm:"default:false" json:"retired"`
+	ValidFrom      time.Time      `gorm:"not null;default:CURRENT_TIMESTAMP" json:"validFrom"`
+	ValidTo        *time.Time     `json:"validTo"`
+	// Version counts the changes to the record, for If-Match; it is not related to ICDCieVersion
+	Version int `gorm:"not null;default:1" json:"version"`
+}
+
+// ICDCieVersion is the state of an ICD record during a period of time, from ValidFrom until ValidTo.
+// A version is opened when the record is created, changed or reinstated and closed when it changes
+// again or is retired, so the classification can be read as it was on any date.
+type ICDCieVersion struct {
+	ID             int            `gorm:"primaryKey" json:"id"`
+	OrganizationID *int           `gorm:"<-:create;index" json:"organizationId"`
+	ICDCieID       int            `gorm:"not null;index" json:"icdCieId"`
+	CieVersion     CieVersionType `gorm:"type:varchar(20)" json:"cieVersion"`
+	Code           string         `gorm:"type:varchar(20)" json:"code"`
+	Description    string         `gorm:"type:varchar(255)" json:"description"`
+	ChapterNo      string         `gorm:"type:varchar(10)" json:"chapterNo"`
+	ChapterTitle   string         `gorm:"type:varchar(255)" json:"chapterTitle"`
+	Kind           ICDKind        `gorm:"type:varchar(20)" json:"kind"`
+	ParentID       *int           `json:"parentId"`
+	Release        string         `gorm:"type:varchar(30)" json:"release"`
+	ValidFrom      time.Time      `gorm:"not null;index" json:"validFrom"`
+	ValidTo        *time.Time     `gorm:"index" json:"validTo"`
+}
+
+// ICDCieOverride is the description an organization gives a global ICD record for itself
+type ICDCieOverride struct {
+	ID             int       `gorm:"primaryKey" json:"id"`
+	OrganizationID int       `gorm:"<-:create;not null;uniqueIndex:idx_icd_cie_overrides_organization_icd_cie,priority:1" json:"organizationId"`
+	ICDCieID       int       `gorm:"not null;uniqueIndex:idx_icd_cie_overrides_organization_icd_cie,priority:2" json:"icdCieId"`
+	Description    *string   `gorm:"type:varchar(255)" json:"description"`
+	CreatedAt      time.Time `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt      time.Time `gorm:"autoUpdateTime" json:"updatedAt"`
+	Version        int       `gorm:"not null;default:1" json:"version"`
+}
+
+// ICDRelease records an official release file imported for a CieVersion, with what it changed
+// with respect to the codes loaded before it and when its codes took effect
+type ICDRelease struct {
+	ID            int            `gorm:"primaryKey" json:"id"`
+	CieVersion    CieVersionType `gorm:"type:varchar(20);not null;uniqueIndex:idx_icd_release" json:"cieVersion"`
+	Release       string         `gorm:"type:varchar(30);not null;uniqueIndex:idx_icd_release" json:"release"`
+	Format        string         `gorm:"type:varchar(10)" json:"format"`
+	FileName      string         `gorm:"type:varchar(255)" json:"fileName"`
+	Checksum      string         `gorm:"type:varchar(64)" json:"checksum"`
+	Added         int            `json:"added"`
+	Changed       int            `json:"changed"`
+	Retired       int            `json:"retired"`
+	Unchanged     int            `json:"unchanged"`
+	ImportedBy    int            `json:"importedBy"`
+	EffectiveFrom time.Time      `gorm:"not null;default:CURRENT_TIMESTAMP" json:"effectiveFrom"`
+	ImportedAt    time.Time      `gorm:"autoCreateTime" json:"importedAt"`
+}
+
+// ICDMapping links a code of one CieVersion to its equivalent in the other, as published in the WHO
+// transition tables. A code mapped to several targets has one row per target, and a row with an empty
+// TargetCode records that the code has no equivalent.
+type ICDMapping struct {
+	ID            int            `gorm:"primaryKey" json:"id"`
+	SourceVersion CieVersionType `gorm:"type:varchar(20);not null;uniqueIndex:idx_icd_mapping" json:"sourceVersion"`
+	SourceCode    string         `gorm:"type:varchar(20);not null;uniqueIndex:idx_icd_mapping" json:"sourceCode"`
+	TargetVersion CieVersionType `gorm:"type:varchar(20);not null;uniqueIndex:idx_icd_mapping" json:"targetVersion"`
+	TargetCode    string         `gorm:"type:varchar(20);not null;uniqueIndex:idx_icd_mapping;index" json:"targetCode"`
+	Release       string         `gorm:"type:varchar(30)" json:"release"`
+	CreatedAt     time.Time      `gorm:"autoCreateTime" json:"createdAt"`
 }
 
 type MedicineType string
@@ -150,21 +303,522 @@ func (t TemperatureControlType) String() string {
 	return string(t)
 }
 
+// Medicine is a product of the catalog. Medicines without OrganizationID form the global catalog every
+// organization reads; the ones an organization adds for itself have its OrganizationID.
 type Medicine struct {
 	ID                 int                    `gorm:"primaryKey" json:"id"`
-	EANCode            string                 `gorm:"type:varchar(30);unique" json:"eanCode"`
+	OrganizationID     *int                   `gorm:"<-:create;uniqueIndex:idx_medicines_organization_ean_code,priority:1" json:"organizationId"`
+	EANCode            string                 `gorm:"type:varchar(30);uniqueIndex:idx_medicines_organization_ean_code,priority:2,where:deleted_at IS NULL;uniqueIndex:idx_medicines_global_ean_code,where:organization_id IS NULL AND deleted_at IS NULL" json:"eanCode"`
 	Description        string                 `gorm:"type:varchar(150)" json:"description"`
 	Type               MedicineType           `gorm:"type:varchar(50)" json:"type"`
 	Laboratory         string                 `gorm:"type:varchar(50)" json:"laboratory"`
-	IVA                string                 `gorm:"type:varchar(5)" json:"iva"`
+	TaxRateID          *int                   `json:"taxRateId"`
+	TaxRate            *TaxRate               `gorm:"foreignKey:TaxRateID" json:"taxRate,omitempty"`
 	SatKey             string                 `gorm:"type:varchar(50)" json:"satKey"`
 	TemperatureControl TemperatureControlType `gorm:"type:varchar(50)" json:"temperatureControl"`
 	ActiveIngredient   string                 `gorm:"type:varchar(150)" json:"activeIngredient"`
 	CreatedAt          time.Time              `gorm:"autoCreateTime" json:"createdAt"`
 	UpdatedAt          time.Time              `gorm:"autoUpdateTime" json:"updatedAt"`
+	Version            int                    `gorm:"not null;default:1" json:"version"`
+	DeletedAt          gorm.DeletedAt         `gorm:"index" json:"deletedAt"`
+	DeletedBy          *int                   `json:"deletedBy"`
 	ColdChain          bool                   `json:"coldChain"`
 	IsControlled       bool                   `json:"isControlled"`
-	IsDeleted          bool                   `gorm:"default:false" json:"isDeleted"`
 	UnitQuantity       float64                `json:"unitQuantity"`
 	UnitType           UnitType               `gorm:"type:varchar(50)" json:"unitType"`
+	Ingredients        []MedicineIngredient   `gorm:"foreignKey:MedicineID" json:"ingredients,omitempty"`
+}
+
+// MedicineOverride is what an organization changed of a global medicine for itself; the fields left nil
+// keep the value of the global catalog. Its prices are the ones of its own price lists.
+type MedicineOverride struct {
+	ID             int       `gorm:"primaryKey" json:"id"`
+	OrganizationID int       `gorm:"<-:create;not null;uniqueIndex:idx_medicine_overrides_organization_medicine,priority:1" json:"organizationId"`
+	MedicineID     int       `gorm:"not null;uniqueIndex:idx_medicine_overrides_organization_medicine,priority:2" json:"medicineId"`
+	Description    *string   `gorm:"type:varchar(150)" json:"description"`
+	Laboratory     *string   `gorm:"type:varchar(50)" json:"laboratory"`
+	CreatedAt      time.Time `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt      time.Time `gorm:"autoUpdateTime" json:"updatedAt"`
+	Version        int       `gorm:"not null;default:1" json:"version"`
+}
+
+// TaxRate is the IVA treatment applied to a medicine; Code is what clients send as "iva"
+type TaxRate struct {
+	ID          int             `gorm:"primaryKey" json:"id"`
+	Code        string          `gorm:"type:varchar(20);unique;not null" json:"code"`
+	Description string          `gorm:"type:varchar(100)" json:"description"`
+	Rate        decimal.Decimal `gorm:"type:numeric(7,6);not null" json:"rate"`
+	Exempt      bool            `gorm:"default:false" json:"exempt"`
+	CreatedAt   time.Time       `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt   time.Time       `gorm:"autoUpdateTime" json:"updatedAt"`
+}
+
+type CustomerType string
+
+const (
+	CustomerTypeRetail      CustomerType = "retail"
+	CustomerTypeWholesale   CustomerType = "wholesale"
+	CustomerTypeInstitution CustomerType = "institution"
+)
+
+var ValidCustomerTypes = []string{
+	CustomerTypeRetail.String(),
+	CustomerTypeWholesale.String(),
+	CustomerTypeInstitution.String(),
+}
+
+// check if the customerType is valid
+func (ct CustomerType) IsValid() bool {
+	return ct == CustomerTypeRetail || ct == CustomerTypeWholesale || ct == CustomerTypeInstitution
+}
+
+// return string of the customerType
+func (ct CustomerType) String() string {
+	return string(ct)
+}
+
+type PriceList struct {
+	ID             int          `gorm:"primaryKey" json:"id"`
+	OrganizationID int          `gorm:"<-:create;not null;uniqueIndex:idx_price_lists_organization_name,priority:1" json:"organizationId"`
+	Name           string       `gorm:"type:varchar(100);not null;uniqueIndex:idx_price_lists_organization_name,priority:2" json:"name"`
+	CustomerType   CustomerType `gorm:"type:varchar(20);not null" json:"customerType"`
+	Institution    string       `gorm:"type:varchar(150)" json:"institution"`
+	Currency       string       `gorm:"type:varchar(3);default:MXN" json:"currency"`
+	Enabled        bool         `gorm:"default:true" json:"enabled"`
+	CreatedAt      time.Time    `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt      time.Time    `gorm:"autoUpdateTime" json:"updatedAt"`
+	Version        int          `gorm:"not null;default:1" json:"version"`
+}
+
+// MedicinePrice is the net (pre-tax) unit price of a medicine in a price list during [ValidFrom, ValidTo).
+// Rows are never updated except to close them, so the table holds the full price history.
+type MedicinePrice struct {
+	ID          int             `gorm:"primaryKey" json:"id"`
+	PriceListID int             `gorm:"not null;index:idx_medicine_price_lookup;uniqueIndex:idx_medicine_prices_open,priority:1" json:"priceListId"`
+	MedicineID  int             `gorm:"not null;index:idx_medicine_price_lookup;uniqueIndex:idx_medicine_prices_open,priority:2,where:valid_to IS NULL" json:"medicineId"`
+	Price       decimal.Decimal `gorm:"type:numeric(14,4);not null" json:"price"`
+	ValidFrom   time.Time       `gorm:"not null;index:idx_medicine_price_lookup" json:"validFrom"`
+	ValidTo     *time.Time      `json:"validTo"`
+	CreatedBy   int             `json:"createdBy"`
+	CreatedAt   time.Time       `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+type InvoiceStatus string
+
+const (
+	InvoiceStatusSealed  InvoiceStatus = "sealed"
+	InvoiceStatusStamped InvoiceStatus = "stamped"
+	InvoiceStatusFailed  InvoiceStatus = "failed"
+)
+
+var ValidInvoiceStatuses = []string{
+	InvoiceStatusSealed.String(),
+	InvoiceStatusStamped.String(),
+	InvoiceStatusFailed.String(),
+}
+
+// check if the invoiceStatus is valid
+func (s InvoiceStatus) IsValid() bool {
+	return s == InvoiceStatusSealed || s == InvoiceStatusStamped || s == InvoiceStatusFailed
+}
+
+// return string of the invoiceStatus
+func (s InvoiceStatus) String() string {
+	return string(s)
+}
+
+// Invoice is a CFDI 4.0 document issued for a medicine sale. XML holds the sealed document until it
+// is stamped, and the stamped document (with its TimbreFiscalDigital) afterwards.
+type Invoice struct {
+	ID             int             `gorm:"primaryKey" json:"id"`
+	OrganizationID int             `gorm:"<-:create;not null;index" json:"organizationId"`
+	UUID           *string         `gorm:"type:varchar(36);uniqueIndex" json:"uuid"`
+	Serie          string          `gorm:"type:varchar(25)" json:"serie"`
+	Folio          string          `gorm:"type:varchar(40)" json:"folio"`
+	IssuerRFC      string          `gorm:"type:varchar(13);not null" json:"issuerRfc"`
+	ReceiverRFC    string          `gorm:"type:varchar(13);not null;index" json:"receiverRfc"`
+	ReceiverName   string          `gorm:"type:varchar(300);not null" json:"receiverName"`
+	PriceListID    int             `gorm:"not null" json:"priceListId"`
+	Currency       string          `gorm:"type:varchar(3);not null" json:"currency"`
+	Subtotal       decimal.Decimal `gorm:"type:numeric(14,2);not null" json:"subtotal"`
+	Tax            decimal.Decimal `gorm:"type:numeric(14,2);not null" json:"iva"`
+	Total          decimal.Decimal `gorm:"type:numeric(14,2);not null" json:"total"`
+	NoCertificado  string          `gorm:"type:varchar(20)" json:"noCertificado"`
+	Status         InvoiceStatus   `gorm:"type:varchar(20);not null" json:"status"`
+	StampError     string          `gorm:"type:text" json:"stampError,omitempty"`
+	StampedAt      *time.Time      `json:"stampedAt"`
+	CadenaOriginal string          `gorm:"type:text" json:"-"`
+	XML            string          `gorm:"type:text;not null" json:"-"`
+	CreatedBy      int             `json:"createdBy"`
+	CreatedAt      time.Time       `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt      time.Time       `gorm:"autoUpdateTime" json:"updatedAt"`
+}
+
+type StrengthUnit string
+
+const (
+	StrengthUnitMilligram              StrengthUnit = "mg"
+	StrengthUnitGram                   StrengthUnit = "g"
+	StrengthUnitMicrogram              StrengthUnit = "mcg"
+	StrengthUnitMilliliter             StrengthUnit = "ml"
+	StrengthUnitMilligramPerMilliliter StrengthUnit = "mg/ml"
+	StrengthUnitInternationalUnit      StrengthUnit = "ui"
+	StrengthUnitPercent                StrengthUnit = "%"
+)
+
+var ValidStrengthUnits = []string{
+	StrengthUnitMilligram.String(),
+	StrengthUnitGram.String(),
+	StrengthUnitMicrogram.String(),
+	StrengthUnitMilliliter.String(),
+	StrengthUnitMilligramPerMilliliter.String(),
+	StrengthUnitInternationalUnit.String(),
+	StrengthUnitPercent.String(),
+}
+
+// check if the strengthUnit is valid
+func (u StrengthUnit) IsValid() bool {
+	switch u {
+	case StrengthUnitMilligram, StrengthUnitGram, StrengthUnitMicrogram, StrengthUnitMilliliter,
+		StrengthUnitMilligramPerMilliliter, StrengthUnitInternationalUnit, StrengthUnitPercent:
+		return true
+	}
+	return false
+}
+
+// return string of the strengthUnit
+func (u StrengthUnit) String() string {
+	return string(u)
+}
+
+// ActiveIngredient is the normalized substance behind the free-text Medicine.ActiveIngredient.
+// NormalizedName and the synonyms' normalized names are unique across both tables.
+type ActiveIngredient struct {
+	ID             int                       `gorm:"primaryKey" json:"id"`
+	Name           string                    `gorm:"type:varchar(150);unique;not null" json:"name"`
+	NormalizedName string                    `gorm:"type:varchar(150);uniqueIndex;not null" json:"normalizedName"`
+	ATCCode        string                    `gorm:"type:varchar(7)" json:"atcCode"`
+	Synonyms       []ActiveIngredientSynonym `gorm:"foreignKey:ActiveIngredientID" json:"synonyms"`
+	CreatedAt      time.Time                 `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt      time.Time                 `gorm:"autoUpdateTime" json:"updatedAt"`
+}
+
+type ActiveIngredientSynonym struct {
+	ID                 int       `gorm:"primaryKey" json:"id"`
+	ActiveIngredientID int       `gorm:"not null;index" json:"activeIngredientId"`
+	Name               string    `gorm:"type:varchar(150);not null" json:"name"`
+	NormalizedName     string    `gorm:"type:varchar(150);uniqueIndex;not null" json:"normalizedName"`
+	CreatedAt          time.Time `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+// MedicineIngredient links a medicine to each of its active ingredients; combination products have several
+type MedicineIngredient struct {
+	MedicineID         int               `gorm:"primaryKey" json:"medicineId"`
+	ActiveIngredientID int               `gorm:"primaryKey" json:"activeIngredientId"`
+	ActiveIngredient   *ActiveIngredient `gorm:"foreignKey:ActiveIngredientID" json:"activeIngredient,omitempty"`
+	Strength           *decimal.Decimal  `gorm:"type:numeric(12,4)" json:"strength"`
+	StrengthUnit       StrengthUnit      `gorm:"type:varchar(10)" json:"strengthUnit"`
+}
+
+type InteractionSeverity string
+
+const (
+	InteractionSeverityMinor           InteractionSeverity = "minor"
+	InteractionSeverityModerate        InteractionSeverity = "moderate"
+	InteractionSeverityMajor           InteractionSeverity = "major"
+	InteractionSeverityContraindicated InteractionSeverity = "contraindicated"
+)
+
+var ValidInteractionSeverities = []string{
+	InteractionSeverityMinor.String(),
+	InteractionSeverityModerate.String(),
+	InteractionSeverityMajor.String(),
+	InteractionSeverityContraindicated.String(),
+}
+
+// check if the interactionSeverity is valid
+func (s InteractionSeverity) IsValid() bool {
+	return s.Rank() > 0
+}
+
+// Rank orders severities from minor (1) to contraindicated (4); invalid severities rank 0
+func (s InteractionSeverity) Rank() int {
+	switch s {
+	case InteractionSeverityMinor:
+		return 1
+	case InteractionSeverityModerate:
+		return 2
+	case InteractionSeverityMajor:
+		return 3
+	case InteractionSeverityContraindicated:
+		return 4
+	}
+	return 0
+}
+
+// return string of the interactionSeverity
+func (s InteractionSeverity) String() string {
+	return string(s)
+}
+
+// DrugInteraction is a known interaction between two active ingredients, stored once per pair
+// with IngredientAID < IngredientBID
+type DrugInteraction struct {
+	ID            int                 `gorm:"primaryKey" json:"id"`
+	IngredientAID int                 `gorm:"not null;uniqueIndex:idx_drug_interaction_pair" json:"ingredientAId"`
+	IngredientA   *ActiveIngredient   `gorm:"foreignKey:IngredientAID" json:"ingredientA,omitempty"`
+	IngredientBID int                 `gorm:"not null;uniqueIndex:idx_drug_interaction_pair;index" json:"ingredientBId"`
+	IngredientB   *ActiveIngredient   `gorm:"foreignKey:IngredientBID" json:"ingredientB,omitempty"`
+	Severity      InteractionSeverity `gorm:"type:varchar(20);not null" json:"severity"`
+	Description   string              `gorm:"type:text" json:"description"`
+	Source        string              `gorm:"type:varchar(100)" json:"source"`
+	CreatedAt     time.Time           `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt     time.Time           `gorm:"autoUpdateTime" json:"updatedAt"`
+}
+
+// TherapeuticEquivalence is an explicit decision on whether two medicines are interchangeable. It takes
+// precedence over the automatic ingredient, strength and form match, and is stored once per pair with
+// MedicineAID < MedicineBID.
+type TherapeuticEquivalence struct {
+	ID             int       `gorm:"primaryKey" json:"id"`
+	OrganizationID int       `gorm:"<-:create;not null;uniqueIndex:idx_therapeutic_equivalence_organization_pair,priority:1" json:"organizationId"`
+	MedicineAID    int       `gorm:"not null;uniqueIndex:idx_therapeutic_equivalence_organization_pair,priority:2" json:"medicineAId"`
+	MedicineA      *Medicine `gorm:"foreignKey:MedicineAID" json:"medicineA,omitempty"`
+	MedicineBID    int       `gorm:"not null;uniqueIndex:idx_therapeutic_equivalence_organization_pair,priority:3;index" json:"medicineBId"`
+	MedicineB      *Medicine `gorm:"foreignKey:MedicineBID" json:"medicineB,omitempty"`
+	Equivalent     bool      `gorm:"not null" json:"equivalent"`
+	Reason         string    `gorm:"type:text" json:"reason"`
+	CreatedBy      int       `json:"createdBy"`
+	CreatedAt      time.Time `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt      time.Time `gorm:"autoUpdateTime" json:"updatedAt"`
+}
+
+type PatientSex string
+
+const (
+	PatientSexFemale PatientSex = "female"
+	PatientSexMale   PatientSex = "male"
+	PatientSexOther  PatientSex = "other"
+)
+
+var ValidPatientSexes = []string{
+	PatientSexFemale.String(),
+	PatientSexMale.String(),
+	PatientSexOther.String(),
+}
+
+// check if the patientSex is valid
+func (s PatientSex) IsValid() bool {
+	return s == PatientSexFemale || s == PatientSexMale || s == PatientSexOther
+}
+
+// return string of the patientSex
+func (s PatientSex) String() string {
+	return string(s)
+}
+
+// Patient is a person attended by the clinic. CURP, the Mexican population registry key, is optional
+// but identifies a single patient of the organization when given.
+type Patient struct {
+	ID             int            `gorm:"primaryKey" json:"id"`
+	OrganizationID int            `gorm:"<-:create;not null;uniqueIndex:idx_patients_organization_curp,priority:1" json:"organizationId"`
+	FirstName      string         `gorm:"type:varchar(100);not null" json:"firstName"`
+	LastName       string         `gorm:"type:varchar(100);not null" json:"lastName"`
+	BirthDate      time.Time      `gorm:"type:date;not null" json:"birthDate"`
+	Sex            PatientSex     `gorm:"type:varchar(10);not null" json:"sex"`
+	CURP           *string        `gorm:"type:varchar(18);uniqueIndex:idx_patients_organization_curp,priority:2,where:deleted_at IS NULL" json:"curp"`
+	Email          string         `gorm:"type:varchar(150)" json:"email"`
+	Phone          string         `gorm:"type:varchar(20)" json:"phone"`
+	CreatedBy      int            `json:"createdBy"`
+	CreatedAt      time.Time      `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt      time.Time      `gorm:"autoUpdateTime" json:"updatedAt"`
+	Version        int            `gorm:"not null;default:1" json:"version"`
+	DeletedAt      gorm.DeletedAt `gorm:"index" json:"deletedAt"`
+	DeletedBy      *int           `json:"deletedBy"`
+}
+
+type DiagnosisRank string
+
+const (
+	DiagnosisRankPrimary   DiagnosisRank = "primary"
+	DiagnosisRankSecondary DiagnosisRank = "secondary"
+)
+
+var ValidDiagnosisRanks = []string{
+	DiagnosisRankPrimary.String(),
+	DiagnosisRankSecondary.String(),
+}
+
+// check if the diagnosisRank is valid
+func (r DiagnosisRank) IsValid() bool {
+	return r == DiagnosisRankPrimary || r == DiagnosisRankSecondary
+}
+
+// return string of the diagnosisRank
+func (r DiagnosisRank) String() string {
+	return string(r)
+}
+
+// Encounter is a consultation of a patient, authored by the User who attended it, with exactly one
+// primary diagnosis and any number of secondary ones
+type Encounter struct {
+	ID             int                  `gorm:"primaryKey" json:"id"`
+	OrganizationID int                  `gorm:"<-:create;not null;index" json:"organizationId"`
+	PatientID      int                  `gorm:"not null;index" json:"patientId"`
+	Patient        *Patient             `gorm:"foreignKey:PatientID" json:"patient,omitempty"`
+	AuthorID       int                  `gorm:"not null;index" json:"authorId"`
+	Author         *User                `gorm:"foreignKey:AuthorID" json:"author,omitempty"`
+	OccurredAt     time.Time            `gorm:"not null;index" json:"occurredAt"`
+	Reason         string               `gorm:"type:varchar(255)" json:"reason"`
+	Notes          string               `gorm:"type:text" json:"notes"`
+	Diagnoses      []EncounterDiagnosis `gorm:"foreignKey:EncounterID" json:"diagnoses"`
+	Prescriptions  []Prescription       `gorm:"foreignKey:EncounterID" json:"prescriptions,omitempty"`
+	CreatedAt      time.Time            `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt      time.Time            `gorm:"autoUpdateTime" json:"updatedAt"`
+	Version        int                  `gorm:"not null;default:1" json:"version"`
+}
+
+// EncounterDiagnosis links an encounter to an ICD record; a code is listed once per encounter
+type EncounterDiagnosis struct {
+	ID          int           `gorm:"primaryKey" json:"id"`
+	EncounterID int           `gorm:"not null;uniqueIndex:idx_encounter_diagnosis" json:"encounterId"`
+	ICDCieID    int           `gorm:"not null;uniqueIndex:idx_encounter_diagnosis;index" json:"icdCieId"`
+	ICDCie      *ICDCie       `gorm:"foreignKey:ICDCieID" json:"icdCie,omitempty"`
+	Rank        DiagnosisRank `gorm:"type:varchar(10);not null" json:"rank"`
+}
+
+// Prescription is issued during an encounter by its author. PatientID repeats the patient of the
+// encounter so prescriptions can be searched without joining it. Prescriptions are not edited once
+// issued; a correction is a new prescription.
+type Prescription struct {
+	ID             int                `gorm:"primaryKey" json:"id"`
+	OrganizationID int                `gorm:"<-:create;not null;index" json:"organizationId"`
+	EncounterID    int                `gorm:"not null;index" json:"encounterId"`
+	PatientID      int                `gorm:"not null;index" json:"patientId"`
+	Patient        *Patient           `gorm:"foreignKey:PatientID" json:"patient,omitempty"`
+	AuthorID       int                `gorm:"not null;index" json:"authorId"`
+	Author         *User              `gorm:"foreignKey:AuthorID" json:"author,omitempty"`
+	Notes          string             `gorm:"type:text" json:"notes"`
+	Items          []PrescriptionItem `gorm:"foreignKey:PrescriptionID" json:"items"`
+	IssuedAt       time.Time          `gorm:"not null;index" json:"issuedAt"`
+	CreatedAt      time.Time          `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+// PrescriptionItem is a medicine of a prescription: Dose DoseUnit every FrequencyHours hours during
+// DurationDays days, Quantity being the units to dispense
+type PrescriptionItem struct {
+	ID             int             `gorm:"primaryKey" json:"id"`
+	PrescriptionID int             `gorm:"not null;index" json:"prescriptionId"`
+	MedicineID     int             `gorm:"not null;index" json:"medicineId"`
+	Medicine       *Medicine       `gorm:"foreignKey:MedicineID" json:"medicine,omitempty"`
+	Dose           decimal.Decimal `gorm:"type:numeric(10,3);not null" json:"dose"`
+	DoseUnit       string          `gorm:"type:varchar(30);not null" json:"doseUnit"`
+	Route          string          `gorm:"type:varchar(50)" json:"route"`
+	FrequencyHours int             `gorm:"not null" json:"frequencyHours"`
+	DurationDays   int             `gorm:"not null" json:"durationDays"`
+	Quantity       int             `gorm:"not null" json:"quantity"`
+	Instructions   string          `gorm:"type:text" json:"instructions"`
+}
+
+type WebhookEvent string
+
+const (
+	WebhookEventUserCreated      WebhookEvent = "user.created"
+	WebhookEventUserUpdated      WebhookEvent = "user.updated"
+	WebhookEventUserDeleted      WebhookEvent = "user.deleted"
+	WebhookEventMedicineCreated  WebhookEvent = "medicine.created"
+	WebhookEventMedicineUpdated  WebhookEvent = "medicine.updated"
+	WebhookEventMedicineDeleted  WebhookEvent = "medicine.deleted"
+	WebhookEventMedicineImported WebhookEvent = "medicine.imported"
+	WebhookEventICDCreated       WebhookEvent = "icd.created"
+	WebhookEventICDUpdated       WebhookEvent = "icd.updated"
+	WebhookEventICDDeleted       WebhookEvent = "icd.deleted"
+	WebhookEventICDImported      WebhookEvent = "icd.imported"
+	WebhookEventLoginFailed      WebhookEvent = "login.failed"
+)
+
+var ValidWebhookEvents = []string{
+	WebhookEventUserCreated.String(),
+	WebhookEventUserUpdated.String(),
+	WebhookEventUserDeleted.String(),
+	WebhookEventMedicineCreated.String(),
+	WebhookEventMedicineUpdated.String(),
+	WebhookEventMedicineDeleted.String(),
+	WebhookEventMedicineImported.String(),
+	WebhookEventICDCreated.String(),
+	WebhookEventICDUpdated.String(),
+	WebhookEventICDDeleted.String(),
+	WebhookEventICDImported.String(),
+	WebhookEventLoginFailed.String(),
+}
+
+// check if the webhookEvent is valid
+func (e WebhookEvent) IsValid() bool {
+	return slices.Contains(ValidWebhookEvents, string(e))
+}
+
+// return string of the webhookEvent
+func (e WebhookEvent) String() string {
+	return string(e)
+}
+
+// WebhookSubscription is an endpoint of an organization that is sent the events it subscribes to. Each
+// delivery is signed with Secret, which is only answered when the subscription is created.
+type WebhookSubscription struct {
+	ID             int            `gorm:"primaryKey" json:"id"`
+	OrganizationID int            `gorm:"<-:create;not null;index" json:"organizationId"`
+	URL            string         `gorm:"type:varchar(500);not null" json:"url"`
+	Description    string         `gorm:"type:varchar(150)" json:"description"`
+	Events         []WebhookEvent `gorm:"type:text;not null;serializer:json" json:"events"`
+	Secret         string         `gorm:"type:varchar(100);not null" json:"-"`
+	Enabled        bool           `gorm:"default:true" json:"enabled"`
+	CreatedAt      time.Time      `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt      time.Time      `gorm:"autoUpdateTime" json:"updatedAt"`
+	Version        int            `gorm:"not null;default:1" json:"version"`
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliverySucceeded WebhookDeliveryStatus = "succeeded"
+	WebhookDeliveryFailed    WebhookDeliveryStatus = "failed"
+)
+
+var ValidWebhookDeliveryStatuses = []string{
+	WebhookDeliveryPending.String(),
+	WebhookDeliverySucceeded.String(),
+	WebhookDeliveryFailed.String(),
+}
+
+// check if the webhookDeliveryStatus is valid
+func (s WebhookDeliveryStatus) IsValid() bool {
+	return s == WebhookDeliveryPending || s == WebhookDeliverySucceeded || s == WebhookDeliveryFailed
+}
+
+// return string of the webhookDeliveryStatus
+func (s WebhookDeliveryStatus) String() string {
+	return string(s)
+}
+
+// WebhookDelivery is an event sent, or to be sent, to a subscription. Payload is the exact body posted.
+// A pending delivery is attempted at NextAttemptAt until it succeeds or runs out of attempts and fails;
+// replaying a delivery queues a new one with the same payload, ReplayOf pointing to it.
+type WebhookDelivery struct {
+	ID             int                   `gorm:"primaryKey" json:"id"`
+	OrganizationID int                   `gorm:"<-:create;not null;index" json:"organizationId"`
+	SubscriptionID int                   `gorm:"not null;index" json:"subscriptionId"`
+	Subscription   *WebhookSubscription  `gorm:"foreignKey:SubscriptionID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"subscription,omitempty"`
+	EventID        string                `gorm:"type:varchar(36);not null;index" json:"eventId"`
+	Event          WebhookEvent          `gorm:"type:varchar(50);not null" json:"event"`
+	Payload        string                `gorm:"type:text;not null" json:"payload"`
+	Status         WebhookDeliveryStatus `gorm:"type:varchar(20);not null;index:idx_webhook_deliveries_due,priority:1" json:"status"`
+	Attempts       int                   `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt  *time.Time            `gorm:"index:idx_webhook_deliveries_due,priority:2" json:"nextAttemptAt"`
+	LastAttemptAt  *time.Time            `json:"lastAttemptAt"`
+	ResponseStatus *int                  `json:"responseStatus"`
+	Error          string                `gorm:"type:text" json:"error"`
+	ReplayOf       *int                  `gorm:"index" json:"replayOf"`
+	CreatedAt      time.Time             `gorm:"autoCreateTime" json:"createdAt"`
+	UpdatedAt      time.Time             `gorm:"autoUpdateTime" json:"updatedAt"`
 }
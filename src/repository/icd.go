@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	icd10Chapter     = regexp.MustCompile(`^(?:XXII|XXI|XX|XIX|XVIII|XVII|XVI|XV|XIV|XIII|XII|XI|X|IX|VIII|VII|VI|V|IV|III|II|I)$`)
+	icd10Block       = regexp.MustCompile(`^[A-Z][0-9]{2}-[A-Z][0-9]{2}$`)
+	icd10Category    = regexp.MustCompile(`^[A-Z][0-9]{2}$`)
+	icd10Subcategory = regexp.MustCompile(`^[A-Z][0-9]{2}\.[0-9A-Z]{1,2}$`)
+
+	// ICD-11 MMS codes never use the letters I and O; the second character is always a letter
+	// and the third always a digit. Blocks are code ranges or WHO block ids such as BlockL1-1A0,
+	// and extension codes (chapter X) have up to six characters.
+	icd11Chapter     = regexp.MustCompile(`^(?:0[1-9]|1[0-9]|2[0-6]|V|X)$`)
+	icd11Block       = regexp.MustCompile(`^(?:[1-9A-HJ-NP-Z][A-HJ-NP-Z][0-9][0-9A-HJ-NP-Z]?-[1-9A-HJ-NP-Z][A-HJ-NP-Z][0-9][0-9A-HJ-NP-Z]?|BLOCKL[0-9]-[0-9A-Z]{3})$`)
+	icd11Category    = regexp.MustCompile(`^(?:[1-9A-HJ-NP-Z][A-HJ-NP-Z][0-9][0-9A-HJ-NP-Z]|X[A-HJ-NP-Z][0-9A-HJ-NP-Z]{2,4})$`)
+	icd11Subcategory = regexp.MustCompile(`^[1-9A-HJ-NP-Z][A-HJ-NP-Z][0-9][0-9A-HJ-NP-Z]\.[0-9A-HJ-NP-Z]{1,2}$`)
+)
+
+// NormalizeICDCode returns the code as stored: trimmed and uppercase
+func NormalizeICDCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// InferICDKind returns the kind of node a code denotes in the given classification version,
+// or false when the code does not follow the syntax of that version
+func InferICDKind(version CieVersionType, code string) (ICDKind, bool) {
+	patterns := map[ICDKind]*regexp.Regexp{
+		ICDKindChapter:     icd10Chapter,
+		ICDKindBlock:       icd10Block,
+		ICDKindCategory:    icd10Category,
+		ICDKindSubcategory: icd10Subcategory,
+	}
+	if version == CIE11 {
+		patterns = map[ICDKind]*regexp.Regexp{
+			ICDKindChapter:     icd11Chapter,
+			ICDKindBlock:       icd11Block,
+			ICDKindCategory:    icd11Category,
+			ICDKindSubcategory: icd11Subcategory,
+		}
+	} else if version != CIE10 {
+		return "", false
+	}
+	for _, kind := range []ICDKind{ICDKindChapter, ICDKindBlock, ICDKindCategory, ICDKindSubcategory} {
+		if patterns[kind].MatchString(code) {
+			return kind, true
+		}
+	}
+	return "", false
+}
+
+// ValidateICDCode checks that a code follows the syntax of its version and, when kind is given,
+// that the syntax matches it. It returns the kind of the code.
+func ValidateICDCode(version CieVersionType, code string, kind ICDKind) (ICDKind, error) {
+	inferred, ok := InferICDKind(version, code)
+	if !ok {
+		return "", NewAppError(fmt.Errorf("code %q is not a valid %s code", code, version), ValidationError)
+	}
+	if kind != "" && kind != inferred {
+		return "", NewAppError(fmt.Errorf("code %q is a %s, not a %s", code, inferred, kind), ValidationError)
+	}
+	return inferred, nil
+}
+
+// CanContainICDNode reports whether a node of kind parent may be the parent of a node of kind child.
+// Blocks may be nested, as may subcategories in ICD-11 (1A00.0 > 1A00.00); chapters are always roots.
+func CanContainICDNode(parent, child ICDKind) bool {
+	if child == ICDKindChapter {
+		return false
+	}
+	if parent == child {
+		return child == ICDKindBlock || child == ICDKindSubcategory
+	}
+	return parent.Rank() < child.Rank()
+}
+
+// ICDBlockContains reports whether a category or block code falls inside the range of a block code
+// such as "J00-J99"; categories are compared on their first three characters
+func ICDBlockContains(block, code string) bool {
+	start, end, ok := strings.Cut(block, "-")
+	if !ok {
+		return false
+	}
+	from, to := code, code
+	if first, last, isRange := strings.Cut(code, "-"); isRange {
+		from, to = first, last
+	}
+	if from == start && to == end {
+		return false
+	}
+	return prefixCompare(from, start) >= 0 && prefixCompare(to, end) <= 0
+}
+
+// prefixCompare compares two codes on the length of the shorter one, so "J45" falls
+// within "J40" to "J47" and "1A0" within "1A00"
+func prefixCompare(a, b string) int {
+	n := min(len(a), len(b))
+	return strings.Compare(a[:n], b[:n])
+}
+
+// RecordICDVersions closes the open version of each record at the given time and, for the records that
+// are not retired, opens a new one holding their current state. It must run in the transaction that
+// changes the records.
+func RecordICDVersions(tx *gorm.DB, records []ICDCie, at time.Time) error {
+	const chunkSize = 500
+	for start := 0; start < len(records); start += chunkSize {
+		chunk := records[start:min(start+chunkSize, len(records))]
+		ids := make([]int, len(chunk))
+		var versions []ICDCieVersion
+		for i, record := range chunk {
+			ids[i] = record.ID
+			if record.Retired {
+				continue
+			}
+			versions = append(versions, ICDCieVersion{
+				OrganizationID: record.OrganizationID,
+				ICDCieID:       record.ID,
+				CieVersion:     record.CieVersion,
+				Code:           record.Code,
+				Description:    record.Description,
+				ChapterNo:      record.ChapterNo,
+				ChapterTitle:   record.ChapterTitle,
+				Kind:           record.Kind,
+				ParentID:       record.ParentID,
+				Release:        record.Release,
+				ValidFrom:      at,
+			})
+		}
+		if err := tx.Model(&ICDCieVersion{}).Where("icd_cie_id IN ? AND valid_to IS NULL", ids).
+			Update("valid_to", at).Error; err != nil {
+			return err
+		}
+		if len(versions) > 0 {
+			if err := tx.Create(&versions).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	accentReplacer = strings.NewReplacer(
+		"á", "a", "é", "e", "í", "i", "ó", "o", "ú", "u", "ü", "u", "ñ", "n",
+		"à", "a", "è", "e", "ì", "i", "ò", "o", "ù", "u", "ç", "c",
+	)
+	nonAlphanumeric = regexp.MustCompile(`[^a-z0-9]+`)
+	ingredientParts = regexp.MustCompile(`\s*(?:\+|/|;|\s+y\s+|\s+and\s+)\s*`)
+	strengthSuffix  = regexp.MustCompile(`(?i)^(.*?)\s*(\d+(?:[.,]\d+)?)\s*(mg/ml|mcg|µg|mg|g|ml|ui|iu|%)$`)
+	concentration   = regexp.MustCompile(`(?i)mg/ml`)
+	strengthAliases = map[string]StrengthUnit{"µg": StrengthUnitMicrogram, "iu": StrengthUnitInternationalUnit}
+)
+
+// NormalizeIngredientName returns the comparison key of an ingredient name: lowercase, without
+// accents and with every run of punctuation or spaces collapsed to a single space
+func NormalizeIngredientName(name string) string {
+	normalized := accentReplacer.Replace(strings.ToLower(strings.TrimSpace(name)))
+	return strings.TrimSpace(nonAlphanumeric.ReplaceAllString(normalized, " "))
+}
+
+// ParsedIngredient is an ingredient mention extracted from free text such as "Paracetamol 500mg"
+type ParsedIngredient struct {
+	Name         string
+	Strength     *decimal.Decimal
+	StrengthUnit StrengthUnit
+}
+
+// ParseIngredientText splits a free-text active ingredient into its components, so combination
+// products like "Paracetamol 500mg + Cafeína 65mg" yield one entry per ingredient
+func ParseIngredientText(text string) []ParsedIngredient {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil
+	}
+	// "mg/ml" must not be taken as a combination separator
+	text = concentration.ReplaceAllString(text, "mg\x00ml")
+
+	var parsed []ParsedIngredient
+	for _, part := range ingredientParts.Split(text, -1) {
+		part = strings.TrimSpace(strings.ReplaceAll(part, "\x00", "/"))
+		if part == "" {
+			continue
+		}
+		ingredient := ParsedIngredient{Name: part}
+		m := strengthSuffix.FindStringSubmatch(part)
+		if m != nil && strings.TrimSpace(m[1]) == "" {
+			// a bare strength such as the "125mg" of "Amoxicilina/Ácido clavulánico 875mg/125mg"
+			continue
+		}
+		if m != nil {
+			if strength, err := decimal.NewFromString(strings.ReplaceAll(m[2], ",", ".")); err == nil {
+				unit := strings.ToLower(m[3])
+				ingredient.Name = strings.TrimSpace(m[1])
+				ingredient.Strength = &strength
+				if alias, ok := strengthAliases[unit]; ok {
+					ingredient.StrengthUnit = alias
+				} else {
+					ingredient.StrengthUnit = StrengthUnit(unit)
+				}
+			}
+		}
+		parsed = append(parsed, ingredient)
+	}
+	return parsed
+}
+
+// OrderedIngredientPair returns both ingredient ids with the smaller one first, which is how
+// interactions are stored so that each pair has a single row
+func OrderedIngredientPair(a, b int) (int, int) {
+	if a > b {
+		return b, a
+	}
+	return a, b
+}
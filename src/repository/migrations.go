@@ -1,22 +1,93 @@
 package repository
 
 import (
+	"context"
+
+	"github.com/shopspring/decimal"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"os"
 )
 
 func (r *Repository) MigrateEntitiesGORM() error {
-	if err := r.DB.AutoMigrate(&User{}, &RoleUser{}, &DeviceDetails{}, &Medicine{}, &ICDCie{}); err != nil {
+	organization, err := r.MigrateOrganizations()
+	if err != nil {
+		r.Logger.Error("Error migrating organizations", zap.Error(err))
+		return err
+	}
+
+	if err := r.MigrateOpenPrices(); err != nil {
+		r.Logger.Error("Error closing duplicated open prices", zap.Error(err))
+		return err
+	}
+
+	if err := r.DB.AutoMigrate(&User{}, &RoleUser{}, &DeviceDetails{}, &TaxRate{}, &Medicine{}, &ICDCie{},
+		&PriceList{}, &MedicinePrice{}, &Invoice{}, &ActiveIngredient{}, &ActiveIngredientSynonym{},
+		&MedicineIngredient{}, &DrugInteraction{}, &TherapeuticEquivalence{}, &ICDRelease{},
+		&ICDMapping{}, &ICDCieVersion{}, &Patient{}, &Encounter{}, &EncounterDiagnosis{}, &Prescription{},
+		&PrescriptionItem{}, &MedicineOverride{}, &ICDCieOverride{}, &WebhookSubscription{},
+		&WebhookDelivery{}); err != nil {
 		r.Logger.Error("Error migrating database entities", zap.Error(err))
 		return err
 	}
 	r.Logger.Info("Database entities migrated successfully")
 
-	if err := r.SeedInitialRole(); err != nil {
+	if err := r.SeedTaxRates(); err != nil {
+		r.Logger.Error("Error seeding tax rates", zap.Error(err))
+		return err
+	}
+
+	if err := r.MigrateMedicineIVA(); err != nil {
+		r.Logger.Error("Error migrating medicine IVA to tax rates", zap.Error(err))
+		return err
+	}
+
+	if err := r.MigrateMedicineGTINs(); err != nil {
+		r.Logger.Error("Error normalizing medicine EAN codes", zap.Error(err))
+		return err
+	}
+
+	if err := r.MigrateICDKinds(); err != nil {
+		r.Logger.Error("Error migrating ICD record kinds", zap.Error(err))
+		return err
+	}
+
+	if err := r.MigrateICDHistory(); err != nil {
+		r.Logger.Error("Error migrating ICD record history", zap.Error(err))
+		return err
+	}
+
+	if err := r.MigrateICDSearch(); err != nil {
+		r.Logger.Error("Error migrating ICD search indexes", zap.Error(err))
+		return err
+	}
+
+	if err := r.MigrateSoftDelete(); err != nil {
+		r.Logger.Error("Error migrating deleted records", zap.Error(err))
+		return err
+	}
+
+	if err := r.MigrateForeignKeys(); err != nil {
+		r.Logger.Error("Error migrating foreign keys", zap.Error(err))
+		return err
+	}
+
+	if err := r.MigrateWebhookResponses(); err != nil {
+		r.Logger.Error("Error dropping webhook response bodies", zap.Error(err))
+		return err
+	}
+
+	if err := r.MigrateTenantRLS(); err != nil {
+		r.Logger.Error("Error migrating row-level security", zap.Error(err))
+		return err
+	}
+
+	if err := r.SeedInitialRole(organization.ID); err != nil {
 		r.Logger.Error("Error seeding initial role", zap.Error(err))
 	}
 
-	if err := r.SeedInitialUser(); err != nil {
+	if err := r.SeedInitialUser(organization.ID); err != nil {
 		r.Logger.Error("Error seeding initial user", zap.Error(err))
 		return err
 	}
@@ -24,9 +95,10 @@ func (r *Repository) MigrateEntitiesGORM() error {
 	return nil
 }
 
-func (r *Repository) SeedInitialRole() error {
+func (r *Repository) SeedInitialRole(organizationID int) error {
+	db := r.DB.WithContext(WithOrganization(context.Background(), organizationID))
 	var count int64
-	if err := r.DB.Model(&RoleUser{}).
+	if err := db.Model(&RoleUser{}).
 		Where("name = ?", "admin").
 		Count(&count).Error; err != nil {
 		r.Logger.Error("Error checking existing role", zap.Error(err))
@@ -35,7 +107,7 @@ func (r *Repository) SeedInitialRole() error {
 
 	if count == 0 {
 		role := RoleUser{Name: "admin", Description: "Administrator"}
-		if err := r.DB.Create(&role).Error; err != nil {
+		if err := db.Create(&role).Error; err != nil {
 			r.Logger.Error("Error creating initial role", zap.Error(err))
 			return err
 		}
@@ -47,7 +119,7 @@ func (r *Repository) SeedInitialRole() error {
 	return nil
 }
 
-func (r *Repository) SeedInitialUser() error {
+func (r *Repository) SeedInitialUser(organizationID int) error {
 	email := os.Getenv("START_USER_EMAIL")
 	pw := os.Getenv("START_USER_PW")
 	if email == "" || pw == "" {
@@ -55,8 +127,9 @@ func (r *Repository) SeedInitialUser() error {
 		return nil
 	}
 
+	db := r.DB.WithContext(WithOrganization(context.Background(), organizationID))
 	var count int64
-	if err := r.DB.Model(&User{}).
+	if err := db.Model(&User{}).
 		Where("email = ?", email).
 		Count(&count).Error; err != nil {
 		r.Logger.Error("Error checking existing user", zap.Error(err))
@@ -70,7 +143,7 @@ func (r *Repository) SeedInitialUser() error {
 			return err
 		}
 		var role RoleUser
-		if err := r.DB.Where("name = ?", "admin").First(&role).Error; err != nil {
+		if err := db.Where("name = ?", "admin").First(&role).Error; err != nil {
 			r.Logger.Error("Error retrieving admin role for initial user", zap.Error(err))
 			return err
 		}
@@ -84,7 +157,7 @@ func (r *Repository) SeedInitialUser() error {
 			Enabled:      true,
 			JobPosition:  "Administrator",
 		}
-		if err := r.DB.Create(&user).Error; err != nil {
+		if err := db.Create(&user).Error; err != nil {
 			r.Logger.Error("Error creating initial user", zap.Error(err))
 			return err
 		}
@@ -95,3 +168,424 @@ func (r *Repository) SeedInitialUser() error {
 
 	return nil
 }
+
+// DefaultTaxRates are the Mexican IVA treatments available out of the box
+var DefaultTaxRates = []TaxRate{
+	{Code: "16", Description: "IVA 16%", Rate: decimal.RequireFromString("0.16")},
+	{Code: "8", Description: "IVA 8% (border region)", Rate: decimal.RequireFromString("0.08")},
+	{Code: "0", Description: "IVA 0%", Rate: decimal.Zero},
+	{Code: "exempt", Description: "IVA exempt", Rate: decimal.Zero, Exempt: true},
+}
+
+func (r *Repository) SeedTaxRates() error {
+	rates := make([]TaxRate, len(DefaultTaxRates))
+	copy(rates, DefaultTaxRates)
+	if err := r.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "code"}},
+		DoNothing: true,
+	}).Create(&rates).Error; err != nil {
+		r.Logger.Error("Error creating default tax rates", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// MigrateOpenPrices runs before the entities are migrated, so that the unique index on the open price of
+// a medicine in a price list can be created: of the open prices that repeat, all but the latest are
+// closed when the next one starts.
+func (r *Repository) MigrateOpenPrices() error {
+	migrator := r.DB.Migrator()
+	if !migrator.HasTable(&MedicinePrice{}) || migrator.HasIndex(&MedicinePrice{}, "idx_medicine_prices_open") {
+		return nil
+	}
+	res := r.DB.Exec(`UPDATE medicine_prices SET valid_to = (
+			SELECT MIN(newer.valid_from) FROM medicine_prices newer
+			WHERE newer.price_list_id = medicine_prices.price_list_id AND newer.medicine_id = medicine_prices.medicine_id
+			AND newer.valid_to IS NULL AND (newer.valid_from, newer.id) > (medicine_prices.valid_from, medicine_prices.id))
+		WHERE valid_to IS NULL AND EXISTS (
+			SELECT 1 FROM medicine_prices newer
+			WHERE newer.price_list_id = medicine_prices.price_list_id AND newer.medicine_id = medicine_prices.medicine_id
+			AND newer.valid_to IS NULL AND (newer.valid_from, newer.id) > (medicine_prices.valid_from, medicine_prices.id))`)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		r.Logger.Warn("Closed duplicated open prices", zap.Int64("count", res.RowsAffected))
+	}
+	return nil
+}
+
+// MigrateMedicineIVA moves the legacy free-text medicines.iva column to tax_rate_id and drops it
+func (r *Repository) MigrateMedicineIVA() error {
+	migrator := r.DB.Migrator()
+	if !migrator.HasColumn(&Medicine{}, "iva") {
+		return nil
+	}
+
+	res := r.DB.Exec(`UPDATE medicines SET tax_rate_id = tax_rates.id
+		FROM tax_rates
+		WHERE medicines.tax_rate_id IS NULL
+		AND tax_rates.code = LOWER(REPLACE(TRIM(medicines.iva), '%', ''))`)
+	if res.Error != nil {
+		r.Logger.Error("Error mapping legacy IVA values", zap.Error(res.Error))
+		return res.Error
+	}
+
+	var unmapped int64
+	if err := r.DB.Table("medicines").
+		Where("tax_rate_id IS NULL AND iva IS NOT NULL AND TRIM(iva) <> ''").
+		Count(&unmapped).Error; err != nil {
+		return err
+	}
+	if unmapped > 0 {
+		// Keep the legacy column so the values can be fixed by hand and mapped on the next start
+		r.Logger.Warn("Medicines with unrecognized legacy IVA values, keeping iva column", zap.Int64("count", unmapped))
+		return nil
+	}
+
+	if err := migrator.DropColumn(&Medicine{}, "iva"); err != nil {
+		return err
+	}
+	r.Logger.Info("Migrated legacy medicine IVA column", zap.Int64("mapped", res.RowsAffected))
+	return nil
+}
+
+// MigrateMedicineGTINs rewrites the EAN codes stored before they were normalized to their NormalizeGTIN
+// form, so that barcode lookups and the unique indexes see them. Codes that are not valid GTINs, and codes
+// whose normalized form is already taken by another medicine of the same catalog or of the global one,
+// are left as they are and logged to be fixed by hand; they are reported again on every start.
+func (r *Repository) MigrateMedicineGTINs() error {
+	type storedCode struct {
+		ID             int
+		OrganizationID *int
+		EANCode        string
+		Deleted        bool
+	}
+	var codes []storedCode
+	if err := r.DB.Table("medicines").Select("id, organization_id, ean_code, deleted_at IS NOT NULL AS deleted").
+		Order("id").Scan(&codes).Error; err != nil {
+		return err
+	}
+
+	// scope keys a code by the catalog it has to be unique in; 0 is the global catalog
+	scope := func(code storedCode) int {
+		if code.OrganizationID == nil {
+			return 0
+		}
+		return *code.OrganizationID
+	}
+	type key struct {
+		scope int
+		code  string
+	}
+	taken := make(map[key]int, len(codes))
+	normalized := make(map[int]string, len(codes))
+	invalid := 0
+	for _, code := range codes {
+		gtin, err := NormalizeGTIN(code.EANCode)
+		if err != nil {
+			invalid++
+			r.Logger.Warn("Medicine with an invalid EAN code, leaving it as it is",
+				zap.Int("medicine", code.ID), zap.String("eanCode", code.EANCode), zap.Error(err))
+			gtin = code.EANCode
+		}
+		if gtin != code.EANCode {
+			normalized[code.ID] = gtin
+		} else if !code.Deleted {
+			taken[key{scope(code), gtin}] = code.ID
+		}
+	}
+
+	rewritten, collisions := 0, 0
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		for _, code := range codes {
+			gtin, ok := normalized[code.ID]
+			if !ok {
+				continue
+			}
+			if !code.Deleted {
+				other, clash := taken[key{scope(code), gtin}]
+				if !clash && scope(code) != 0 {
+					other, clash = taken[key{0, gtin}]
+				}
+				if clash {
+					collisions++
+					r.Logger.Warn("Medicine whose normalized EAN code is taken by another one, leaving it as it is",
+						zap.Int("medicine", code.ID), zap.String("eanCode", code.EANCode), zap.String("normalized", gtin),
+						zap.Int("takenBy", other))
+					continue
+				}
+				taken[key{scope(code), gtin}] = code.ID
+			}
+			if err := tx.Table("medicines").Where("id = ?", code.ID).
+				Updates(map[string]interface{}{"ean_code": gtin, "version": gorm.Expr("version + 1")}).Error; err != nil {
+				return err
+			}
+			rewritten++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if rewritten > 0 || invalid > 0 || collisions > 0 {
+		r.Logger.Info("Normalized medicine EAN codes", zap.Int("rewritten", rewritten), zap.Int("invalid", invalid),
+			zap.Int("collisions", collisions))
+	}
+	return nil
+}
+
+// MigrateICDKinds sets the kind of the ICD records created before the hierarchy existed. Codes that do
+// not follow the syntax of their version are left without a kind and reported.
+func (r *Repository) MigrateICDKinds() error {
+	var records []ICDCie
+	if err := r.DB.Where("kind IS NULL OR kind = ''").Find(&records).Error; err != nil {
+		return err
+	}
+	invalid := 0
+	for _, record := range records {
+		kind, ok := InferICDKind(record.CieVersion, NormalizeICDCode(record.Code))
+		if !ok {
+			invalid++
+			continue
+		}
+		if err := r.DB.Model(&ICDCie{}).Where("id = ?", record.ID).Update("kind", kind).Error; err != nil {
+			return err
+		}
+	}
+	if invalid > 0 {
+		r.Logger.Warn("ICD records with codes that do not match their version syntax", zap.Int("count", invalid))
+	}
+	return nil
+}
+
+// MigrateICDHistory opens the first version of the ICD records created before they were versioned, which
+// are taken as valid since the migration. Records retired back then are closed at the same time.
+func (r *Repository) MigrateICDHistory() error {
+	if err := r.DB.Exec(`UPDATE icd_cies SET valid_to = valid_from WHERE retired = ? AND valid_to IS NULL`, true).Error; err != nil {
+		return err
+	}
+	res := r.DB.Exec(`INSERT INTO icd_cie_versions
+		(icd_cie_id, organization_id, cie_version, code, description, chapter_no, chapter_title, kind, parent_id, release, valid_from, valid_to)
+		SELECT id, organization_id, cie_version, code, description, chapter_no, chapter_title, kind, parent_id, release, valid_from, valid_to
+		FROM icd_cies c
+		WHERE NOT EXISTS (SELECT 1 FROM icd_cie_versions v WHERE v.icd_cie_id = c.id)`)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		r.Logger.Info("Opened the history of existing ICD records", zap.Int64("count", res.RowsAffected))
+	}
+	return nil
+}
+
+// icdSearchStatements set up the ICD diagnosis search: an es_unaccent text search configuration (Spanish
+// stemming over unaccented words), a weighted search_vector column kept by Postgres, and trigram indexes
+// over the unaccented titles for typo-tolerant matching. unaccent is only STABLE, so indexes go through
+// the IMMUTABLE f_unaccent wrapper. Every statement can run again on the next start.
+var icdSearchStatements = []string{
+	`CREATE EXTENSION IF NOT EXISTS unaccent`,
+	`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+	`CREATE OR REPLACE FUNCTION f_unaccent(text) RETURNS text
+		LANGUAGE sql IMMUTABLE PARALLEL SAFE STRICT
+		AS $$ SELECT public.unaccent('public.unaccent'::regdictionary, $1) $$`,
+	`DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_ts_config WHERE cfgname = 'es_unaccent') THEN
+			CREATE TEXT SEARCH CONFIGURATION es_unaccent (COPY = spanish);
+			ALTER TEXT SEARCH CONFIGURATION es_unaccent
+				ALTER MAPPING FOR hword, hword_part, word WITH unaccent, spanish_stem;
+		END IF;
+	END
+	$$`,
+	`ALTER TABLE icd_cies ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+		setweight(to_tsvector('es_unaccent', coalesce(code, '')), 'A') ||
+		setweight(to_tsvector('es_unaccent', coalesce(description, '')), 'B') ||
+		setweight(to_tsvector('es_unaccent', coalesce(chapter_title, '')), 'C')) STORED`,
+	`CREATE INDEX IF NOT EXISTS idx_icd_cies_search_vector ON icd_cies USING GIN (search_vector)`,
+	`CREATE INDEX IF NOT EXISTS idx_icd_cies_description_trgm ON icd_cies USING GIN (f_unaccent(lower(description)) gin_trgm_ops)`,
+	`CREATE INDEX IF NOT EXISTS idx_icd_cies_chapter_title_trgm ON icd_cies USING GIN (f_unaccent(lower(chapter_title)) gin_trgm_ops)`,
+}
+
+// MigrateICDSearch creates the extensions, text search configuration, column and indexes used by the
+// ICD search endpoints
+func (r *Repository) MigrateICDSearch() error {
+	for _, statement := range icdSearchStatements {
+		if err := r.DB.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateSoftDelete moves the legacy is_deleted flags of medicines and patients to deleted_at, taking the
+// last update as the time they were deleted, and drops the CURP index that covered deleted patients too
+func (r *Repository) MigrateSoftDelete() error {
+	migrator := r.DB.Migrator()
+	for _, model := range []interface{}{&Medicine{}, &Patient{}} {
+		if !migrator.HasColumn(model, "is_deleted") {
+			continue
+		}
+		res := r.DB.Model(model).Unscoped().
+			Where("is_deleted = ? AND deleted_at IS NULL", true).
+			UpdateColumn("deleted_at", gorm.Expr("updated_at"))
+		if res.Error != nil {
+			return res.Error
+		}
+		if err := migrator.DropColumn(model, "is_deleted"); err != nil {
+			return err
+		}
+		r.Logger.Info("Migrated legacy is_deleted column", zap.Int64("deleted", res.RowsAffected))
+	}
+	if migrator.HasIndex(&Patient{}, "idx_patients_curp") {
+		if err := migrator.DropIndex(&Patient{}, "idx_patients_curp"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// foreignKeyRules are the foreign keys whose on-delete rule was set after their table was created, by
+// the model and relation they belong to and the confdeltype Postgres reports for the rule
+var foreignKeyRules = []struct {
+	model    interface{}
+	relation string
+	name     string
+	onDelete string
+}{
+	{model: &User{}, relation: "Role", name: "fk_users_role", onDelete: "r"},
+	{model: &User{}, relation: "Devices", name: "fk_users_devices", onDelete: "c"},
+}
+
+// MigrateForeignKeys recreates the foreign keys AutoMigrate created before they had an on-delete rule,
+// as it never changes a constraint that already exists
+func (r *Repository) MigrateForeignKeys() error {
+	migrator := r.DB.Migrator()
+	for _, fk := range foreignKeyRules {
+		var rule string
+		if err := r.DB.Raw("SELECT confdeltype FROM pg_constraint WHERE conname = ?", fk.name).Scan(&rule).Error; err != nil {
+			return err
+		}
+		if rule == fk.onDelete {
+			continue
+		}
+		if rule != "" {
+			if err := migrator.DropConstraint(fk.model, fk.name); err != nil {
+				return err
+			}
+		}
+		if err := migrator.CreateConstraint(fk.model, fk.relation); err != nil {
+			return err
+		}
+		r.Logger.Info("Migrated foreign key", zap.String("constraint", fk.name))
+	}
+	return nil
+}
+
+// replacedUniqueIndexes made values unique across every organization; they are replaced by indexes
+// that include the organization
+var replacedUniqueIndexes = []struct {
+	model interface{}
+	name  string
+}{
+	{model: &RoleUser{}, name: "idx_role_users_name"},
+	{model: &User{}, name: "idx_users_username"},
+	{model: &User{}, name: "idx_users_email"},
+	{model: &Medicine{}, name: "idx_medicines_ean_code"},
+	{model: &Patient{}, name: "idx_patients_curp_active"},
+	{model: &TherapeuticEquivalence{}, name: "idx_therapeutic_equivalence_pair"},
+	{model: &ICDCie{}, name: "idx_icd_cie_version_code"},
+}
+
+// MigrateOrganizations runs before the other entities are migrated. It creates the default organization
+// and, on a database from before organizations, adds organization_id to the tenant tables handing their
+// records to it, so that AutoMigrate can make the column required, and drops the indexes that made
+// values unique across every organization. The shared catalogs get the column from AutoMigrate, so their
+// records stay global.
+func (r *Repository) MigrateOrganizations() (Organization, error) {
+	if err := r.DB.AutoMigrate(&Organization{}); err != nil {
+		return Organization{}, err
+	}
+	organization := Organization{Name: "Default organization", Slug: DefaultOrganizationSlug, Enabled: true}
+	if err := r.DB.Where("slug = ?", organization.Slug).FirstOrCreate(&organization).Error; err != nil {
+		return Organization{}, err
+	}
+
+	migrator := r.DB.Migrator()
+	for _, model := range tenantModels {
+		if !migrator.HasTable(model) || migrator.HasColumn(model, "organization_id") {
+			continue
+		}
+		table := clause.Table{Name: r.tableName(model)}
+		if err := r.DB.Exec("ALTER TABLE ? ADD COLUMN organization_id bigint", table).Error; err != nil {
+			return Organization{}, err
+		}
+		res := r.DB.Exec("UPDATE ? SET organization_id = ?", table, organization.ID)
+		if res.Error != nil {
+			return Organization{}, res.Error
+		}
+		r.Logger.Info("Moved records to the default organization", zap.String("table", table.Name), zap.Int64("records", res.RowsAffected))
+	}
+	for _, index := range replacedUniqueIndexes {
+		if migrator.HasTable(index.model) && migrator.HasIndex(index.model, index.name) {
+			if err := migrator.DropIndex(index.model, index.name); err != nil {
+				return Organization{}, err
+			}
+		}
+	}
+	return organization, nil
+}
+
+// MigrateWebhookResponses drops the bodies of the answers to webhook deliveries kept before only their
+// status was, as an endpoint may not be the subscriber's
+func (r *Repository) MigrateWebhookResponses() error {
+	migrator := r.DB.Migrator()
+	if !migrator.HasColumn(&WebhookDelivery{}, "response_body") {
+		return nil
+	}
+	return migrator.DropColumn(&WebhookDelivery{}, "response_body")
+}
+
+// MigrateTenantRLS creates, with TENANT_RLS=true, the TenantRole requests run as and the row-level security
+// policies that keep it to the rows of the organization in app.organization_id and the global rows of the
+// shared catalogs, and to no row at all when the setting is missing. The role the application connects
+// with owns the tables and is not bound by the policies: migrations, scheduled jobs, webhook deliveries
+// and logins run as it. Without TENANT_RLS the policies are removed.
+func (r *Repository) MigrateTenantRLS() error {
+	enabled := TenantRLSEnabled()
+	if enabled {
+		statements := []string{
+			"DO $$ BEGIN IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = '" + TenantRole + "') THEN " +
+				"CREATE ROLE " + TenantRole + " NOLOGIN; END IF; END $$",
+			"GRANT " + TenantRole + " TO CURRENT_USER",
+			"DO $$ BEGIN EXECUTE format('GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA %I TO " +
+				TenantRole + "', current_schema()); EXECUTE format('GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA %I TO " +
+				TenantRole + "', current_schema()); END $$",
+		}
+		for _, statement := range statements {
+			if err := r.DB.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+	}
+	ownRows := "organization_id = NULLIF(current_setting('" + TenantSetting + "', true), '')::bigint"
+	policies := map[string][]interface{}{ownRows: tenantModels, ownRows + " OR organization_id IS NULL": sharedModels}
+	for visible, models := range policies {
+		for _, model := range models {
+			table := clause.Table{Name: r.tableName(model)}
+			statements := []string{"DROP POLICY IF EXISTS tenant_isolation ON ?", "ALTER TABLE ? NO FORCE ROW LEVEL SECURITY",
+				"ALTER TABLE ? DISABLE ROW LEVEL SECURITY"}
+			if enabled {
+				statements = []string{"DROP POLICY IF EXISTS tenant_isolation ON ?",
+					"CREATE POLICY tenant_isolation ON ? TO " + TenantRole + " USING (" + visible + ")",
+					"ALTER TABLE ? ENABLE ROW LEVEL SECURITY", "ALTER TABLE ? NO FORCE ROW LEVEL SECURITY"}
+			}
+			for _, statement := range statements {
+				if err := r.DB.Exec(statement, table).Error; err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package repository
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrInvalidCURPFormat     = errors.New("CURP must have 4 letters, a birth date, sex, state, 3 consonants and 2 check characters")
+	ErrInvalidCURPCheckDigit = errors.New("CURP check digit is invalid")
+
+	curpPattern = regexp.MustCompile(`^[A-Z][AEIOUX][A-Z]{2}[0-9]{2}(0[1-9]|1[0-2])(0[1-9]|[12][0-9]|3[01])[HMX][A-Z]{2}[B-DF-HJ-NP-TV-Z]{3}[0-9A-Z][0-9]$`)
+)
+
+// curpAlphabet gives each CURP character its value in the check digit computation
+var curpAlphabet = []rune("0123456789ABCDEFGHIJKLMNÑOPQRSTUVWXYZ")
+
+// CURPCheckDigit computes the RENAPO check digit for the first 17 characters of a CURP
+func CURPCheckDigit(curp string) int {
+	sum := 0
+	for i, r := range []rune(curp)[:17] {
+		sum += slices.Index(curpAlphabet, r) * (18 - i)
+	}
+	return (10 - sum%10) % 10
+}
+
+// NormalizeCURP validates a CURP and returns it trimmed and uppercase
+func NormalizeCURP(curp string) (string, error) {
+	curp = strings.ToUpper(strings.TrimSpace(curp))
+	if !curpPattern.MatchString(curp) {
+		return "", ErrInvalidCURPFormat
+	}
+	if int(curp[17]-'0') != CURPCheckDigit(curp) {
+		return "", ErrInvalidCURPCheckDigit
+	}
+	return curp, nil
+}
@@ -98,6 +98,11 @@ func (r *Repository) InitDatabase() error {
 		return err
 	}
 
+	if err := RegisterTenantScope(r.DB); err != nil {
+		r.Logger.Error("Error registering the tenant scope", zap.Error(err))
+		return err
+	}
+
 	if err := r.MigrateEntitiesGORM(); err != nil {
 		r.Logger.Error("Error migrating the database", zap.Error(err))
 		return err
@@ -0,0 +1,84 @@
+package repository
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// defaultSoftDeleteRetentionDays is how long deleted records can be restored when
+// SOFT_DELETE_RETENTION_DAYS is not set
+const defaultSoftDeleteRetentionDays = 90
+
+// SoftDeleteRetention is how long deleted records are kept before they are purged, set in days with
+// SOFT_DELETE_RETENTION_DAYS
+func SoftDeleteRetention() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("SOFT_DELETE_RETENTION_DAYS"))
+	if err != nil || days < 0 {
+		days = defaultSoftDeleteRetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// purgeTarget is a soft deleted table and the tables whose rows belong to its records, by the column
+// referencing them, which are purged along with them
+type purgeTarget struct {
+	model interface{}
+	owned map[string]string
+}
+
+// purgeTargets are purged in this order, so that records go before the ones they reference
+var purgeTargets = []purgeTarget{
+	{model: &DeviceDetails{}},
+	{model: &User{}},
+	{model: &RoleUser{}},
+	{model: &Patient{}},
+	{model: &Medicine{}, owned: map[string]string{"medicine_ingredients": "medicine_id", "medicine_prices": "medicine_id",
+		"medicine_overrides": "medicine_id"}},
+}
+
+// PurgeDeleted removes for good the records deleted before the retention period. A record still
+// referenced by another, e.g. a medicine on an invoice, cannot be removed; it is kept, and logged, until
+// whatever references it is gone.
+func (r *Repository) PurgeDeleted(retention time.Duration) (purged int, kept int, err error) {
+	cutoff := time.Now().Add(-retention)
+	for _, target := range purgeTargets {
+		var ids []int
+		if err := r.DB.Model(target.model).Unscoped().
+			Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff).
+			Pluck("id", &ids).Error; err != nil {
+			return purged, kept, err
+		}
+		for _, id := range ids {
+			err := r.DB.Transaction(func(tx *gorm.DB) error {
+				for table, column := range target.owned {
+					if err := tx.Exec("DELETE FROM ? WHERE ? = ?", clause.Table{Name: table}, clause.Column{Name: column}, id).Error; err != nil {
+						return err
+					}
+				}
+				return tx.Unscoped().Delete(target.model, id).Error
+			})
+			if err != nil {
+				kept++
+				r.Logger.Warn("Deleted record kept, it is still referenced",
+					zap.String("table", r.tableName(target.model)), zap.Int("id", id), zap.Error(err))
+				continue
+			}
+			purged++
+		}
+	}
+	return purged, kept, nil
+}
+
+// tableName is the table of a model
+func (r *Repository) tableName(model interface{}) string {
+	stmt := &gorm.Statement{DB: r.DB}
+	if err := stmt.Parse(model); err != nil {
+		return ""
+	}
+	return stmt.Schema.Table
+}
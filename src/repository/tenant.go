@@ -0,0 +1,227 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// DefaultOrganizationSlug is the slug of the organization the records from before organizations belong
+// to, and the one the initial role and user are seeded in. Its admins are the platform admins.
+const DefaultOrganizationSlug = "default"
+
+// tenantField is the field of the tenant-owned models holding the organization of a record
+const tenantField = "OrganizationID"
+
+// tenantModels are the models owned by an organization. Rows only reached through one of them, such as
+// the items of a prescription or the prices of a price list, belong to the organization of that record.
+var tenantModels = []interface{}{
+	&RoleUser{}, &User{}, &DeviceDetails{}, &PriceList{}, &Invoice{}, &TherapeuticEquivalence{},
+	&Patient{}, &Encounter{}, &Prescription{}, &MedicineOverride{}, &ICDCieOverride{}, &WebhookSubscription{},
+	&WebhookDelivery{},
+}
+
+// sharedModels are the catalogs shared by every organization. Their organization is nullable: records
+// without one are global, read by every organization and written by platform admins, and the others are
+// additions of an organization, read and written by it alone.
+var sharedModels = []interface{}{&Medicine{}, &ICDCie{}, &ICDCieVersion{}}
+
+// organizationKey is the key of the context the organization of the queries run with it is kept under
+type organizationKey struct{}
+
+// WithOrganization scopes the queries run with ctx to an organization: reads, updates and deletes of
+// tenant-owned models only see its records, and the records created belong to it
+func WithOrganization(ctx context.Context, organizationID int) context.Context {
+	return context.WithValue(ctx, organizationKey{}, organizationID)
+}
+
+// OrganizationFrom is the organization the queries run with ctx are scoped to, if any
+func OrganizationFrom(ctx context.Context) (int, bool) {
+	id, ok := ctx.Value(organizationKey{}).(int)
+	return id, ok
+}
+
+// globalCatalogKey is the key of the context that makes the queries run with it work on the global catalog
+type globalCatalogKey struct{}
+
+// WithGlobalCatalog makes the queries of shared catalogs run with ctx work on their global records alone:
+// they only read, update and delete those, and the records created are global. Tenant-owned models are
+// still scoped to the organization of ctx.
+func WithGlobalCatalog(ctx context.Context) context.Context {
+	return context.WithValue(ctx, globalCatalogKey{}, true)
+}
+
+// GlobalCatalog tells whether the queries run with ctx work on the global catalog
+func GlobalCatalog(ctx context.Context) bool {
+	global, _ := ctx.Value(globalCatalogKey{}).(bool)
+	return global
+}
+
+// AcrossOrganizations runs fn in a transaction of db whose queries see every organization, e.g. to queue an
+// event of the global catalog for the subscriptions of all of them. With TENANT_RLS the transaction leaves
+// the tenant role for the role the application connects with until fn returns.
+func AcrossOrganizations(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	ctx := context.WithValue(db.Statement.Context, organizationKey{}, nil)
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if !TenantRLSEnabled() {
+			return fn(tx)
+		}
+		var role string
+		if err := tx.Raw("SELECT current_user").Scan(&role).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("SET LOCAL ROLE NONE").Error; err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+		// in a savepoint of an enclosing transaction the role would otherwise last until that one ends
+		return tx.Exec("SET LOCAL ROLE ?", clause.Table{Name: role}).Error
+	})
+}
+
+// errNoOrganization keeps tenant-owned records from being created outside of an organization
+var errNoOrganization = errors.New("tenant-owned record created without an organization")
+
+// RegisterTenantScope registers the callbacks that scope every query of db run with WithOrganization to
+// that organization. Queries run without it, such as migrations, scheduled jobs and logins, see every
+// organization; raw SQL is never scoped.
+func RegisterTenantScope(db *gorm.DB) error {
+	callbacks := db.Callback()
+	if err := callbacks.Create().Before("gorm:create").Register("tenant:create", assignOrganization); err != nil {
+		return err
+	}
+	if err := callbacks.Query().Before("gorm:query").Register("tenant:query", scopeReads); err != nil {
+		return err
+	}
+	if err := callbacks.Row().Before("gorm:row").Register("tenant:row", scopeReads); err != nil {
+		return err
+	}
+	if err := callbacks.Update().Before("gorm:update").Register("tenant:update", scopeWrites); err != nil {
+		return err
+	}
+	return callbacks.Delete().Before("gorm:delete").Register("tenant:delete", scopeWrites)
+}
+
+// organizationOf is the tenant field of the model of a statement and the organization it is scoped to;
+// ok is false when the model is not tenant-owned or the statement is not scoped
+func organizationOf(db *gorm.DB) (field *schema.Field, organizationID int, ok bool) {
+	if db.Statement.Schema == nil {
+		return nil, 0, false
+	}
+	field = db.Statement.Schema.LookUpField(tenantField)
+	if field == nil {
+		return nil, 0, false
+	}
+	organizationID, ok = OrganizationFrom(db.Statement.Context)
+	return field, organizationID, ok
+}
+
+// shared tells whether the tenant field of a model is nullable, which makes it a shared catalog
+func shared(field *schema.Field) bool {
+	return field.FieldType.Kind() == reflect.Ptr
+}
+
+// tenantScoped marks the clauses of a statement already scoped, as a statement can run more than once,
+// e.g. a count and then a find
+const tenantScoped = "tenant_scoped"
+
+// scopeReads restricts a query of a tenant-owned model to the rows of its organization, and one of a
+// shared catalog to its global rows and the additions of the organization, with its overrides applied
+func scopeReads(db *gorm.DB) {
+	field, organizationID, ok := organizationOf(db)
+	if db.Error != nil || field == nil {
+		return
+	}
+	if _, scoped := db.Statement.Clauses[tenantScoped]; scoped {
+		return
+	}
+	db.Statement.Clauses[tenantScoped] = clause.Clause{}
+	column := clause.Column{Table: clause.CurrentTable, Name: field.DBName}
+	switch {
+	case shared(field) && GlobalCatalog(db.Statement.Context):
+		db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{clause.Eq{Column: column, Value: nil}}})
+	case !ok:
+	case shared(field):
+		db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+			clause.Or(clause.Eq{Column: column, Value: organizationID}, clause.Eq{Column: column, Value: nil}),
+		}})
+		overlayOverrides(db.Statement, organizationID)
+	default:
+		db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{clause.Eq{Column: column, Value: organizationID}}})
+	}
+}
+
+// scopeWrites restricts an update or delete of a tenant-owned model or a shared catalog to the rows of its
+// organization, or of a shared catalog to its global rows when run with WithGlobalCatalog
+func scopeWrites(db *gorm.DB) {
+	field, organizationID, ok := organizationOf(db)
+	if db.Error != nil || field == nil {
+		return
+	}
+	column := clause.Column{Table: clause.CurrentTable, Name: field.DBName}
+	switch {
+	case shared(field) && GlobalCatalog(db.Statement.Context):
+		db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{clause.Eq{Column: column, Value: nil}}})
+	case ok:
+		db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{clause.Eq{Column: column, Value: organizationID}}})
+	}
+}
+
+// assignOrganization sets the organization of the records being created to the one of the statement,
+// whatever they were given. Records of a shared catalog are global when created with WithGlobalCatalog
+// or outside of an organization, such as by the release imports.
+func assignOrganization(db *gorm.DB) {
+	field, organizationID, ok := organizationOf(db)
+	if field == nil || db.Error != nil {
+		return
+	}
+	var value interface{} = organizationID
+	switch {
+	case shared(field) && GlobalCatalog(db.Statement.Context):
+		value = nil
+	case shared(field) && !ok:
+		return
+	case shared(field):
+		value = &organizationID
+	case !ok:
+		db.AddError(errNoOrganization)
+		return
+	}
+	records := db.Statement.ReflectValue
+	switch records.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < records.Len(); i++ {
+			if err := field.Set(db.Statement.Context, records.Index(i), value); err != nil {
+				db.AddError(err)
+				return
+			}
+		}
+	case reflect.Struct:
+		if err := field.Set(db.Statement.Context, records, value); err != nil {
+			db.AddError(err)
+		}
+	}
+}
+
+// TenantSetting is the Postgres setting the row-level security policies read the organization of a
+// connection from
+const TenantSetting = "app.organization_id"
+
+// TenantRole is the Postgres role the connections of the requests switch to with TENANT_RLS; the row-level
+// security policies apply to it alone
+const TenantRole = "app_tenant"
+
+// TenantRLSEnabled tells whether TENANT_RLS asks for the isolation of organizations to be enforced by
+// Postgres row-level security as well
+func TenantRLSEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("TENANT_RLS"))
+	return enabled
+}
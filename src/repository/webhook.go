@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// WebhookPayload is the body posted to a subscription. ID identifies the event, the same for each
+// subscription it is sent to and for the replays of a delivery, so that receivers can tell repeats apart.
+type WebhookPayload struct {
+	ID             string       `json:"id"`
+	Event          WebhookEvent `json:"event"`
+	OrganizationID int          `json:"organizationId"`
+	CreatedAt      time.Time    `json:"createdAt"`
+	Data           interface{}  `json:"data"`
+}
+
+// QueueWebhookEvent queues a delivery of event, carrying data, to each enabled subscription to it that db
+// reads, e.g. the ones of the organization of its context, answering how many it queued. The deliveries
+// are created in db, so that in a transaction they are only sent once it commits.
+func QueueWebhookEvent(db *gorm.DB, event WebhookEvent, data interface{}) (int, error) {
+	var subscriptions []WebhookSubscription
+	if err := db.Where("enabled = ?", true).Order("id").Find(&subscriptions).Error; err != nil {
+		return 0, err
+	}
+	eventID, err := GenerateNewUUID()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	queued := 0
+	for _, subscription := range subscriptions {
+		if !slices.Contains(subscription.Events, event) {
+			continue
+		}
+		payload, err := json.Marshal(WebhookPayload{
+			ID:             eventID,
+			Event:          event,
+			OrganizationID: subscription.OrganizationID,
+			CreatedAt:      now,
+			Data:           data,
+		})
+		if err != nil {
+			return queued, err
+		}
+		delivery := WebhookDelivery{
+			SubscriptionID: subscription.ID,
+			EventID:        eventID,
+			Event:          event,
+			Payload:        string(payload),
+			Status:         WebhookDeliveryPending,
+			NextAttemptAt:  &now,
+		}
+		// the delivery belongs to the organization of its subscription, which is not always the one of db
+		ctx := WithOrganization(db.Statement.Context, subscription.OrganizationID)
+		if err := db.WithContext(ctx).Create(&delivery).Error; err != nil {
+			return queued, err
+		}
+		queued++
+	}
+	return queued, nil
+}
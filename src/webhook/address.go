@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// ErrForbiddenAddress is returned for an endpoint on a loopback, private, link-local or multicast address,
+// which could reach the services next to the API rather than a receiver of the subscriber
+var ErrForbiddenAddress = errors.New("the endpoint is on a loopback, private, link-local or multicast address")
+
+// AllowPrivateNetworks tells whether WEBHOOK_ALLOW_PRIVATE_NETWORKS lets endpoints be on any address, e.g. for
+// receivers on the same host in tests
+func AllowPrivateNetworks() bool {
+	allow, _ := strconv.ParseBool(os.Getenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS"))
+	return allow
+}
+
+// forbidden tells whether ip is an address endpoints cannot be on
+func forbidden(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+// dialControl turns down connections to forbidden addresses. It runs once the host is resolved, on the
+// address actually dialed, so a host that resolves elsewhere after it was checked is still turned down.
+func dialControl(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if forbidden(ip) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// CheckHost resolves the host of an endpoint and returns ErrForbiddenAddress when any of its addresses is
+// forbidden, so that subscriptions to them are turned down when made rather than at every delivery
+func CheckHost(ctx context.Context, host string) error {
+	if AllowPrivateNetworks() {
+		return nil
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if forbidden(ip) {
+			return ErrForbiddenAddress
+		}
+		return nil
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if forbidden(ip) {
+			return ErrForbiddenAddress
+		}
+	}
+	return nil
+}
+
+// newTransport is the transport deliveries are sent with. It goes to the endpoints directly, never through
+// a proxy, so that the address dialed is the one checked.
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	dialer := &net.Dialer{Timeout: requestTimeout}
+	if !AllowPrivateNetworks() {
+		dialer.Control = dialControl
+	}
+	transport.DialContext = dialer.DialContext
+	return transport
+}
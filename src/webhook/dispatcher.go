@@ -0,0 +1,227 @@
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"ia-boilerplate/src/infrastructure"
+	"ia-boilerplate/src/repository"
+)
+
+const (
+	// defaultMaxAttempts, defaultRetryBaseSeconds and defaultPollSeconds apply when WEBHOOK_MAX_ATTEMPTS,
+	// WEBHOOK_RETRY_BASE_SECONDS and WEBHOOK_POLL_SECONDS are not set
+	defaultMaxAttempts      = 10
+	defaultRetryBaseSeconds = 30
+	defaultPollSeconds      = 5
+
+	// maxBackoff caps the wait between two attempts of a delivery
+	maxBackoff = 6 * time.Hour
+	// requestTimeout is how long an endpoint has to answer a delivery
+	requestTimeout = 10 * time.Second
+	// claimLease is how long a claimed delivery is kept from other dispatchers; past it, a delivery whose
+	// dispatcher stopped halfway is attempted again
+	claimLease = time.Minute
+	// batchSize is how many deliveries are claimed, and attempted concurrently, at a time
+	batchSize = 20
+
+	userAgent = "ia-boilerplate-webhooks/1.0"
+)
+
+// Dispatcher attempts the pending deliveries once they are due. Its only state is the deliveries table,
+// so a restart loses nothing and several instances of the API can each run one.
+type Dispatcher struct {
+	DB     *gorm.DB
+	Logger *infrastructure.Logger
+	Client *http.Client
+	// MaxAttempts is how many times a delivery is attempted before it fails
+	MaxAttempts int
+	// RetryBase is the wait after the first failed attempt, doubled after each of the next ones
+	RetryBase time.Duration
+	// PollInterval is how often due deliveries are looked for when the dispatcher is not woken
+	PollInterval time.Duration
+	wake         chan struct{}
+}
+
+// NewDispatcher creates a dispatcher configured by WEBHOOK_MAX_ATTEMPTS, WEBHOOK_RETRY_BASE_SECONDS,
+// WEBHOOK_POLL_SECONDS and WEBHOOK_ALLOW_PRIVATE_NETWORKS
+func NewDispatcher(db *gorm.DB, logger *infrastructure.Logger) *Dispatcher {
+	return &Dispatcher{
+		DB:     db,
+		Logger: logger,
+		Client: &http.Client{
+			Transport: newTransport(),
+			Timeout:   requestTimeout,
+			// a redirect is an answer of the endpoint, not a place to send the event to
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		MaxAttempts:  envInt("WEBHOOK_MAX_ATTEMPTS", defaultMaxAttempts),
+		RetryBase:    time.Duration(envInt("WEBHOOK_RETRY_BASE_SECONDS", defaultRetryBaseSeconds)) * time.Second,
+		PollInterval: time.Duration(envInt("WEBHOOK_POLL_SECONDS", defaultPollSeconds)) * time.Second,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// envInt reads a positive integer from the environment, or fallback when it is not set or invalid
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// Wake makes Run look for due deliveries without waiting for the next poll, e.g. once events are queued
+func (d *Dispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run attempts the due deliveries every PollInterval, and whenever woken, until ctx is done
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.PollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			claimed, err := d.DeliverDue(ctx)
+			if err != nil {
+				d.Logger.Error("Error delivering webhooks", zap.Error(err))
+			}
+			if err != nil || claimed < batchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// Backoff is the wait after the attempt-th failed attempt of a delivery
+func (d *Dispatcher) Backoff(attempt int) time.Duration {
+	backoff := d.RetryBase
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
+
+// DeliverDue claims the due deliveries, at most batchSize of them, and attempts them, answering how many
+// it claimed. Claiming moves their next attempt past the time an attempt can take, so that other
+// dispatchers skip them.
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+	now := time.Now()
+	var deliveries []repository.WebhookDelivery
+	err := d.DB.WithContext(ctx).Raw(`UPDATE webhook_deliveries SET next_attempt_at = ?
+		WHERE id IN (SELECT id FROM webhook_deliveries WHERE status = ? AND next_attempt_at <= ?
+			ORDER BY next_attempt_at, id LIMIT ? FOR UPDATE SKIP LOCKED)
+		RETURNING *`, now.Add(claimLease), repository.WebhookDeliveryPending, now, batchSize).Scan(&deliveries).Error
+	if err != nil || len(deliveries) == 0 {
+		return 0, err
+	}
+
+	ids := make([]int, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		ids = append(ids, delivery.SubscriptionID)
+	}
+	var subscriptions []repository.WebhookSubscription
+	if err := d.DB.WithContext(ctx).Where("id IN ?", ids).Find(&subscriptions).Error; err != nil {
+		return 0, err
+	}
+	byID := make(map[int]repository.WebhookSubscription, len(subscriptions))
+	for _, subscription := range subscriptions {
+		byID[subscription.ID] = subscription
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.attempt(ctx, delivery, byID[delivery.SubscriptionID])
+		}()
+	}
+	wg.Wait()
+	return len(deliveries), nil
+}
+
+// attempt sends a delivery and records the outcome: it succeeds on a 2xx answer, and otherwise waits for
+// its next attempt or, out of attempts, fails. The deliveries of a disabled subscription fail unsent.
+func (d *Dispatcher) attempt(ctx context.Context, delivery repository.WebhookDelivery, subscription repository.WebhookSubscription) {
+	now := time.Now()
+	updates := map[string]interface{}{"updated_at": now}
+	if !subscription.Enabled {
+		updates["status"] = repository.WebhookDeliveryFailed
+		updates["next_attempt_at"] = nil
+		updates["error"] = "the subscription is disabled"
+	} else {
+		status, err := Send(ctx, d.Client, subscription, delivery)
+		attempts := delivery.Attempts + 1
+		updates["attempts"] = attempts
+		updates["last_attempt_at"] = now
+		updates["response_status"] = nil
+		if status != 0 {
+			updates["response_status"] = status
+		}
+		failure := ""
+		if err != nil {
+			failure = err.Error()
+		} else if status < 200 || status > 299 {
+			failure = "the endpoint answered " + strconv.Itoa(status)
+		}
+		updates["error"] = failure
+		switch {
+		case failure == "":
+			updates["status"] = repository.WebhookDeliverySucceeded
+			updates["next_attempt_at"] = nil
+		case attempts >= d.MaxAttempts:
+			updates["status"] = repository.WebhookDeliveryFailed
+			updates["next_attempt_at"] = nil
+		default:
+			updates["next_attempt_at"] = now.Add(d.Backoff(attempts))
+		}
+	}
+	// the outcome is recorded even when ctx is done, as the endpoint may have been sent the delivery
+	err := d.DB.WithContext(context.WithoutCancel(ctx)).Model(&repository.WebhookDelivery{}).
+		Where("id = ?", delivery.ID).Updates(updates).Error
+	if err != nil {
+		d.Logger.Error("Error recording a webhook delivery", zap.Int("delivery", delivery.ID), zap.Error(err))
+	}
+}
+
+// Send posts the payload of a delivery to the endpoint of its subscription, signed with its secret,
+// answering the status of the answer; its body is never read, as the endpoint may not be the subscriber's
+func Send(ctx context.Context, client *http.Client, subscription repository.WebhookSubscription, delivery repository.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(HeaderEvent, delivery.Event.String())
+	req.Header.Set(HeaderID, delivery.EventID)
+	req.Header.Set(HeaderDelivery, strconv.Itoa(delivery.ID))
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(subscription.Secret, timestamp, []byte(delivery.Payload)))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
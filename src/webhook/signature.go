@@ -0,0 +1,47 @@
+// Package webhook sends the events of the API to the endpoints subscribed to them, signing each delivery
+// with the secret of its subscription and retrying the failed ones with exponential backoff.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// The headers of a delivery. Signature is the HMAC-SHA256 of the timestamp, a dot and the body, keyed
+// with the secret of the subscription, e.g. sha256=3f2a…; receivers should check it and turn down
+// timestamps too far from their clock.
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderID        = "X-Webhook-Id"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+
+	signaturePrefix = "sha256="
+	secretPrefix    = "whsec_"
+)
+
+// Sign computes the signature of a body sent at timestamp, in Unix seconds
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify tells whether signature is the one of a body sent at timestamp
+func Verify(secret, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// NewSecret generates the secret of a subscription
+func NewSecret() (string, error) {
+	key := make([]byte, 24)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return secretPrefix + hex.EncodeToString(key), nil
+}